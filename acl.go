@@ -0,0 +1,152 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+/*
+Access permissions which can be granted on a path prefix
+*/
+const (
+	AccessRead   = "r" // Directory listings and reading of files
+	AccessWrite  = "w" // Writing of files, creating and renaming items
+	AccessDelete = "d" // Deleting items
+)
+
+/*
+DefaultAccessRules is the key for rules which apply to all clients without
+their own access rules.
+*/
+const DefaultAccessRules = "*"
+
+/*
+accessRule grants permissions on a path prefix.
+*/
+type accessRule struct {
+	Path   string `json:"path"`   // Path prefix
+	Access string `json:"access"` // Granted permissions (e.g. rwd)
+}
+
+/*
+AccessControlList contains the access rules of a branch. Rules are stored per
+client name - the name of a client is the node name in its verified token.
+*/
+type AccessControlList struct {
+	rules map[string][]*accessRule
+}
+
+/*
+NewAccessControlList creates a new access control list from a given config
+object. The config object maps client names to a list of rules. Each rule
+has a path prefix and a string of granted permissions:
+
+	{
+	  "alice" : [
+	    { "path" : "/", "access" : "r" },
+	    { "path" : "/alice", "access" : "rwd" }
+	  ],
+	  "*" : [
+	    { "path" : "/pub", "access" : "r" }
+	  ]
+	}
+
+The rules of the client name * apply to all clients without their own rules.
+An empty config object produces a list which allows all operations.
+*/
+func NewAccessControlList(cfg interface{}) (*AccessControlList, error) {
+	var rules map[string][]*accessRule
+
+	// Convert the config object into rules using its JSON representation
+	// (config objects are usually loaded from a JSON file)
+
+	data, err := json.Marshal(cfg)
+
+	if err == nil {
+		err = json.Unmarshal(data, &rules)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid access control config: %v", err)
+	}
+
+	for client, crules := range rules {
+		for _, r := range crules {
+
+			if !strings.HasPrefix(r.Path, "/") {
+				return nil, fmt.Errorf("Access rule path for client %v must be absolute: %v",
+					client, r.Path)
+			}
+
+			for _, c := range r.Access {
+				if !strings.ContainsRune(AccessRead+AccessWrite+AccessDelete, c) {
+					return nil, fmt.Errorf("Unknown access permission for client %v: %v",
+						client, string(c))
+				}
+			}
+
+			r.Path = path.Clean(r.Path)
+		}
+	}
+
+	return &AccessControlList{rules}, nil
+}
+
+/*
+IsEnabled returns if this list restricts access.
+*/
+func (acl *AccessControlList) IsEnabled() bool {
+	return len(acl.rules) > 0
+}
+
+/*
+Check checks if a given client has a certain permission on a given path.
+*/
+func (acl *AccessControlList) Check(client string, spath string, access string) error {
+
+	if !acl.IsEnabled() {
+		return nil
+	}
+
+	crules, ok := acl.rules[client]
+	if !ok {
+		crules = acl.rules[DefaultAccessRules]
+	}
+
+	spath = path.Clean("/" + spath)
+
+	for _, r := range crules {
+
+		// Path prefixes match only complete path elements
+
+		if r.Path == "/" || spath == r.Path || strings.HasPrefix(spath, r.Path+"/") {
+			if strings.Contains(r.Access, access) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("Access denied for client '%v': No %v permission on %v",
+		client, accessNames[access], spath)
+}
+
+/*
+accessNames are readable names for access permissions
+*/
+var accessNames = map[string]string{
+	AccessRead:   "read",
+	AccessWrite:  "write",
+	AccessDelete: "delete",
+}
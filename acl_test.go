@@ -0,0 +1,207 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"devt.de/krotik/rufs/config"
+)
+
+func TestAccessControlList(t *testing.T) {
+
+	acl, err := NewAccessControlList(map[string]interface{}{})
+
+	if err != nil || acl.IsEnabled() || acl.Check("foo", "/bar", AccessDelete) != nil {
+		t.Error("Unexpected result:", acl, err)
+		return
+	}
+
+	var cfg interface{}
+
+	json.Unmarshal([]byte(`{
+  "alice" : [
+    { "path" : "/", "access" : "r" },
+    { "path" : "/alice/", "access" : "rwd" }
+  ],
+  "*" : [
+    { "path" : "/pub", "access" : "r" }
+  ]
+}`), &cfg)
+
+	acl, err = NewAccessControlList(cfg)
+
+	if err != nil || !acl.IsEnabled() {
+		t.Error("Unexpected result:", acl, err)
+		return
+	}
+
+	for _, c := range []struct {
+		client, path, access, err string
+	}{
+		{"alice", "/", AccessRead, "<nil>"},
+		{"alice", "bob/foo", AccessRead, "<nil>"},
+		{"alice", "/bob/foo", AccessWrite, "Access denied for client 'alice': No write permission on /bob/foo"},
+		{"alice", "/alice", AccessWrite, "<nil>"},
+		{"alice", "/alice/../bob", AccessWrite, "Access denied for client 'alice': No write permission on /bob"},
+		{"alice", "/alice/foo", AccessDelete, "<nil>"},
+		{"alice", "/alicefoo", AccessDelete, "Access denied for client 'alice': No delete permission on /alicefoo"},
+		{"", "/pub/foo", AccessRead, "<nil>"},
+		{"", "/", AccessRead, "Access denied for client '': No read permission on /"},
+		{"bob", "/pub", AccessRead, "<nil>"},
+		{"bob", "/pub", AccessWrite, "Access denied for client 'bob': No write permission on /pub"},
+	} {
+		if err := acl.Check(c.client, c.path, c.access); fmt.Sprint(err) != c.err {
+			t.Error("Unexpected result:", c, err)
+			return
+		}
+	}
+
+	// Test error cases
+
+	if _, err = NewAccessControlList(map[string]interface{}{
+		"alice": []interface{}{map[string]interface{}{"path": "/", "access": "rx"}},
+	}); err == nil || err.Error() != "Unknown access permission for client alice: x" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = NewAccessControlList(map[string]interface{}{
+		"alice": []interface{}{map[string]interface{}{"path": "foo", "access": "r"}},
+	}); err == nil || err.Error() != "Access rule path for client alice must be absolute: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = NewAccessControlList(map[string]interface{}{
+		"alice": "foo",
+	}); err == nil || !strings.HasPrefix(err.Error(), "Invalid access control config:") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestBranchAccessControl(t *testing.T) {
+	var err error
+
+	oldACL := footest.acl
+	defer func() {
+		footest.acl = oldACL
+	}()
+
+	footest.acl, err = NewAccessControlList(map[string]interface{}{
+		"alice": []interface{}{
+			map[string]interface{}{"path": "/", "access": "r"},
+			map[string]interface{}{"path": "/sub1", "access": "rw"},
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost],
+		branchConfigs["footest"][config.RPCPort])
+
+	createTree := func(name string) *Tree {
+		cfg := map[string]interface{}{
+			config.TreeSecret: "123",
+		}
+
+		if name != "" {
+			cfg[config.TreeClientName] = name
+		}
+
+		tree, err := NewTree(cfg, clientCert)
+		if err == nil {
+			tree.AddBranch("footest", branchRPC, "")
+			tree.AddMapping("/", "footest", true)
+		}
+
+		return tree
+	}
+
+	alice := createTree("alice")
+	anon := createTree("")
+
+	// Check read access
+
+	var buf bytes.Buffer
+
+	if err := alice.ReadFileToBuffer("/test1", &buf); err != nil || buf.String() != "Test1 file" {
+		t.Error("Unexpected result:", buf.String(), err)
+		return
+	}
+
+	if _, err := anon.ReadFile("/test1", make([]byte, 5), 0); err == nil ||
+		err.Error() != "RufsError: Remote error (Access denied for client '': No read permission on /test1)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := anon.ReadFileToBuffer("/test1", &buf); err == nil ||
+		err.Error() != "RufsError: Remote error (Access denied for client '': No read permission on /test1)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Check write access
+
+	if _, err := alice.WriteFile("/test3", []byte("foo"), 0); err == nil ||
+		err.Error() != "RufsError: Remote error (Access denied for client 'alice': No write permission on /test3)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := alice.WriteFileFromBuffer("/sub1/acltest", bytes.NewBufferString("foo")); err != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Check item operations
+
+	if _, err := alice.ItemOp("/sub1", map[string]string{
+		ItemOpAction:  ItemOpActRename,
+		ItemOpName:    "acltest",
+		ItemOpNewName: "acltest2",
+	}); err != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err := alice.ItemOp("/sub1", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "acltest2",
+	}); err == nil || err.Error() != "RufsError: Remote error (Access denied for client 'alice': No delete permission on /sub1/acltest2)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	footest.acl = oldACL
+
+	if _, err := anon.ItemOp("/sub1", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "acltest2",
+	}); err != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if res := dirLocal("foo/sub1"); res != "test3(17)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
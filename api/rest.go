@@ -156,10 +156,15 @@ var RemoveTree = func(id string) error {
 	treesLock.Lock()
 	defer treesLock.Unlock()
 
-	if _, ok := trees[id]; !ok {
+	tree, ok := trees[id]
+
+	if !ok {
 		return fmt.Errorf("Tree %v does not exist", id)
 	}
 
+	tree.StopHealthMonitor()
+	tree.StopSyncJobs()
+
 	delete(trees, id)
 
 	return nil
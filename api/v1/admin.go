@@ -35,6 +35,34 @@ the request should have the following form:
 
 A DELETE request to a particular tree will delete the tree.
 
+/admin/<tree>/status
+
+A GET request to the status endpoint returns the health status of all known
+branches of a tree:
+
+	{
+	    <branch name> : {
+	        reachable : <Flag if the branch answered the last ping>,
+	        lastseen : <Time of the last answered ping (RFC3339)>,
+	        rtt : <Round trip time of the last answered ping in milliseconds>,
+	        errors : <Number of failed pings since the branch was last seen>
+	    }
+	}
+
+/admin/<tree>/cache
+
+A GET request to the cache endpoint returns the statistics of the block cache
+of a tree. An empty object is returned if the tree has no block cache:
+
+	{
+	    hits : <Number of blocks which were served from the cache>,
+	    misses : <Number of blocks which had to be requested from a branch>,
+	    memblocks : <Number of blocks in memory>,
+	    memsize : <Size of all blocks in memory in bytes>,
+	    diskblocks : <Number of blocks on disk>,
+	    disksize : <Size of all blocks on disk in bytes>
+	}
+
 /admin/<tree>/branch
 
 A new branch can be created in an existing tree by sending a POST request
@@ -56,7 +84,10 @@ form:
 	{
 	    branch : <Name of the branch>,
 	    dir : <Tree directory of the branch root>,
-	    writable : <Flag if the branch should handle write operations>
+	    writable : <Flag if the branch should handle write operations>,
+	    policy : <Optional write policy for new items (all, first, mostfree or roundrobin)>,
+	    priority : <Optional priority of the branch (branches with a higher priority are read first)>,
+	    replica : <Optional flag if the branches of the directory are replicas which share reads>
 	}
 
 
@@ -75,6 +106,71 @@ subdirectories to the listing and the checksums flag will add
 checksums for all listed files.
 
 
+Search endpoint
+
+/search/<tree>/<path>
+
+The search endpoint handles requests to search a directory and all its
+subdirectories for files. A request url should be of the following form:
+
+/search/<tree>/<path>?name=<glob>&minsize=<bytes>&maxsize=<bytes>&after=<time>&before=<time>&content=<string>
+
+All parameters are optional and all given filters must match. Times should
+be given in RFC3339 format or as a date (YYYY-MM-DD). The result is a map
+of directories with a list of matching files as values.
+
+
+Sync job endpoint
+
+/syncjob/<tree>
+
+A GET request to the sync job endpoint returns all sync jobs of a tree:
+
+	{
+	    <job name> : {
+	        source : <Source directory>,
+	        destination : <Destination directory>,
+	        schedule : <Schedule of the job>,
+	        policy : <Conflict policy of a two-way sync (empty for a one-way sync)>,
+	        options : <Options of a one-way sync>,
+	        paused : <Flag if scheduled runs are paused>,
+	        running : <Flag if the job is currently running>,
+	        nextrun : <Time of the next scheduled run (RFC3339)>,
+	        lasterror : <Error of the last run>,
+	        history : [ {
+	            start : <Start time of the run (RFC3339)>,
+	            duration : <Duration of the run in milliseconds>,
+	            error : <Error of the run>
+	        }, ... ]
+	    }
+	}
+
+A POST request creates a new sync job. The body of the request should have
+the following form (sync options are the same as for the sync action of the
+file endpoint):
+
+	{
+	    name : <Unique name of the job>,
+	    source : <Source directory (first directory of a two-way sync)>,
+	    destination : <Destination directory (second directory of a two-way sync)>,
+	    schedule : <Cron expression (minute hour day month weekday) or
+	                fixed interval (@every <duration>)>,
+	    policy : <Optional conflict policy of a two-way sync (report, newest
+	              or keepboth)>
+	}
+
+/syncjob/<tree>/<job>
+
+A PUT request controls a sync job. The body of the request should have the
+form:
+
+	{
+	    action : <Action to perform (run, pause or resume)>
+	}
+
+A DELETE request deletes a sync job.
+
+
 File queries and manipulation
 
 /file/{tree}/{path}
@@ -102,8 +198,21 @@ should be a JSON object of the form (parameters are operation specific):
 						parameter or syncing directories>
 	}
 
-The action can either be: sync, rename, mkdir or copy. Copy and sync returns a JSON
-structure containing a progress id:
+The action can either be: sync, rename, mkdir or copy. A sync can be
+controlled with the following optional parameters:
+
+	{
+	    dryrun : <Only report the operations without changing anything>,
+	    include : <List of glob patterns of files which should be synced>,
+	    exclude : <List of glob patterns of files and directories which
+	               should not be synced>,
+	    nodelete : <Keep items in the destination which are not in the source>,
+	    updateonly : <Only replace destination files which are older than
+	                  the source file>,
+	    checksumonly : <Compare files only by checksum>
+	}
+
+Copy and sync returns a JSON structure containing a progress id:
 
 	{
 	    progress_id : <Id for progress of the copy operation>
@@ -146,6 +255,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"devt.de/krotik/rufs"
 	"devt.de/krotik/rufs/api"
@@ -177,6 +287,11 @@ HandleGET handles an admin query REST call.
 func (a *adminEndpoint) HandleGET(w http.ResponseWriter, r *http.Request, resources []string) {
 	data := make(map[string]interface{})
 
+	if len(resources) > 0 {
+		a.handleSection(w, resources)
+		return
+	}
+
 	trees, err := api.Trees()
 
 	if err != nil {
@@ -203,6 +318,84 @@ func (a *adminEndpoint) HandleGET(w http.ResponseWriter, r *http.Request, resour
 	json.NewEncoder(w).Encode(data)
 }
 
+/*
+handleSection handles REST calls to query a section of a tree.
+*/
+func (a *adminEndpoint) handleSection(w http.ResponseWriter, resources []string) {
+
+	if !checkResources(w, resources, 2, 2, "Need a tree name and a section (status or cache)") {
+		return
+	}
+
+	tree, ok, err := api.GetTree(resources[0])
+
+	if err == nil && !ok {
+		err = fmt.Errorf("Unknown tree: %v", resources[0])
+	} else if err == nil && resources[1] != "status" && resources[1] != "cache" {
+		err = fmt.Errorf("Unknown section: %v", resources[1])
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data map[string]interface{}
+
+	if resources[1] == "status" {
+		data = a.statusData(tree)
+	} else {
+		data = a.cacheData(tree)
+	}
+
+	// Write data
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(data)
+}
+
+/*
+statusData returns the health status of the branches of a tree.
+*/
+func (a *adminEndpoint) statusData(tree *rufs.Tree) map[string]interface{} {
+	data := make(map[string]interface{})
+
+	for name, status := range tree.BranchStatus() {
+		var lastSeen string
+
+		if !status.LastSeen.IsZero() {
+			lastSeen = status.LastSeen.Format(time.RFC3339)
+		}
+
+		data[name] = map[string]interface{}{
+			"reachable": status.Reachable,
+			"lastseen":  lastSeen,
+			"rtt":       status.RTT.Seconds() * 1000,
+			"errors":    status.Errors,
+		}
+	}
+
+	return data
+}
+
+/*
+cacheData returns the statistics of the block cache of a tree.
+*/
+func (a *adminEndpoint) cacheData(tree *rufs.Tree) map[string]interface{} {
+	data := make(map[string]interface{})
+
+	if stats := tree.CacheStats(); stats != nil {
+		data["hits"] = stats.Hits
+		data["misses"] = stats.Misses
+		data["memblocks"] = stats.MemBlocks
+		data["memsize"] = stats.MemSize
+		data["diskblocks"] = stats.DiskBlocks
+		data["disksize"] = stats.DiskSize
+	}
+
+	return data
+}
+
 /*
 HandlePOST handles REST calls to create a new tree.
 */
@@ -289,13 +482,29 @@ func (a *adminEndpoint) HandlePOST(w http.ResponseWriter, r *http.Request, resou
 				if branch, ok := getMapValue(w, data, "branch"); ok {
 					if writeableStr, ok := getMapValue(w, data, "writeable"); ok {
 
+						var opts rufs.MappingOptions
+
 						writeable, err := strconv.ParseBool(writeableStr)
+						opts.Policy, _ = data["policy"].(string)
+
+						if prio, ok := data["priority"]; ok && err == nil {
+							if opts.Priority, err = strconv.Atoi(fmt.Sprint(prio)); err != nil {
+								err = fmt.Errorf("Priority value must be an integer: %v", err.Error())
+							}
+						} else if err != nil {
+							err = fmt.Errorf("Writeable value must be a boolean: %v", err.Error())
+						}
+
+						if replica, ok := data["replica"]; ok && err == nil {
+							if opts.Replica, err = strconv.ParseBool(fmt.Sprint(replica)); err != nil {
+								err = fmt.Errorf("Replica value must be a boolean: %v", err.Error())
+							}
+						}
 
 						if err != nil {
-							http.Error(w, fmt.Sprintf("Writeable value must be a boolean: %v", err.Error()),
-								http.StatusBadRequest)
+							http.Error(w, err.Error(), http.StatusBadRequest)
 
-						} else if err := tree.AddMapping(dir, branch, writeable); err != nil {
+						} else if err := tree.AddMappingWithOptions(dir, branch, writeable, opts); err != nil {
 
 							http.Error(w, fmt.Sprintf("Could not add branch: %v", err.Error()),
 								http.StatusBadRequest)
@@ -422,6 +631,68 @@ func (a *adminEndpoint) SwaggerDefs(s map[string]interface{}) {
 		},
 	}
 
+	s["paths"].(map[string]interface{})["/v1/admin/{tree}/status"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Return the branch status.",
+			"description": "Return the health status of all known branches of a tree.",
+			"produces": []string{
+				"text/plain",
+				"application/json",
+			},
+			"parameters": []map[string]interface{}{
+				{
+					"name":        "tree",
+					"in":          "path",
+					"description": "Name of the tree.",
+					"required":    true,
+					"type":        "string",
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "A key-value map of branch name to branch status",
+				},
+				"default": map[string]interface{}{
+					"description": "Error response",
+					"schema": map[string]interface{}{
+						"$ref": "#/definitions/Error",
+					},
+				},
+			},
+		},
+	}
+
+	s["paths"].(map[string]interface{})["/v1/admin/{tree}/cache"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Return the cache statistics.",
+			"description": "Return the statistics of the block cache of a tree.",
+			"produces": []string{
+				"text/plain",
+				"application/json",
+			},
+			"parameters": []map[string]interface{}{
+				{
+					"name":        "tree",
+					"in":          "path",
+					"description": "Name of the tree.",
+					"required":    true,
+					"type":        "string",
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "A key-value map of cache statistics",
+				},
+				"default": map[string]interface{}{
+					"description": "Error response",
+					"schema": map[string]interface{}{
+						"$ref": "#/definitions/Error",
+					},
+				},
+			},
+		},
+	}
+
 	s["paths"].(map[string]interface{})["/v1/admin/{tree}/branch"] = map[string]interface{}{
 		"post": map[string]interface{}{
 			"summary":     "Add a new branch.",
@@ -516,6 +787,18 @@ func (a *adminEndpoint) SwaggerDefs(s map[string]interface{}) {
 								"description": "Flag if the branch should be mapped as writable.",
 								"type":        "string",
 							},
+							"policy": map[string]interface{}{
+								"description": "Optional write policy for new items (all, first, mostfree or roundrobin).",
+								"type":        "string",
+							},
+							"priority": map[string]interface{}{
+								"description": "Optional priority of the branch (branches with a higher priority are read first).",
+								"type":        "integer",
+							},
+							"replica": map[string]interface{}{
+								"description": "Optional flag if the branches of the directory are replicas which share reads.",
+								"type":        "boolean",
+							},
 						},
 					},
 				},
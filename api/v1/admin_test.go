@@ -11,9 +11,11 @@
 package v1
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
+	"devt.de/krotik/common/errorutil"
 	"devt.de/krotik/rufs"
 	"devt.de/krotik/rufs/api"
 	"devt.de/krotik/rufs/config"
@@ -95,6 +97,78 @@ func TestAdminQuery(t *testing.T) {
 		return
 	}
 
+	// Check the branch status
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/status", "GET", nil)
+
+	var status map[string]map[string]interface{}
+	json.Unmarshal([]byte(res), &status)
+
+	if fs := status["footest"]; st != "200 OK" || len(status) != 1 || fs["reachable"] != true ||
+		fs["lastseen"] == "" || fs["errors"] != float64(0) {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Check the cache statistics
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/cache", "GET", nil)
+	if st != "200 OK" || res != "{}" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	cacheTree, err := rufs.NewTree(map[string]interface{}{
+		config.TreeSecret:   "123",
+		config.CacheMemSize: 1024,
+	}, api.TreeCertTemplate)
+	errorutil.AssertOk(err)
+	errorutil.AssertOk(api.AddTree("Hans3", cacheTree))
+	errorutil.AssertOk(cacheTree.AddBranch("footest", fooRPC, fooFP))
+	errorutil.AssertOk(cacheTree.AddMapping("/", "footest", false))
+
+	_, err = cacheTree.Stat("/test1")
+	errorutil.AssertOk(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = cacheTree.ReadFile("/test1", make([]byte, 5), 0)
+		errorutil.AssertOk(err)
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans3/cache", "GET", nil)
+	if st != "200 OK" || res != `
+{
+  "diskblocks": 0,
+  "disksize": 0,
+  "hits": 1,
+  "memblocks": 1,
+  "memsize": 10,
+  "misses": 1
+}`[1:] {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	errorutil.AssertOk(api.RemoveTree("Hans3"))
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "GET", nil)
+	if st != "400 Bad Request" || res != "Need a tree name and a section (status or cache)" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans2/status", "GET", nil)
+	if st != "400 Bad Request" || res != "Unknown tree: Hans2" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/foo", "GET", nil)
+	if st != "400 Bad Request" || res != "Unknown section: foo" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
 	// Add a new mapping
 
 	st, _, res = sendTestRequest(queryURL+"Hans1/mapping", "POST", []byte(`
@@ -245,6 +319,42 @@ func TestAdminQuery(t *testing.T) {
 		return
 	}
 
+	st, _, res = sendTestRequest(queryURL+"Hans1/mapping", "POST", []byte(`
+{
+	"dir" : "/",
+	"branch" : "footest",
+	"writeable" : true,
+	"policy" : "foo"
+}`))
+	if st != "400 Bad Request" || res != "Could not add branch: Unknown write policy: foo" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/mapping", "POST", []byte(`
+{
+	"dir" : "/",
+	"branch" : "footest",
+	"writeable" : true,
+	"priority" : "high"
+}`))
+	if st != "400 Bad Request" || res != "Priority value must be an integer: strconv.Atoi: parsing \"high\": invalid syntax" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/mapping", "POST", []byte(`
+{
+	"dir" : "/",
+	"branch" : "footest",
+	"writeable" : true,
+	"replica" : "yes"
+}`))
+	if st != "400 Bad Request" || res != "Replica value must be a boolean: strconv.ParseBool: parsing \"yes\": invalid syntax" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
 	// Delete twice
 
 	if trees, err := api.Trees(); len(trees) != 1 || err != nil {
@@ -436,9 +436,11 @@ func (f *fileEndpoint) handleFileOp(requestType string, w http.ResponseWriter, r
 					err = tree.Copy(files, fmt.Sprint(dest),
 						func(file string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
 
-							if p, ok := ProgressMap.Get(mapLookup); ok && writtenBytes > 0 {
+							progress, update := copyProgress(writtenBytes, totalBytes)
+
+							if p, ok := ProgressMap.Get(mapLookup); ok && update {
 								p.(*Progress).Subject = file
-								p.(*Progress).Progress = writtenBytes
+								p.(*Progress).Progress = progress
 								p.(*Progress).TotalProgress = totalBytes
 								p.(*Progress).Item = currentFile
 								p.(*Progress).TotalItems = totalFiles
@@ -459,13 +461,14 @@ func (f *fileEndpoint) handleFileOp(requestType string, w http.ResponseWriter, r
 		}
 
 	} else if action == "sync" {
+		var opts rufs.SyncOptions
 
 		dest, ok := data["destination"]
 
 		if !ok {
 			err = fmt.Errorf("Parameter destination is missing from request body")
 
-		} else {
+		} else if opts, err = syncOptions(data); err == nil {
 
 			uuid := fmt.Sprintf("%x", cryptutil.GenerateUUID())
 			ret["progress_id"] = uuid
@@ -484,14 +487,16 @@ func (f *fileEndpoint) handleFileOp(requestType string, w http.ResponseWriter, r
 
 			go func() {
 
-				err = tree.Sync(fullPath, fmt.Sprint(dest), true,
+				err = tree.SyncWithOptions(fullPath, fmt.Sprint(dest), true, opts,
 					func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
 
-						if p, ok := ProgressMap.Get(mapLookup); ok && writtenBytes > 0 {
+						progress, update := copyProgress(writtenBytes, totalBytes)
+
+						if p, ok := ProgressMap.Get(mapLookup); ok && update {
 
 							p.(*Progress).Op = op
 							p.(*Progress).Subject = srcFile
-							p.(*Progress).Progress = writtenBytes
+							p.(*Progress).Progress = progress
 							p.(*Progress).TotalProgress = totalBytes
 							p.(*Progress).Item = currentFile
 							p.(*Progress).TotalItems = totalFiles
@@ -703,6 +708,38 @@ func (f *fileEndpoint) SwaggerDefs(s map[string]interface{}) {
 								"description": "Destination directory when copying files.",
 								"type":        "string",
 							},
+							"dryrun": map[string]interface{}{
+								"description": "Only report the operations of a sync without changing anything.",
+								"type":        "boolean",
+							},
+							"include": map[string]interface{}{
+								"description": "Glob patterns of files which should be synced.",
+								"type":        "array",
+								"items": map[string]interface{}{
+									"description": "Glob pattern.",
+									"type":        "string",
+								},
+							},
+							"exclude": map[string]interface{}{
+								"description": "Glob patterns of files and directories which should not be synced.",
+								"type":        "array",
+								"items": map[string]interface{}{
+									"description": "Glob pattern.",
+									"type":        "string",
+								},
+							},
+							"nodelete": map[string]interface{}{
+								"description": "Keep items in the destination which are not in the source when syncing.",
+								"type":        "boolean",
+							},
+							"updateonly": map[string]interface{}{
+								"description": "Only replace destination files which are older than the source file when syncing.",
+								"type":        "boolean",
+							},
+							"checksumonly": map[string]interface{}{
+								"description": "Compare files only by checksum when syncing.",
+								"type":        "boolean",
+							},
 							"files": map[string]interface{}{
 								"description": "List of (full path) files which should be copied / renamed.",
 								"type":        "array",
@@ -837,3 +874,73 @@ func (f *fileEndpoint) SwaggerDefs(s map[string]interface{}) {
 		"type":        "string",
 	}
 }
+
+/*
+syncOptions reads the optional sync options from a request body.
+*/
+func syncOptions(data map[string]interface{}) (rufs.SyncOptions, error) {
+	var opts rufs.SyncOptions
+	var err error
+
+	readFlag := func(key string) bool {
+		var res bool
+
+		if v, ok := data[key]; ok && err == nil {
+			if res, ok = v.(bool); !ok {
+				err = fmt.Errorf("Parameter %v must be a boolean", key)
+			}
+		}
+
+		return res
+	}
+
+	readPatterns := func(key string) []string {
+		var res []string
+
+		if v, ok := data[key]; ok && err == nil {
+			if lp, ok := v.([]interface{}); !ok {
+				err = fmt.Errorf("Parameter %v must be a list of patterns", key)
+
+			} else {
+				res = make([]string, len(lp))
+
+				for i, p := range lp {
+					res[i] = fmt.Sprint(p)
+				}
+			}
+		}
+
+		return res
+	}
+
+	opts.DryRun = readFlag("dryrun")
+	opts.NoDelete = readFlag("nodelete")
+	opts.UpdateOnly = readFlag("updateonly")
+	opts.ChecksumOnly = readFlag("checksumonly")
+	opts.Include = readPatterns("include")
+	opts.Exclude = readPatterns("exclude")
+
+	return opts, err
+}
+
+/*
+copyProgress returns the progress of a file copy which should be reported for
+a given update. A file is only reported as complete once its copy has been
+verified.
+*/
+func copyProgress(writtenBytes, totalBytes int64) (int64, bool) {
+
+	if writtenBytes == rufs.CopyStatusFinished {
+		return totalBytes, true
+
+	} else if writtenBytes > 0 {
+
+		if writtenBytes >= totalBytes {
+			writtenBytes = totalBytes - 1
+		}
+
+		return writtenBytes, true
+	}
+
+	return 0, false
+}
@@ -234,6 +234,62 @@ func TestFileSync(t *testing.T) {
 		return
 	}
 
+	st, _, res = sendTestRequest(queryURL+"Hans1/", "PUT", []byte(`
+{
+    "action" : "sync",
+	"destination" : "/sync1",
+	"dryrun" : "yes"
+}`))
+	if st != "400 Bad Request" || res != "Parameter dryrun must be a boolean" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/", "PUT", []byte(`
+{
+    "action" : "sync",
+	"destination" : "/sync1",
+	"exclude" : "sub1"
+}`))
+	if st != "400 Bad Request" || res != "Parameter exclude must be a list of patterns" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/", "PUT", []byte(`
+{
+    "action" : "sync",
+	"destination" : "/sync1",
+	"include" : ["["]
+}`))
+	if st != "400 Bad Request" || res != "Invalid sync pattern [: syntax error in pattern" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Do a dry run which does not change anything
+
+	errorutil.AssertOk(os.Remove("foo/sync1/test2"))
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/", "PUT", []byte(`
+{
+    "action" : "sync",
+	"destination" : "/sync1",
+	"dryrun" : true,
+	"exclude" : ["sync1"]
+}`))
+	if st != "200 OK" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := os.Stat("foo/sync1/test2"); !os.IsNotExist(err) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
 	tree.Reset(false)
 	ProgressMap = datautil.NewMapCache(100, 0)
 
@@ -694,7 +750,7 @@ Test2 file`[1:] {
 		st, _, res = sendTestRequest(progressqueryURL+"Hans1/"+pid, "GET", nil)
 		json.Unmarshal([]byte(res), &resMap)
 
-		if st != "200 OK" || resMap["progress"] == resMap["total_progress"] {
+		if st != "200 OK" || (resMap["progress"] == resMap["total_progress"] && resMap["item"] == resMap["total_items"]) {
 			break
 		}
 	}
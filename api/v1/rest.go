@@ -32,6 +32,9 @@ var V1EndpointMap = map[string]api.RestEndpointInst{
 	EndpointFile:     FileEndpointInst,
 	EndpointProgress: ProgressEndpointInst,
 	EndpointZip:      ZipEndpointInst,
+	EndpointWatch:    WatchEndpointInst,
+	EndpointSearch:   SearchEndpointInst,
+	EndpointSyncJob:  SyncJobEndpointInst,
 }
 
 // Helper functions
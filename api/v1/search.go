@@ -0,0 +1,180 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+)
+
+/*
+EndpointSearch is the search endpoint URL (rooted). Handles everything
+under search/...
+*/
+const EndpointSearch = api.APIRoot + APIv1 + "/search/"
+
+/*
+SearchEndpointInst creates a new endpoint handler.
+*/
+func SearchEndpointInst() api.RestEndpointHandler {
+	return &searchEndpoint{}
+}
+
+/*
+Handler object for search operations.
+*/
+type searchEndpoint struct {
+	*api.DefaultEndpointHandler
+}
+
+/*
+searchParams maps query parameters to search filters.
+*/
+var searchParams = map[string]string{
+	"name":    rufs.SearchName,
+	"minsize": rufs.SearchMinSize,
+	"maxsize": rufs.SearchMaxSize,
+	"after":   rufs.SearchAfter,
+	"before":  rufs.SearchBefore,
+	"content": rufs.SearchContent,
+}
+
+/*
+HandleGET handles a search query REST call.
+*/
+func (s *searchEndpoint) HandleGET(w http.ResponseWriter, r *http.Request, resources []string) {
+	var tree *rufs.Tree
+	var ok bool
+	var err error
+	var dirs []string
+	var fis [][]os.FileInfo
+
+	if len(resources) == 0 {
+		http.Error(w, "Need at least a tree name",
+			http.StatusBadRequest)
+		return
+	}
+
+	if tree, ok, err = api.GetTree(resources[0]); err == nil && !ok {
+		err = fmt.Errorf("Unknown tree: %v", resources[0])
+	}
+
+	if err == nil {
+		query := make(map[string]string)
+
+		for param, filter := range searchParams {
+			if v := r.URL.Query().Get(param); v != "" {
+				query[filter] = v
+			}
+		}
+
+		dirs, fis, err = tree.Search(path.Join(resources[1:]...), query)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := make(map[string]interface{})
+
+	for i, d := range dirs {
+		var flist []map[string]interface{}
+
+		for _, f := range fis[i] {
+			flist = append(flist, map[string]interface{}{
+				"name":  f.Name(),
+				"size":  f.Size(),
+				"isdir": f.IsDir(),
+			})
+		}
+
+		data[d] = flist
+	}
+
+	// Write data
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(data)
+}
+
+/*
+SwaggerDefs is used to describe the endpoint in swagger.
+*/
+func (s *searchEndpoint) SwaggerDefs(sw map[string]interface{}) {
+
+	queryParam := func(name string, description string, typ string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":        name,
+			"in":          "query",
+			"description": description,
+			"required":    false,
+			"type":        typ,
+		}
+	}
+
+	sw["paths"].(map[string]interface{})["/v1/search/{tree}/{path}"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Search for files.",
+			"description": "Search a directory and its subdirectories for files which match all given filters.",
+			"produces": []string{
+				"text/plain",
+				"application/json",
+			},
+			"parameters": []map[string]interface{}{
+				{
+					"name":        "tree",
+					"in":          "path",
+					"description": "Name of the tree.",
+					"required":    true,
+					"type":        "string",
+				},
+				{
+					"name":        "path",
+					"in":          "path",
+					"description": "Directory path.",
+					"required":    true,
+					"type":        "string",
+				},
+				queryParam("name", "Glob pattern for file names.", "string"),
+				queryParam("minsize", "Minimum file size in bytes.", "integer"),
+				queryParam("maxsize", "Maximum file size in bytes.", "integer"),
+				queryParam("after", "Earliest modification time (RFC3339 or YYYY-MM-DD).", "string"),
+				queryParam("before", "Latest modification time (RFC3339 or YYYY-MM-DD).", "string"),
+				queryParam("content", "String which must be contained in a file.", "string"),
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Returns a map of directories with a list of matching files as values.",
+				},
+				"default": map[string]interface{}{
+					"description": "Error response",
+					"schema": map[string]interface{}{
+						"$ref": "#/definitions/Error",
+					},
+				},
+			},
+		},
+	}
+
+	// Add generic error object to definition
+
+	sw["definitions"].(map[string]interface{})["Error"] = map[string]interface{}{
+		"description": "A human readable error mesage.",
+		"type":        "string",
+	}
+}
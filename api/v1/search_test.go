@@ -0,0 +1,111 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSearchQuery(t *testing.T) {
+	queryURL := "http://localhost" + TESTPORT + EndpointSearch
+
+	// Setup a tree
+
+	defer func() {
+
+		// Make sure all trees are removed
+
+		api.ResetTrees()
+	}()
+
+	tree, err := rufs.NewTree(api.TreeConfigTemplate, api.TreeCertTemplate)
+	errorutil.AssertOk(err)
+
+	api.AddTree("Hans1", tree)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	fooFP := footest.SSLFingerprint()
+
+	err = tree.AddBranch("footest", fooRPC, fooFP)
+	errorutil.AssertOk(err)
+
+	err = tree.AddMapping("/", "footest", false)
+	errorutil.AssertOk(err)
+
+	// Search for files
+
+	st, _, res := sendTestRequest(queryURL+"Hans1?name=test*&maxsize=10", "GET", nil)
+	if st != "200 OK" || res != `
+{
+  "/": [
+    {
+      "isdir": false,
+      "name": "test1",
+      "size": 10
+    },
+    {
+      "isdir": false,
+      "name": "test2",
+      "size": 10
+    }
+  ]
+}`[1:] {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/sub1?content=dir&after=2000-01-01", "GET", nil)
+	if st != "200 OK" || res != `
+{
+  "/sub1": [
+    {
+      "isdir": false,
+      "name": "test3",
+      "size": 17
+    }
+  ]
+}`[1:] {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1?content=xxx", "GET", nil)
+	if st != "200 OK" || res != "{}" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Test error cases
+
+	st, _, res = sendTestRequest(queryURL, "GET", nil)
+	if st != "400 Bad Request" || res != "Need at least a tree name" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"dave", "GET", nil)
+	if st != "400 Bad Request" || res != "Unknown tree: dave" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1?minsize=a", "GET", nil)
+	if st != "400 Bad Request" || res != `Invalid size a: strconv.ParseInt: parsing "a": invalid syntax` {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+}
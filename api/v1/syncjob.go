@@ -0,0 +1,413 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+)
+
+/*
+EndpointSyncJob is the sync job endpoint URL (rooted). Handles everything
+under syncjob/...
+*/
+const EndpointSyncJob = api.APIRoot + APIv1 + "/syncjob/"
+
+/*
+SyncJobEndpointInst creates a new endpoint handler.
+*/
+func SyncJobEndpointInst() api.RestEndpointHandler {
+	return &syncJobEndpoint{}
+}
+
+/*
+Handler object for sync job operations.
+*/
+type syncJobEndpoint struct {
+	*api.DefaultEndpointHandler
+}
+
+/*
+getTree returns the tree of a sync job request.
+*/
+func (s *syncJobEndpoint) getTree(w http.ResponseWriter, resources []string,
+	requiredMin int, requiredMax int, errorMsg string) (*rufs.Tree, bool) {
+
+	if !checkResources(w, resources, requiredMin, requiredMax, errorMsg) {
+		return nil, false
+	}
+
+	tree, ok, err := api.GetTree(resources[0])
+
+	if err == nil && !ok {
+		err = fmt.Errorf("Unknown tree: %v", resources[0])
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return tree, true
+}
+
+/*
+HandleGET handles REST calls to list all sync jobs of a tree.
+*/
+func (s *syncJobEndpoint) HandleGET(w http.ResponseWriter, r *http.Request, resources []string) {
+
+	tree, ok := s.getTree(w, resources, 1, 1, "Need a tree name")
+	if !ok {
+		return
+	}
+
+	data := make(map[string]interface{})
+
+	for _, job := range tree.SyncJobs() {
+		var nextRun string
+		var history []map[string]interface{}
+
+		if !job.NextRun.IsZero() {
+			nextRun = job.NextRun.Format(time.RFC3339)
+		}
+
+		for _, run := range job.History {
+			history = append(history, map[string]interface{}{
+				"start":    run.Start.Format(time.RFC3339),
+				"duration": run.Duration.Seconds() * 1000,
+				"error":    run.Error,
+			})
+		}
+
+		data[job.Name] = map[string]interface{}{
+			"source":      job.Src,
+			"destination": job.Dst,
+			"schedule":    job.Schedule,
+			"policy":      job.Policy,
+			"options":     job.Options,
+			"paused":      job.Paused,
+			"running":     job.Running,
+			"nextrun":     nextRun,
+			"lasterror":   job.LastError,
+			"history":     history,
+		}
+	}
+
+	// Write data
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(data)
+}
+
+/*
+HandlePOST handles REST calls to create a new sync job.
+*/
+func (s *syncJobEndpoint) HandlePOST(w http.ResponseWriter, r *http.Request, resources []string) {
+	var data map[string]interface{}
+
+	tree, ok := s.getTree(w, resources, 1, 1, "Need a tree name")
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, fmt.Sprintf("Could not decode request body: %v", err.Error()),
+			http.StatusBadRequest)
+		return
+	}
+
+	job := rufs.SyncJob{}
+
+	if job.Name, ok = getMapValue(w, data, "name"); !ok {
+		return
+	} else if job.Src, ok = getMapValue(w, data, "source"); !ok {
+		return
+	} else if job.Dst, ok = getMapValue(w, data, "destination"); !ok {
+		return
+	} else if job.Schedule, ok = getMapValue(w, data, "schedule"); !ok {
+		return
+	}
+
+	job.Policy, _ = data["policy"].(string)
+
+	opts, err := syncOptions(data)
+
+	if err == nil {
+		job.Options = opts
+
+		if err = tree.AddSyncJob(job); err != nil {
+			err = fmt.Errorf("Could not add sync job: %v", err)
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+/*
+HandlePUT handles REST calls to trigger, pause or resume a sync job.
+*/
+func (s *syncJobEndpoint) HandlePUT(w http.ResponseWriter, r *http.Request, resources []string) {
+	var data map[string]interface{}
+	var err error
+
+	tree, ok := s.getTree(w, resources, 2, 2, "Need a tree name and a job name")
+	if !ok {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, fmt.Sprintf("Could not decode request body: %v", err.Error()),
+			http.StatusBadRequest)
+		return
+	}
+
+	action, ok := getMapValue(w, data, "action")
+	if !ok {
+		return
+	}
+
+	if action == "run" {
+		err = tree.TriggerSyncJob(resources[1])
+	} else if action == "pause" {
+		err = tree.PauseSyncJob(resources[1], true)
+	} else if action == "resume" {
+		err = tree.PauseSyncJob(resources[1], false)
+	} else {
+		err = fmt.Errorf("Unknown action: %v", action)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+/*
+HandleDELETE handles REST calls to delete a sync job.
+*/
+func (s *syncJobEndpoint) HandleDELETE(w http.ResponseWriter, r *http.Request, resources []string) {
+
+	tree, ok := s.getTree(w, resources, 2, 2, "Need a tree name and a job name")
+	if !ok {
+		return
+	}
+
+	if err := tree.RemoveSyncJob(resources[1]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+/*
+SwaggerDefs is used to describe the endpoint in swagger.
+*/
+func (s *syncJobEndpoint) SwaggerDefs(sw map[string]interface{}) {
+
+	treeParam := map[string]interface{}{
+		"name":        "tree",
+		"in":          "path",
+		"description": "Name of the tree.",
+		"required":    true,
+		"type":        "string",
+	}
+
+	jobParam := map[string]interface{}{
+		"name":        "job",
+		"in":          "path",
+		"description": "Name of the sync job.",
+		"required":    true,
+		"type":        "string",
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "Error response",
+		"schema": map[string]interface{}{
+			"$ref": "#/definitions/Error",
+		},
+	}
+
+	patterns := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"type":        "array",
+			"items": map[string]interface{}{
+				"description": "Glob pattern.",
+				"type":        "string",
+			},
+		}
+	}
+
+	sw["paths"].(map[string]interface{})["/v1/syncjob/{tree}"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "List all sync jobs.",
+			"description": "All sync jobs of a tree with their schedule, state and run history.",
+			"produces": []string{
+				"text/plain",
+				"application/json",
+			},
+			"parameters": []map[string]interface{}{
+				treeParam,
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Returns a map of job names to sync jobs.",
+				},
+				"default": errorResponse,
+			},
+		},
+		"post": map[string]interface{}{
+			"summary":     "Create a sync job.",
+			"description": "Create a new sync job which runs according to a schedule.",
+			"consumes": []string{
+				"application/json",
+			},
+			"produces": []string{
+				"text/plain",
+			},
+			"parameters": []map[string]interface{}{
+				treeParam,
+				{
+					"name":        "job",
+					"in":          "body",
+					"description": "Sync job definition.",
+					"required":    true,
+					"schema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"name": map[string]interface{}{
+								"description": "Unique name of the job.",
+								"type":        "string",
+							},
+							"source": map[string]interface{}{
+								"description": "Source directory (first directory of a two-way sync).",
+								"type":        "string",
+							},
+							"destination": map[string]interface{}{
+								"description": "Destination directory (second directory of a two-way sync).",
+								"type":        "string",
+							},
+							"schedule": map[string]interface{}{
+								"description": "Cron expression (minute hour day month weekday) or fixed interval (@every <duration>).",
+								"type":        "string",
+							},
+							"policy": map[string]interface{}{
+								"description": "Conflict policy of a two-way sync (empty for a one-way sync).",
+								"type":        "string",
+								"enum": []string{
+									"",
+									rufs.ConflictReport,
+									rufs.ConflictNewest,
+									rufs.ConflictKeepBoth,
+								},
+							},
+							"dryrun": map[string]interface{}{
+								"description": "Only report the operations of a one-way sync without changing anything.",
+								"type":        "boolean",
+							},
+							"include": patterns("Glob patterns of files which should be synced."),
+							"exclude": patterns("Glob patterns of files and directories which should not be synced."),
+							"nodelete": map[string]interface{}{
+								"description": "Keep items in the destination which are not in the source.",
+								"type":        "boolean",
+							},
+							"updateonly": map[string]interface{}{
+								"description": "Only replace destination files which are older than the source file.",
+								"type":        "boolean",
+							},
+							"checksumonly": map[string]interface{}{
+								"description": "Compare files only by checksum.",
+								"type":        "boolean",
+							},
+						},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The job was created.",
+				},
+				"default": errorResponse,
+			},
+		},
+	}
+
+	sw["paths"].(map[string]interface{})["/v1/syncjob/{tree}/{job}"] = map[string]interface{}{
+		"put": map[string]interface{}{
+			"summary":     "Control a sync job.",
+			"description": "Run a sync job immediately or pause and resume its scheduled runs.",
+			"consumes": []string{
+				"application/json",
+			},
+			"produces": []string{
+				"text/plain",
+			},
+			"parameters": []map[string]interface{}{
+				treeParam,
+				jobParam,
+				{
+					"name":        "operation",
+					"in":          "body",
+					"description": "Operation which should be executed.",
+					"required":    true,
+					"schema": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"action": map[string]interface{}{
+								"description": "Action to perform.",
+								"type":        "string",
+								"enum": []string{
+									"run",
+									"pause",
+									"resume",
+								},
+							},
+						},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The action was performed.",
+				},
+				"default": errorResponse,
+			},
+		},
+		"delete": map[string]interface{}{
+			"summary":     "Delete a sync job.",
+			"description": "Delete a sync job. A running job is not interrupted.",
+			"produces": []string{
+				"text/plain",
+			},
+			"parameters": []map[string]interface{}{
+				treeParam,
+				jobParam,
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The job was deleted.",
+				},
+				"default": errorResponse,
+			},
+		},
+	}
+
+	// Add generic error object to definition
+
+	sw["definitions"].(map[string]interface{})["Error"] = map[string]interface{}{
+		"description": "A human readable error mesage.",
+		"type":        "string",
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSyncJobs(t *testing.T) {
+	queryURL := "http://localhost" + TESTPORT + EndpointSyncJob
+
+	// Setup a tree
+
+	defer func() {
+
+		// Make sure all trees are removed
+
+		api.ResetTrees()
+	}()
+
+	tree, err := rufs.NewTree(api.TreeConfigTemplate, api.TreeCertTemplate)
+	errorutil.AssertOk(err)
+	defer tree.StopSyncJobs()
+
+	api.AddTree("Hans1", tree)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	fooFP := footest.SSLFingerprint()
+
+	err = tree.AddBranch("footest", fooRPC, fooFP)
+	errorutil.AssertOk(err)
+
+	err = tree.AddMapping("/", "footest", true)
+	errorutil.AssertOk(err)
+
+	os.Mkdir("foo/jobdst", 0755)
+	defer os.RemoveAll("foo/jobdst")
+
+	// Create a job
+
+	st, _, res := sendTestRequest(queryURL+"Hans1", "POST", []byte(`
+{
+    "name" : "job1",
+    "source" : "/sub1",
+    "destination" : "/jobdst",
+    "schedule" : "0 3 * * *",
+    "exclude" : ["*.tmp"]
+}`))
+	if st != "200 OK" || res != "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Pause and trigger the job
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "PUT", []byte(`{ "action" : "pause" }`))
+	if st != "200 OK" || res != "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "PUT", []byte(`{ "action" : "run" }`))
+	if st != "200 OK" || res != "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		if jobs := tree.SyncJobs(); len(jobs[0].History) > 0 && !jobs[0].Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res, err := ioutil.ReadFile("foo/jobdst/test3"); err != nil || string(res) != "Sub dir test file" {
+		t.Error("Unexpected result:", string(res), err)
+		return
+	}
+
+	// List all jobs
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "GET", nil)
+
+	var data map[string]map[string]interface{}
+	errorutil.AssertOk(json.Unmarshal([]byte(res), &data))
+
+	job := data["job1"]
+	history := job["history"].([]interface{})
+
+	if st != "200 OK" || job["source"] != "/sub1" || job["destination"] != "/jobdst" ||
+		job["schedule"] != "0 3 * * *" || job["paused"] != true || job["running"] != false ||
+		job["nextrun"] != "" || job["lasterror"] != "" || len(history) != 1 ||
+		fmt.Sprint(job["options"]) != "map[checksumonly:false dryrun:false exclude:[*.tmp] include:<nil> nodelete:false updateonly:false]" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	if run := history[0].(map[string]interface{}); run["error"] != "" || run["start"] == "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "PUT", []byte(`{ "action" : "resume" }`))
+	if st != "200 OK" || res != "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	if jobs := tree.SyncJobs(); jobs[0].Paused || jobs[0].NextRun.Hour() != 3 {
+		t.Error("Unexpected result:", jobs)
+		return
+	}
+
+	// Delete the job
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "DELETE", nil)
+	if st != "200 OK" || res != "" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "GET", nil)
+	if st != "200 OK" || res != "{}" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Test error cases
+
+	st, _, res = sendTestRequest(queryURL, "GET", nil)
+	if st != "400 Bad Request" || res != "Need a tree name" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"foo", "GET", nil)
+	if st != "400 Bad Request" || res != "Unknown tree: foo" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "POST", []byte(`{`))
+	if st != "400 Bad Request" || res != "Could not decode request body: unexpected EOF" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "POST", []byte(`{ "name" : "job1" }`))
+	if st != "400 Bad Request" || res != "Value for source is missing in posted data" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "POST", []byte(`
+{
+    "name" : "job1",
+    "source" : "/sub1",
+    "destination" : "/jobdst",
+    "schedule" : "0 3 * *"
+}`))
+	if st != "400 Bad Request" || res != "Could not add sync job: Invalid schedule 0 3 * *: Expected 5 fields (minute hour day month weekday)" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "POST", []byte(`
+{
+    "name" : "job1",
+    "source" : "/sub1",
+    "destination" : "/jobdst",
+    "schedule" : "0 3 * * *",
+    "nodelete" : 1
+}`))
+	if st != "400 Bad Request" || res != "Parameter nodelete must be a boolean" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1", "PUT", []byte(`{ "action" : "run" }`))
+	if st != "400 Bad Request" || res != "Need a tree name and a job name" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "PUT", []byte(`{ "action" : "run" }`))
+	if st != "400 Bad Request" || res != "Unknown sync job: job1" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "PUT", []byte(`{ "action" : "foo" }`))
+	if st != "400 Bad Request" || res != "Unknown action: foo" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/job1", "DELETE", nil)
+	if st != "400 Bad Request" || res != "Unknown sync job: job1" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+)
+
+/*
+EndpointWatch is the watch endpoint URL (rooted). Handles everything
+under watch/...
+*/
+const EndpointWatch = api.APIRoot + APIv1 + "/watch/"
+
+/*
+WatchEventBufferSize is the number of events which are buffered for a single
+client. Events are dropped if a client cannot keep up - the client receives
+an overflow event in this case.
+*/
+var WatchEventBufferSize = 1000
+
+/*
+WatchEndpointInst creates a new endpoint handler.
+*/
+func WatchEndpointInst() api.RestEndpointHandler {
+	return &watchEndpoint{}
+}
+
+/*
+Handler object for watch operations.
+*/
+type watchEndpoint struct {
+	*api.DefaultEndpointHandler
+}
+
+/*
+HandleGET handles a watch REST call. Changes are pushed to the client as
+server-sent events until the client closes the connection.
+*/
+func (we *watchEndpoint) HandleGET(w http.ResponseWriter, r *http.Request, resources []string) {
+	var tree *rufs.Tree
+	var watch *rufs.TreeWatch
+	var ok bool
+	var err error
+
+	if len(resources) == 0 {
+		http.Error(w, "Need at least a tree name",
+			http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	if tree, ok, err = api.GetTree(resources[0]); err == nil && !ok {
+		err = fmt.Errorf("Unknown tree: %v", resources[0])
+	}
+
+	events := make(chan map[string]interface{}, WatchEventBufferSize)
+	overflow := make(chan bool, 1)
+
+	if err == nil {
+		watch, err = tree.Watch(path.Join(resources[1:]...), func(event string, path string, branch string) {
+
+			select {
+			case events <- map[string]interface{}{
+				"event":  event,
+				"path":   path,
+				"branch": branch,
+			}:
+			default:
+
+				// Client is too slow - notify it that events were lost
+
+				select {
+				case overflow <- true:
+				default:
+				}
+			}
+		})
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer watch.Close()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+
+	// Send an initial comment so the client knows the stream is open
+
+	fmt.Fprint(w, ": watching\n\n")
+	flusher.Flush()
+
+	for {
+		var event map[string]interface{}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case event = <-events:
+		case <-overflow:
+			event = map[string]interface{}{
+				"event": rufs.WatchOverflow,
+				"path":  "/",
+			}
+		}
+
+		data, _ := json.Marshal(event)
+
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+/*
+SwaggerDefs is used to describe the endpoint in swagger.
+*/
+func (we *watchEndpoint) SwaggerDefs(s map[string]interface{}) {
+
+	s["paths"].(map[string]interface{})["/v1/watch/{tree}/{path}"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Watch a directory.",
+			"description": "Receive changes under a directory as server-sent events.",
+			"produces": []string{
+				"text/plain",
+				"text/event-stream",
+			},
+			"parameters": []map[string]interface{}{
+				{
+					"name":        "tree",
+					"in":          "path",
+					"description": "Name of the tree.",
+					"required":    true,
+					"type":        "string",
+				},
+				{
+					"name":        "path",
+					"in":          "path",
+					"description": "Directory path.",
+					"required":    true,
+					"type":        "string",
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "A stream of events. Each event is an object with the keys event (create, modify, delete or overflow), path and branch.",
+				},
+				"default": map[string]interface{}{
+					"description": "Error response",
+					"schema": map[string]interface{}{
+						"$ref": "#/definitions/Error",
+					},
+				},
+			},
+		},
+	}
+
+	// Add generic error object to definition
+
+	s["definitions"].(map[string]interface{})["Error"] = map[string]interface{}{
+		"description": "A human readable error mesage.",
+		"type":        "string",
+	}
+}
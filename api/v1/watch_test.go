@@ -0,0 +1,127 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package v1
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/api"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestWatch(t *testing.T) {
+	queryURL := "http://localhost" + TESTPORT + EndpointWatch
+
+	oldWatchPollTimeout := rufs.WatchPollTimeout
+	rufs.WatchPollTimeout = 100 * time.Millisecond
+
+	defer func() {
+		rufs.WatchPollTimeout = oldWatchPollTimeout
+
+		// Make sure all trees are removed
+
+		api.ResetTrees()
+	}()
+
+	tree, err := rufs.NewTree(api.TreeConfigTemplate, api.TreeCertTemplate)
+	errorutil.AssertOk(err)
+
+	api.AddTree("Hans1", tree)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	fooFP := footest.SSLFingerprint()
+
+	err = tree.AddBranch("footest", fooRPC, fooFP)
+	errorutil.AssertOk(err)
+
+	err = tree.AddMapping("/mnt", "footest", false)
+	errorutil.AssertOk(err)
+
+	// Test error cases
+
+	st, _, res := sendTestRequest(queryURL, "GET", nil)
+	if st != "400 Bad Request" || res != "Need at least a tree name" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"foo", "GET", nil)
+	if st != "400 Bad Request" || res != "Unknown tree: foo" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	st, _, res = sendTestRequest(queryURL+"Hans1/other", "GET", nil)
+	if st != "400 Bad Request" || res != "No branches are mapped under /other" {
+		t.Error("Unexpected response:", st, res)
+		return
+	}
+
+	// Watch a directory
+
+	resp, err := http.Get(queryURL + "Hans1/mnt/sub1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("content-type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+		t.Error("Unexpected response:", resp.Status, ct)
+		return
+	}
+
+	reader := bufio.NewReader(resp.Body)
+
+	if line, err := reader.ReadString('\n'); err != nil || line != ": watching\n" {
+		t.Error("Unexpected response:", line, err)
+		return
+	}
+
+	// Wait until the tree polls the branch
+
+	time.Sleep(200 * time.Millisecond)
+
+	defer os.Remove("foo/sub1/watchtest")
+
+	ioutil.WriteFile("foo/test1", []byte("Test1 file"), 0770)
+	ioutil.WriteFile("foo/sub1/watchtest", []byte("foo"), 0770)
+
+	var events []string
+
+	for len(events) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimSpace(line[6:]))
+		}
+	}
+
+	if res := strings.Join(events, "\n"); res != `
+{"branch":"footest","event":"create","path":"/mnt/sub1/watchtest"}
+{"branch":"footest","event":"modify","path":"/mnt/sub1/watchtest"}`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
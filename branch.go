@@ -51,8 +51,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"devt.de/krotik/common/errorutil"
 	"devt.de/krotik/common/fileutil"
 	"devt.de/krotik/common/pools"
 	"devt.de/krotik/common/stringutil"
@@ -72,9 +73,18 @@ func init() {
 Branch models a single exported branch in Rufs.
 */
 type Branch struct {
-	rootPath string         // Local directory (absolute path) modeling the branch root
-	node     *node.RufsNode // Local RPC node
-	readonly bool           // Flag if this branch is readonly
+	rootPath string             // Local directory (absolute path) modeling the branch root
+	node     *node.RufsNode     // Local RPC node
+	readonly bool               // Flag if this branch is readonly
+	acl      *AccessControlList // Access rules for clients
+	crypt    *branchCrypt       // Encryption of the local data (nil if data is stored unencrypted)
+
+	fileLocks *fileLocks // Locks of open local files (only used for encrypted data)
+
+	watchLock *sync.Mutex    // Lock for the file system watcher
+	watcher   *branchWatcher // File system watcher (nil if nobody watches)
+
+	writeSessions *writeSessions // Open write sessions
 }
 
 /*
@@ -96,6 +106,16 @@ func NewBranch(cfg map[string]interface{}, cert *tls.Certificate) (*Branch, erro
 		rn := node.NewNode(addr, fileutil.ConfStr(cfg, config.BranchName),
 			fileutil.ConfStr(cfg, config.BranchSecret), cert, nil)
 
+		// Older clients might still authenticate with static tokens
+
+		rn.AcceptLegacyTokens = fileutil.ConfBool(cfg, config.LegacyTokenAuth)
+
+		// Set the accepted secrets and the authorized client certificates
+
+		if err = configureAuth(rn, cfg); err != nil {
+			return nil, err
+		}
+
 		// Start the rpc server
 
 		if err = rn.Start(cert); err == nil {
@@ -104,8 +124,33 @@ func NewBranch(cfg map[string]interface{}, cert *tls.Certificate) (*Branch, erro
 			//  Construct root path
 
 			if rootPath, err = filepath.Abs(fileutil.ConfStr(cfg, config.LocalFolder)); err == nil {
-				b = &Branch{rootPath, rn, fileutil.ConfBool(cfg, config.EnableReadOnly)}
-				rn.DataHandler = b.requestHandler
+				var acl *AccessControlList
+				var crypt *branchCrypt
+
+				// Access rules are optional
+
+				aclCfg := confValue(cfg, config.DefaultBranchExportConfig, config.AccessControl)
+
+				if acl, err = NewAccessControlList(aclCfg); err == nil {
+
+					// Unlock the local data if it is encrypted
+
+					crypt, err = newLocalCrypt(rootPath, cfg)
+				}
+
+				if err == nil {
+					b = &Branch{rootPath, rn, fileutil.ConfBool(cfg, config.EnableReadOnly), acl,
+						crypt, &fileLocks{&sync.Mutex{}, make(map[string]*fileLock)},
+						&sync.Mutex{}, nil, &writeSessions{&sync.Mutex{},
+							make(map[string]*writeSession)}}
+					rn.DataHandler = b.requestHandler
+					rn.StreamHandler = b.streamHandler
+					rn.AccessHandler = b.accessHandler
+				}
+			}
+
+			if err != nil {
+				rn.Shutdown()
 			}
 		}
 	}
@@ -131,9 +176,156 @@ func (b *Branch) SSLFingerprint() string {
 Shutdown shuts the branch down.
 */
 func (b *Branch) Shutdown() error {
+	b.stopWatcher()
+	b.abortAllWriteSessions()
+
 	return b.node.Shutdown()
 }
 
+/*
+UpdateAuth updates the accepted secrets and the authorized client
+certificates of the running branch from a given branch export config. Whether
+client certificates are required at all can only be changed by restarting
+the branch.
+*/
+func (b *Branch) UpdateAuth(cfg map[string]interface{}) error {
+
+	if fileutil.ConfBool(cfg, config.RequireClientCerts) != b.node.RequiresClientCerts() {
+		return fmt.Errorf("Branch %v needs a restart to change %v", b.Name(), config.RequireClientCerts)
+	}
+
+	return configureAuth(b.node, cfg)
+}
+
+/*
+configureAuth sets the accepted secrets and the authorized client
+certificates of a node from a given branch export config. The node is only
+changed if the whole config is valid.
+*/
+func configureAuth(rn *node.RufsNode, cfg map[string]interface{}) error {
+	var fps []string
+
+	requireClientCerts := fileutil.ConfBool(cfg, config.RequireClientCerts)
+
+	secrets, err := branchSecrets(cfg)
+
+	if err == nil && requireClientCerts {
+		fps, err = confStrings(cfg, config.DefaultBranchExportConfig, config.ClientFingerprints)
+	}
+
+	if err == nil {
+		rn.SetSecrets(secrets)
+
+		// Clients might need to present an authorized certificate
+
+		if requireClientCerts {
+			rn.RequireClientCerts(fps)
+		}
+	}
+
+	return err
+}
+
+/*
+branchSecrets returns all secrets which are accepted by a branch according
+to a given branch export config. The branch secret never expires. Additional
+secrets may have an expiry date. Additional secrets are either given directly
+or as a secret file which is used like the secret file of the command line
+tools.
+*/
+func branchSecrets(cfg map[string]interface{}) ([]node.Secret, error) {
+	var defs []map[string]interface{}
+
+	ret := []node.Secret{{Value: fileutil.ConfStr(cfg, config.BranchSecret)}}
+
+	switch sdefs := confValue(cfg, config.DefaultBranchExportConfig, config.BranchSecrets).(type) {
+
+	case []map[string]interface{}:
+		defs = sdefs
+
+	case []interface{}:
+		for i, sdef := range sdefs {
+			def, ok := sdef.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Secret definition %v is not an object", i)
+			}
+			defs = append(defs, def)
+		}
+
+	default:
+		return nil, fmt.Errorf("Secret definitions must be a list")
+	}
+
+	for i, def := range defs {
+		var expires time.Time
+
+		secret, _ := def["secret"].(string)
+
+		if secretFile, ok := def["file"].(string); ok && secretFile != "" {
+
+			data, err := ioutil.ReadFile(secretFile)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read secret file in secret definition %v: %v", i, err)
+			}
+
+			// The data of secret files is used in the same string form as
+			// the data of the main secret file
+
+			secret = fmt.Sprint(data)
+		}
+
+		if secret == "" {
+			return nil, fmt.Errorf("Secret definition %v needs a secret", i)
+		}
+
+		if e, ok := def["expires"]; ok && e != nil && e != "" {
+			var err error
+
+			if expires, err = time.Parse(time.RFC3339, fmt.Sprint(e)); err != nil {
+				return nil, fmt.Errorf("Invalid expiry date in secret definition %v: %v", i, err)
+			}
+		}
+
+		ret = append(ret, node.Secret{Value: secret, Expires: expires})
+	}
+
+	return ret, nil
+}
+
+/*
+newLocalCrypt returns the encryption of the local data of a branch in a given
+local folder according to a given branch export config. Returns nil if the
+data is not encrypted.
+*/
+func newLocalCrypt(rootPath string, cfg map[string]interface{}) (*branchCrypt, error) {
+	var crypt *branchCrypt
+
+	keyFile := fmt.Sprint(confValue(cfg, config.DefaultBranchExportConfig, config.EncryptionKeyFile))
+
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	key, err := loadEncryptionKey(keyFile)
+
+	if err == nil {
+		encryptNames := fileutil.ConfBool(cfg, config.EncryptNames)
+
+		if crypt, err = newBranchCrypt(rootPath, key, encryptNames); err == nil {
+			err = crypt.unlock()
+		}
+	}
+
+	return crypt, err
+}
+
+/*
+IsEncrypted returns if the local data of this branch is encrypted.
+*/
+func (b *Branch) IsEncrypted() bool {
+	return b.crypt != nil
+}
+
 /*
 IsReadOnly returns if this branch is read-only.
 */
@@ -148,7 +340,7 @@ func (b *Branch) checkReadOnly() error {
 	var err error
 
 	if b.IsReadOnly() {
-		err = fmt.Errorf("Branch %v is read-only", b.Name())
+		err = &node.ReadOnlyError{Name: b.Name()}
 	}
 
 	return err
@@ -157,6 +349,14 @@ func (b *Branch) checkReadOnly() error {
 // Branch API
 // ==========
 
+/*
+FreeSpace returns the number of bytes which are available on the file system
+of the branch.
+*/
+func (b *Branch) FreeSpace() (uint64, error) {
+	return diskFreeSpace(b.rootPath)
+}
+
 /*
 Dir returns file listings matching a given pattern of one or more directories.
 The contents of the given path is returned along with checksums if the checksum
@@ -165,6 +365,15 @@ returned if the recursive flag is set. The return values is a list of traversed
 directories (platform-agnostic) and their corresponding contents.
 */
 func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums bool) ([]string, [][]os.FileInfo, error) {
+	return b.dir(spath, pattern, recursive, checksums, false)
+}
+
+/*
+dir returns file listings matching a given pattern of one or more directories.
+Union markers are handled if the union flag is set (i.e. the branch is part of
+a union in the requesting tree).
+*/
+func (b *Branch) dir(spath string, pattern string, recursive bool, checksums bool, union bool) ([]string, [][]os.FileInfo, error) {
 	var fis []os.FileInfo
 
 	// Compile pattern
@@ -180,10 +389,24 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 		fis = make([]os.FileInfo, 0, len(afis))
 
 		for _, fi := range afis {
+			name := fi.Name()
+
+			// Temporary files are only listed if they are asked for by name
+
+			if isTempFile(name) && pattern != fmt.Sprintf("^%v$", regexp.QuoteMeta(name)) {
+				continue
+			}
+
+			// Whiteout markers are matched with the name of the item they
+			// hide - opaque markers are always included
+
+			if union && IsUnionMarker(name) && name != OpaqueMarker {
+				name = name[len(WhiteoutPrefix):]
+			}
 
 			// Append if it matches the pattern
 
-			if re.MatchString(fi.Name()) {
+			if (union && name == OpaqueMarker) || re.MatchString(name) {
 				fis = append(fis, fi)
 			}
 		}
@@ -199,7 +422,7 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 					// The sum is either there or not ... - access errors should
 					// be caught when trying to read the file
 
-					sum, _ := fileutil.CheckSumFileFast(filepath.Join(dirname, fi.Name()))
+					sum, _ := b.checkSum(filepath.Join(dirname, b.localName(fi.Name())))
 
 					fi.(*FileInfo).FiChecksum = sum
 				}
@@ -215,9 +438,9 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 
 		if !recursive {
 
-			if fis, err = ioutil.ReadDir(subPath); err == nil {
+			if fis, err = b.readDir(subPath); err == nil {
 				return []string{spath},
-					[][]os.FileInfo{createRufsFileInfos(subPath, fis)}, nil
+					[][]os.FileInfo{b.markHidden(spath, createRufsFileInfos(subPath, fis), union)}, nil
 			}
 
 		} else {
@@ -230,7 +453,7 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 			// in a platform-agnostic way
 
 			addSubDir = func(p string, rp string) error {
-				fis, err = ioutil.ReadDir(p)
+				fis, err = b.readDir(p)
 
 				if err == nil {
 					rpaths = append(rpaths, rp)
@@ -240,7 +463,7 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 					for _, fi := range fis {
 
 						if err == nil && fi.IsDir() {
-							err = addSubDir(filepath.Join(p, fi.Name()),
+							err = addSubDir(filepath.Join(p, b.localName(fi.Name())),
 								path.Join(rp, fi.Name()))
 						}
 					}
@@ -250,6 +473,8 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 			}
 
 			if err = addSubDir(subPath, spath); err == nil {
+				rfis[0] = b.markHidden(spath, rfis[0], union)
+
 				return rpaths, rfis, nil
 			}
 		}
@@ -259,6 +484,12 @@ func (b *Branch) Dir(spath string, pattern string, recursive bool, checksums boo
 
 	if os.IsNotExist(err) {
 		err = nil
+
+		// A path which does not exist might still be hidden on other branches
+
+		if fis := b.markHidden(spath, nil, union); len(fis) > 0 {
+			return []string{spath}, [][]os.FileInfo{fis}, nil
+		}
 	}
 
 	return nil, nil, err
@@ -269,26 +500,38 @@ ReadFileToBuffer reads a complete file into a given buffer which implements
 io.Writer.
 */
 func (b *Branch) ReadFileToBuffer(spath string, buf io.Writer) error {
-	var n int
-	var err error
-	var offset int64
+	return b.readFileToBuffer(spath, 0, buf)
+}
 
-	readBuf := make([]byte, DefaultReadBufferSize)
+/*
+readFileToBuffer reads a file from a given offset into a given buffer which
+implements io.Writer.
+*/
+func (b *Branch) readFileToBuffer(spath string, offset int64, buf io.Writer) error {
 
-	for err == nil {
-		n, err = b.ReadFile(spath, readBuf, offset)
+	subPath, err := b.constructSubPath(spath)
 
-		if err == nil {
-			_, err = buf.Write(readBuf[:n])
+	if err == nil {
+		var fi os.FileInfo
 
-			offset += int64(n)
+		if fi, err = os.Stat(subPath); err == nil {
 
-		} else if IsEOF(err) {
+			if fi.IsDir() {
+				err = fmt.Errorf("read /%v: is a directory", spath)
 
-			// We reached the end of the file
+			} else {
+				var f branchFile
 
-			err = nil
-			break
+				if f, err = b.openFile(subPath, os.O_RDONLY, 0); err == nil {
+					var size int64
+
+					defer f.Close()
+
+					if size, err = f.Size(); err == nil {
+						_, err = io.Copy(buf, io.NewSectionReader(f, offset, size-offset))
+					}
+				}
+			}
 		}
 	}
 
@@ -314,15 +557,19 @@ func (b *Branch) ReadFile(spath string, p []byte, offset int64) (int, error) {
 				err = fmt.Errorf("read /%v: is a directory", spath)
 
 			} else if err == nil {
-				var f *os.File
+				var f branchFile
+
+				if f, err = b.openFile(subPath, os.O_RDONLY, 0); err == nil {
+					var size int64
 
-				if f, err = os.Open(subPath); err == nil {
 					defer f.Close()
 
-					sr := io.NewSectionReader(f, 0, fi.Size())
+					if size, err = f.Size(); err == nil {
+						sr := io.NewSectionReader(f, 0, size)
 
-					if _, err = sr.Seek(offset, io.SeekStart); err == nil {
-						n, err = sr.Read(p)
+						if _, err = sr.Seek(offset, io.SeekStart); err == nil {
+							n, err = sr.Read(p)
+						}
 					}
 				}
 			}
@@ -338,32 +585,52 @@ io.Reader.
 */
 func (b *Branch) WriteFileFromBuffer(spath string, buf io.Reader) error {
 	var err error
-	var offset int64
 
 	if err = b.checkReadOnly(); err == nil {
+		err = b.writeFileFromBuffer(spath, 0, buf, true, false)
+	}
+
+	return err
+}
+
+/*
+writeFileFromBuffer writes a file from a given offset from a given buffer
+which implements io.Reader. The file is truncated after the written data if
+the replace flag is set. Whiteout markers of a new file are removed if the
+union flag is set.
+*/
+func (b *Branch) writeFileFromBuffer(spath string, offset int64, buf io.Reader, replace bool, union bool) error {
+	var created bool
+
+	subPath, err := b.constructSubPath(spath)
 
-		writeBuf := make([]byte, DefaultReadBufferSize)
+	if err == nil {
+		var f branchFile
 
-		for err == nil {
-			var n int
+		created = createsItem(subPath, union)
 
-			if n, err = buf.Read(writeBuf); err == nil {
+		// Ensure path exists
 
-				_, err = b.WriteFile(spath, writeBuf[:n], offset)
-				offset += int64(n)
+		dir, _ := filepath.Split(subPath)
 
-			} else if IsEOF(err) {
+		if err = os.MkdirAll(dir, 0755); err == nil {
 
-				// We reached the end of the file
+			if f, err = b.openFile(subPath, os.O_RDWR|os.O_CREATE, 0644); err == nil {
+				var n int64
 
-				b.WriteFile(spath, []byte{}, offset)
+				defer f.Close()
 
-				err = nil
-				break
+				if n, err = io.Copy(&offsetWriter{f, offset}, buf); err == nil && replace {
+					err = f.Truncate(offset + n)
+				}
 			}
 		}
 	}
 
+	if err == nil && created {
+		b.clearWhiteouts(spath)
+	}
+
 	return err
 }
 
@@ -372,84 +639,49 @@ WriteFile writes p into the given file from the given offset. It
 returns the number of written bytes and any error encountered.
 */
 func (b *Branch) WriteFile(spath string, p []byte, offset int64) (int, error) {
+	return b.writeFile(spath, p, offset, false)
+}
+
+/*
+writeFile writes p into the given file from the given offset. Whiteout
+markers of a new file are removed if the union flag is set.
+*/
+func (b *Branch) writeFile(spath string, p []byte, offset int64, union bool) (int, error) {
 	var n int
-	var m int64
+	var created bool
 
 	if err := b.checkReadOnly(); err != nil {
 		return 0, err
 	}
 
-	buf := byteSlicePool.Get().([]byte)
-	defer func() {
-		byteSlicePool.Put(buf)
-	}()
-
-	growFile := func(f *os.File, n int64) {
-		var err error
-
-		toWrite := n
-
-		for err == nil && toWrite > 0 {
-			if toWrite > int64(DefaultReadBufferSize) {
-				_, err = f.Write(buf[:DefaultReadBufferSize])
-				toWrite -= int64(DefaultReadBufferSize)
-			} else {
-				_, err = f.Write(buf[:toWrite])
-				toWrite = 0
-			}
-		}
-	}
-
 	subPath, err := b.constructSubPath(spath)
 
 	if err == nil {
-		var fi os.FileInfo
-		var f *os.File
+		var f branchFile
 
-		if fi, err = os.Stat(subPath); os.IsNotExist(err) {
+		created = createsItem(subPath, union)
 
-			// Ensure path exists
+		// Ensure path exists
 
-			dir, _ := filepath.Split(subPath)
+		dir, _ := filepath.Split(subPath)
 
-			if err = os.MkdirAll(dir, 0755); err == nil {
+		if err = os.MkdirAll(dir, 0755); err == nil {
 
-				// Create the file newly
+			// The file is created newly if necessary - files are grown with
+			// zero bytes if the offset is beyond their end
 
-				if f, err = os.OpenFile(subPath, os.O_RDWR|os.O_CREATE, 0644); err == nil {
-					defer f.Close()
-
-					if offset > 0 {
-						growFile(f, offset)
-					}
-
-					m, err = io.Copy(f, bytes.NewBuffer(p))
-					n += int(m)
-				}
-			}
-
-		} else if err == nil {
-
-			// File does exist
-
-			if f, err := os.OpenFile(subPath, os.O_RDWR, 0644); err == nil {
+			if f, err = b.openFile(subPath, os.O_RDWR|os.O_CREATE, 0644); err == nil {
 				defer f.Close()
 
-				if fi.Size() < offset {
-					f.Seek(fi.Size(), io.SeekStart)
-					growFile(f, offset-fi.Size())
-				} else {
-					f.Seek(offset, io.SeekStart)
-				}
-
-				m, err = io.Copy(f, bytes.NewBuffer(p))
-				errorutil.AssertOk(err)
-
-				n += int(m)
+				n, err = f.WriteAt(p, offset)
 			}
 		}
 	}
 
+	if err == nil && created {
+		b.clearWhiteouts(spath)
+	}
+
 	return n, err
 }
 
@@ -460,24 +692,28 @@ const (
 	ItemOpAction  = "itemop_action"  // ItemOp action
 	ItemOpName    = "itemop_name"    // Item name
 	ItemOpNewName = "itemop_newname" // New item name
+	ItemOpSize    = "itemop_size"    // New item size
 )
 
 /*
 ItemOp actions
 */
 const (
-	ItemOpActRename = "rename" // Rename a file or directory
-	ItemOpActDelete = "delete" // Delete a file or directory
-	ItemOpActMkDir  = "mkdir"  // Create a directory
+	ItemOpActRename   = "rename"   // Rename a file or directory
+	ItemOpActDelete   = "delete"   // Delete a file or directory
+	ItemOpActMkDir    = "mkdir"    // Create a directory
+	ItemOpActTruncate = "truncate" // Change the size of a file
 )
 
 /*
 ItemOp executes a file or directory specific operation which can either
 succeed or fail (e.g. rename or delete). Actions and parameters should
-be given in the opdata map.
+be given in the opdata map. Whiteout markers of created items are removed
+if the union flag (ParamUnion) is set in the opdata map.
 */
 func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 	res := false
+	union := strings.ToLower(opdata[ParamUnion]) == "true"
 
 	if err := b.checkReadOnly(); err != nil {
 		return false, err
@@ -501,7 +737,7 @@ func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 
 			// Build the relative paths
 
-			return filepath.Join(filepath.FromSlash(subPath), name), nil
+			return filepath.Join(filepath.FromSlash(subPath), b.localName(name)), nil
 		}
 
 		if action == ItemOpActMkDir {
@@ -510,8 +746,11 @@ func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 			// Make directory action
 
 			if name, err = fileFromOpData(ItemOpName); err == nil {
+				created := createsItem(name, union)
 
-				err = os.MkdirAll(name, 0755)
+				if err = os.MkdirAll(name, 0755); err == nil && created {
+					b.clearWhiteouts(path.Join(spath, filepath.Base(opdata[ItemOpName])))
+				}
 			}
 
 		} else if action == ItemOpActRename {
@@ -521,8 +760,24 @@ func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 
 			if name, err = fileFromOpData(ItemOpName); err == nil {
 				if newname, err = fileFromOpData(ItemOpNewName); err == nil {
+					created := createsItem(newname, union)
+
+					if err = os.Rename(name, newname); err == nil && created {
+						b.clearWhiteouts(path.Join(spath, filepath.Base(opdata[ItemOpNewName])))
+					}
+				}
+			}
+
+		} else if action == ItemOpActTruncate {
+			var name string
+			var size int64
 
-					err = os.Rename(name, newname)
+			// Truncate action - files are either shrunk or grown with zero bytes
+
+			if name, err = fileFromOpData(ItemOpName); err == nil {
+				if size, err = strconv.ParseInt(opdata[ItemOpSize], 10, 64); err == nil {
+
+					err = b.truncateFile(name, size)
 				}
 			}
 
@@ -543,13 +798,11 @@ func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 					return err
 				}
 
-				if strings.Contains(name, "*") {
+				if _, glob := filepath.Split(opdata[ItemOpName]); strings.Contains(glob, "*") {
 					var rex string
 
 					// We have a wildcard
 
-					rootdir, glob := filepath.Split(name)
-
 					// Create a regex from the given glob expression
 
 					if rex, err = stringutil.GlobToRegex(glob); err == nil {
@@ -563,8 +816,9 @@ func (b *Branch) ItemOp(spath string, opdata map[string]string) (bool, error) {
 								// Remove all files and dirs according to the wildcard
 
 								for _, fi := range fis[i] {
-									os.RemoveAll(filepath.Join(rootdir,
-										filepath.FromSlash(dir), fi.Name()))
+									if p, perr := b.constructSubPath(path.Join(dir, fi.Name())); perr == nil {
+										os.RemoveAll(p)
+									}
 								}
 							}
 						}
@@ -614,6 +868,11 @@ const (
 	ParamChecksums = "c" // Checksum flag
 	ParamOffset    = "o" // Offset parameter
 	ParamSize      = "s" // Size parameter
+	ParamSequence  = "q" // Sequence number parameter
+	ParamTimeout   = "t" // Timeout parameter (in milliseconds)
+	ParamSession   = "i" // Write session parameter
+	ParamReplace   = "e" // Replace flag (the file ends after the written data)
+	ParamUnion     = "u" // Union flag (the branch is part of a union in the tree)
 )
 
 /*
@@ -624,6 +883,17 @@ const (
 	OpRead   = "read"   // Read the contents of a file
 	OpWrite  = "write"  // Read the contents of a file
 	OpItemOp = "itemop" // File or directory operation
+	OpWatch  = "watch"  // Wait for changes under a path
+
+	OpFreeSpace = "freespace" // Query the free space of a branch
+	OpSearch    = "search"    // Search for items under a path
+
+	OpSignature  = "signature"  // Calculate the block signature of a file
+	OpApplyDelta = "applydelta" // Write a new version of a file from a delta stream
+
+	OpOpenWrite   = "openwrite"   // Open a write session for a file
+	OpCommitWrite = "commitwrite" // Replace a file with the data of a write session
+	OpAbortWrite  = "abortwrite"  // Discard the data of a write session
 )
 
 /*
@@ -646,11 +916,24 @@ func (b *Branch) requestHandler(ctrl map[string]string, data []byte) ([]byte, er
 		pattern := ctrl[ParamPattern]
 		rec := strings.ToLower(ctrl[ParamRecursive]) == "true"
 		sum := strings.ToLower(ctrl[ParamChecksums]) == "true"
+		union := strings.ToLower(ctrl[ParamUnion]) == "true"
+
+		if dirs, fis, err = b.dir(dir, pattern, rec, sum, union); err == nil {
+			res = []interface{}{dirs, fis}
+		}
+
+	} else if action == OpSearch {
+		var dirs []string
+		var fis [][]os.FileInfo
 
-		if dirs, fis, err = b.Dir(dir, pattern, rec, sum); err == nil {
+		if dirs, fis, err = b.Search(ctrl[ParamPath], ctrl); err == nil {
 			res = []interface{}{dirs, fis}
 		}
 
+	} else if action == OpSignature {
+
+		res, err = b.Signature(ctrl[ParamPath])
+
 	} else if action == OpItemOp {
 
 		res, err = b.ItemOp(ctrl[ParamPath], ctrl)
@@ -686,9 +969,65 @@ func (b *Branch) requestHandler(ctrl map[string]string, data []byte) ([]byte, er
 		var offset int64
 
 		spath := ctrl[ParamPath]
+		union := strings.ToLower(ctrl[ParamUnion]) == "true"
+
 		if offset, err = strconv.ParseInt(ctrl[ParamOffset], 10, 64); err == nil {
 
-			res, err = b.WriteFile(spath, data, offset)
+			if session, ok := ctrl[ParamSession]; ok {
+				var n int64
+
+				n, err = b.writeSessionData(session, spath, offset, bytes.NewReader(data))
+				res = int(n)
+
+			} else if strings.ToLower(ctrl[ParamReplace]) == "true" {
+
+				if err = b.checkReadOnly(); err == nil {
+					err = b.writeFileFromBuffer(spath, offset, bytes.NewReader(data), true, union)
+					res = len(data)
+				}
+
+			} else {
+
+				res, err = b.writeFile(spath, data, offset, union)
+			}
+		}
+
+	} else if action == OpOpenWrite {
+
+		res, err = b.openWriteSession(ctrl[ParamPath],
+			strings.ToLower(ctrl[ParamUnion]) == "true")
+
+	} else if action == OpCommitWrite {
+
+		err = b.CommitWriteSession(ctrl[ParamSession], ctrl[ParamPath])
+		res = err == nil
+
+	} else if action == OpAbortWrite {
+
+		err = b.AbortWriteSession(ctrl[ParamSession], ctrl[ParamPath])
+		res = err == nil
+
+	} else if action == OpFreeSpace {
+
+		res, err = b.FreeSpace()
+
+	} else if action == OpWatch {
+		var seq, timeout int64
+
+		if seq, err = strconv.ParseInt(ctrl[ParamSequence], 10, 64); err == nil {
+			if timeout, err = strconv.ParseInt(ctrl[ParamTimeout], 10, 64); err == nil {
+				var events []*WatchEvent
+
+				if seq, events, err = b.Watch(ctrl[ParamPath], seq,
+					time.Duration(timeout)*time.Millisecond); err == nil {
+
+					if events == nil {
+						events = []*WatchEvent{}
+					}
+
+					res = []interface{}{seq, events}
+				}
+			}
 		}
 	}
 
@@ -725,23 +1064,137 @@ func (b *Branch) requestHandler(ctrl map[string]string, data []byte) ([]byte, er
 		}()
 	}
 
-	if err != nil {
+	return ret, b.cleanError(err)
+}
 
-		// Ensure we don't leak local paths - this might not work in
-		// all situations and depends on the underlying os. In this
-		// error messages might include information on the full local
-		// path in error messages.
+/*
+accessHandler checks that a client is allowed to make a request or to use a
+data stream.
+*/
+func (b *Branch) accessHandler(client string, ctrl map[string]string) error {
+	var err error
 
-		absRoot, _ := filepath.Abs(b.rootPath)
-		err = fmt.Errorf("%v", strings.Replace(err.Error(), absRoot, "", -1))
+	if !b.acl.IsEnabled() {
+		return nil
+	}
+
+	action := ctrl[ParamAction]
+	spath := ctrl[ParamPath]
+
+	itemPath := func(key string) string {
+		_, name := path.Split(ctrl[key])
+		return path.Join(spath, name)
+	}
+
+	if action == OpDir || action == OpRead || action == OpWatch || action == OpFreeSpace ||
+		action == OpSearch || action == OpSignature {
+
+		err = b.acl.Check(client, spath, AccessRead)
+
+	} else if action == OpWrite || action == OpOpenWrite || action == OpCommitWrite ||
+		action == OpAbortWrite || action == OpApplyDelta {
+
+		err = b.acl.Check(client, spath, AccessWrite)
+
+	} else if action == OpItemOp {
+		itemAction := ctrl[ItemOpAction]
+
+		if itemAction == ItemOpActMkDir || itemAction == ItemOpActTruncate {
+
+			err = b.acl.Check(client, itemPath(ItemOpName), AccessWrite)
+
+		} else if itemAction == ItemOpActRename {
+
+			if err = b.acl.Check(client, itemPath(ItemOpName), AccessWrite); err == nil {
+				err = b.acl.Check(client, itemPath(ItemOpNewName), AccessWrite)
+			}
+
+		} else if itemAction == ItemOpActDelete {
+
+			err = b.acl.Check(client, itemPath(ItemOpName), AccessDelete)
+
+		} else {
+
+			err = fmt.Errorf("Access denied for client '%v': Unknown item operation %v",
+				client, itemAction)
+		}
+
+	} else {
+
+		err = fmt.Errorf("Access denied for client '%v': Unknown action %v", client, action)
+	}
+
+	return b.cleanError(err)
+}
+
+/*
+streamHandler handles incoming data streams from other branches or trees.
+*/
+func (b *Branch) streamHandler(ctrl map[string]string, in io.Reader, out io.Writer) error {
+	var err error
+	var offset int64
+
+	action := ctrl[ParamAction]
+	spath := ctrl[ParamPath]
+
+	if o, ok := ctrl[ParamOffset]; ok {
+		offset, err = strconv.ParseInt(o, 10, 64)
 	}
 
-	return ret, err
+	if err == nil {
+
+		if action == OpRead {
+
+			err = b.readFileToBuffer(spath, offset, out)
+
+		} else if action == OpWrite {
+
+			if session, ok := ctrl[ParamSession]; ok {
+
+				_, err = b.writeSessionData(session, spath, offset, in)
+
+			} else if err = b.checkReadOnly(); err == nil {
+
+				replace := strings.ToLower(ctrl[ParamReplace]) == "true"
+				union := strings.ToLower(ctrl[ParamUnion]) == "true"
+
+				err = b.writeFileFromBuffer(spath, offset, in, replace, union)
+			}
+
+		} else if action == OpApplyDelta {
+			var blockSize int
+
+			if blockSize, err = strconv.Atoi(ctrl[ParamSize]); err == nil {
+				err = b.applyDelta(ctrl[ParamSession], spath, blockSize, in)
+			}
+
+		} else {
+
+			err = fmt.Errorf("Unknown stream action: %v", action)
+		}
+	}
+
+	return b.cleanError(err)
 }
 
 // Util functions
 // ==============
 
+/*
+cleanError ensures we don't leak local paths - this might not work in
+all situations and depends on the underlying os. In this error messages
+might include information on the full local path in error messages.
+*/
+func (b *Branch) cleanError(err error) error {
+
+	if err != nil {
+		absRoot, _ := filepath.Abs(b.rootPath)
+		err = fmt.Errorf("%v", strings.Replace(err.Error(), absRoot, "", -1))
+	}
+
+	return err
+}
+
 func (b *Branch) constructSubPath(rpath string) (string, error) {
 
 	// Produce the actual subpath - this should also produce windows
@@ -756,6 +1209,13 @@ func (b *Branch) constructSubPath(rpath string) (string, error) {
 	if err == nil {
 
 		if strings.HasPrefix(absSubPath, b.rootPath) {
+
+			// Names of encrypted branches are stored encrypted
+
+			if b.crypt != nil {
+				return b.crypt.localPath(absSubPath, rpath)
+			}
+
 			return subPath, nil
 		}
 
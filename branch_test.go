@@ -65,6 +65,502 @@ func TestReadOnlyBranch(t *testing.T) {
 		t.Error("Unepxected result:", res, err)
 		return
 	}
+
+	// Remote writes report the read-only branch
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	cfg := branchConfigs["footest3"]
+
+	errorutil.AssertOk(tree.AddBranch("footest3", fmt.Sprintf("%v:%v", cfg[config.RPCHost], cfg[config.RPCPort]), ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest3", true))
+
+	if _, err := tree.WriteFile("/test1", []byte("test"), 0); !IsNotWritable(err) ||
+		err.Error() != "RufsError: Remote error (Branch footest3 is read-only)" {
+		t.Error("Unepxected result:", err)
+		return
+	}
+}
+
+func TestBranchClientCerts(t *testing.T) {
+
+	x, err := createBranch("certtest", "certtest", false)
+	errorutil.AssertOk(err)
+	defer os.RemoveAll("certtest")
+
+	ioutil.WriteFile("certtest/test1", []byte("Test1 file"), 0770)
+
+	cfg := branchConfigs["certtest"]
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(certdir, fmt.Sprintf("cert-%v.pem", portCount)),
+		filepath.Join(certdir, fmt.Sprintf("key-%v.pem", portCount)))
+	errorutil.AssertOk(err)
+
+	createTree := func(cert *tls.Certificate) *Tree {
+		tree, err := NewTree(map[string]interface{}{
+			config.TreeSecret: "123",
+		}, cert)
+		errorutil.AssertOk(err)
+
+		tree.AddBranch("certtest", fmt.Sprintf("%v:%v", cfg[config.RPCHost], cfg[config.RPCPort]), "")
+		tree.AddMapping("/", "certtest", true)
+
+		return tree
+	}
+
+	// Create another client certificate
+
+	errorutil.AssertOk(cryptutil.GenCert(certdir, "cert-other.pem", "key-other.pem", "localhost",
+		"", 365*24*time.Hour, true, 2048, ""))
+
+	otherCert, err := tls.LoadX509KeyPair(filepath.Join(certdir, "cert-other.pem"),
+		filepath.Join(certdir, "key-other.pem"))
+	errorutil.AssertOk(err)
+
+	client := createTree(clientCert)
+	other := createTree(&otherCert)
+
+	// Restart the branch so it only accepts the test client certificate
+
+	errorutil.AssertOk(x.Shutdown())
+
+	cfg[config.RequireClientCerts] = true
+	cfg[config.ClientFingerprints] = []interface{}{client.SSLFingerprint()}
+
+	x, err = NewBranch(cfg, &serverCert)
+	errorutil.AssertOk(err)
+	defer x.Shutdown()
+
+	var buf bytes.Buffer
+
+	if err := client.ReadFileToBuffer("/test1", &buf); err != nil || buf.String() != "Test1 file" {
+		t.Error("Unexpected result:", buf.String(), err)
+		return
+	}
+
+	if res, err := other.PingBranch("certtest", ""); err == nil ||
+		err.Error() != "RufsError: Remote error (Client certificate is not authorized)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Test error cases
+
+	cfg[config.ClientFingerprints] = "foo"
+
+	if _, err := NewBranch(cfg, &serverCert); err == nil ||
+		err.Error() != "Config value ClientFingerprints must be a list of strings: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestBranchLegacyTokens(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret:      "123",
+		config.LegacyTokenAuth: true,
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	if _, err := tree.PingBranch("footest", fooRPC); err == nil ||
+		err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	footest.node.AcceptLegacyTokens = true
+	defer func() {
+		footest.node.AcceptLegacyTokens = false
+	}()
+
+	if _, err := tree.PingBranch("footest", fooRPC); err != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestBranchSecrets(t *testing.T) {
+
+	x, err := createBranch("secrettest", "secrettest", false)
+	errorutil.AssertOk(err)
+	defer os.RemoveAll("secrettest")
+	defer x.Shutdown()
+
+	cfg := branchConfigs["secrettest"]
+	xRPC := fmt.Sprintf("%v:%v", cfg[config.RPCHost], cfg[config.RPCPort])
+
+	ping := func(secret string) error {
+		tree, err := NewTree(map[string]interface{}{
+			config.TreeSecret: secret,
+		}, clientCert)
+		errorutil.AssertOk(err)
+
+		_, err = tree.PingBranch("secrettest", xRPC)
+
+		return err
+	}
+
+	if err := ping("456"); err == nil || err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Accept an additional secret, a secret file and an already expired secret
+
+	ioutil.WriteFile("secrettest.secret", []byte("abc"), 0600)
+	defer os.Remove("secrettest.secret")
+
+	cfg[config.BranchSecrets] = []interface{}{
+		map[string]interface{}{"secret": "456"},
+		map[string]interface{}{"file": "secrettest.secret"},
+		map[string]interface{}{"secret": "789", "expires": time.Now().Add(-time.Hour).Format(time.RFC3339)},
+	}
+
+	errorutil.AssertOk(x.UpdateAuth(cfg))
+
+	for secret, expected := range map[string]string{
+		"123":        "<nil>",
+		"456":        "<nil>",
+		"[97 98 99]": "<nil>",
+		"abc":        "RufsError: Remote error (Invalid node token)",
+		"789":        "RufsError: Remote error (Invalid node token)",
+	} {
+		if err := ping(secret); fmt.Sprint(err) != expected {
+			t.Error("Unexpected result:", secret, err)
+			return
+		}
+	}
+
+	// Test error cases
+
+	for _, test := range []struct {
+		defs     interface{}
+		expected string
+	}{
+		{"foo", "Secret definitions must be a list"},
+		{[]interface{}{"foo"}, "Secret definition 0 is not an object"},
+		{[]interface{}{map[string]interface{}{"expires": "2020-01-01T00:00:00Z"}},
+			"Secret definition 0 needs a secret"},
+		{[]map[string]interface{}{{"file": "secrettest.foo"}},
+			"Could not read secret file in secret definition 0: open secrettest.foo: no such file or directory"},
+		{[]map[string]interface{}{{"secret": "a", "expires": "foo"}},
+			`Invalid expiry date in secret definition 0: parsing time "foo" as "2006-01-02T15:04:05Z07:00": cannot parse "foo" as "2006"`},
+	} {
+		cfg[config.BranchSecrets] = test.defs
+
+		if err := x.UpdateAuth(cfg); err == nil || err.Error() != test.expected {
+			t.Error("Unexpected result:", err)
+			return
+		}
+	}
+
+	cfg[config.BranchSecrets] = nil
+	cfg[config.RequireClientCerts] = true
+
+	if err := x.UpdateAuth(cfg); err == nil || err.Error() != "Branch secrettest needs a restart to change RequireClientCerts" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// The secrets were not changed by the invalid configs
+
+	if err := ping("456"); err != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestBranchEncryption(t *testing.T) {
+
+	x, err := createBranch("crypttest", "crypttest", false)
+	errorutil.AssertOk(err)
+	defer os.RemoveAll("crypttest")
+	defer os.Remove("crypttest.key")
+
+	cfg := branchConfigs["crypttest"]
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(certdir, fmt.Sprintf("cert-%v.pem", portCount)),
+		filepath.Join(certdir, fmt.Sprintf("key-%v.pem", portCount)))
+	errorutil.AssertOk(err)
+
+	// Restart the branch with encryption
+
+	errorutil.AssertOk(x.Shutdown())
+
+	errorutil.AssertOk(ioutil.WriteFile("crypttest.key", []byte("0123456789abcdef0123456789abcdef"), 0600))
+
+	cfg[config.EncryptionKeyFile] = "crypttest.key"
+	cfg[config.EncryptNames] = true
+
+	x, err = NewBranch(cfg, &serverCert)
+	errorutil.AssertOk(err)
+
+	if !x.IsEncrypted() || footest.IsEncrypted() {
+		t.Error("Unexpected encryption state")
+		return
+	}
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("crypttest", fmt.Sprintf("%v:%v", cfg[config.RPCHost], cfg[config.RPCPort]), ""))
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "crypttest", true))
+	errorutil.AssertOk(tree.AddMapping("/plain", "footest", false))
+
+	// Copy a file from an unencrypted branch - the checksums of both
+	// files must match
+
+	errorutil.AssertOk(tree.CopyFile("/plain/test1", "/test1", nil))
+
+	// Write a file with random offset writes
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	errorutil.AssertOk(tree.WriteFileFromBuffer("/sub/test2", bytes.NewBuffer(data[:5000])))
+
+	if n, err := tree.WriteFile("/sub/test2", data[3000:], 3000); n != 7000 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	if n, err := tree.WriteFile("/sub/test2", []byte("needle"), 12000); n != 6 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	data = append(data, make([]byte, 2000)...)
+	data = append(data, []byte("needle")...)
+
+	buf := make([]byte, 5000)
+
+	if n, err := tree.ReadFile("/sub/test2", buf, 4000); n != 5000 || err != nil ||
+		!bytes.Equal(buf, data[4000:9000]) {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	var out bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/sub/test2", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Error("Unexpected result:", out.Len(), err)
+		return
+	}
+
+	paths, infos, err := tree.Dir("/", "", true, true)
+	if res := DirResultToString(paths, infos); err != nil || res != `
+/
+drwxrwxrwx   0 B   plain
+drwxrwxrwx 4.0 KiB sub
+-rw-rw-rw-  10 B   test1 [73b8af47]
+
+/plain
+drwxrwxrwx 4.0 KiB sub1
+-rw-rw-rw-  10 B   test1 [73b8af47]
+-rw-rw-rw-  10 B   test2 [b0c1fadd]
+
+/plain/sub1
+-rw-rw-rw- 17 B   test3 [f89782b1]
+
+/sub
+-rw-rw-rw- 11.7 KiB test2 [8c9bdb49]
+`[1:] {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	paths, infos, err = tree.Search("/", map[string]string{SearchContent: "needle"})
+	if res := DirResultToString(paths, infos); err != nil || res != `
+/sub
+-rw-rw-rw- 11.7 KiB test2
+`[1:] {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Sync a changed file with a delta transfer
+
+	oldMinSize := DeltaSyncMinSize
+	DeltaSyncMinSize = 1024
+	defer func() {
+		DeltaSyncMinSize = oldMinSize
+	}()
+
+	errorutil.AssertOk(tree.WriteFileFromBuffer("/copy/test2", bytes.NewBuffer(data[:9000])))
+	errorutil.AssertOk(tree.Sync("/sub", "/copy", false, nil))
+
+	out.Reset()
+
+	if err := tree.ReadFileToBuffer("/copy/test2", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Error("Unexpected result:", out.Len(), err)
+		return
+	}
+
+	// Item operations
+
+	for _, opdata := range []map[string]string{
+		{ItemOpAction: ItemOpActRename, ItemOpName: "test2", ItemOpNewName: "test3"},
+		{ItemOpAction: ItemOpActTruncate, ItemOpName: "test3", ItemOpSize: "5"},
+		{ItemOpAction: ItemOpActMkDir, ItemOpName: "sub2"},
+	} {
+		if ok, err := tree.ItemOp("/sub", opdata); !ok || err != nil {
+			t.Error("Unexpected result:", opdata, ok, err)
+			return
+		}
+	}
+
+	if ok, err := tree.ItemOp("/copy", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "test*",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	paths, infos, err = tree.Dir("/", "", true, false)
+	if res := DirResultToString(paths, infos); err != nil || res != `
+/
+drwxrwxrwx 4.0 KiB copy
+drwxrwxrwx   0 B   plain
+drwxrwxrwx 4.0 KiB sub
+-rw-rw-rw-  10 B   test1
+
+/copy
+
+/plain
+drwxrwxrwx 4.0 KiB sub1
+-rw-rw-rw-  10 B   test1
+-rw-rw-rw-  10 B   test2
+
+/plain/sub1
+-rw-rw-rw- 17 B   test3
+
+/sub
+drwxrwxrwx 4.0 KiB sub2
+-rw-rw-rw-   5 B   test3
+
+/sub/sub2
+`[1:] {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Neither names nor contents are stored in plain form
+
+	err = filepath.Walk("crypttest", func(p string, info os.FileInfo, err error) error {
+		if err == nil && p != "crypttest" {
+			if strings.Contains(info.Name(), "test") || strings.Contains(info.Name(), "sub") {
+				err = fmt.Errorf("Unencrypted name: %v", p)
+			} else if !info.IsDir() && info.Name() != ".rufscrypt" {
+				var content []byte
+
+				if content, err = ioutil.ReadFile(p); err == nil && bytes.Contains(content, []byte("Test1")) {
+					err = fmt.Errorf("Unencrypted content: %v", p)
+				}
+			}
+		}
+		return err
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The encrypted data can only be read with the right key and settings
+
+	errorutil.AssertOk(x.Shutdown())
+
+	cfg[config.EncryptNames] = false
+
+	if _, err := NewBranch(cfg, &serverCert); err == nil ||
+		!strings.HasSuffix(err.Error(), "crypttest was encrypted with a different setting for name encryption") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[config.EncryptNames] = true
+
+	errorutil.AssertOk(ioutil.WriteFile("crypttest.key", []byte("0123456789abcdef0123456789abcdeX"), 0600))
+
+	if _, err := NewBranch(cfg, &serverCert); err == nil ||
+		!strings.HasPrefix(err.Error(), "Wrong encryption key for local folder") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	errorutil.AssertOk(ioutil.WriteFile("crypttest.key", []byte("0123456789"), 0600))
+
+	if _, err := NewBranch(cfg, &serverCert); err == nil ||
+		err.Error() != "Encryption key in crypttest.key is too short (needs at least 16 bytes)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Existing unencrypted data cannot be encrypted
+
+	errorutil.AssertOk(ioutil.WriteFile("crypttest.key", []byte("0123456789abcdef0123456789abcdef"), 0600))
+
+	cfg[config.LocalFolder] = "foo"
+
+	if _, err := NewBranch(cfg, &serverCert); err == nil ||
+		!strings.HasSuffix(err.Error(), "foo contains unencrypted data") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[config.LocalFolder] = "crypttest"
+
+	x, err = NewBranch(cfg, &serverCert)
+	errorutil.AssertOk(err)
+	defer x.Shutdown()
+
+	out.Reset()
+
+	if err := x.ReadFileToBuffer("/sub/test3", &out); err != nil || !bytes.Equal(out.Bytes(), data[:5]) {
+		t.Error("Unexpected result:", out.Bytes(), err)
+		return
+	}
+
+	// Watch events report item names
+
+	seq, _, err := x.Watch("/", -1, 0)
+	errorutil.AssertOk(err)
+
+	_, err = x.WriteFile("/sub/test4", []byte("foo"), 0)
+	errorutil.AssertOk(err)
+
+	var res []string
+
+	for timeout := time.Now().Add(5 * time.Second); time.Now().Before(timeout) &&
+		strings.Join(res, "\n") != "create /sub/test4\nmodify /sub/test4"; {
+		var events []*WatchEvent
+
+		seq, events, err = x.Watch("/sub", seq, time.Second)
+		errorutil.AssertOk(err)
+
+		for _, e := range events {
+			res = append(res, fmt.Sprintf("%v %v", e.Type, e.Path))
+		}
+	}
+
+	if strings.Join(res, "\n") != "create /sub/test4\nmodify /sub/test4" {
+		t.Error("Unexpected result:", res)
+		return
+	}
 }
 
 func TestTreeTraversal(t *testing.T) {
@@ -155,7 +651,7 @@ func TestTreeTraversal(t *testing.T) {
 
 	var res string
 
-	treeVisitor := func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool) {
+	treeVisitor := func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
 		// treePath is used for the result (to present to the user)
 		// branchPath is send to the branch
 		// branches are the branches on the current level
@@ -0,0 +1,710 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+DefaultCacheBlockSize is the default size of a cached file block
+*/
+const DefaultCacheBlockSize = 64 * 1024
+
+/*
+cacheFileExt is the file extension of cached blocks on disk
+*/
+const cacheFileExt = ".rufsblock"
+
+/*
+BlockCache is a size-bounded cache for file blocks. Blocks are kept in memory
+and are moved to an optional disk directory once they are evicted from memory.
+Cached blocks are keyed by branch, path, modification time and size of a file.
+The cache only knows about files which were seen in a directory listing. A
+file is invalidated if a listing shows a different modification time, size or
+checksum.
+*/
+type BlockCache struct {
+	lock       *sync.Mutex
+	blockSize  int64                      // Size of a cached block
+	maxMem     int64                      // Maximum size of blocks in memory
+	memSize    int64                      // Current size of blocks in memory
+	memLRU     *list.List                 // Blocks in memory (least recently used last)
+	memBlocks  map[string]*list.Element   // Lookup map for blocks in memory
+	diskDir    string                     // Directory for blocks on disk
+	maxDisk    int64                      // Maximum size of blocks on disk
+	diskSize   int64                      // Current size of blocks on disk
+	diskLRU    *list.List                 // Blocks on disk (least recently used last)
+	diskBlocks map[string]*list.Element   // Lookup map for blocks on disk
+	versions   map[string]*fileVersion    // Known file versions
+	fileBlocks map[string]map[string]bool // Cached block keys for each file
+	hits       int64                      // Number of cache hits
+	misses     int64                      // Number of cache misses
+}
+
+/*
+BlockCacheStats contains statistics of a block cache.
+*/
+type BlockCacheStats struct {
+	Hits       int64 // Number of blocks which were served from the cache
+	Misses     int64 // Number of blocks which had to be requested from a branch
+	MemBlocks  int   // Number of blocks in memory
+	MemSize    int64 // Size of all blocks in memory
+	DiskBlocks int   // Number of blocks on disk
+	DiskSize   int64 // Size of all blocks on disk
+}
+
+/*
+fileVersion is a known version of a file on a branch.
+*/
+type fileVersion struct {
+	modTime  time.Time // Modification time
+	size     int64     // Size in bytes
+	checksum string    // Checksum (if known)
+}
+
+/*
+cacheBlock is a single cached block.
+*/
+type cacheBlock struct {
+	key     string // Block key
+	fileKey string // Key of the file which contains the block
+	data    []byte // Block data (only for blocks in memory)
+	size    int64  // Block size
+}
+
+/*
+NewBlockCache creates a new block cache. The cache holds up to memSize bytes
+in memory. An optional disk directory can hold up to diskSize bytes. The
+disk directory is cleared when the cache is created.
+*/
+func NewBlockCache(blockSize int64, memSize int64, diskDir string, diskSize int64) (*BlockCache, error) {
+	var err error
+
+	if blockSize <= 0 {
+		blockSize = DefaultCacheBlockSize
+	}
+
+	if diskDir != "" {
+
+		if err = os.MkdirAll(diskDir, 0700); err == nil {
+			var fis []os.FileInfo
+
+			// Remove blocks of previous caches
+
+			if fis, err = ioutil.ReadDir(diskDir); err == nil {
+				for _, fi := range fis {
+					if strings.HasSuffix(fi.Name(), cacheFileExt) {
+						os.Remove(filepath.Join(diskDir, fi.Name()))
+					}
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not create block cache: %v", err)
+	}
+
+	return &BlockCache{&sync.Mutex{}, blockSize, memSize, 0, list.New(),
+		make(map[string]*list.Element), diskDir, diskSize, 0, list.New(),
+		make(map[string]*list.Element), make(map[string]*fileVersion),
+		make(map[string]map[string]bool), 0, 0}, nil
+}
+
+/*
+Stats returns the current statistics of the cache.
+*/
+func (bc *BlockCache) Stats() *BlockCacheStats {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	return &BlockCacheStats{bc.hits, bc.misses, bc.memLRU.Len(), bc.memSize,
+		bc.diskLRU.Len(), bc.diskSize}
+}
+
+/*
+Clear removes all cached blocks and known file versions.
+*/
+func (bc *BlockCache) Clear() {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	for fileKey := range bc.fileBlocks {
+		bc.removeFile(fileKey)
+	}
+
+	bc.versions = make(map[string]*fileVersion)
+}
+
+/*
+UpdateVersion records the version of a file as seen in a directory listing.
+All cached blocks of the file are invalidated if the version has changed.
+*/
+func (bc *BlockCache) UpdateVersion(branch string, spath string, fi os.FileInfo) {
+	var checksum string
+
+	if fi.IsDir() {
+		return
+	}
+
+	if rfi, ok := fi.(*FileInfo); ok {
+		checksum = rfi.Checksum()
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	fileKey := cacheFileKey(branch, spath)
+
+	if v, ok := bc.versions[fileKey]; ok {
+
+		if v.modTime.Equal(fi.ModTime()) && v.size == fi.Size() &&
+			(checksum == "" || v.checksum == "" || v.checksum == checksum) {
+
+			// Version is unchanged - remember the checksum if it is new
+
+			if checksum != "" {
+				v.checksum = checksum
+			}
+
+			return
+		}
+
+		bc.removeFile(fileKey)
+	}
+
+	bc.versions[fileKey] = &fileVersion{fi.ModTime(), fi.Size(), checksum}
+}
+
+/*
+Invalidate removes the cached blocks and the known versions of all files
+under a given path of a branch. This should be called when files are modified.
+*/
+func (bc *BlockCache) Invalidate(branch string, spath string) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	fileKey := cacheFileKey(branch, spath)
+	dirPrefix := strings.TrimSuffix(fileKey, "/") + "/"
+
+	matches := func(k string) bool {
+		return k == fileKey || strings.HasPrefix(k, dirPrefix)
+	}
+
+	for k := range bc.versions {
+		if matches(k) {
+			delete(bc.versions, k)
+		}
+	}
+
+	for k := range bc.fileBlocks {
+		if matches(k) {
+			bc.removeFile(k)
+		}
+	}
+}
+
+/*
+ReadAt reads up to len(p) bytes of a file from the given offset. Blocks which
+are not in the cache are requested with the given fetch function. Returns
+false if the cache could not handle the request (e.g. the version of the file
+is unknown). The caller should request the data directly in this case.
+*/
+func (bc *BlockCache) ReadAt(branch string, spath string, p []byte, offset int64,
+	fetch func(p []byte, offset int64) (int, error)) (int, bool, error) {
+
+	var n int
+
+	fileKey := cacheFileKey(branch, spath)
+
+	bc.lock.Lock()
+	v, ok := bc.versions[fileKey]
+	if ok {
+		v = &fileVersion{v.modTime, v.size, v.checksum}
+	}
+	bc.lock.Unlock()
+
+	if !ok {
+		return 0, false, nil
+	}
+
+	if offset >= v.size {
+		return 0, true, io.EOF
+	}
+
+	versionKey := fmt.Sprintf("%v\x00%v\x00%v", fileKey, v.modTime.UnixNano(), v.size)
+
+	for n < len(p) && offset < v.size {
+		idx := offset / bc.blockSize
+		start := idx * bc.blockSize
+		blockLen := bc.blockSize
+
+		if start+blockLen > v.size {
+			blockLen = v.size - start
+		}
+
+		key := fmt.Sprintf("%v\x00%v", versionKey, idx)
+
+		data := bc.get(key)
+
+		if data == nil {
+			data = make([]byte, blockLen)
+
+			if bn, err := fetch(data, start); err != nil || int64(bn) != blockLen {
+
+				// The file has changed or cannot be read - forget the version
+
+				bc.Invalidate(branch, spath)
+
+				return 0, false, nil
+			}
+
+			bc.put(key, fileKey, v, data)
+		}
+
+		c := copy(p[n:], data[offset-start:])
+		n += c
+		offset += int64(c)
+	}
+
+	return n, true, nil
+}
+
+// Internal functions
+// ==================
+
+/*
+get retrieves a block from the cache. Returns nil if the block is not cached.
+*/
+func (bc *BlockCache) get(key string) []byte {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if e, ok := bc.memBlocks[key]; ok {
+		bc.hits++
+		bc.memLRU.MoveToFront(e)
+		return e.Value.(*cacheBlock).data
+	}
+
+	if e, ok := bc.diskBlocks[key]; ok {
+		block := e.Value.(*cacheBlock)
+
+		data, err := ioutil.ReadFile(bc.diskFile(key))
+
+		bc.removeDiskBlock(e)
+
+		if err == nil && int64(len(data)) == block.size {
+			bc.hits++
+
+			// Move the block back into memory
+
+			bc.putMem(key, block.fileKey, data)
+
+			return data
+		}
+	}
+
+	bc.misses++
+
+	return nil
+}
+
+/*
+put adds a block of a given file version to the cache.
+*/
+func (bc *BlockCache) put(key string, fileKey string, v *fileVersion, data []byte) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	// Only add blocks if the file version has not changed in the meantime
+
+	if cv, ok := bc.versions[fileKey]; !ok || !cv.modTime.Equal(v.modTime) || cv.size != v.size {
+		return
+	}
+
+	if _, ok := bc.memBlocks[key]; ok {
+		return
+	}
+
+	bc.putMem(key, fileKey, data)
+}
+
+/*
+putMem adds a block to the memory of the cache. Blocks which do not fit
+into memory anymore are moved to disk.
+*/
+func (bc *BlockCache) putMem(key string, fileKey string, data []byte) {
+	size := int64(len(data))
+
+	if size > bc.maxMem {
+		bc.putDisk(key, fileKey, data)
+		return
+	}
+
+	bc.memBlocks[key] = bc.memLRU.PushFront(&cacheBlock{key, fileKey, data, size})
+	bc.memSize += size
+	bc.addFileBlock(fileKey, key)
+
+	for bc.memSize > bc.maxMem {
+		e := bc.memLRU.Back()
+		block := e.Value.(*cacheBlock)
+
+		bc.removeMemBlock(e)
+		bc.putDisk(block.key, block.fileKey, block.data)
+	}
+}
+
+/*
+putDisk adds a block to the disk directory of the cache.
+*/
+func (bc *BlockCache) putDisk(key string, fileKey string, data []byte) {
+	size := int64(len(data))
+
+	if bc.diskDir == "" || size > bc.maxDisk {
+		return
+	}
+
+	if err := ioutil.WriteFile(bc.diskFile(key), data, 0600); err != nil {
+		return
+	}
+
+	bc.diskBlocks[key] = bc.diskLRU.PushFront(&cacheBlock{key, fileKey, nil, size})
+	bc.diskSize += size
+	bc.addFileBlock(fileKey, key)
+
+	for bc.diskSize > bc.maxDisk {
+		bc.removeDiskBlock(bc.diskLRU.Back())
+	}
+}
+
+/*
+removeMemBlock removes a block from memory.
+*/
+func (bc *BlockCache) removeMemBlock(e *list.Element) {
+	block := e.Value.(*cacheBlock)
+
+	bc.memLRU.Remove(e)
+	delete(bc.memBlocks, block.key)
+	bc.memSize -= block.size
+	bc.removeFileBlock(block.fileKey, block.key)
+}
+
+/*
+removeDiskBlock removes a block from disk.
+*/
+func (bc *BlockCache) removeDiskBlock(e *list.Element) {
+	block := e.Value.(*cacheBlock)
+
+	os.Remove(bc.diskFile(block.key))
+
+	bc.diskLRU.Remove(e)
+	delete(bc.diskBlocks, block.key)
+	bc.diskSize -= block.size
+	bc.removeFileBlock(block.fileKey, block.key)
+}
+
+/*
+removeFile removes all cached blocks of a file.
+*/
+func (bc *BlockCache) removeFile(fileKey string) {
+	for key := range bc.fileBlocks[fileKey] {
+		if e, ok := bc.memBlocks[key]; ok {
+			bc.removeMemBlock(e)
+		}
+		if e, ok := bc.diskBlocks[key]; ok {
+			bc.removeDiskBlock(e)
+		}
+	}
+}
+
+/*
+addFileBlock records a cached block of a file.
+*/
+func (bc *BlockCache) addFileBlock(fileKey string, key string) {
+	blocks, ok := bc.fileBlocks[fileKey]
+	if !ok {
+		blocks = make(map[string]bool)
+		bc.fileBlocks[fileKey] = blocks
+	}
+	blocks[key] = true
+}
+
+/*
+removeFileBlock removes the record of a cached block of a file.
+*/
+func (bc *BlockCache) removeFileBlock(fileKey string, key string) {
+	if blocks, ok := bc.fileBlocks[fileKey]; ok {
+
+		// A block might be in memory and on disk at the same time
+
+		_, inMem := bc.memBlocks[key]
+		_, onDisk := bc.diskBlocks[key]
+
+		if !inMem && !onDisk {
+			delete(blocks, key)
+
+			if len(blocks) == 0 {
+				delete(bc.fileBlocks, fileKey)
+			}
+		}
+	}
+}
+
+/*
+diskFile returns the file name of a block on disk.
+*/
+func (bc *BlockCache) diskFile(key string) string {
+	return filepath.Join(bc.diskDir, fmt.Sprintf("%x%v", sha256.Sum256([]byte(key)), cacheFileExt))
+}
+
+/*
+cacheFileKey returns the key of a file on a branch.
+*/
+func cacheFileKey(branch string, spath string) string {
+	return branch + "\x00" + path.Clean("/"+spath)
+}
+
+/*
+dirCache caches the results of directory listings for a given time.
+*/
+type dirCache struct {
+	lock    *sync.Mutex
+	ttl     time.Duration            // Time for which a listing is cached
+	entries map[string]*dirCacheItem // Cached listings
+}
+
+/*
+dirCacheItem is a single cached directory listing.
+*/
+type dirCacheItem struct {
+	dir     string          // Listed directory
+	dirs    []string        // Traversed directories
+	fis     [][]os.FileInfo // Contents of traversed directories
+	expires time.Time       // Expiry time of the listing
+}
+
+/*
+newDirCache creates a new directory listing cache.
+*/
+func newDirCache(ttl time.Duration) *dirCache {
+	return &dirCache{&sync.Mutex{}, ttl, make(map[string]*dirCacheItem)}
+}
+
+/*
+get returns a cached directory listing. Returns false if the listing is not
+in the cache.
+*/
+func (dc *dirCache) get(key string) ([]string, [][]os.FileInfo, bool) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	item, ok := dc.entries[key]
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	if time.Now().After(item.expires) {
+		delete(dc.entries, key)
+		return nil, nil, false
+	}
+
+	return copyDirResult(item.dirs, item.fis)
+}
+
+/*
+put adds a directory listing to the cache.
+*/
+func (dc *dirCache) put(key string, dir string, dirs []string, fis [][]os.FileInfo) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	now := time.Now()
+
+	// Remove all expired listings
+
+	for k, item := range dc.entries {
+		if now.After(item.expires) {
+			delete(dc.entries, k)
+		}
+	}
+
+	dirs, fis, _ = copyDirResult(dirs, fis)
+
+	dc.entries[key] = &dirCacheItem{path.Clean("/" + dir), dirs, fis, now.Add(dc.ttl)}
+}
+
+/*
+invalidate removes all listings which might contain a given path.
+*/
+func (dc *dirCache) invalidate(spath string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	spath = path.Clean("/" + spath)
+
+	isParent := func(p, c string) bool {
+		return p == c || p == "/" || strings.HasPrefix(c, p+"/")
+	}
+
+	for k, item := range dc.entries {
+
+		// Remove listings of parent directories (which might list the path)
+		// and listings of subdirectories (which might be below the path)
+
+		if isParent(item.dir, spath) || isParent(spath, item.dir) {
+			delete(dc.entries, k)
+		}
+	}
+}
+
+/*
+clear removes all cached listings.
+*/
+func (dc *dirCache) clear() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	dc.entries = make(map[string]*dirCacheItem)
+}
+
+/*
+itemCache caches information about single items of a tree for a given time.
+*/
+type itemCache struct {
+	lock    *sync.Mutex
+	entries map[string]*itemCacheItem // Cached information by item path
+}
+
+/*
+itemCacheItem is the cached information of a single item.
+*/
+type itemCacheItem struct {
+	dir     string      // Directory of the item
+	value   interface{} // Cached information
+	expires time.Time   // Expiry time of the information
+}
+
+/*
+newItemCache creates a new item cache.
+*/
+func newItemCache() *itemCache {
+	return &itemCache{&sync.Mutex{}, make(map[string]*itemCacheItem)}
+}
+
+/*
+get returns the cached information of an item. Returns false if there is no
+information in the cache.
+*/
+func (ic *itemCache) get(spath string) (interface{}, bool) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	spath = path.Clean("/" + spath)
+
+	item, ok := ic.entries[spath]
+
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(item.expires) {
+		delete(ic.entries, spath)
+		return nil, false
+	}
+
+	return item.value, true
+}
+
+/*
+put adds the information of an item to the cache which is kept for a given
+time.
+*/
+func (ic *itemCache) put(spath string, value interface{}, ttl time.Duration) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	now := time.Now()
+
+	// Remove all expired information
+
+	for k, item := range ic.entries {
+		if now.After(item.expires) {
+			delete(ic.entries, k)
+		}
+	}
+
+	spath = path.Clean("/" + spath)
+	dir, _ := path.Split(spath)
+
+	ic.entries[spath] = &itemCacheItem{path.Clean(dir), value, now.Add(ttl)}
+}
+
+/*
+invalidate removes the information of all items which might be affected by a
+change of a given path. These are the items in the directories of the path
+and all items below the path.
+*/
+func (ic *itemCache) invalidate(spath string) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	spath = path.Clean("/" + spath)
+
+	isParent := func(p, c string) bool {
+		return p == c || p == "/" || strings.HasPrefix(c, p+"/")
+	}
+
+	for k, item := range ic.entries {
+		if isParent(item.dir, spath) || isParent(spath, item.dir) {
+			delete(ic.entries, k)
+		}
+	}
+}
+
+/*
+clear removes all cached information.
+*/
+func (ic *itemCache) clear() {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	ic.entries = make(map[string]*itemCacheItem)
+}
+
+/*
+copyDirResult copies the lists of a directory listing so callers can modify
+them (e.g. by sorting).
+*/
+func copyDirResult(dirs []string, fis [][]os.FileInfo) ([]string, [][]os.FileInfo, bool) {
+	rdirs := make([]string, len(dirs))
+	rfis := make([][]os.FileInfo, len(fis))
+
+	copy(rdirs, dirs)
+
+	for i, fi := range fis {
+		rfis[i] = make([]os.FileInfo, len(fi))
+		copy(rfis[i], fi)
+	}
+
+	return rdirs, rfis, true
+}
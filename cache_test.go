@@ -0,0 +1,474 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/rufs/config"
+)
+
+func TestBlockCache(t *testing.T) {
+	var fetched []int64
+
+	cacheDir := "cachetest"
+	defer os.RemoveAll(cacheDir)
+
+	os.MkdirAll(cacheDir, 0700)
+	ioutil.WriteFile("cachetest/old"+cacheFileExt, []byte("old"), 0600)
+	ioutil.WriteFile("cachetest/other", []byte("other"), 0600)
+
+	// Cache with 2 blocks in memory and 2 blocks on disk
+
+	bc, err := NewBlockCache(4, 8, cacheDir, 8)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal(cacheDir); res != "other(5)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	content := []byte("0123456789abcdefghij")
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fetch := func(p []byte, offset int64) (int, error) {
+		fetched = append(fetched, offset)
+		return copy(p, content[offset:]), nil
+	}
+
+	buf := make([]byte, 6)
+
+	// Files without a known version are not handled
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 0, fetch); n != 0 || ok || err != nil {
+		t.Error("Unexpected result:", n, ok, err)
+		return
+	}
+
+	bc.UpdateVersion("b1", "foo", &FileInfo{"foo", int64(len(content)), 0666, modTime, "", false, ""})
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 2, fetch); n != 6 || !ok || err != nil ||
+		string(buf) != "234567" || fmt.Sprint(fetched) != "[0 4]" {
+		t.Error("Unexpected result:", n, ok, err, string(buf), fetched)
+		return
+	}
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 1, fetch); n != 6 || !ok || err != nil ||
+		string(buf) != "123456" || fmt.Sprint(fetched) != "[0 4]" {
+		t.Error("Unexpected result:", n, ok, err, string(buf), fetched)
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:2 Misses:2 MemBlocks:2 MemSize:8 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Read the end of the file - blocks are moved to disk
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 16, fetch); n != 4 || !ok || err != nil ||
+		string(buf[:n]) != "ghij" || fmt.Sprint(fetched) != "[0 4 16]" {
+		t.Error("Unexpected result:", n, ok, err, string(buf), fetched)
+		return
+	}
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 20, fetch); n != 0 || !ok || err != io.EOF {
+		t.Error("Unexpected result:", n, ok, err)
+		return
+	}
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 8, fetch); n != 6 || !ok || err != nil ||
+		string(buf) != "89abcd" || fmt.Sprint(fetched) != "[0 4 16 8 12]" {
+		t.Error("Unexpected result:", n, ok, err, string(buf), fetched)
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:2 Misses:5 MemBlocks:2 MemSize:8 DiskBlocks:2 DiskSize:8}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Blocks on disk are served from disk
+
+	fetched = nil
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 4, fetch); n != 6 || !ok || err != nil ||
+		string(buf) != "456789" || fmt.Sprint(fetched) != "[]" {
+		t.Error("Unexpected result:", n, ok, err, string(buf), fetched)
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:4 Misses:5 MemBlocks:2 MemSize:8 DiskBlocks:2 DiskSize:8}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// An unchanged version keeps the cached blocks
+
+	bc.UpdateVersion("b1", "/foo", &FileInfo{"foo", int64(len(content)), 0666, modTime, "123", false, ""})
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:4 Misses:5 MemBlocks:2 MemSize:8 DiskBlocks:2 DiskSize:8}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A changed checksum invalidates all blocks
+
+	bc.UpdateVersion("b1", "/foo", &FileInfo{"foo", int64(len(content)), 0666, modTime, "456", false, ""})
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:4 Misses:5 MemBlocks:0 MemSize:0 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := dirLocal(cacheDir); res != "other(5)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Fetch errors invalidate the file
+
+	content = []byte("0123")
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 2, fetch); n != 0 || ok || err != nil {
+		t.Error("Unexpected result:", n, ok, err)
+		return
+	}
+
+	if n, ok, err := bc.ReadAt("b1", "/foo", buf, 0, fetch); n != 0 || ok || err != nil {
+		t.Error("Unexpected result:", n, ok, err)
+		return
+	}
+
+	// Invalidate directories
+
+	bc.UpdateVersion("b1", "/foo", &FileInfo{"foo", 4, 0666, modTime, "", false, ""})
+	bc.UpdateVersion("b1", "/bar/foo", &FileInfo{"foo", 4, 0666, modTime, "", false, ""})
+	bc.UpdateVersion("b1", "/barfoo", &FileInfo{"foo", 4, 0666, modTime, "", false, ""})
+	bc.UpdateVersion("b2", "/bar/foo", &FileInfo{"foo", 4, 0666, modTime, "", false, ""})
+
+	bc.ReadAt("b1", "/bar/foo", buf, 0, fetch)
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:4 Misses:8 MemBlocks:1 MemSize:4 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	bc.Invalidate("b1", "bar")
+
+	if res := fmt.Sprintf("%+v", *bc.Stats()); res != "{Hits:4 Misses:8 MemBlocks:0 MemSize:0 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if len(bc.versions) != 3 {
+		t.Error("Unexpected result:", bc.versions)
+		return
+	}
+
+	bc.Invalidate("b1", "/")
+
+	if len(bc.versions) != 1 {
+		t.Error("Unexpected result:", bc.versions)
+		return
+	}
+
+	bc.Clear()
+
+	if len(bc.versions) != 0 {
+		t.Error("Unexpected result:", bc.versions)
+		return
+	}
+}
+
+func TestTreeBlockCache(t *testing.T) {
+
+	cfg := map[string]interface{}{
+		config.TreeSecret:   "123",
+		config.CacheMemSize: float64(1024 * 1024),
+	}
+
+	tree, err := NewTree(cfg, clientCert)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost],
+		branchConfigs["footest"][config.RPCPort])
+
+	tree.AddBranch("footest", branchRPC, "")
+	tree.AddMapping("/", "footest", true)
+
+	buf := make([]byte, 5)
+
+	// Reading a file without a listing goes to the branch
+
+	if n, err := tree.ReadFile("/test2", buf, 0); n != 5 || err != nil || string(buf) != "Test2" {
+		t.Error("Unexpected result:", n, err, string(buf))
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *tree.CacheStats()); res != "{Hits:0 Misses:0 MemBlocks:0 MemSize:0 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A listing makes the file known to the cache
+
+	if _, err := tree.Stat("/test2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if n, err := tree.ReadFile("/test2", buf, 5); n != 5 || err != nil || string(buf) != " file" {
+			t.Error("Unexpected result:", n, err, string(buf))
+			return
+		}
+	}
+
+	if n, err := tree.ReadFile("/test2", buf, 10); n != 0 || !IsEOF(err) {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *tree.CacheStats()); res != "{Hits:1 Misses:1 MemBlocks:1 MemSize:10 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Writes invalidate cached blocks
+
+	if _, err := tree.WriteFile("/test2", []byte("T"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := fmt.Sprintf("%+v", *tree.CacheStats()); res != "{Hits:1 Misses:1 MemBlocks:0 MemSize:0 DiskBlocks:0 DiskSize:0}" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	var out bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/test2", &out); err != nil || out.String() != "Test2 file" {
+		t.Error("Unexpected result:", out.String(), err)
+		return
+	}
+
+	// Check error cases
+
+	cfg[config.CacheMemSize] = "abc"
+
+	if _, err = NewTree(cfg, clientCert); err == nil || err.Error() != "Config value CacheMemSize must be an integer: abc" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[config.CacheMemSize] = 0
+
+	if tree, err = NewTree(cfg, clientCert); err != nil || tree.CacheStats() != nil {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestTreeDirCache(t *testing.T) {
+
+	cfg := map[string]interface{}{
+		config.TreeSecret:  "123",
+		config.DirCacheTTL: float64(60000),
+	}
+
+	tree, err := NewTree(cfg, clientCert)
+	if err != nil || tree.DirCacheTTL() != time.Minute {
+		t.Error("Unexpected result:", tree, err)
+		return
+	}
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost],
+		branchConfigs["footest"][config.RPCPort])
+
+	tree.AddBranch("footest", branchRPC, "")
+	tree.AddMapping("/", "footest", true)
+
+	defer os.RemoveAll("foo/sub1/dircache1")
+	defer os.RemoveAll("foo/sub1/dircache2")
+
+	dirString := func(dir string) string {
+		paths, infos, err := tree.Dir(dir, "", false, false)
+		if err != nil {
+			return err.Error()
+		}
+		return DirResultToString(paths, infos)
+	}
+
+	if res := dirString("/sub1"); res != `
+/sub1
+-rw-rw-rw- 17 B   test3
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Changes which are not made through the tree are not visible
+
+	ioutil.WriteFile("foo/sub1/dircache1", []byte("test"), 0770)
+
+	if res := dirString("/sub1/"); res != `
+/sub1
+-rw-rw-rw- 17 B   test3
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Writes through the tree invalidate the cache
+
+	if _, err := tree.WriteFile("/sub1/dircache2", []byte("test"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirString("/sub1"); res != `
+/sub1
+-rw-rw-rw-  4 B   dircache1
+-rw-rw-rw-  4 B   dircache2
+-rw-rw-rw- 17 B   test3
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if _, err := tree.ItemOp("/sub1", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "dircache2",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirString("/sub1"); res != `
+/sub1
+-rw-rw-rw-  4 B   dircache1
+-rw-rw-rw- 17 B   test3
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Expired listings are not used
+
+	os.Remove("foo/sub1/dircache1")
+
+	for _, item := range tree.dirCache.entries {
+		item.expires = time.Now().Add(-time.Second)
+	}
+
+	if res := dirString("/sub1"); res != `
+/sub1
+-rw-rw-rw- 17 B   test3
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if len(tree.dirCache.entries) != 1 {
+		t.Error("Unexpected result:", tree.dirCache.entries)
+		return
+	}
+
+	tree.Reset(false)
+
+	if len(tree.dirCache.entries) != 0 {
+		t.Error("Unexpected result:", tree.dirCache.entries)
+		return
+	}
+}
+
+func TestDirCacheInvalidate(t *testing.T) {
+	dc := newDirCache(time.Minute)
+
+	for _, dir := range []string{"", "/foo", "/foo/bar", "/foobar", "/bar"} {
+		dc.put(dir, dir, nil, nil)
+	}
+
+	dc.invalidate("/foo/bar/x")
+
+	if len(dc.entries) != 2 || dc.entries["/foobar"] == nil || dc.entries["/bar"] == nil {
+		t.Error("Unexpected result:", dc.entries)
+		return
+	}
+
+	dc.invalidate("/bar")
+
+	if len(dc.entries) != 1 || dc.entries["/foobar"] == nil {
+		t.Error("Unexpected result:", dc.entries)
+		return
+	}
+}
+
+func TestItemCache(t *testing.T) {
+	ic := newItemCache()
+
+	for _, item := range []string{"/foo/a", "/foo/bar/b", "/foobar/c", "/bar/d"} {
+		ic.put(item, item, time.Minute)
+	}
+
+	if res, ok := ic.get("/foo/a"); !ok || res != "/foo/a" {
+		t.Error("Unexpected result:", res, ok)
+		return
+	}
+
+	// Changes in a directory remove the information of the items in it
+
+	ic.invalidate("/foo/x")
+
+	if len(ic.entries) != 3 || ic.entries["/foo/a"] != nil {
+		t.Error("Unexpected result:", ic.entries)
+		return
+	}
+
+	// Changes of a directory remove the information of the items below it
+
+	ic.invalidate("/foo")
+
+	if len(ic.entries) != 2 || ic.entries["/foobar/c"] == nil || ic.entries["/bar/d"] == nil {
+		t.Error("Unexpected result:", ic.entries)
+		return
+	}
+
+	// Expired information is not used
+
+	ic.put("/bar/e", "e", -time.Second)
+
+	if res, ok := ic.get("/bar/e"); ok {
+		t.Error("Unexpected result:", res, ok)
+		return
+	}
+
+	ic.clear()
+
+	if len(ic.entries) != 0 {
+		t.Error("Unexpected result:", ic.entries)
+		return
+	}
+}
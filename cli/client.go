@@ -40,7 +40,7 @@ func clientCli() error {
 	var fuseMount, dokanMount, webExport *string
 
 	if runtime.GOOS == "linux" {
-		fuseMount = flag.String("fuse-mount", "", "Mount tree as FUSE filesystem at specified path (read-only)")
+		fuseMount = flag.String("fuse-mount", "", "Mount tree as FUSE filesystem at specified path")
 	}
 	if runtime.GOOS == "windows" {
 		dokanMount = flag.String("dokan-mount", "", "Mount tree as DOKAN filesystem at specified path (read-only)")
@@ -48,6 +48,16 @@ func clientCli() error {
 
 	webExport = flag.String("web", "", "Export the tree through a https interface on the specified host:port")
 
+	clientName := flag.String("name", "", "Client name which is used by branches for access checks")
+
+	cacheMem := flag.Int("cache-mem", 0, "Size of the file block cache in memory in MiB")
+	cacheDir := flag.String("cache-dir", "", "Directory for the file block cache on disk")
+	cacheDisk := flag.Int("cache-disk", 0, "Size of the file block cache on disk in MiB")
+	dirCacheTTL := flag.Int("dir-cache-ttl", 0, "Time in milliseconds for which directory listings are cached")
+	healthInterval := flag.Int("health-interval", 0, "Time in milliseconds between background health checks of branches")
+	syncJobFile := flag.String("sync-jobs", "", "File which stores scheduled sync jobs")
+	legacyAuth := flag.Bool("legacy-auth", false, "Authenticate with static tokens (for branches of older versions)")
+
 	secretFile, certDir := commonCliOptions()
 
 	showHelp := flag.Bool("help", false, "Show this help message")
@@ -77,7 +87,10 @@ func clientCli() error {
 		fmt.Println(`    {`)
 		fmt.Println(`      "path"      : <path>,`)
 		fmt.Println(`      "branch"    : <branch name>,`)
-		fmt.Println(`      "writeable" : <writable flag>`)
+		fmt.Println(`      "writeable" : <writable flag>,`)
+		fmt.Println(`      "policy"    : <optional write policy (all, first, mostfree, roundrobin)>,`)
+		fmt.Println(`      "priority"  : <optional priority (branches with a higher priority are read first)>,`)
+		fmt.Println(`      "replica"   : <optional flag if the branches of the path are replicas which share reads>`)
 		fmt.Println(`    },`)
 		fmt.Println("    ...")
 		fmt.Println("  ]")
@@ -103,6 +116,14 @@ func clientCli() error {
 	delete(cfg, config.TreeSecret)
 
 	cfg[config.TreeSecret] = secret
+	cfg[config.TreeClientName] = *clientName
+	cfg[config.CacheMemSize] = *cacheMem * 1024 * 1024
+	cfg[config.CacheDiskDir] = *cacheDir
+	cfg[config.CacheDiskSize] = *cacheDisk * 1024 * 1024
+	cfg[config.DirCacheTTL] = *dirCacheTTL
+	cfg[config.HealthCheckInterval] = *healthInterval
+	cfg[config.SyncJobFile] = *syncJobFile
+	cfg[config.LegacyTokenAuth] = *legacyAuth
 
 	// Check for a mapping file
 
@@ -116,6 +137,8 @@ func clientCli() error {
 
 	if tree, err = rufs.NewTree(cfg, cert); err == nil {
 
+		fmt.Println(fmt.Sprintf("Client SSL fingerprint: %s", tree.SSLFingerprint()))
+
 		// Load mapping file
 
 		if ok, _ := fileutil.PathExists(mappingFile); ok {
@@ -41,7 +41,17 @@ func setupFuseMount(fuseMount *string, tree *rufs.Tree) error {
 		Tree:       tree,
 	}, nil)
 
-	if server, _, err = nodefs.MountRoot(*fuseMount, nfs.Root(), nil); err != nil {
+	// Attribute and entry timeouts follow the directory listing cache
+
+	var opts *nodefs.Options
+
+	if ttl := tree.DirCacheTTL(); ttl > 0 {
+		opts = nodefs.NewOptions()
+		opts.AttrTimeout = ttl
+		opts.EntryTimeout = ttl
+	}
+
+	if server, _, err = nodefs.MountRoot(*fuseMount, nfs.Root(), opts); err != nil {
 		return err
 	}
 
@@ -50,7 +60,7 @@ func setupFuseMount(fuseMount *string, tree *rufs.Tree) error {
 	// Attach SIGINT handler - on unix and windows this is send
 	// when the user presses ^C (Control-C).
 
-	sigchan := make(chan os.Signal)
+	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT)
 
 	go func() {
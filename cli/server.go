@@ -11,8 +11,10 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -88,26 +90,54 @@ func serverCli() error {
 
 		fmt.Println(fmt.Sprintf("Using config: %s", *serverConfigFile))
 
-		// Ensure the local shared folder actually exists
+		// Get the configs of all exported branches
 
-		if ok, _ := fileutil.PathExists(cfg[config.LocalFolder].(string)); !ok {
-			os.MkdirAll(cfg[config.LocalFolder].(string), 0777)
-		}
+		var bcfgs []map[string]interface{}
+		var branches []*rufs.Branch
+
+		if bcfgs, err = config.BranchExportConfigs(cfg); err == nil {
+
+			for _, bcfg := range bcfgs {
+				var branch *rufs.Branch
+
+				// Ensure the local shared folder actually exists
 
-		absLocalFolder, _ := filepath.Abs(cfg[config.LocalFolder].(string))
-		fmt.Println(fmt.Sprintf("Exporting folder: %s", absLocalFolder))
+				localFolder := fileutil.ConfStr(bcfg, config.LocalFolder)
 
-		// We got everything together let's start
+				if ok, _ := fileutil.PathExists(localFolder); !ok {
+					os.MkdirAll(localFolder, 0777)
+				}
+
+				absLocalFolder, _ := filepath.Abs(localFolder)
+				fmt.Println(fmt.Sprintf("Exporting folder: %s as branch %s",
+					absLocalFolder, fileutil.ConfStr(bcfg, config.BranchName)))
 
-		var branch *rufs.Branch
+				// Ensure the encryption key exists if the folder is encrypted
+
+				if keyFile, ok := bcfg[config.EncryptionKeyFile].(string); ok && keyFile != "" {
+					if err = ensureEncryptionKey(keyFile); err != nil {
+						break
+					}
+				}
+
+				// We got everything together let's start
+
+				if branch, err = rufs.NewBranch(bcfg, cert); err != nil {
+					break
+				}
+
+				branches = append(branches, branch)
+			}
+		}
 
-		if branch, err = rufs.NewBranch(cfg, cert); err == nil {
+		if err == nil {
 
 			// Attach SIGINT handler - on unix and windows this is send
-			// when the user presses ^C (Control-C).
+			// when the user presses ^C (Control-C). SIGHUP reloads the
+			// secrets and authorized client certificates.
 
-			sigchan := make(chan os.Signal)
-			signal.Notify(sigchan, syscall.SIGINT)
+			sigchan := make(chan os.Signal, 1)
+			signal.Notify(sigchan, syscall.SIGINT, syscall.SIGHUP)
 
 			// Create a wait group to wait for the os signal
 
@@ -120,12 +150,15 @@ func serverCli() error {
 					signal := <-sigchan
 
 					if signal == syscall.SIGINT {
-
-						// Shutdown the branch
-
-						branch.Shutdown()
 						break
 					}
+
+					if signal == syscall.SIGHUP {
+						if err := reloadAuth(*secretFile, *serverConfigFile,
+							defaultConfig, branches); err != nil {
+							fmt.Println(fmt.Sprintf("Could not reload authentication settings: %v", err))
+						}
+					}
 				}
 
 				// Done waiting main thread can exit
@@ -133,11 +166,90 @@ func serverCli() error {
 				wg.Done()
 			}()
 
-			// Suspend main thread until branch is shutdown
+			// Suspend main thread until the signal was received
 
 			wg.Add(1)
 			wg.Wait()
 		}
+
+		// Shutdown all branches
+
+		for _, branch := range branches {
+			branch.Shutdown()
+		}
+	}
+
+	return err
+}
+
+/*
+ensureEncryptionKey ensures that a given encryption key file exists. A new
+random key is created if necessary.
+*/
+func ensureEncryptionKey(keyFile string) error {
+	var err error
+
+	if ok, _ := fileutil.PathExists(keyFile); !ok {
+		key := make([]byte, 32)
+
+		if _, err = rand.Read(key); err == nil {
+			if err = ioutil.WriteFile(keyFile, key, 0600); err == nil {
+				fmt.Println(fmt.Sprintf("Created new encryption key: %s (encrypted data cannot be read without it)",
+					keyFile))
+			}
+		}
+	}
+
+	if err == nil {
+		fmt.Println(fmt.Sprintf("Using encryption key from: %s", keyFile))
+	}
+
+	return err
+}
+
+/*
+reloadAuth reloads the secret file and the server config and updates the
+accepted secrets and authorized client certificates of all running branches.
+*/
+func reloadAuth(secretFile string, serverConfigFile string,
+	defaultConfig map[string]interface{}, branches []*rufs.Branch) error {
+
+	var cfg map[string]interface{}
+	var bcfgs []map[string]interface{}
+
+	secret, err := ioutil.ReadFile(secretFile)
+
+	if err == nil {
+		if cfg, err = fileutil.LoadConfig(serverConfigFile, defaultConfig); err == nil {
+
+			cfg[config.BranchSecret] = secret
+
+			bcfgs, err = config.BranchExportConfigs(cfg)
+		}
+	}
+
+	if err == nil {
+		bcfgsByName := make(map[string]map[string]interface{})
+
+		for _, bcfg := range bcfgs {
+			bcfgsByName[fileutil.ConfStr(bcfg, config.BranchName)] = bcfg
+		}
+
+		for _, branch := range branches {
+			bcfg, ok := bcfgsByName[branch.Name()]
+
+			if !ok {
+				fmt.Println(fmt.Sprintf("Branch %s is no longer configured (needs a restart)",
+					branch.Name()))
+				continue
+			}
+
+			if err = branch.UpdateAuth(bcfg); err != nil {
+				break
+			}
+
+			fmt.Println(fmt.Sprintf("Reloaded authentication settings of branch %s", branch.Name()))
+		}
 	}
 
 	return err
@@ -0,0 +1,123 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/datautil"
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/common/fileutil"
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSecretRotation(t *testing.T) {
+
+	os.Mkdir("secrettest", 0770)
+	defer os.RemoveAll("secrettest")
+
+	secretFile := "secrettest/rufs.secret"
+	serverConfigFile := "secrettest/rufs.server.json"
+
+	// Secret files are created like in a new deployment
+
+	oldSecret, cert, err := loadSecretAndCert(secretFile, "secrettest/ssl")
+	errorutil.AssertOk(err)
+
+	errorutil.AssertOk(os.Rename(secretFile, "secrettest/rufs.secret.old"))
+
+	newSecret, _, err := loadSecretAndCert(secretFile, "secrettest/ssl")
+	errorutil.AssertOk(err)
+
+	writeConfig := func(secrets string) {
+		errorutil.AssertOk(ioutil.WriteFile(serverConfigFile, []byte(fmt.Sprintf(`{
+  "BranchName" : "secrettest",
+  "LocalFolder" : "secrettest/data",
+  "RPCHost" : "localhost",
+  "RPCPort" : "9091",
+  "BranchSecrets" : [%v]
+}`, secrets)), 0600))
+	}
+
+	writeConfig("")
+
+	defaultConfig := datautil.MergeMaps(config.DefaultBranchExportConfig)
+	delete(defaultConfig, config.BranchSecret)
+
+	cfg, err := fileutil.LoadConfig(serverConfigFile, defaultConfig)
+	errorutil.AssertOk(err)
+
+	cfg[config.BranchSecret] = newSecret
+
+	bcfgs, err := config.BranchExportConfigs(cfg)
+	errorutil.AssertOk(err)
+
+	branch, err := rufs.NewBranch(bcfgs[0], cert)
+	errorutil.AssertOk(err)
+	defer branch.Shutdown()
+
+	// Clients use their secret file like the client command line
+
+	ping := func(secret []byte, cert *tls.Certificate) error {
+		cfg := datautil.MergeMaps(config.DefaultTreeConfig)
+		cfg[config.TreeSecret] = secret
+
+		tree, err := rufs.NewTree(cfg, cert)
+		errorutil.AssertOk(err)
+
+		_, err = tree.PingBranch("secrettest", "localhost:9091")
+
+		return err
+	}
+
+	if err := ping(newSecret, cert); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ping(oldSecret, cert); err == nil {
+		t.Error("Old secret should not be accepted")
+		return
+	}
+
+	// Accept the old secret file until it expires
+
+	writeConfig(fmt.Sprintf(`{ "file" : "secrettest/rufs.secret.old", "expires" : "%v" }`,
+		time.Now().Add(time.Hour).Format(time.RFC3339)))
+
+	errorutil.AssertOk(reloadAuth(secretFile, serverConfigFile, defaultConfig, []*rufs.Branch{branch}))
+
+	if err := ping(newSecret, cert); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ping(oldSecret, cert); err != nil {
+		t.Error(err)
+		return
+	}
+
+	writeConfig(fmt.Sprintf(`{ "file" : "secrettest/rufs.secret.old", "expires" : "%v" }`,
+		time.Now().Add(-time.Hour).Format(time.RFC3339)))
+
+	errorutil.AssertOk(reloadAuth(secretFile, serverConfigFile, defaultConfig, []*rufs.Branch{branch}))
+
+	if err := ping(oldSecret, cert); err == nil {
+		t.Error("Expired secret should not be accepted")
+		return
+	}
+}
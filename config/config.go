@@ -26,33 +26,95 @@ const (
 
 	BranchName     = "BranchName"
 	BranchSecret   = "BranchSecret"
+	BranchSecrets  = "BranchSecrets"
 	EnableReadOnly = "EnableReadOnly"
 	RPCHost        = "RPCHost"
 	RPCPort        = "RPCPort"
 	LocalFolder    = "LocalFolder"
+	AccessControl  = "AccessControl"
+	Branches       = "Branches"
+
+	RequireClientCerts = "RequireClientCerts"
+	ClientFingerprints = "ClientFingerprints"
+	EncryptionKeyFile  = "EncryptionKeyFile"
+	EncryptNames       = "EncryptNames"
+
+	// Branch and tree configuration
+
+	LegacyTokenAuth = "LegacyTokenAuth"
 
 	// Tree configuration
 
-	TreeSecret = "TreeSecret"
+	TreeSecret     = "TreeSecret"
+	TreeClientName = "TreeClientName"
+	CacheMemSize   = "CacheMemSize"
+	CacheDiskDir   = "CacheDiskDir"
+	CacheDiskSize  = "CacheDiskSize"
+	DirCacheTTL    = "DirCacheTTL"
+
+	HealthCheckInterval = "HealthCheckInterval"
+	SyncJobFile         = "SyncJobFile"
 )
 
 /*
 DefaultBranchExportConfig is the default configuration for an exported branch
 */
 var DefaultBranchExportConfig = map[string]interface{}{
-	BranchName:     "",      // Auto name (based on available network interface)
-	BranchSecret:   "",      // Secret needs to be provided by the client
-	EnableReadOnly: false,   // FS access is readonly for clients
-	RPCHost:        "",      // Auto (first available external interface)
-	RPCPort:        "9020",  // Communication port for this branch
-	LocalFolder:    "share", // Local folder which is being made available
+	BranchName:     "",                       // Auto name (based on available network interface)
+	BranchSecret:   "",                       // Secret needs to be provided by the client
+	BranchSecrets:  []interface{}{},          // Additional accepted secrets (with optional expiry dates)
+	EnableReadOnly: false,                    // FS access is readonly for clients
+	RPCHost:        "",                       // Auto (first available external interface)
+	RPCPort:        "9020",                   // Communication port for this branch
+	LocalFolder:    "share",                  // Local folder which is being made available
+	AccessControl:  map[string]interface{}{}, // Per client access rules (empty means no restrictions)
+	Branches:       []interface{}{},          // Branch definitions (overwriting the values above) if several branches should be exported
+
+	RequireClientCerts: false,           // Clients need to present an authorized certificate
+	ClientFingerprints: []interface{}{}, // SHA256 fingerprints of authorized client certificates
+	LegacyTokenAuth:    false,           // Accept static tokens from clients of older versions
+	EncryptionKeyFile:  "",              // File with the key for encrypting the local folder (empty means no encryption)
+	EncryptNames:       false,           // Encrypt item names in the local folder as well
 }
 
 /*
 DefaultTreeConfig is the default configuration for a tree which imports branches
 */
 var DefaultTreeConfig = map[string]interface{}{
-	TreeSecret: "", // Secret needs to be provided by the client
+	TreeSecret:     "", // Secret needs to be provided by the client
+	TreeClientName: "", // Client name which is presented to branches
+	CacheMemSize:   0,  // Size of the block cache in memory in bytes
+	CacheDiskDir:   "", // Directory for the block cache on disk (empty means no disk cache)
+	CacheDiskSize:  0,  // Size of the block cache on disk in bytes
+	DirCacheTTL:    0,  // Time in milliseconds for which directory listings are cached (0 disables the cache)
+
+	HealthCheckInterval: 0,  // Time in milliseconds between background health checks of branches (0 disables the checks)
+	SyncJobFile:         "", // File which stores the sync jobs of the tree (empty means jobs are not persisted)
+
+	LegacyTokenAuth: false, // Send static tokens to branches of older versions
+}
+
+/*
+optionalConfigKeys are configuration keys which may be missing in a given
+config. Their default values are used in this case.
+*/
+var optionalConfigKeys = map[string]bool{
+	AccessControl:  true,
+	Branches:       true,
+	BranchSecrets:  true,
+	TreeClientName: true,
+	CacheMemSize:   true,
+	CacheDiskDir:   true,
+	CacheDiskSize:  true,
+	DirCacheTTL:    true,
+
+	HealthCheckInterval: true,
+	SyncJobFile:         true,
+	RequireClientCerts:  true,
+	ClientFingerprints:  true,
+	LegacyTokenAuth:     true,
+	EncryptionKeyFile:   true,
+	EncryptNames:        true,
 }
 
 // Helper functions
@@ -63,19 +125,85 @@ CheckBranchExportConfig checks a given branch export config.
 */
 func CheckBranchExportConfig(config map[string]interface{}) error {
 	for k := range DefaultBranchExportConfig {
-		if _, ok := config[k]; !ok {
+		if _, ok := config[k]; !ok && !optionalConfigKeys[k] {
 			return fmt.Errorf("Missing %v key in branch export config", k)
 		}
 	}
 	return nil
 }
 
+/*
+BranchExportConfigs returns the configs of all branches which should be
+exported according to a given branch export config. Each entry in the
+Branches list of the config defines a branch. Values of a definition
+overwrite the values of the given config. The given config is the only
+exported branch if it has no branch definitions.
+*/
+func BranchExportConfigs(config map[string]interface{}) ([]map[string]interface{}, error) {
+	var defs []map[string]interface{}
+
+	switch bdefs := config[Branches].(type) {
+
+	case nil:
+
+	case []map[string]interface{}:
+		defs = bdefs
+
+	case []interface{}:
+		for i, bdef := range bdefs {
+			def, ok := bdef.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Branch definition %v is not an object", i)
+			}
+			defs = append(defs, def)
+		}
+
+	default:
+		return nil, fmt.Errorf("Branch definitions must be a list")
+	}
+
+	if len(defs) == 0 {
+		return []map[string]interface{}{config}, nil
+	}
+
+	var ret []map[string]interface{}
+
+	for i, def := range defs {
+		bconfig := make(map[string]interface{})
+
+		for k, v := range config {
+			if k != Branches {
+				bconfig[k] = v
+			}
+		}
+
+		// Every branch needs its own name and local folder
+
+		for _, k := range []string{BranchName, LocalFolder} {
+			if _, ok := def[k]; !ok {
+				return nil, fmt.Errorf("Missing %v key in branch definition %v", k, i)
+			}
+		}
+
+		for k, v := range def {
+			if k == Branches || k == BranchSecret {
+				return nil, fmt.Errorf("Key %v is not allowed in branch definition %v", k, i)
+			}
+			bconfig[k] = v
+		}
+
+		ret = append(ret, bconfig)
+	}
+
+	return ret, nil
+}
+
 /*
 CheckTreeConfig checks a given tree config.
 */
 func CheckTreeConfig(config map[string]interface{}) error {
 	for k := range DefaultTreeConfig {
-		if _, ok := config[k]; !ok {
+		if _, ok := config[k]; !ok && !optionalConfigKeys[k] {
 			return fmt.Errorf("Missing %v key in tree config", k)
 		}
 	}
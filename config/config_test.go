@@ -11,6 +11,8 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -40,4 +42,75 @@ func TestConfig(t *testing.T) {
 		t.Error(err)
 		return
 	}
+
+	// Optional keys can be omitted
+
+	if err = CheckTreeConfig(map[string]interface{}{TreeSecret: ""}); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestBranchExportConfigs(t *testing.T) {
+
+	cfg := map[string]interface{}{
+		BranchName:     "main",
+		BranchSecret:   "123",
+		EnableReadOnly: false,
+		LocalFolder:    "share",
+	}
+
+	res, err := BranchExportConfigs(cfg)
+
+	if err != nil || fmt.Sprint(res) != "[map[BranchName:main BranchSecret:123 EnableReadOnly:false LocalFolder:share]]" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	var bdefs []interface{}
+
+	json.Unmarshal([]byte(`[
+  { "BranchName" : "media", "LocalFolder" : "/srv/media", "EnableReadOnly" : true },
+  { "BranchName" : "backups", "LocalFolder" : "/srv/backups", "RPCPort" : "9021" }
+]`), &bdefs)
+
+	cfg[Branches] = bdefs
+
+	res, err = BranchExportConfigs(cfg)
+
+	if err != nil || fmt.Sprint(res) != "[map[BranchName:media BranchSecret:123 EnableReadOnly:true LocalFolder:/srv/media] "+
+		"map[BranchName:backups BranchSecret:123 EnableReadOnly:false LocalFolder:/srv/backups RPCPort:9021]]" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Test error cases
+
+	cfg[Branches] = "foo"
+
+	if _, err = BranchExportConfigs(cfg); err == nil || err.Error() != "Branch definitions must be a list" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[Branches] = []interface{}{"foo"}
+
+	if _, err = BranchExportConfigs(cfg); err == nil || err.Error() != "Branch definition 0 is not an object" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[Branches] = []map[string]interface{}{{BranchName: "foo"}}
+
+	if _, err = BranchExportConfigs(cfg); err == nil || err.Error() != "Missing LocalFolder key in branch definition 0" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cfg[Branches] = []map[string]interface{}{{BranchName: "foo", LocalFolder: "foo", BranchSecret: "456"}}
+
+	if _, err = BranchExportConfigs(cfg); err == nil || err.Error() != "Key BranchSecret is not allowed in branch definition 0" {
+		t.Error("Unexpected result:", err)
+		return
+	}
 }
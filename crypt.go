@@ -0,0 +1,990 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"devt.de/krotik/common/bitutil"
+	"devt.de/krotik/common/fileutil"
+)
+
+/*
+Encrypted branches store the data of each file in chunks. Each chunk is
+encrypted with AES-GCM using a random nonce. The file id in the header and
+the index of a chunk are authenticated with each chunk so chunks cannot be
+swapped between files or positions. Empty files have no header.
+*/
+const (
+	cryptMagic      = "RUFSENC1"                         // Magic of encrypted files
+	cryptHeaderSize = len(cryptMagic) + 16               // Size of the file header (magic and file id)
+	cryptChunkSize  = 4096                               // Size of the plain data of a chunk
+	cryptNonceSize  = 12                                 // Size of the nonce of a chunk
+	cryptOverhead   = cryptNonceSize + 16                // Size of nonce and authentication tag of a chunk
+	cryptBlockSize  = cryptChunkSize + cryptOverhead     // Size of an encrypted chunk
+	cryptCheckFile  = ".rufscrypt"                       // File in the branch root which is used to check the key
+	cryptCheckValue = "Rufs encrypted branch"            // Value which is encrypted in the check file
+	cryptMinKeySize = 16                                 // Minimum size of an encryption key
+	cryptNameChars  = "abcdefghijklmnopqrstuvwxyz234567" // Characters of encrypted names
+)
+
+/*
+cryptNameEncoding encodes encrypted names. Names only use lower case
+characters so they can be stored on case-insensitive file systems.
+*/
+var cryptNameEncoding = base32.NewEncoding(cryptNameChars).WithPadding(base32.NoPadding)
+
+/*
+branchCrypt encrypts the local data of a branch.
+*/
+type branchCrypt struct {
+	rootPath string      // Local directory (absolute path) of the branch
+	content  cipher.AEAD // Cipher for file contents
+	names    cipher.AEAD // Cipher for item names (nil if names are not encrypted)
+	nameSalt []byte      // Key for deriving the nonces of item names
+}
+
+/*
+cryptCheck is the content of the check file of an encrypted branch.
+*/
+type cryptCheck struct {
+	Version int    `json:"version"` // Version of the encryption scheme
+	Names   bool   `json:"names"`   // Flag if item names are encrypted
+	Check   string `json:"check"`   // Encrypted check value (hex)
+}
+
+/*
+loadEncryptionKey reads the encryption key of a branch from a given file.
+*/
+func loadEncryptionKey(keyFile string) ([]byte, error) {
+	key, err := ioutil.ReadFile(keyFile)
+
+	if err == nil && len(key) < cryptMinKeySize {
+		err = fmt.Errorf("Encryption key in %v is too short (needs at least %v bytes)",
+			keyFile, cryptMinKeySize)
+	}
+
+	return key, err
+}
+
+/*
+newBranchCrypt creates a new encryption for the branch in a given local
+folder from a given key. The keys of the actual ciphers are derived from the
+given key.
+*/
+func newBranchCrypt(rootPath string, key []byte, encryptNames bool) (*branchCrypt, error) {
+
+	deriveKey := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	newAEAD := func(purpose string) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(deriveKey(purpose))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+
+	content, err := newAEAD("rufs content")
+
+	bc := &branchCrypt{rootPath, content, nil, nil}
+
+	if err == nil && encryptNames {
+		if bc.names, err = newAEAD("rufs names"); err == nil {
+			bc.nameSalt = deriveKey("rufs name nonces")
+		}
+	}
+
+	return bc, err
+}
+
+/*
+unlock checks that the data in the local folder of the branch was encrypted
+with the key and the settings of this encryption. The check file is created
+if the folder holds no data yet.
+*/
+func (c *branchCrypt) unlock() error {
+	var check cryptCheck
+
+	rootPath := c.rootPath
+	checkFile := filepath.Join(rootPath, cryptCheckFile)
+
+	data, err := ioutil.ReadFile(checkFile)
+
+	if os.IsNotExist(err) {
+		var fis []os.FileInfo
+
+		// Existing data cannot be encrypted in place
+
+		if err = os.MkdirAll(rootPath, 0755); err == nil {
+			if fis, err = ioutil.ReadDir(rootPath); err == nil && len(fis) > 0 {
+				err = fmt.Errorf("Local folder %v contains unencrypted data", rootPath)
+			}
+		}
+
+		if err == nil {
+			nonce := make([]byte, cryptNonceSize)
+
+			if _, err = rand.Read(nonce); err == nil {
+				check = cryptCheck{1, c.names != nil,
+					hex.EncodeToString(c.content.Seal(nonce, nonce, []byte(cryptCheckValue), nil))}
+
+				if data, err = json.Marshal(check); err == nil {
+					err = ioutil.WriteFile(checkFile, data, 0600)
+				}
+			}
+		}
+
+		return err
+	}
+
+	if err == nil {
+		if err = json.Unmarshal(data, &check); err == nil {
+			var sealed []byte
+
+			if check.Version != 1 {
+				err = fmt.Errorf("Unknown encryption version %v in %v", check.Version, checkFile)
+
+			} else if check.Names != (c.names != nil) {
+				err = fmt.Errorf("Local folder %v was encrypted with a different setting for name encryption",
+					rootPath)
+
+			} else if sealed, err = hex.DecodeString(check.Check); err == nil {
+
+				if len(sealed) < cryptOverhead {
+					err = fmt.Errorf("Invalid check value in %v", checkFile)
+
+				} else if _, oerr := c.content.Open(nil, sealed[:cryptNonceSize],
+					sealed[cryptNonceSize:], nil); oerr != nil {
+
+					err = fmt.Errorf("Wrong encryption key for local folder %v", rootPath)
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+// Item names
+// ==========
+
+/*
+encryptName returns the local name of a given item name. The encryption is
+deterministic so the local name of an item can always be constructed from
+its name.
+*/
+func (c *branchCrypt) encryptName(name string) string {
+
+	if c.names == nil || name == "" || name == "." || name == ".." {
+		return name
+	}
+
+	mac := hmac.New(sha256.New, c.nameSalt)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:cryptNonceSize]
+
+	return cryptNameEncoding.EncodeToString(c.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+/*
+decryptName returns the item name of a given local name. Returns false if
+the local name is not a name of this branch.
+*/
+func (c *branchCrypt) decryptName(localName string) (string, bool) {
+
+	if c.names == nil {
+		return localName, true
+	}
+
+	sealed, err := cryptNameEncoding.DecodeString(localName)
+
+	if err == nil && len(sealed) > cryptOverhead {
+		var name []byte
+
+		if name, err = c.names.Open(nil, sealed[:cryptNonceSize], sealed[cryptNonceSize:], nil); err == nil {
+			return string(name), true
+		}
+	}
+
+	return "", false
+}
+
+/*
+localPath returns the local path of a given path of the branch. The given
+absolute path is the path of the item if names are not encrypted.
+*/
+func (c *branchCrypt) localPath(absPath string, rpath string) (string, error) {
+
+	rel, err := filepath.Rel(c.rootPath, absPath)
+
+	if err != nil || rel == "." {
+		return absPath, err
+	}
+
+	names := strings.Split(rel, string(filepath.Separator))
+
+	if c.names == nil {
+
+		if names[0] == cryptCheckFile {
+			return "", fmt.Errorf("Requested path %v is reserved", rpath)
+		}
+
+		return absPath, nil
+	}
+
+	for i, name := range names {
+		names[i] = c.encryptName(name)
+	}
+
+	return filepath.Join(c.rootPath, filepath.Join(names...)), nil
+}
+
+/*
+branchPath returns the path of an item from a given local path relative to
+the branch root. Returns false if the local path does not belong to an
+item of the branch.
+*/
+func (c *branchCrypt) branchPath(localPath string) (string, bool) {
+	var names []string
+
+	if path.Clean("/"+localPath) == "/"+cryptCheckFile {
+		return "", false
+	}
+
+	for _, localName := range strings.Split(path.Clean("/"+localPath), "/")[1:] {
+		if localName != "" {
+			name, ok := c.decryptName(localName)
+
+			if !ok {
+				return "", false
+			}
+
+			names = append(names, name)
+		}
+	}
+
+	return "/" + path.Join(names...), true
+}
+
+/*
+readDir reads a given local directory and returns the items of the branch
+with their names and plain sizes. The check file is not part of the result.
+*/
+func (c *branchCrypt) readDir(dir string) ([]os.FileInfo, error) {
+
+	fis, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]os.FileInfo, 0, len(fis))
+
+	isRoot := filepath.Clean(dir) == c.rootPath
+
+	for _, fi := range fis {
+		if isRoot && fi.Name() == cryptCheckFile {
+			continue
+		}
+
+		if name, ok := c.decryptName(fi.Name()); ok {
+			size := fi.Size()
+
+			if fi.Mode().IsRegular() {
+				size = plainSize(size)
+			}
+
+			ret = append(ret, &cryptFileInfo{fi, name, size})
+		}
+	}
+
+	return ret, nil
+}
+
+/*
+cryptFileInfo is the file info of an encrypted item.
+*/
+type cryptFileInfo struct {
+	os.FileInfo
+	name string // Decrypted name
+	size int64  // Size of the plain data
+}
+
+/*
+Name returns the decrypted name.
+*/
+func (fi *cryptFileInfo) Name() string {
+	return fi.name
+}
+
+/*
+Size returns the size of the plain data.
+*/
+func (fi *cryptFileInfo) Size() int64 {
+	return fi.size
+}
+
+// File contents
+// =============
+
+/*
+branchFile is a local file of a branch. Data is encrypted transparently if
+the branch is encrypted.
+*/
+type branchFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	/*
+		Name returns the local path of the file.
+	*/
+	Name() string
+
+	/*
+		Size returns the size of the plain data.
+	*/
+	Size() (int64, error)
+
+	/*
+		Truncate changes the size of the plain data. Files are grown with
+		zero bytes.
+	*/
+	Truncate(size int64) error
+
+	/*
+		Sync commits the file to disk.
+	*/
+	Sync() error
+}
+
+/*
+plainFile is a local file of an unencrypted branch.
+*/
+type plainFile struct {
+	*os.File
+}
+
+/*
+Size returns the size of the file.
+*/
+func (f *plainFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+/*
+cryptFile is a local file of an encrypted branch.
+*/
+type cryptFile struct {
+	file *os.File    // Local file
+	aead cipher.AEAD // Cipher for the file contents
+	id   []byte      // Id of the file (nil if the file has no header yet)
+}
+
+/*
+newCryptFile wraps a given local file.
+*/
+func newCryptFile(f *os.File, aead cipher.AEAD) (*cryptFile, error) {
+	var fi os.FileInfo
+
+	cf := &cryptFile{f, aead, nil}
+
+	fi, err := f.Stat()
+
+	if err == nil && fi.Size() > 0 {
+		header := make([]byte, cryptHeaderSize)
+
+		if _, err = f.ReadAt(header, 0); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+			err = fmt.Errorf("File %v is not encrypted", f.Name())
+		}
+
+		cf.id = header[len(cryptMagic):]
+	}
+
+	return cf, err
+}
+
+/*
+plainSize returns the size of the plain data of an encrypted file with a
+given size.
+*/
+func plainSize(size int64) int64 {
+	var ret int64
+
+	if size > int64(cryptHeaderSize) {
+		body := size - int64(cryptHeaderSize)
+
+		ret = body / cryptBlockSize * cryptChunkSize
+
+		if rem := body % cryptBlockSize; rem > cryptOverhead {
+			ret += rem - cryptOverhead
+		}
+	}
+
+	return ret
+}
+
+/*
+Name returns the local path of the file.
+*/
+func (cf *cryptFile) Name() string {
+	return cf.file.Name()
+}
+
+/*
+Close closes the file.
+*/
+func (cf *cryptFile) Close() error {
+	return cf.file.Close()
+}
+
+/*
+Sync commits the file to disk.
+*/
+func (cf *cryptFile) Sync() error {
+	return cf.file.Sync()
+}
+
+/*
+Size returns the size of the plain data.
+*/
+func (cf *cryptFile) Size() (int64, error) {
+	fi, err := cf.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return plainSize(fi.Size()), nil
+}
+
+/*
+ReadAt reads len(p) bytes of plain data into p from a given offset.
+*/
+func (cf *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %v", off)
+	}
+
+	size, err := cf.Size()
+
+	raw := make([]byte, cryptBlockSize)
+	data := make([]byte, 0, cryptChunkSize)
+
+	for err == nil && n < len(p) && off < size {
+		i := off / cryptChunkSize
+
+		if data, err = cf.readChunk(i, raw, data); err == nil {
+			c := copy(p[n:], data[off-i*cryptChunkSize:])
+
+			n += c
+			off += int64(c)
+		}
+	}
+
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+/*
+WriteAt writes len(p) bytes of plain data from p at a given offset. The file
+is grown with zero bytes if the offset is beyond the end of the file.
+*/
+func (cf *cryptFile) WriteAt(p []byte, off int64) (int, error) {
+	var n int
+
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %v", off)
+	}
+
+	size, err := cf.Size()
+
+	if err == nil {
+		if size, err = cf.grow(size, off); err == nil {
+			n, _, err = cf.writeAt(p, off, size)
+		}
+	}
+
+	return n, err
+}
+
+/*
+Truncate changes the size of the plain data. The file is grown with zero
+bytes.
+*/
+func (cf *cryptFile) Truncate(size int64) error {
+
+	cur, err := cf.Size()
+
+	if err != nil || size == cur {
+		return err
+
+	} else if size > cur {
+		_, err = cf.grow(cur, size)
+		return err
+
+	} else if size <= 0 {
+
+		// Empty files have no header
+
+		cf.id = nil
+
+		return cf.file.Truncate(0)
+	}
+
+	i := size / cryptChunkSize
+	rem := size % cryptChunkSize
+	end := int64(cryptHeaderSize) + i*cryptBlockSize
+
+	if rem > 0 {
+		var data []byte
+
+		// Reencrypt the last chunk with the remaining data
+
+		if data, err = cf.readChunk(i, make([]byte, cryptBlockSize), nil); err == nil {
+			err = cf.writeChunk(i, data[:rem])
+		}
+
+		end += rem + cryptOverhead
+	}
+
+	if err == nil {
+		err = cf.file.Truncate(end)
+	}
+
+	return err
+}
+
+/*
+grow grows the plain data from a given size to a given new size with zero
+bytes. Returns the new size.
+*/
+func (cf *cryptFile) grow(size int64, newSize int64) (int64, error) {
+	var err error
+
+	zeros := make([]byte, cryptChunkSize)
+
+	for err == nil && size < newSize {
+		toWrite := newSize - size
+
+		if toWrite > cryptChunkSize {
+			toWrite = cryptChunkSize
+		}
+
+		_, size, err = cf.writeAt(zeros[:toWrite], size, size)
+	}
+
+	return size, err
+}
+
+/*
+writeAt writes plain data at a given offset which must not be beyond the
+given size of the plain data. Returns the number of written bytes and the
+new size.
+*/
+func (cf *cryptFile) writeAt(p []byte, off int64, size int64) (int, int64, error) {
+	var n int
+	var err error
+
+	if cf.id == nil && len(p) > 0 {
+		id := make([]byte, cryptHeaderSize-len(cryptMagic))
+
+		// Write the header of a new file
+
+		if _, err = rand.Read(id); err == nil {
+			if _, err = cf.file.WriteAt(append([]byte(cryptMagic), id...), 0); err == nil {
+				cf.id = id
+			}
+		}
+	}
+
+	raw := make([]byte, cryptBlockSize)
+	data := make([]byte, 0, cryptChunkSize)
+
+	for err == nil && n < len(p) {
+		i := off / cryptChunkSize
+		start := off - i*cryptChunkSize
+		end := start + int64(len(p)-n)
+
+		if end > cryptChunkSize {
+			end = cryptChunkSize
+		}
+
+		data = data[:0]
+
+		// Existing chunks need to be merged unless they are replaced completely
+
+		if i*cryptChunkSize < size && (start > 0 || end < cryptChunkSize) {
+			data, err = cf.readChunk(i, raw, data)
+		}
+
+		if err == nil {
+			if int64(len(data)) < end {
+				data = data[:end]
+			}
+
+			copy(data[start:end], p[n:])
+
+			if err = cf.writeChunk(i, data); err == nil {
+				n += int(end - start)
+				off += end - start
+
+				if off > size {
+					size = off
+				}
+			}
+		}
+	}
+
+	return n, size, err
+}
+
+/*
+readChunk reads and decrypts a given chunk. The given buffers are used to
+hold the encrypted and the decrypted data.
+*/
+func (cf *cryptFile) readChunk(i int64, raw []byte, data []byte) ([]byte, error) {
+
+	n, err := cf.file.ReadAt(raw[:cryptBlockSize], int64(cryptHeaderSize)+i*cryptBlockSize)
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	if err == nil {
+		if n <= cryptOverhead {
+			err = fmt.Errorf("File %v is damaged", cf.file.Name())
+
+		} else if data, err = cf.aead.Open(data[:0], raw[:cryptNonceSize], raw[cryptNonceSize:n],
+			cf.chunkData(i)); err != nil {
+
+			err = fmt.Errorf("File %v is damaged or was modified", cf.file.Name())
+		}
+	}
+
+	return data, err
+}
+
+/*
+writeChunk encrypts and writes a given chunk.
+*/
+func (cf *cryptFile) writeChunk(i int64, data []byte) error {
+
+	nonce := make([]byte, cryptNonceSize, cryptBlockSize)
+
+	_, err := rand.Read(nonce)
+
+	if err == nil {
+		_, err = cf.file.WriteAt(cf.aead.Seal(nonce, nonce, data, cf.chunkData(i)),
+			int64(cryptHeaderSize)+i*cryptBlockSize)
+	}
+
+	return err
+}
+
+/*
+chunkData returns the additional data which is authenticated with a given
+chunk.
+*/
+func (cf *cryptFile) chunkData(i int64) []byte {
+	ret := make([]byte, len(cf.id)+8)
+
+	copy(ret, cf.id)
+	binary.BigEndian.PutUint64(ret[len(cf.id):], uint64(i))
+
+	return ret
+}
+
+/*
+offsetWriter writes sequentially into an io.WriterAt from a given offset.
+*/
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+/*
+Write writes len(p) bytes from p at the current offset.
+*/
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
+
+/*
+fileLocks holds the locks of local files which are currently open. Encrypted
+files are read and written in chunks and need a header - concurrent writers
+would otherwise overwrite each other's header or chunks.
+*/
+type fileLocks struct {
+	lock  *sync.Mutex
+	locks map[string]*fileLock
+}
+
+/*
+fileLock is the lock of a single local file.
+*/
+type fileLock struct {
+	lock  *sync.RWMutex
+	users int // Number of users holding or waiting for this lock
+}
+
+/*
+acquire locks a given local file. Write locks are exclusive. Returns a
+function which releases the lock.
+*/
+func (fl *fileLocks) acquire(localPath string, write bool) func() {
+
+	fl.lock.Lock()
+
+	l, ok := fl.locks[localPath]
+	if !ok {
+		l = &fileLock{&sync.RWMutex{}, 0}
+		fl.locks[localPath] = l
+	}
+	l.users++
+
+	fl.lock.Unlock()
+
+	if write {
+		l.lock.Lock()
+	} else {
+		l.lock.RLock()
+	}
+
+	return func() {
+
+		if write {
+			l.lock.Unlock()
+		} else {
+			l.lock.RUnlock()
+		}
+
+		fl.lock.Lock()
+		defer fl.lock.Unlock()
+
+		if l.users--; l.users == 0 {
+			delete(fl.locks, localPath)
+		}
+	}
+}
+
+/*
+lockedFile is a local file which holds a file lock until it is closed.
+*/
+type lockedFile struct {
+	branchFile
+	release func()
+}
+
+/*
+Close closes the file and releases its lock.
+*/
+func (lf *lockedFile) Close() error {
+	err := lf.branchFile.Close()
+	lf.release()
+	return err
+}
+
+// Branch functions
+// ================
+
+/*
+openFile opens a local file of the branch. Encrypted files are locked until
+they are closed - readers share the lock while writers hold it exclusively.
+*/
+func (b *Branch) openFile(localPath string, flag int, perm os.FileMode) (branchFile, error) {
+	var release func()
+
+	if b.crypt != nil {
+		release = b.fileLocks.acquire(localPath, flag&(os.O_WRONLY|os.O_RDWR) != 0)
+	}
+
+	f, err := os.OpenFile(localPath, flag, perm)
+
+	if err == nil {
+		var bf branchFile
+
+		if bf, err = b.wrapFile(f); err == nil {
+
+			if release == nil {
+				return bf, nil
+			}
+
+			return &lockedFile{bf, release}, nil
+		}
+	}
+
+	if release != nil {
+		release()
+	}
+
+	return nil, err
+}
+
+/*
+wrapFile wraps an open local file of the branch.
+*/
+func (b *Branch) wrapFile(f *os.File) (branchFile, error) {
+
+	if b.crypt == nil {
+		return &plainFile{f}, nil
+	}
+
+	cf, err := newCryptFile(f, b.crypt.content)
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+/*
+truncateFile changes the size of a local file of the branch.
+*/
+func (b *Branch) truncateFile(localPath string, size int64) error {
+
+	if b.crypt == nil {
+		return os.Truncate(localPath, size)
+	}
+
+	f, err := b.openFile(localPath, os.O_RDWR, 0)
+
+	if err == nil {
+		err = f.Truncate(size)
+		f.Close()
+	}
+
+	return err
+}
+
+/*
+localName returns the local name of a given item name.
+*/
+func (b *Branch) localName(name string) string {
+
+	if b.crypt == nil {
+		return name
+	}
+
+	return b.crypt.encryptName(name)
+}
+
+/*
+readDir reads the items of a local directory of the branch.
+*/
+func (b *Branch) readDir(dir string) ([]os.FileInfo, error) {
+
+	if b.crypt == nil {
+		return ioutil.ReadDir(dir)
+	}
+
+	return b.crypt.readDir(dir)
+}
+
+/*
+checkSum calculates the checksum of a local file of the branch. The checksum
+of encrypted files is calculated from their plain data.
+*/
+func (b *Branch) checkSum(localPath string) (string, error) {
+	var sum string
+	var size int64
+
+	if b.crypt == nil {
+		return fileutil.CheckSumFileFast(localPath)
+	}
+
+	f, err := b.openFile(localPath, os.O_RDONLY, 0)
+
+	if err == nil {
+		defer f.Close()
+
+		if size, err = f.Size(); err == nil {
+			sum, err = checkSumFast(f, size)
+		}
+	}
+
+	return sum, err
+}
+
+/*
+fastSumSampleSize is the sample size for fast checksums.
+*/
+const fastSumSampleSize = 16 * 1024
+
+/*
+checkSumFast calculates the same 32bit MurmurHash3 checksum as
+fileutil.CheckSumFileFast from the data of a given reader.
+*/
+func checkSumFast(r io.ReaderAt, size int64) (string, error) {
+	var buf []byte
+	var res uint32
+	var err error
+
+	if size < fastSumSampleSize*8 {
+		buf = make([]byte, size)
+
+		if _, err = io.ReadFull(io.NewSectionReader(r, 0, size), buf); err == nil {
+			res, err = bitutil.MurMurHashData(buf, 0, len(buf), 42)
+		}
+
+	} else {
+		buf = make([]byte, fastSumSampleSize*3)
+
+		// Sample the start, the middle and the end of the data
+
+		for i, off := range []int64{0, size / 2, size - fastSumSampleSize} {
+			if err == nil {
+				_, err = r.ReadAt(buf[i*fastSumSampleSize:(i+1)*fastSumSampleSize], off)
+			}
+		}
+
+		if err == nil {
+			res, err = bitutil.MurMurHashData(buf, 0, len(buf)-1, 42)
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", res), nil
+}
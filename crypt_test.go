@@ -0,0 +1,374 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/common/fileutil"
+)
+
+func TestCryptFile(t *testing.T) {
+
+	os.Mkdir("crypt", 0770)
+	defer os.RemoveAll("crypt")
+
+	bc, err := newBranchCrypt("crypt", []byte("0123456789abcdef"), false)
+	errorutil.AssertOk(err)
+
+	f, err := os.OpenFile("crypt/test1", os.O_RDWR|os.O_CREATE, 0660)
+	errorutil.AssertOk(err)
+
+	cf, err := newCryptFile(f, bc.content)
+	errorutil.AssertOk(err)
+	defer cf.Close()
+
+	// Empty files have no header
+
+	if size, err := cf.Size(); size != 0 || err != nil || cf.id != nil {
+		t.Error("Unexpected result:", size, err)
+		return
+	}
+
+	if n, err := cf.ReadAt(make([]byte, 10), 0); n != 0 || err != io.EOF {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	// Do random writes, reads and truncates and compare with plain data
+
+	var plain []byte
+
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 200; i++ {
+		off := r.Int63n(3 * cryptChunkSize)
+		data := make([]byte, r.Intn(2*cryptChunkSize))
+		r.Read(data)
+
+		switch r.Intn(4) {
+
+		case 0:
+			if _, err := cf.WriteAt(data, off); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if grow := off + int64(len(data)) - int64(len(plain)); grow > 0 {
+				plain = append(plain, make([]byte, grow)...)
+			}
+
+			copy(plain[off:], data)
+
+		case 1:
+			if err := cf.Truncate(off); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if off < int64(len(plain)) {
+				plain = plain[:off]
+			} else {
+				plain = append(plain, make([]byte, off-int64(len(plain)))...)
+			}
+
+		default:
+			var expected []byte
+
+			n, err := cf.ReadAt(data, off)
+
+			if off < int64(len(plain)) {
+				expected = plain[off:]
+
+				if len(expected) > len(data) {
+					expected = expected[:len(data)]
+				}
+			}
+
+			if n != len(expected) || (n < len(data) && err != io.EOF) || (n == len(data) && err != nil) ||
+				!bytes.Equal(data[:n], expected) {
+				t.Error("Unexpected read result:", i, off, n, len(expected), err)
+				return
+			}
+		}
+
+		if size, err := cf.Size(); size != int64(len(plain)) || err != nil {
+			t.Error("Unexpected size:", i, size, len(plain), err)
+			return
+		}
+	}
+
+	// The data on disk is encrypted
+
+	cf.WriteAt([]byte("secret data"), 100)
+
+	raw, err := ioutil.ReadFile("crypt/test1")
+	errorutil.AssertOk(err)
+
+	if !bytes.HasPrefix(raw, []byte(cryptMagic)) || bytes.Contains(raw, []byte("secret data")) {
+		t.Error("Unexpected result:", string(raw[:100]))
+		return
+	}
+
+	if int64(len(raw)) != int64(cryptHeaderSize)+(int64(len(plain))+cryptChunkSize-1)/cryptChunkSize*cryptOverhead+
+		int64(len(plain)) {
+		t.Error("Unexpected size:", len(raw), len(plain))
+		return
+	}
+
+	// Files can be reopened
+
+	f2, err := os.Open("crypt/test1")
+	errorutil.AssertOk(err)
+
+	cf2, err := newCryptFile(f2, bc.content)
+	errorutil.AssertOk(err)
+
+	buf := make([]byte, 11)
+
+	if n, err := cf2.ReadAt(buf, 100); n != 11 || err != nil || string(buf) != "secret data" {
+		t.Error("Unexpected result:", n, err, string(buf))
+		return
+	}
+
+	cf2.Close()
+
+	// Chunks cannot be modified
+
+	raw[cryptHeaderSize+cryptNonceSize+5] ^= 1
+	errorutil.AssertOk(ioutil.WriteFile("crypt/test2", raw, 0660))
+
+	f2, err = os.Open("crypt/test2")
+	errorutil.AssertOk(err)
+
+	cf2, err = newCryptFile(f2, bc.content)
+	errorutil.AssertOk(err)
+
+	if _, err := cf2.ReadAt(buf, 0); err == nil || err.Error() != "File crypt/test2 is damaged or was modified" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cf2.Close()
+
+	// Plain files are not accepted
+
+	errorutil.AssertOk(ioutil.WriteFile("crypt/test3", []byte("plain"), 0660))
+
+	f2, err = os.Open("crypt/test3")
+	errorutil.AssertOk(err)
+	defer f2.Close()
+
+	if _, err := newCryptFile(f2, bc.content); err == nil || err.Error() != "File crypt/test3 is not encrypted" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err := cf.ReadAt(buf, -1); err == nil || err.Error() != "Negative offset -1" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Truncating to zero removes the header
+
+	errorutil.AssertOk(cf.Truncate(0))
+
+	if fi, err := os.Stat("crypt/test1"); err != nil || fi.Size() != 0 || cf.id != nil {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+}
+
+func TestCryptConcurrentWrites(t *testing.T) {
+
+	os.Mkdir("crypt", 0770)
+	defer os.RemoveAll("crypt")
+
+	absRoot, _ := filepath.Abs("crypt")
+
+	bc, err := newBranchCrypt(absRoot, []byte("0123456789abcdef"), false)
+	errorutil.AssertOk(err)
+
+	b := &Branch{rootPath: absRoot, crypt: bc,
+		fileLocks: &fileLocks{&sync.Mutex{}, make(map[string]*fileLock)}}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	for i := 0; i < 20; i++ {
+		var wg sync.WaitGroup
+
+		name := fmt.Sprintf("test%v", i)
+
+		// Write into different chunks of an empty file and into the same
+		// chunk at different offsets
+
+		write := func(data []byte, off int64) {
+			defer wg.Done()
+
+			if _, err := b.WriteFile(name, data, off); err != nil {
+				t.Error(err)
+			}
+		}
+
+		wg.Add(2 + 32)
+
+		go write(bytes.Repeat([]byte("a"), 100), 0)
+		go write(bytes.Repeat([]byte("b"), 100), cryptChunkSize)
+
+		for j := 0; j < 32; j++ {
+			go write([]byte{byte('0' + j)}, int64(200+j))
+		}
+
+		wg.Wait()
+
+		buf := make([]byte, cryptChunkSize+100)
+
+		if n, err := b.ReadFile(name, buf, 0); n != len(buf) || err != nil {
+			t.Error("Unexpected result:", n, err)
+			return
+		}
+
+		for j := 0; j < 32; j++ {
+			if buf[200+j] != byte('0'+j) {
+				t.Error("Unexpected result:", j, string(buf[200:232]))
+				return
+			}
+		}
+
+		if !bytes.Equal(buf[:100], bytes.Repeat([]byte("a"), 100)) ||
+			!bytes.Equal(buf[cryptChunkSize:], bytes.Repeat([]byte("b"), 100)) {
+			t.Error("Unexpected result:", string(buf[:100]), string(buf[cryptChunkSize:]))
+			return
+		}
+	}
+
+	if len(b.fileLocks.locks) != 0 {
+		t.Error("Unexpected locks:", b.fileLocks.locks)
+	}
+}
+
+func TestCryptNames(t *testing.T) {
+
+	bc, err := newBranchCrypt("crypt", []byte("0123456789abcdef"), true)
+	errorutil.AssertOk(err)
+
+	other, err := newBranchCrypt("crypt", []byte("0123456789abcdeX"), true)
+	errorutil.AssertOk(err)
+
+	name := bc.encryptName("Test File.txt")
+
+	if name != bc.encryptName("Test File.txt") || name == other.encryptName("Test File.txt") ||
+		strings.ToLower(name) != name || strings.Contains(name, "Test") {
+		t.Error("Unexpected result:", name)
+		return
+	}
+
+	if res, ok := bc.decryptName(name); !ok || res != "Test File.txt" {
+		t.Error("Unexpected result:", res, ok)
+		return
+	}
+
+	for _, localName := range []string{name[1:], "test", cryptCheckFile, ".test.rufswrite123"} {
+		if res, ok := bc.decryptName(localName); ok {
+			t.Error("Unexpected result:", localName, res)
+			return
+		}
+	}
+
+	if _, ok := other.decryptName(name); ok {
+		t.Error("Name should not be readable with another key")
+		return
+	}
+
+	if res := bc.encryptName(".."); res != ".." {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Convert paths
+
+	absRoot, _ := filepath.Abs("crypt")
+	bc.rootPath = absRoot
+
+	localPath, err := bc.localPath(filepath.Join(absRoot, "foo", "bar"), "/foo/bar")
+
+	if err != nil || localPath != filepath.Join(absRoot, bc.encryptName("foo"), bc.encryptName("bar")) {
+		t.Error("Unexpected result:", localPath, err)
+		return
+	}
+
+	if res, ok := bc.branchPath("/" + bc.encryptName("foo") + "/" + bc.encryptName("bar")); !ok || res != "/foo/bar" {
+		t.Error("Unexpected result:", res, ok)
+		return
+	}
+
+	if res, ok := bc.branchPath("/" + bc.encryptName("foo") + "/bar"); ok {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Names are not changed if only contents are encrypted
+
+	bc, err = newBranchCrypt(absRoot, []byte("0123456789abcdef"), false)
+	errorutil.AssertOk(err)
+
+	if res, ok := bc.branchPath("/foo/" + cryptCheckFile); !ok || res != "/foo/"+cryptCheckFile {
+		t.Error("Unexpected result:", res, ok)
+		return
+	}
+
+	if res, ok := bc.branchPath("/" + cryptCheckFile); ok {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if _, err := bc.localPath(filepath.Join(absRoot, cryptCheckFile), "/"+cryptCheckFile); err == nil ||
+		err.Error() != "Requested path /.rufscrypt is reserved" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestCheckSumFast(t *testing.T) {
+
+	os.Mkdir("crypt", 0770)
+	defer os.RemoveAll("crypt")
+
+	r := rand.New(rand.NewSource(42))
+
+	for _, size := range []int{0, 10, fastSumSampleSize*8 - 1, fastSumSampleSize*8 + 1000} {
+		data := make([]byte, size)
+		r.Read(data)
+
+		errorutil.AssertOk(ioutil.WriteFile("crypt/test", data, 0660))
+
+		// Empty files have no checksum
+
+		expected, expectedErr := fileutil.CheckSumFileFast("crypt/test")
+
+		if res, err := checkSumFast(bytes.NewReader(data), int64(size)); res != expected ||
+			fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+			t.Error("Unexpected result:", size, res, expected, err, expectedErr)
+			return
+		}
+	}
+}
@@ -0,0 +1,651 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"devt.de/krotik/rufs/node"
+)
+
+/*
+DeltaBlockSize is the minimum block size of file signatures which are used
+for delta transfers.
+*/
+var DeltaBlockSize = 8 * 1024
+
+/*
+DeltaMaxBlocks is the maximum number of blocks of a file signature. The block
+size of large files is increased so the signature stays within this limit.
+*/
+var DeltaMaxBlocks int64 = 64 * 1024
+
+/*
+DeltaSyncMinSize is the minimum size of files which are updated with a delta
+transfer during a sync. Smaller files are always copied completely.
+*/
+var DeltaSyncMinSize int64 = 1024 * 1024
+
+/*
+deltaMaxLiteral is the maximum size of a single literal data instruction.
+*/
+const deltaMaxLiteral = 64 * 1024
+
+/*
+Delta instructions - a delta is a sequence of instructions which construct
+a new file from the blocks of an existing file and literal data.
+*/
+const (
+	deltaOpBlocks = 'b' // Copy a run of blocks (followed by start and count)
+	deltaOpData   = 'd' // Copy literal data (followed by length and data)
+)
+
+/*
+BlockSignature is the signature of a single block of a file.
+*/
+type BlockSignature struct {
+	Weak   uint32 // Rolling checksum of the block
+	Strong []byte // Strong hash of the block
+}
+
+/*
+FileSignature is the block signature of a file.
+*/
+type FileSignature struct {
+	BlockSize int              // Size of a block (the last block might be shorter)
+	Size      int64            // Size of the file
+	Blocks    []BlockSignature // Signatures of all blocks
+}
+
+/*
+signatureBlockSize returns the block size of the signature of a file with a
+given size.
+*/
+func signatureBlockSize(size int64) int {
+	bs := int64(DeltaBlockSize)
+
+	if blocks := size / bs; blocks > DeltaMaxBlocks {
+		bs = (size/DeltaMaxBlocks/bs + 1) * bs
+	}
+
+	return int(bs)
+}
+
+/*
+weakChecksum calculates the rolling checksum of a given block. Returns both
+halves of the checksum.
+*/
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+
+	l := uint32(len(block))
+
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+
+	return a & 0xffff, b & 0xffff
+}
+
+/*
+strongHash calculates the strong hash of a given block.
+*/
+func strongHash(block []byte) []byte {
+	h := md5.Sum(block)
+	return h[:]
+}
+
+/*
+newFileSignature calculates the block signature of the data of a given
+reader.
+*/
+func newFileSignature(r io.Reader, blockSize int) (*FileSignature, error) {
+	var err error
+
+	sig := &FileSignature{blockSize, 0, nil}
+	block := make([]byte, blockSize)
+
+	for err == nil {
+		var n int
+
+		if n, err = io.ReadFull(r, block); n > 0 {
+			a, b := weakChecksum(block[:n])
+
+			sig.Blocks = append(sig.Blocks, BlockSignature{a | b<<16, strongHash(block[:n])})
+			sig.Size += int64(n)
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return sig, err
+}
+
+/*
+deltaWriter writes delta instructions. Consecutive block references are
+combined into runs.
+*/
+type deltaWriter struct {
+	w        *bufio.Writer
+	runStart int   // Start of the current block run
+	runCount int   // Length of the current block run
+	literal  int64 // Number of written literal bytes
+}
+
+/*
+writeBlock writes a reference to a given block.
+*/
+func (dw *deltaWriter) writeBlock(index int) error {
+	var err error
+
+	if dw.runCount > 0 && dw.runStart+dw.runCount == index {
+		dw.runCount++
+	} else if err = dw.flushRun(); err == nil {
+		dw.runStart, dw.runCount = index, 1
+	}
+
+	return err
+}
+
+/*
+writeData writes literal data.
+*/
+func (dw *deltaWriter) writeData(data []byte) error {
+	var header [5]byte
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	err := dw.flushRun()
+
+	if err == nil {
+		header[0] = deltaOpData
+		binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+		if _, err = dw.w.Write(header[:]); err == nil {
+			_, err = dw.w.Write(data)
+			dw.literal += int64(len(data))
+		}
+	}
+
+	return err
+}
+
+/*
+flushRun writes the current block run.
+*/
+func (dw *deltaWriter) flushRun() error {
+	var instr [9]byte
+	var err error
+
+	if dw.runCount > 0 {
+		instr[0] = deltaOpBlocks
+		binary.BigEndian.PutUint32(instr[1:], uint32(dw.runStart))
+		binary.BigEndian.PutUint32(instr[5:], uint32(dw.runCount))
+
+		_, err = dw.w.Write(instr[:])
+		dw.runCount = 0
+	}
+
+	return err
+}
+
+/*
+flush writes all pending instructions.
+*/
+func (dw *deltaWriter) flush() error {
+	err := dw.flushRun()
+
+	if err == nil {
+		err = dw.w.Flush()
+	}
+
+	return err
+}
+
+/*
+writeDelta writes the delta between the data of a given reader and a file
+with a given signature. Data which can be found in the blocks of the
+signature is written as block references. Returns the number of written
+literal bytes.
+*/
+func writeDelta(w io.Writer, r io.Reader, sig *FileSignature) (int64, error) {
+	var a, b uint32
+	var rolling bool
+	var err error
+
+	bs := sig.BlockSize
+	dw := &deltaWriter{bufio.NewWriter(w), 0, 0, 0}
+	br := bufio.NewReader(r)
+
+	// Index all full blocks by their rolling checksum
+
+	index := make(map[uint32][]int)
+
+	for i, bsig := range sig.Blocks {
+		if int64(i+1)*int64(bs) <= sig.Size {
+			index[bsig.Weak] = append(index[bsig.Weak], i)
+		}
+	}
+
+	findBlock := func(weak uint32, block []byte) int {
+		var strong []byte
+
+		for _, i := range index[weak] {
+			if strong == nil {
+				strong = strongHash(block)
+			}
+			if bytes.Equal(strong, sig.Blocks[i].Strong) {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	// The buffer holds pending literal data followed by the current window
+
+	buf := make([]byte, 0, deltaMaxLiteral+bs+1)
+
+	for err == nil {
+		var c byte
+
+		if c, err = br.ReadByte(); err != nil {
+			break
+		}
+
+		buf = append(buf, c)
+
+		if !rolling {
+
+			if len(buf) < bs {
+				continue
+			}
+
+			a, b = weakChecksum(buf[len(buf)-bs:])
+			rolling = true
+
+		} else {
+
+			// Roll the checksum by one byte
+
+			out := uint32(buf[len(buf)-bs-1])
+
+			a = (a - out + uint32(c)) & 0xffff
+			b = (b - uint32(bs)*out + a) & 0xffff
+		}
+
+		window := buf[len(buf)-bs:]
+
+		if i := findBlock(a|b<<16, window); i >= 0 {
+
+			if err = dw.writeData(buf[:len(buf)-bs]); err == nil {
+				err = dw.writeBlock(i)
+			}
+
+			buf = buf[:0]
+			rolling = false
+
+		} else if len(buf)-bs >= deltaMaxLiteral {
+
+			// Write pending literal data and keep the window
+
+			if err = dw.writeData(buf[:len(buf)-bs]); err == nil {
+				buf = append(buf[:0], window...)
+			}
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+
+		// Check if the remaining data ends with the last block of the
+		// signature if it is shorter than a full block
+
+		if last := len(sig.Blocks) - 1; last >= 0 {
+
+			if l := int(sig.Size - int64(last)*int64(bs)); l < bs && l <= len(buf) {
+				tail := buf[len(buf)-l:]
+				ta, tb := weakChecksum(tail)
+
+				if ta|tb<<16 == sig.Blocks[last].Weak && bytes.Equal(strongHash(tail), sig.Blocks[last].Strong) {
+
+					if err = dw.writeData(buf[:len(buf)-l]); err == nil {
+						err = dw.writeBlock(last)
+					}
+
+					buf = buf[:0]
+				}
+			}
+		}
+
+		if err == nil {
+			if err = dw.writeData(buf); err == nil {
+				err = dw.flush()
+			}
+		}
+	}
+
+	return dw.literal, err
+}
+
+/*
+deltaReader is an io.Reader which constructs a new file from the blocks of
+an existing file and a stream of delta instructions.
+*/
+type deltaReader struct {
+	base      io.ReaderAt   // Existing file
+	baseSize  int64         // Size of the existing file
+	blockSize int64         // Block size of the delta
+	delta     *bufio.Reader // Stream of delta instructions
+	src       io.Reader     // Source of the current instruction
+	remaining int64         // Remaining bytes of the current instruction
+}
+
+/*
+newDeltaReader creates a new deltaReader.
+*/
+func newDeltaReader(base io.ReaderAt, baseSize int64, blockSize int, delta io.Reader) *deltaReader {
+	return &deltaReader{base, baseSize, int64(blockSize), bufio.NewReader(delta), nil, 0}
+}
+
+/*
+Read reads up to len(p) bytes of the new file into p.
+*/
+func (dr *deltaReader) Read(p []byte) (int, error) {
+
+	for dr.remaining == 0 {
+		var args [8]byte
+
+		op, err := dr.delta.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if op == deltaOpBlocks {
+
+			if _, err = io.ReadFull(dr.delta, args[:8]); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			start := int64(binary.BigEndian.Uint32(args[:4])) * dr.blockSize
+			end := start + int64(binary.BigEndian.Uint32(args[4:]))*dr.blockSize
+
+			if end > dr.baseSize {
+				end = dr.baseSize
+			}
+
+			if start >= end {
+				return 0, fmt.Errorf("Invalid block reference in delta: %v", start/dr.blockSize)
+			}
+
+			dr.src = io.NewSectionReader(dr.base, start, end-start)
+			dr.remaining = end - start
+
+		} else if op == deltaOpData {
+
+			if _, err = io.ReadFull(dr.delta, args[:4]); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			dr.src = dr.delta
+			dr.remaining = int64(binary.BigEndian.Uint32(args[:4]))
+
+		} else {
+
+			return 0, fmt.Errorf("Unknown delta instruction: %v", op)
+		}
+	}
+
+	if int64(len(p)) > dr.remaining {
+		p = p[:dr.remaining]
+	}
+
+	n, err := dr.src.Read(p)
+	dr.remaining -= int64(n)
+
+	if err == io.EOF {
+		err = nil
+
+		if dr.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, err
+}
+
+// Branch functions
+// ================
+
+/*
+Signature calculates the block signature of a given file.
+*/
+func (b *Branch) Signature(spath string) (*FileSignature, error) {
+	var sig *FileSignature
+	var fi os.FileInfo
+
+	subPath, err := b.constructSubPath(spath)
+
+	if err == nil {
+		if fi, err = os.Stat(subPath); err == nil {
+
+			if fi.IsDir() {
+				err = fmt.Errorf("read %v: is a directory", path.Clean("/"+spath))
+
+			} else {
+				var f branchFile
+
+				if f, err = b.openFile(subPath, os.O_RDONLY, 0); err == nil {
+					var size int64
+
+					defer f.Close()
+
+					if size, err = f.Size(); err == nil {
+						sig, err = newFileSignature(io.NewSectionReader(f, 0, size),
+							signatureBlockSize(size))
+					}
+				}
+			}
+		}
+	}
+
+	return sig, err
+}
+
+/*
+applyDelta constructs a new version of a given file from its current version
+and a stream of delta instructions. The new version is written into a given
+write session.
+*/
+func (b *Branch) applyDelta(id string, spath string, blockSize int, delta io.Reader) error {
+	var f branchFile
+	var size int64
+
+	if blockSize <= 0 {
+		return fmt.Errorf("Invalid block size: %v", blockSize)
+	}
+
+	subPath, err := b.constructSubPath(spath)
+
+	if err == nil {
+		if f, err = b.openFile(subPath, os.O_RDONLY, 0); err == nil {
+			defer f.Close()
+
+			if size, err = f.Size(); err == nil {
+				_, err = b.writeSessionData(id, spath, 0,
+					newDeltaReader(f, size, blockSize, delta))
+			}
+		}
+	}
+
+	return err
+}
+
+// Tree functions
+// ==============
+
+/*
+syncFileDelta updates an existing destination file with the data of a given
+source file. The destination branch sends a block signature of its version
+of the file and only data which cannot be found in these blocks is sent to
+it. Returns false if a delta transfer is not possible because the file is
+not on exactly one writable branch.
+*/
+func (t *Tree) syncFileDelta(srcPath, dstPath string, srcFi os.FileInfo, updFunc func(writtenBytes int)) (bool, error) {
+	var sig FileSignature
+	var session string
+	var res []byte
+	var reported int64
+
+	// The tree lock is only held while the branches are resolved
+
+	t.treeLock.RLock()
+	branches, rpaths, err := t.writeBranches(dstPath)
+	t.treeLock.RUnlock()
+
+	if err != nil || len(branches) != 1 {
+		return false, err
+	}
+
+	branch, rpath := branches[0], rpaths[0]
+
+	if res, err = t.client.SendData(branch, map[string]string{
+		ParamAction: OpSignature,
+		ParamPath:   rpath,
+	}, nil); err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&sig)
+	}
+
+	if err != nil {
+
+		// The file does not exist on the writable branch
+
+		if rerr, ok := err.(*node.Error); ok && rerr.IsNotExist {
+			err = nil
+		}
+
+		return false, err
+	}
+
+	defer t.invalidateCaches(dstPath)
+
+	if t.cache != nil {
+		defer t.cache.Invalidate(branch, rpath)
+	}
+
+	if res, err = t.client.SendData(branch, map[string]string{
+		ParamAction: OpOpenWrite,
+		ParamPath:   rpath,
+	}, nil); err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&session)
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	updFunc(CopyStatusDelta)
+
+	// Stream the source through the delta calculation to the destination
+
+	spr, spw := io.Pipe()
+	dpr, dpw := io.Pipe()
+	errs := make(chan error, 2)
+
+	go func() {
+		rerr := t.readFileToBuffer(srcPath, 0, &positionWriter{spw, 0, func(pos int64) {
+			updFunc(int(pos - reported))
+			reported = pos
+		}})
+		spw.CloseWithError(rerr)
+		errs <- rerr
+	}()
+
+	go func() {
+		werr := t.client.SendStream(branch, map[string]string{
+			ParamAction:  OpApplyDelta,
+			ParamPath:    rpath,
+			ParamSession: session,
+			ParamSize:    fmt.Sprint(sig.BlockSize),
+		}, dpr, nil)
+		dpr.CloseWithError(werr)
+		errs <- werr
+	}()
+
+	literal, err := writeDelta(dpw, spr, &sig)
+
+	dpw.CloseWithError(err)
+	spr.CloseWithError(err)
+
+	// Errors of the source or the destination take precedence
+
+	for i := 0; i < 2; i++ {
+		if rerr := <-errs; rerr != nil {
+			err = rerr
+		}
+	}
+
+	if err == nil {
+		node.LogDebug("Delta sync of ", srcPath, " to ", dstPath, " sent ",
+			literal, " of ", srcFi.Size(), " bytes")
+
+		err = t.finishWriteSessions(OpCommitWrite, branches, rpaths, []string{session})
+	} else {
+		t.finishWriteSessions(OpAbortWrite, branches, rpaths, []string{session})
+	}
+
+	return true, err
+}
+
+/*
+syncFile copies a given source file to a destination which exists with
+different content. Large files are updated with a delta transfer - a full
+copy is made if this is not possible or fails.
+*/
+func (t *Tree) syncFile(srcPath, dstPath string, srcFi os.FileInfo, updFunc func(writtenBytes int)) error {
+
+	if srcFi.Size() >= DeltaSyncMinSize {
+
+		if updFunc == nil {
+			updFunc = func(int) {}
+		}
+
+		ok, err := t.syncFileDelta(srcPath, dstPath, srcFi, updFunc)
+
+		if ok && err == nil {
+			updFunc(CopyStatusVerifying)
+
+			if err = t.verifyCopy(srcFi, dstPath); err == nil {
+				updFunc(CopyStatusFinished)
+				return nil
+			}
+		}
+
+		if err != nil {
+			node.LogDebug("Delta sync of ", srcPath, " to ", dstPath, " failed: ", err)
+		}
+	}
+
+	return t.CopyFile(srcPath, dstPath, updFunc)
+}
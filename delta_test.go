@@ -0,0 +1,258 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+	"devt.de/krotik/rufs/node"
+)
+
+func TestSignatureBlockSize(t *testing.T) {
+
+	if res := signatureBlockSize(0); res != DeltaBlockSize {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := signatureBlockSize(int64(DeltaBlockSize) * DeltaMaxBlocks); res != DeltaBlockSize {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	size := int64(DeltaBlockSize) * DeltaMaxBlocks * 10
+
+	if res := signatureBlockSize(size); res%DeltaBlockSize != 0 || size/int64(res) > DeltaMaxBlocks {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	bs := 512
+
+	rnd := rand.New(rand.NewSource(1))
+
+	randomData := func(n int) []byte {
+		data := make([]byte, n)
+		rnd.Read(data)
+		return data
+	}
+
+	base := randomData(100*bs + 100)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	changed := append([]byte{}, base...)
+	changed[50*bs+10]++
+
+	tests := []struct {
+		name       string
+		base       []byte
+		data       []byte
+		maxLiteral int64
+	}{
+		{"unchanged", base, base, 0},
+		{"changed byte", base, changed, int64(bs)},
+		{"insert", base, join(base[:30*bs+7], randomData(100), base[30*bs+7:]), int64(bs + 100)},
+		{"delete", base, join(base[:30*bs+7], base[40*bs:]), int64(bs)},
+		{"prepend", base, join(randomData(33), base), 33},
+		{"append", base, join(base, randomData(1000)), int64(bs + 1000)},
+		{"truncate", base, base[:70*bs], 0},
+		{"reorder", base, join(base[60*bs:], base[:60*bs]), int64(bs)},
+		{"empty base", nil, base, int64(len(base))},
+		{"empty data", base, nil, 0},
+		{"random", base, randomData(10 * bs), int64(10 * bs)},
+	}
+
+	for _, test := range tests {
+		var delta bytes.Buffer
+
+		sig, err := newFileSignature(bytes.NewReader(test.base), bs)
+		if err != nil || sig.Size != int64(len(test.base)) {
+			t.Error("Unexpected result:", test.name, sig, err)
+			return
+		}
+
+		literal, err := writeDelta(&delta, bytes.NewReader(test.data), sig)
+		if err != nil || literal > test.maxLiteral {
+			t.Error("Unexpected result:", test.name, literal, err)
+			return
+		}
+
+		res, err := ioutil.ReadAll(newDeltaReader(bytes.NewReader(test.base),
+			int64(len(test.base)), bs, &delta))
+
+		if err != nil || !bytes.Equal(res, test.data) {
+			t.Error("Unexpected result:", test.name, len(res), len(test.data), err)
+			return
+		}
+	}
+
+	// Test error cases
+
+	readDelta := func(delta []byte) error {
+		_, err := ioutil.ReadAll(newDeltaReader(bytes.NewReader(base),
+			int64(len(base)), bs, bytes.NewReader(delta)))
+		return err
+	}
+
+	if err := readDelta([]byte("x")); err == nil || err.Error() != "Unknown delta instruction: 120" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := readDelta([]byte{deltaOpBlocks, 0, 0}); err == nil || err.Error() != "unexpected EOF" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := readDelta([]byte{deltaOpData, 0, 0, 0, 5, 1, 2}); err == nil || err.Error() != "unexpected EOF" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := readDelta([]byte{deltaOpBlocks, 0, 0, 1, 0, 0, 0, 0, 1}); err == nil ||
+		err.Error() != "Invalid block reference in delta: 256" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestSyncDelta(t *testing.T) {
+	var buf bytes.Buffer
+
+	oldBlockSize := DeltaBlockSize
+	oldMinSize := DeltaSyncMinSize
+	DeltaBlockSize = 1024
+	DeltaSyncMinSize = 1024
+
+	defer func() {
+		DeltaBlockSize = oldBlockSize
+		DeltaSyncMinSize = oldMinSize
+	}()
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/src", "footest", false))
+	errorutil.AssertOk(tree.AddMapping("/dst", "bartest", true))
+
+	os.Mkdir("foo/deltatest", 0770)
+	os.Mkdir("bar/deltatest", 0770)
+	defer os.RemoveAll("foo/deltatest")
+	defer os.RemoveAll("bar/deltatest")
+
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	ioutil.WriteFile("foo/deltatest/big", data, 0660)
+	ioutil.WriteFile("foo/deltatest/small", []byte("small file"), 0660)
+
+	old := append([]byte{}, data[:150*1024]...)
+	old[1000]++
+
+	ioutil.WriteFile("bar/deltatest/big", old, 0660)
+	ioutil.WriteFile("bar/deltatest/small", []byte("Small file"), 0660)
+
+	// Record debug messages to see how much data was sent
+
+	var debug bytes.Buffer
+
+	oldLogDebug := node.LogDebug
+	node.LogDebug = func(v ...interface{}) {
+		if msg := fmt.Sprint(v...); strings.HasPrefix(msg, "Delta sync") {
+			debug.WriteString(msg + "\n")
+		}
+	}
+	defer func() {
+		node.LogDebug = oldLogDebug
+	}()
+
+	updFunc := func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+		if writtenBytes == 0 {
+			buf.WriteString(fmt.Sprintf("%v %v -> %v\n", op, srcFile, dstFile))
+		}
+	}
+
+	if err := tree.Sync("/src/deltatest", "/dst/deltatest", true, updFunc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := buf.String(); !strings.Contains(res, "Delta file /src/deltatest/big -> /dst/deltatest/big") ||
+		strings.Contains(res, "Delta file /src/deltatest/small") {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Only the changed block and the appended data should have been sent
+
+	if res := debug.String(); res != `
+Delta sync of /src/deltatest/big to /dst/deltatest/big sent 52224 of 204800 bytes
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res, err := ioutil.ReadFile("bar/deltatest/big"); err != nil || !bytes.Equal(res, data) {
+		t.Error("Unexpected result:", len(res), err)
+		return
+	}
+
+	if res, err := ioutil.ReadFile("bar/deltatest/small"); err != nil || string(res) != "small file" {
+		t.Error("Unexpected result:", string(res), err)
+		return
+	}
+
+	// No temporary files should be left behind
+
+	if fis, err := ioutil.ReadDir("bar/deltatest"); err != nil || len(fis) != 2 {
+		t.Error("Unexpected result:", fis, err)
+		return
+	}
+
+	// Test error cases
+
+	if _, err := bartest.Signature("/deltatest"); err == nil || err.Error() != "read /deltatest: is a directory" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := bartest.applyDelta("123", "/deltatest/big", 1024, nil); err == nil ||
+		err.Error() != "Unknown write session 123 for /deltatest/big" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := bartest.applyDelta("123", "/deltatest/big", 0, nil); err == nil ||
+		err.Error() != "Invalid block size: 0" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
@@ -0,0 +1,23 @@
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import "fmt"
+
+/*
+diskFreeSpace returns the free space of the file system of a given directory.
+Querying the free space is not supported on this platform.
+*/
+func diskFreeSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("Free disk space is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+// +build linux darwin freebsd dragonfly
+
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import "syscall"
+
+/*
+diskFreeSpace returns the number of bytes which are available to
+unprivileged users on the file system of a given directory.
+*/
+func diskFreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
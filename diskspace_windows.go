@@ -0,0 +1,37 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+/*
+diskFreeSpace returns the number of bytes which are available to the
+current user on the volume of a given directory.
+*/
+func diskFreeSpace(dir string) (uint64, error) {
+	var free uint64
+
+	p, err := syscall.UTF16PtrFromString(dir)
+
+	if err == nil {
+		if r, _, cerr := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+			err = cerr
+		}
+	}
+
+	return free, err
+}
@@ -25,12 +25,16 @@ Copyright (c) 2010 the Go-FUSE Authors. All rights reserved.
 */
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/node"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
@@ -144,6 +148,120 @@ func (rf *RufsFuse) Open(name string, flags uint32, context *fuse.Context) (file
 	return &RufsFile{nodefs.NewDefaultFile(), path.Join("/", name), rf.Tree}, fuse.OK
 }
 
+/*
+Create creates a new empty file and opens it.
+*/
+func (rf *RufsFuse) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	name = path.Join("/", name)
+
+	// Writing an empty slice at offset 0 creates the file on all writable branches
+
+	if _, err := rf.Tree.WriteFile(name, []byte{}, 0); err != nil {
+		return nil, errorToStatus(err)
+	}
+
+	return &RufsFile{nodefs.NewDefaultFile(), name, rf.Tree}, fuse.OK
+}
+
+/*
+Truncate changes the size of a file.
+*/
+func (rf *RufsFuse) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	dir, file := path.Split(path.Join("/", name))
+
+	_, err := rf.Tree.ItemOp(dir, map[string]string{
+		rufs.ItemOpAction: rufs.ItemOpActTruncate,
+		rufs.ItemOpName:   file,
+		rufs.ItemOpSize:   fmt.Sprint(size),
+	})
+
+	return errorToStatus(err)
+}
+
+/*
+Mkdir creates a new directory.
+*/
+func (rf *RufsFuse) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	dir, file := path.Split(path.Join("/", name))
+
+	_, err := rf.Tree.ItemOp(dir, map[string]string{
+		rufs.ItemOpAction: rufs.ItemOpActMkDir,
+		rufs.ItemOpName:   file,
+	})
+
+	return errorToStatus(err)
+}
+
+/*
+Rename renames a file or directory. Items can only be renamed within the same
+directory - moving items across directories is reported as a cross-device
+link so tools fall back to copy and delete.
+*/
+func (rf *RufsFuse) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	oldDir, oldFile := path.Split(path.Join("/", oldName))
+	newDir, newFile := path.Split(path.Join("/", newName))
+
+	if oldDir != newDir {
+		return fuse.Status(syscall.EXDEV)
+	}
+
+	_, err := rf.Tree.ItemOp(oldDir, map[string]string{
+		rufs.ItemOpAction:  rufs.ItemOpActRename,
+		rufs.ItemOpName:    oldFile,
+		rufs.ItemOpNewName: newFile,
+	})
+
+	return errorToStatus(err)
+}
+
+/*
+Unlink deletes a file.
+*/
+func (rf *RufsFuse) Unlink(name string, context *fuse.Context) fuse.Status {
+	dir, file := path.Split(path.Join("/", name))
+
+	_, err := rf.Tree.ItemOp(dir, map[string]string{
+		rufs.ItemOpAction: rufs.ItemOpActDelete,
+		rufs.ItemOpName:   file,
+	})
+
+	return errorToStatus(err)
+}
+
+/*
+Rmdir deletes an empty directory.
+*/
+func (rf *RufsFuse) Rmdir(name string, context *fuse.Context) fuse.Status {
+	name = path.Join("/", name)
+
+	// Branches remove directories recursively - make sure the directory is empty
+
+	_, fis, err := rf.Tree.Dir(name, "", false, false)
+
+	if err != nil {
+		return errorToStatus(err)
+	} else if len(fis) > 0 && len(fis[0]) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+
+	dir, file := path.Split(name)
+
+	_, err = rf.Tree.ItemOp(dir, map[string]string{
+		rufs.ItemOpAction: rufs.ItemOpActDelete,
+		rufs.ItemOpName:   file,
+	})
+
+	return errorToStatus(err)
+}
+
+/*
+Utimens accepts changes of access and modification times. Times are
+managed by the branches so the request is ignored.
+*/
+func (rf *RufsFuse) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) fuse.Status {
+	return fuse.OK
+}
+
 // File related objects
 // ====================
 
@@ -176,6 +294,15 @@ func (f *RufsFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	return res, status
 }
 
+/*
+Write writes a portion of the file.
+*/
+func (f *RufsFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, err := f.tree.WriteFile(f.name, data, off)
+
+	return uint32(n), errorToStatus(err)
+}
+
 /*
 RufsReadResult is an implementation of fuse.ReadResult.
 */
@@ -206,6 +333,28 @@ func (r *RufsReadResult) Done() {}
 // Helper functions
 // ================
 
+/*
+errorToStatus converts a given tree error into a FUSE status.
+*/
+func errorToStatus(err error) fuse.Status {
+
+	if err == nil {
+		return fuse.OK
+	}
+
+	if rufs.IsNotWritable(err) {
+		return fuse.EROFS
+	}
+
+	if rerr, ok := err.(*node.Error); ok && rerr.IsNotExist {
+		return fuse.ENOENT
+	}
+
+	LogError(err)
+
+	return fuse.EIO
+}
+
 /*
 OSModeToFuseMode converts a given os.FileMode to a Fuse Mode
 */
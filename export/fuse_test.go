@@ -0,0 +1,307 @@
+// +build linux
+
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package export
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/cryptutil"
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/common/fileutil"
+	"devt.de/krotik/rufs"
+	"devt.de/krotik/rufs/config"
+	"devt.de/krotik/rufs/node"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+func TestErrorToStatus(t *testing.T) {
+	var logged []interface{}
+
+	oldLogError := LogError
+	LogError = func(v ...interface{}) {
+		logged = append(logged, v...)
+	}
+	defer func() {
+		LogError = oldLogError
+	}()
+
+	for _, tc := range []struct {
+		err    error
+		status fuse.Status
+	}{
+		{nil, fuse.OK},
+		{rufs.ErrNotWritable, fuse.EROFS},
+		{&node.ReadOnlyError{Name: "footest"}, fuse.EROFS},
+		{&node.Error{Type: node.ErrRemoteAction, Detail: "Branch footest is read-only", IsReadOnly: true}, fuse.EROFS},
+		{&node.Error{Type: node.ErrRemoteAction, Detail: "Branch footest is read-only"}, fuse.EIO},
+		{&node.Error{Type: node.ErrRemoteAction, Detail: os.ErrNotExist.Error(), IsNotExist: true}, fuse.ENOENT},
+		{&node.Error{Type: node.ErrNodeComm, Detail: "Testerror"}, fuse.EIO},
+		{fmt.Errorf("Testerror"), fuse.EIO},
+	} {
+		if res := errorToStatus(tc.err); res != tc.status {
+			t.Error("Unexpected result:", tc.err, res)
+			return
+		}
+	}
+
+	// Only unexpected errors are logged
+
+	if fmt.Sprint(logged) != "[RufsError: Remote error (Branch footest is read-only) RufsError: Network error (Testerror) Testerror]" {
+		t.Error("Unexpected result:", logged)
+		return
+	}
+}
+
+func TestFuseWrite(t *testing.T) {
+
+	createFuse := func(writable bool) *RufsFuse {
+		tree, err := rufs.NewTree(map[string]interface{}{
+			config.TreeSecret: "123",
+		}, clientCert)
+		errorutil.AssertOk(err)
+
+		fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+		errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+		errorutil.AssertOk(tree.AddMapping("/", "footest", writable))
+
+		return &RufsFuse{pathfs.NewDefaultFileSystem(), tree}
+	}
+
+	rf := createFuse(true)
+
+	// Create and write a file
+
+	f, status := rf.Create("test1", 0, 0644, nil)
+	if status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if n, status := f.Write([]byte("Test1 file"), 0); n != 10 || status != fuse.OK {
+		t.Error("Unexpected result:", n, status)
+		return
+	}
+
+	if status := rf.Truncate("test1", 5, nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if data, err := ioutil.ReadFile("foo/test1"); err != nil || string(data) != "Test1" {
+		t.Error("Unexpected result:", string(data), err)
+		return
+	}
+
+	if status := rf.Utimens("test1", nil, nil, nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	// Read-only mappings cannot be written to
+
+	if _, status := createFuse(false).Create("test2", 0, 0644, nil); status != fuse.EROFS {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	// Items can only be renamed within the same directory
+
+	if status := rf.Mkdir("dir1", 0755, nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if status := rf.Rename("test1", "dir1/test1", nil); status != fuse.EXDEV {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if status := rf.Rename("test1", "test2", nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/test2"); !res {
+		t.Error("File should have been renamed")
+		return
+	}
+
+	// Only empty directories can be removed
+
+	ioutil.WriteFile("foo/dir1/test3", []byte("Test3 file"), 0660)
+
+	if status := rf.Rmdir("dir1", nil); status != fuse.Status(syscall.ENOTEMPTY) {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/dir1/test3"); !res {
+		t.Error("Directory should not have been removed")
+		return
+	}
+
+	if status := rf.Unlink("dir1/test3", nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if status := rf.Rmdir("dir1", nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if status := rf.Unlink("test2", nil); status != fuse.OK {
+		t.Error("Unexpected result:", status)
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/dir1"); res {
+		t.Error("Directory should have been removed")
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/test2"); res {
+		t.Error("File should have been removed")
+		return
+	}
+}
+
+const certdir = "certs" // Directory for certificates
+var portCount = 0       // Port assignment counter for Branch ports
+
+var branchConfigs = map[string]map[string]interface{}{} // All branch configs
+var clientCert *tls.Certificate
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	// Create a ssl certificate directory
+
+	if res, _ := fileutil.PathExists(certdir); res {
+		os.RemoveAll(certdir)
+	}
+
+	err := os.Mkdir(certdir, 0770)
+	if err != nil {
+		fmt.Print("Could not create test directory:", err.Error())
+		os.Exit(1)
+	}
+
+	// Create client certificate
+
+	certFile := fmt.Sprintf("cert-client.pem")
+	keyFile := fmt.Sprintf("key-client.pem")
+	host := "localhost"
+
+	err = cryptutil.GenCert(certdir, certFile, keyFile, host, "", 365*24*time.Hour, true, 2048, "")
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(path.Join(certdir, certFile), path.Join(certdir, keyFile))
+	if err != nil {
+		panic(err)
+	}
+
+	clientCert = &cert
+
+	// Ensure logging is discarded
+
+	log.SetOutput(ioutil.Discard)
+
+	// Set up test branch
+
+	b1, err := createBranch("footest", "foo")
+	errorutil.AssertOk(err)
+
+	// Run the tests
+
+	res := m.Run()
+
+	// Shutdown the branch
+
+	errorutil.AssertOk(b1.Shutdown())
+
+	// Remove all directories again
+
+	if err = os.RemoveAll(certdir); err != nil {
+		fmt.Print("Could not remove test directory:", err.Error())
+	}
+	if err = os.RemoveAll("foo"); err != nil {
+		fmt.Print("Could not remove test directory:", err.Error())
+	}
+
+	os.Exit(res)
+}
+
+func createBranch(name, dir string) (*rufs.Branch, error) {
+
+	// Create the path directory
+
+	if res, _ := fileutil.PathExists(dir); res {
+		os.RemoveAll(dir)
+	}
+
+	err := os.Mkdir(dir, 0770)
+	if err != nil {
+		fmt.Print("Could not create test directory:", err.Error())
+		os.Exit(1)
+	}
+
+	// Create the certificate
+
+	portCount++
+	host := fmt.Sprintf("localhost:%v", 9020+portCount)
+
+	// Generate a certificate and private key
+
+	certFile := fmt.Sprintf("cert-%v.pem", portCount)
+	keyFile := fmt.Sprintf("key-%v.pem", portCount)
+
+	err = cryptutil.GenCert(certdir, certFile, keyFile, host, "", 365*24*time.Hour, true, 2048, "")
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certdir, certFile), filepath.Join(certdir, keyFile))
+	if err != nil {
+		panic(err)
+	}
+
+	// Create the Branch
+
+	config := map[string]interface{}{
+		config.BranchName:     name,
+		config.BranchSecret:   "123",
+		config.EnableReadOnly: false,
+		config.RPCHost:        "localhost",
+		config.RPCPort:        fmt.Sprint(9020 + portCount),
+		config.LocalFolder:    dir,
+	}
+
+	branchConfigs[name] = config
+
+	return rufs.NewBranch(config, &cert)
+}
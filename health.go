@@ -0,0 +1,207 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+HealthCheckMaxBackoff is the maximum time between two health checks of a
+branch which could not be reached.
+*/
+var HealthCheckMaxBackoff = 5 * time.Minute
+
+/*
+BranchStatus is the health status of a known branch.
+*/
+type BranchStatus struct {
+	Reachable bool          // Flag if the branch answered the last ping
+	LastSeen  time.Time     // Time of the last answered ping (zero if the branch was never seen)
+	RTT       time.Duration // Round trip time of the last answered ping
+	Errors    int           // Number of failed pings since the branch was last seen
+	nextCheck time.Time     // Time of the next health check
+}
+
+/*
+healthMonitor holds the status of all known branches of a tree and controls
+the background health checks.
+*/
+type healthMonitor struct {
+	lock     *sync.Mutex
+	status   map[string]*BranchStatus // Status of all pinged branches
+	interval time.Duration            // Interval of the health checks
+	stop     chan bool                // Channel to stop the health checks (nil if not running)
+}
+
+/*
+newHealthMonitor creates a new healthMonitor object.
+*/
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{&sync.Mutex{}, make(map[string]*BranchStatus), 0, nil}
+}
+
+/*
+record records the result of a ping to a given branch. Failed pings delay
+the next health check of the branch exponentially.
+*/
+func (hm *healthMonitor) record(branch string, rtt time.Duration, err error) {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	now := time.Now()
+
+	s, ok := hm.status[branch]
+	if !ok {
+		s = &BranchStatus{}
+		hm.status[branch] = s
+	}
+
+	if err == nil {
+		s.Reachable = true
+		s.LastSeen = now
+		s.RTT = rtt
+		s.Errors = 0
+		s.nextCheck = now.Add(hm.interval)
+
+		return
+	}
+
+	s.Reachable = false
+	s.Errors++
+
+	backoff := hm.interval
+	for i := 1; i < s.Errors && backoff < HealthCheckMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > HealthCheckMaxBackoff {
+		backoff = HealthCheckMaxBackoff
+	}
+
+	s.nextCheck = now.Add(backoff)
+}
+
+/*
+isDue returns if a given branch should be checked.
+*/
+func (hm *healthMonitor) isDue(branch string) bool {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+
+	s, ok := hm.status[branch]
+
+	return !ok || !time.Now().Before(s.nextCheck)
+}
+
+/*
+StartHealthMonitor starts pinging all known branches in the background at a
+given interval. Branches which can no longer be reached are removed from the
+tree and branches which can be reached again are added back. Branches which
+cannot be reached are pinged less often the longer they fail.
+*/
+func (t *Tree) StartHealthMonitor(interval time.Duration) {
+	t.StopHealthMonitor()
+
+	t.health.lock.Lock()
+	defer t.health.lock.Unlock()
+
+	stop := make(chan bool)
+
+	t.health.interval = interval
+	t.health.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.refreshBranches(false)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+StopHealthMonitor stops the background health checks.
+*/
+func (t *Tree) StopHealthMonitor() {
+
+	if t.health == nil {
+		return
+	}
+
+	t.health.lock.Lock()
+	defer t.health.lock.Unlock()
+
+	if t.health.stop != nil {
+		close(t.health.stop)
+		t.health.stop = nil
+	}
+}
+
+/*
+BranchStatus returns the health status of all known branches.
+*/
+func (t *Tree) BranchStatus() map[string]BranchStatus {
+	ret := make(map[string]BranchStatus)
+
+	known := t.KnownBranches()
+
+	t.health.lock.Lock()
+	defer t.health.lock.Unlock()
+
+	for name := range known {
+		if s, ok := t.health.status[name]; ok {
+			ret[name] = *s
+		} else {
+			ret[name] = BranchStatus{}
+		}
+	}
+
+	return ret
+}
+
+/*
+pingKnownBranch sends a ping to a known branch and records the result.
+*/
+func (t *Tree) pingKnownBranch(branchName string, branchRPC string) (string, error) {
+	start := time.Now()
+
+	_, fp, err := t.client.SendPing(branchName, branchRPC)
+
+	t.health.record(branchName, time.Since(start), err)
+
+	return fp, err
+}
+
+/*
+statusMap returns the health status of a branch as a string map.
+*/
+func (s BranchStatus) statusMap() map[string]string {
+	var lastSeen string
+
+	if !s.LastSeen.IsZero() {
+		lastSeen = s.LastSeen.Format(time.RFC3339)
+	}
+
+	return map[string]string{
+		"lastseen": lastSeen,
+		"rtt":      s.RTT.String(),
+		"errors":   fmt.Sprint(s.Errors),
+	}
+}
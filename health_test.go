@@ -0,0 +1,209 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestHealthBackoff(t *testing.T) {
+
+	hm := newHealthMonitor()
+	hm.interval = 10 * time.Second
+
+	if !hm.isDue("b1") {
+		t.Error("Unknown branch should be due")
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		hm.record("b1", 0, fmt.Errorf("Testerror"))
+	}
+
+	if s := hm.status["b1"]; s.Reachable || s.Errors != 3 || !s.LastSeen.IsZero() ||
+		time.Until(s.nextCheck) < 39*time.Second || time.Until(s.nextCheck) > 40*time.Second {
+		t.Error("Unexpected result:", s)
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		hm.record("b1", 0, fmt.Errorf("Testerror"))
+	}
+
+	if s := hm.status["b1"]; time.Until(s.nextCheck) > HealthCheckMaxBackoff {
+		t.Error("Unexpected result:", s)
+		return
+	}
+
+	if hm.isDue("b1") {
+		t.Error("Branch should not be due")
+		return
+	}
+
+	hm.record("b1", time.Millisecond, nil)
+
+	if s := hm.status["b1"]; !s.Reachable || s.Errors != 0 || s.LastSeen.IsZero() || s.RTT != time.Millisecond {
+		t.Error("Unexpected result:", s)
+		return
+	}
+}
+
+func TestHealthMonitor(t *testing.T) {
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	// Reach the branch through a proxy which can be cut
+
+	proxy := newTestProxy("localhost:0", fooRPC)
+	addr := proxy.Addr().String()
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret:          "123",
+		config.HealthCheckInterval: 10,
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	defer tree.StopHealthMonitor()
+
+	errorutil.AssertOk(tree.AddBranch("footest", addr, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", false))
+
+	if s := tree.BranchStatus()["footest"]; !s.Reachable || s.Errors != 0 || s.LastSeen.IsZero() || s.RTT == 0 {
+		t.Error("Unexpected result:", s)
+		return
+	}
+
+	waitFor := func(check func() bool) bool {
+		for i := 0; i < 200; i++ {
+			if check() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	// The branch is removed once it can no longer be reached
+
+	proxy.cut()
+
+	if !waitFor(func() bool { return len(tree.NotReachableBranches()) == 1 }) {
+		t.Error("Branch should not be reachable")
+		return
+	}
+
+	if res, _ := tree.ActiveBranches(); len(res) != 0 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	nr := tree.NotReachableBranches()["footest"]
+
+	if nr["rpc"] != addr || nr["errors"] == "0" || nr["lastseen"] == "" {
+		t.Error("Unexpected result:", nr)
+		return
+	}
+
+	// The branch is added back once it can be reached again
+
+	proxy = newTestProxy(addr, fooRPC)
+	defer proxy.cut()
+
+	if !waitFor(func() bool { return len(tree.NotReachableBranches()) == 0 }) {
+		t.Error("Branch should be reachable")
+		return
+	}
+
+	if fi, err := tree.Stat("/test1"); err != nil || fi.Size() != 10 {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+
+	if s := tree.BranchStatus()["footest"]; !s.Reachable || s.Errors != 0 {
+		t.Error("Unexpected result:", s)
+		return
+	}
+}
+
+func TestRefreshConcurrentAccess(t *testing.T) {
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+
+	os.MkdirAll("foo/refreshtest/src", 0770)
+	defer os.RemoveAll("foo/refreshtest")
+
+	for i := 0; i < 5; i++ {
+		ioutil.WriteFile(fmt.Sprintf("foo/refreshtest/src/test%v", i), []byte("Test"), 0660)
+	}
+
+	stop := make(chan bool)
+	refreshed := make(chan bool)
+
+	// Rebuild the tree continuously
+
+	go func() {
+		defer close(refreshed)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tree.Refresh()
+			}
+		}
+	}()
+
+	// Items are always visible and syncs do not block while the tree is
+	// rebuilt
+
+	done := make(chan error)
+
+	go func() {
+		var err error
+
+		for i := 0; i < 20 && err == nil; i++ {
+
+			if _, err = tree.Stat("/refreshtest/src/test1"); err == nil {
+				err = tree.Sync("/refreshtest/src", fmt.Sprintf("/refreshtest/dst%v", i%2), true, nil)
+			}
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Error("Operations did not finish")
+	}
+
+	close(stop)
+	<-refreshed
+}
@@ -14,10 +14,12 @@ Package node contains the network communication code for Rufs via RPC calls.
 package node
 
 import (
+	"bufio"
 	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
@@ -52,7 +54,8 @@ type RufsNodeToken struct {
 Client is the client for the RPC API of a node.
 */
 type Client struct {
-	token        *RufsNodeToken         // Token to be send to other nodes for authentication
+	token        *RufsNodeToken         // Static token to be send to other nodes for authentication (legacy)
+	secret       string                 // Secret to answer challenges of other nodes
 	rpc          string                 // This client's rpc network interface (may be empty in case of pure clients)
 	peers        map[string]string      // Map of node names to their rpc network interface
 	conns        map[string]*rpc.Client // Map of node names to network connections
@@ -60,6 +63,8 @@ type Client struct {
 	cert         *tls.Certificate       // Client certificate
 	maplock      *sync.RWMutex          // Lock for maps
 	redial       bool                   // Flag if this client is attempting a redial
+
+	LegacyTokens bool // Send static tokens instead of answering challenges (for nodes of older versions)
 }
 
 /*
@@ -205,105 +210,150 @@ func (c *Client) SendData(node string, ctrl map[string]string, data []byte) ([]b
 }
 
 /*
-SendRequest sends a request to another node.
+SendStream opens a streaming data channel to a node. All data from the in
+reader is streamed to the node while all data which is streamed back by the
+node is written to the out writer. Both in and out may be nil. Data flows
+continuously through a dedicated connection which provides backpressure
+through the network layer.
 */
-func (c *Client) SendRequest(node string, remoteCall RPCFunction,
-	args map[RequestArgument]interface{}) (interface{}, error) {
+func (c *Client) SendStream(node string, ctrl map[string]string, in io.Reader, out io.Writer) error {
 
-	var err error
+	c.maplock.Lock()
+	laddr, ok := c.peers[node]
+	c.maplock.Unlock()
 
-	// Function to categorize errors
+	if !ok {
+		return fmt.Errorf("Unknown peer: %v", node)
+	}
 
-	handleError := func(err error) error {
+	nconn, err := c.dial(node, laddr, "Stream")
+	if err != nil {
+		return err
+	}
+	defer nconn.Close()
 
-		if _, ok := err.(net.Error); ok {
-			return &Error{ErrNodeComm, err.Error(), false}
-		}
+	LogDebug(c.token.NodeName, ": ",
+		fmt.Sprintf("> %v.Stream (laddr=%v)", node, laddr))
 
-		// Wrap remote errors in a proper error object
+	// Send the stream header and the stream request
 
-		if err != nil && !strings.HasPrefix(err.Error(), "RufsError: ") {
+	bw := bufio.NewWriter(nconn)
+	br := bufio.NewReader(nconn)
+	token := c.token
 
-			// Check if the error is known to report that a file or directory
-			// does not exist.
+	if c.LegacyTokens {
+		bw.WriteString(legacyStreamMagic)
 
-			err = &Error{ErrRemoteAction, err.Error(), err.Error() == os.ErrNotExist.Error()}
+	} else {
+		var nonce string
+
+		// Answer the challenge of the node in the stream request
+
+		bw.WriteString(streamMagic)
+
+		if err = bw.Flush(); err == nil {
+			nonce, err = br.ReadString('\n')
 		}
 
-		return err
+		if err != nil {
+			return categorizeError(err)
+		}
+
+		nonce = strings.TrimSpace(nonce)
+		token = &RufsNodeToken{c.token.NodeName, authResponse(c.secret, nonce, node, c.token.NodeName)}
 	}
 
-	c.maplock.Lock()
-	laddr, ok := c.peers[node]
-	c.maplock.Unlock()
+	if err = gob.NewEncoder(bw).Encode(&streamRequest{node, token, ctrl}); err == nil {
+		err = bw.Flush()
+	}
 
-	if ok {
+	if err != nil {
+		return categorizeError(err)
+	}
 
-		// Get network connection to the node
+	// Send the input data in a separate go routine
 
-		c.maplock.Lock()
-		conn, ok := c.conns[node]
-		c.maplock.Unlock()
+	errc := make(chan error, 1)
 
-		if !ok {
+	go func() {
+		var err error
 
-			// Create a new connection if necessary
+		sw := &streamWriter{bw}
 
-			nconn, err := net.DialTimeout("tcp", laddr, DialTimeout)
+		if in != nil {
+			_, err = io.Copy(sw, in)
+		}
 
-			if err != nil {
-				LogDebug(c.token.NodeName, ": ",
-					fmt.Sprintf("- %v.%v (laddr=%v err=%v)",
-						node, remoteCall, laddr, err))
-				return nil, handleError(err)
-			}
+		if err != nil {
+			sw.CloseWithError(err)
+		} else {
+			err = sw.Close()
+		}
 
-			if c.cert != nil && c.cert.Certificate[0] != nil {
+		errc <- err
+	}()
 
-				// Wrap the conn in a TLS client
+	if out == nil {
+		out = ioutil.Discard
+	}
 
-				config := tls.Config{
-					Certificates:       []tls.Certificate{*c.cert},
-					InsecureSkipVerify: true,
-				}
+	// Read the output data until the node signals the end of the stream
 
-				tlsconn := tls.Client(nconn, &config)
+	_, err = io.Copy(out, &streamReader{r: br})
 
-				// Do the handshake and look at the server certificate
+	if err == nil {
 
-				tlsconn.Handshake()
-				rfp := fingerprint(tlsconn.ConnectionState().PeerCertificates[0].Raw)
+		// The node has consumed all input data - wait for the sender to finish
 
-				c.maplock.Lock()
-				expected, _ := c.fingerprints[node]
-				c.maplock.Unlock()
+		err = <-errc
+	}
 
-				if expected == "" {
+	LogDebug(c.token.NodeName, ": ",
+		fmt.Sprintf("< %v.Stream (err=%v)", node, err))
 
-					// Accept the certificate and store it
+	return categorizeError(err)
+}
 
-					c.maplock.Lock()
-					c.fingerprints[node] = rfp
-					c.maplock.Unlock()
+/*
+SendRequest sends a request to another node.
+*/
+func (c *Client) SendRequest(node string, remoteCall RPCFunction,
+	args map[RequestArgument]interface{}) (interface{}, error) {
 
-				} else if expected != rfp {
+	var err error
 
-					// Fingerprint was NOT verified
+	c.maplock.Lock()
+	laddr, ok := c.peers[node]
+	c.maplock.Unlock()
 
-					LogDebug(c.token.NodeName, ": ",
-						fmt.Sprintf("Not trusting %v (laddr=%v) presented fingerprint: %v expected fingerprint: %v", node, laddr, rfp, expected))
+	if ok {
 
-					return nil, &Error{ErrUntrustedTarget, node, false}
-				}
+		// Get network connection to the node
+
+		c.maplock.Lock()
+		conn, ok := c.conns[node]
+		c.maplock.Unlock()
 
-				LogDebug(c.token.NodeName, ": ",
-					fmt.Sprintf("%v (laddr=%v) has SSL fingerprint %v ", node, laddr, rfp))
+		if !ok {
 
-				nconn = tlsconn
+			// Create a new connection if necessary
+
+			nconn, err := c.dial(node, laddr, string(remoteCall))
+			if err != nil {
+				return nil, err
 			}
 
 			conn = rpc.NewClient(nconn)
 
+			// Establish a session for the connection
+
+			if !c.LegacyTokens {
+				if err = c.authenticate(conn, node); err != nil {
+					conn.Close()
+					return nil, categorizeError(err)
+				}
+			}
+
 			// Store the connection so it can be reused
 
 			c.maplock.Lock()
@@ -315,7 +365,7 @@ func (c *Client) SendRequest(node string, remoteCall RPCFunction,
 
 		request := map[RequestArgument]interface{}{
 			RequestTARGET: node,
-			RequestTOKEN:  c.token,
+			RequestTOKEN:  c.requestToken(),
 		}
 
 		if args != nil {
@@ -352,8 +402,141 @@ func (c *Client) SendRequest(node string, remoteCall RPCFunction,
 		LogDebug(c.token.NodeName, ": ",
 			fmt.Sprintf("< %v.%v (err=%v)", node, remoteCall, err))
 
-		return response, handleError(err)
+		return response, categorizeError(err)
+	}
+
+	return nil, &Error{ErrUnknownTarget, node, false, false}
+}
+
+/*
+authenticate authenticates the client on a new connection to a given node by
+answering a challenge of the node.
+*/
+func (c *Client) authenticate(conn *rpc.Client, node string) error {
+	var nonce, response interface{}
+
+	err := conn.Call("RufsServer."+string(RPCChallenge), map[RequestArgument]interface{}{
+		RequestTARGET: node,
+		RequestTOKEN:  c.requestToken(),
+	}, &nonce)
+
+	if err == nil {
+		err = conn.Call("RufsServer."+string(RPCAuthenticate), map[RequestArgument]interface{}{
+			RequestTARGET: node,
+			RequestTOKEN: &RufsNodeToken{c.token.NodeName,
+				authResponse(c.secret, fmt.Sprint(nonce), node, c.token.NodeName)},
+		}, &response)
+	}
+
+	LogDebug(c.token.NodeName, ": ",
+		fmt.Sprintf("- %v.%v (err=%v)", node, RPCAuthenticate, err))
+
+	return err
+}
+
+/*
+requestToken returns the token which is sent with each request. The static
+token is only sent in legacy mode - otherwise the token only identifies the
+client and the node relies on the session of the connection.
+*/
+func (c *Client) requestToken() *RufsNodeToken {
+	if c.LegacyTokens {
+		return c.token
+	}
+	return &RufsNodeToken{c.token.NodeName, ""}
+}
+
+/*
+dial creates a new network connection to a given node. The connection is
+wrapped in a TLS client if the client has a certificate. The presented
+server certificate is checked against the expected fingerprint.
+*/
+func (c *Client) dial(node string, laddr string, remoteCall string) (net.Conn, error) {
+
+	nconn, err := net.DialTimeout("tcp", laddr, DialTimeout)
+
+	if err != nil {
+		LogDebug(c.token.NodeName, ": ",
+			fmt.Sprintf("- %v.%v (laddr=%v err=%v)",
+				node, remoteCall, laddr, err))
+		return nil, categorizeError(err)
+	}
+
+	if c.cert != nil && c.cert.Certificate[0] != nil {
+
+		// Wrap the conn in a TLS client
+
+		config := tls.Config{
+			Certificates:       []tls.Certificate{*c.cert},
+			InsecureSkipVerify: true,
+		}
+
+		tlsconn := tls.Client(nconn, &config)
+
+		// Do the handshake and look at the server certificate
+
+		if err = tlsconn.Handshake(); err != nil {
+			LogDebug(c.token.NodeName, ": ",
+				fmt.Sprintf("- %v.%v (laddr=%v handshake err=%v)",
+					node, remoteCall, laddr, err))
+			nconn.Close()
+			return nil, &Error{ErrNodeComm, err.Error(), false, false}
+		}
+
+		rfp := fingerprint(tlsconn.ConnectionState().PeerCertificates[0].Raw)
+
+		c.maplock.Lock()
+		expected, _ := c.fingerprints[node]
+		c.maplock.Unlock()
+
+		if expected == "" {
+
+			// Accept the certificate and store it
+
+			c.maplock.Lock()
+			c.fingerprints[node] = rfp
+			c.maplock.Unlock()
+
+		} else if expected != rfp {
+
+			// Fingerprint was NOT verified
+
+			LogDebug(c.token.NodeName, ": ",
+				fmt.Sprintf("Not trusting %v (laddr=%v) presented fingerprint: %v expected fingerprint: %v", node, laddr, rfp, expected))
+
+			nconn.Close()
+
+			return nil, &Error{ErrUntrustedTarget, node, false, false}
+		}
+
+		LogDebug(c.token.NodeName, ": ",
+			fmt.Sprintf("%v (laddr=%v) has SSL fingerprint %v ", node, laddr, rfp))
+
+		nconn = tlsconn
+	}
+
+	return nconn, nil
+}
+
+/*
+categorizeError wraps a given error in a proper error object.
+*/
+func categorizeError(err error) error {
+
+	if _, ok := err.(net.Error); ok {
+		return &Error{ErrNodeComm, err.Error(), false, false}
+	}
+
+	// Wrap remote errors in a proper error object
+
+	if err != nil && !strings.HasPrefix(err.Error(), "RufsError: ") {
+
+		// Check if the error is known to report that a file or directory
+		// does not exist or that the data is read-only.
+
+		err = &Error{ErrRemoteAction, err.Error(), err.Error() == os.ErrNotExist.Error(),
+			isReadOnlyError(err.Error())}
 	}
 
-	return nil, &Error{ErrUnknownTarget, node, false}
+	return err
 }
@@ -51,6 +51,7 @@ type Error struct {
 	Type       error  // Error type (to be used for equal checks)
 	Detail     string // Details of this error
 	IsNotExist bool   // Error is file or directory does not exist
+	IsReadOnly bool   // Error is a write operation on read-only data
 }
 
 /*
@@ -73,4 +74,34 @@ var (
 	ErrUnknownTarget   = errors.New("Unknown target node")
 	ErrUntrustedTarget = errors.New("Unexpected SSL certificate from target node")
 	ErrInvalidToken    = errors.New("Invalid node token")
+	ErrUntrustedClient = errors.New("Client certificate is not authorized")
 )
+
+/*
+ReadOnlyError is returned by a remote action if a write operation is requested
+on read-only data.
+*/
+type ReadOnlyError struct {
+	Name string // Name of the read-only branch
+}
+
+/*
+Error returns a human-readable string representation of this error.
+*/
+func (re *ReadOnlyError) Error() string {
+	return fmt.Sprintf("Branch %v is read-only", re.Name)
+}
+
+/*
+isReadOnlyError checks if a given error message was produced by a
+ReadOnlyError.
+*/
+func isReadOnlyError(msg string) bool {
+	var name string
+
+	if _, err := fmt.Sscanf(msg, "Branch %s is read-only", &name); err != nil {
+		return false
+	}
+
+	return (&ReadOnlyError{name}).Error() == msg
+}
@@ -11,12 +11,13 @@
 package node
 
 import (
-	"crypto/sha512"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/rpc"
+	"strings"
 	"sync"
+	"time"
 )
 
 /*
@@ -27,26 +28,52 @@ the result or an error.
 */
 type RequestHandler func(ctrl map[string]string, data []byte) ([]byte, error)
 
+/*
+AccessHandler is a function to authorize incoming requests and data streams.
+It gets the name of the requesting node (as given during its authentication) and
+the control object of the request. The request is rejected if the handler
+returns an error.
+*/
+type AccessHandler func(source string, ctrl map[string]string) error
+
+/*
+Secret is a secret which is accepted by a node. A secret without an expiry
+date is valid forever.
+*/
+type Secret struct {
+	Value   string    // Secret string
+	Expires time.Time // Time after which the secret is no longer accepted
+}
+
 /*
 RufsNode is the management object for a node in the Rufs network.
 
 A RufsNode registers itself to the rpc server which is the global
 server object. Each node needs to have a unique name. Communication between nodes
-is secured by using a secret string which is never exchanged over the network
-and a hash generated token which identifies a member.
+is secured by using a secret string which is never exchanged over the network.
+A client authenticates itself once per connection by answering a random
+challenge of the target node with a HMAC of the challenge (keyed with the
+secret). Older clients identify themselves with a static hash generated token
+which is only accepted if AcceptLegacyTokens is set. A node can accept several
+secrets at the same time so secrets can be changed without downtime.
 
 Each RufsNode object contains a Client object which can be used to communicate
 with other nodes. This object should be used by pure clients - code which should
 communicate with the cluster without running an actual member.
 */
 type RufsNode struct {
-	name        string           // Name of the node
-	secret      string           // Network wide secret
-	Client      *Client          // RPC client object
-	listener    net.Listener     // RPC server listener
-	wg          sync.WaitGroup   // RPC server Waitgroup for listener shutdown
-	DataHandler RequestHandler   // Handler function for data requests
-	cert        *tls.Certificate // Node certificate
+	name          string           // Name of the node
+	secrets       []Secret         // Accepted network wide secrets
+	Client        *Client          // RPC client object
+	listener      *nodeListener    // RPC server listener
+	DataHandler   RequestHandler   // Handler function for data requests
+	StreamHandler StreamHandler    // Handler function for data streams
+	AccessHandler AccessHandler    // Handler function for access checks
+	cert          *tls.Certificate // Node certificate
+	clientFPs     map[string]bool  // Authorized client certificate fingerprints (nil if not required)
+	authLock      *sync.RWMutex    // Lock for secrets and authorized client certificate fingerprints
+
+	AcceptLegacyTokens bool // Accept static tokens from clients which do not support challenges
 }
 
 /*
@@ -57,11 +84,11 @@ func NewNode(rpcInterface string, name string, secret string, clientCert *tls.Ce
 
 	// Generate node token
 
-	token := &RufsNodeToken{name, fmt.Sprintf("%X", sha512.Sum512_224([]byte(name+secret)))}
+	token := &RufsNodeToken{name, legacyToken(name, secret)}
 
-	rn := &RufsNode{name, secret, &Client{token, rpcInterface, make(map[string]string),
-		make(map[string]*rpc.Client), make(map[string]string), clientCert, &sync.RWMutex{}, false},
-		nil, sync.WaitGroup{}, dataHandler, clientCert}
+	rn := &RufsNode{name, []Secret{{secret, time.Time{}}}, &Client{token, secret, rpcInterface, make(map[string]string),
+		make(map[string]*rpc.Client), make(map[string]string), clientCert, &sync.RWMutex{}, false, false},
+		nil, dataHandler, nil, nil, clientCert, nil, &sync.RWMutex{}, false}
 
 	return rn
 }
@@ -70,7 +97,15 @@ func NewNode(rpcInterface string, name string, secret string, clientCert *tls.Ce
 NewClient create a new Client object.
 */
 func NewClient(secret string, clientCert *tls.Certificate) *Client {
-	return NewNode("", "", secret, clientCert, nil).Client
+	return NewNamedClient("", secret, clientCert)
+}
+
+/*
+NewNamedClient create a new Client object which identifies itself with a
+given name. Remote nodes can use the name for access checks.
+*/
+func NewNamedClient(name string, secret string, clientCert *tls.Certificate) *Client {
+	return NewNode("", name, secret, clientCert, nil).Client
 }
 
 // General node API
@@ -94,6 +129,89 @@ func (rn *RufsNode) SSLFingerprint() string {
 	return ret
 }
 
+/*
+RequireClientCerts lets the node only accept requests from clients which
+present a certificate with one of the given fingerprints. The rpc server of
+the node requires client certificates if this is called before Start. It can
+be called again at any time to change the authorized fingerprints (e.g. to
+revoke a client).
+*/
+func (rn *RufsNode) RequireClientCerts(fingerprints []string) {
+	fps := make(map[string]bool)
+
+	for _, fp := range fingerprints {
+		fps[strings.ToLower(strings.TrimSpace(fp))] = true
+	}
+
+	rn.authLock.Lock()
+	rn.clientFPs = fps
+	rn.authLock.Unlock()
+}
+
+/*
+RequiresClientCerts returns if the node requires client certificates.
+*/
+func (rn *RufsNode) RequiresClientCerts() bool {
+	rn.authLock.RLock()
+	defer rn.authLock.RUnlock()
+
+	return rn.clientFPs != nil
+}
+
+/*
+SetSecrets sets the secrets which are accepted by this node. It can be called
+at any time - established sessions end once their secret is no longer
+accepted. The node's own client keeps using the secret given on creation.
+*/
+func (rn *RufsNode) SetSecrets(secrets []Secret) {
+	rn.authLock.Lock()
+	rn.secrets = append([]Secret{}, secrets...)
+	rn.authLock.Unlock()
+}
+
+/*
+acceptedSecrets returns all secrets which are currently accepted by this node.
+*/
+func (rn *RufsNode) acceptedSecrets() []string {
+	var ret []string
+
+	now := time.Now()
+
+	rn.authLock.RLock()
+	defer rn.authLock.RUnlock()
+
+	for _, secret := range rn.secrets {
+		if secret.Expires.IsZero() || now.Before(secret.Expires) {
+			ret = append(ret, secret.Value)
+		}
+	}
+
+	return ret
+}
+
+/*
+acceptsSecret checks if a given secret is currently accepted by this node.
+*/
+func (rn *RufsNode) acceptsSecret(secret string) bool {
+	for _, s := range rn.acceptedSecrets() {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+isAuthorizedClient checks if a client with a given certificate fingerprint is
+allowed to send requests to this node.
+*/
+func (rn *RufsNode) isAuthorizedClient(fingerprint string) bool {
+	rn.authLock.RLock()
+	defer rn.authLock.RUnlock()
+
+	return rn.clientFPs == nil || (fingerprint != "" && rn.clientFPs[fingerprint])
+}
+
 /*
 LogInfo logs a node related message at info level.
 */
@@ -102,7 +220,11 @@ func (rn *RufsNode) LogInfo(v ...interface{}) {
 }
 
 /*
-Start starts process for this node.
+Start starts process for this node. Nodes which use the same rpc interface
+share one rpc server - the server certificate of the first node is used in
+this case. The rpc server requires client certificates if the node requires
+them (see RequireClientCerts). Nodes which share an rpc server must agree on
+this.
 */
 func (rn *RufsNode) Start(serverCert *tls.Certificate) error {
 
@@ -110,33 +232,47 @@ func (rn *RufsNode) Start(serverCert *tls.Certificate) error {
 		return fmt.Errorf("Cannot start node %s twice", rn.name)
 	}
 
-	rn.LogInfo("Starting node ", rn.name, " rpc server on: ", rn.Client.rpc)
+	rn.authLock.RLock()
+	clientAuth := rn.clientFPs != nil
+	rn.authLock.RUnlock()
 
-	l, err := net.Listen("tcp", rn.Client.rpc)
-	if err != nil {
-		return err
-	}
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
 
-	if serverCert != nil && serverCert.Certificate[0] != nil {
-		rn.cert = serverCert
+	l, ok := listeners[rn.Client.rpc]
 
-		rn.LogInfo("SSL fingerprint: ", rn.SSLFingerprint())
+	if !ok {
+		var err error
 
-		// Wrap the listener in a TLS listener
+		rn.LogInfo("Starting node ", rn.name, " rpc server on: ", rn.Client.rpc)
 
-		config := tls.Config{Certificates: []tls.Certificate{*serverCert}}
+		if clientAuth && (serverCert == nil || serverCert.Certificate[0] == nil) {
+			return fmt.Errorf("Node %s requires client certificates but has no server certificate", rn.name)
+		}
 
-		l = tls.NewListener(l, &config)
+		if l, err = newNodeListener(rn.Client.rpc, serverCert, clientAuth); err != nil {
+			return err
+		}
+
+		listeners[rn.Client.rpc] = l
+
+	} else if l.clientAuth != clientAuth {
+
+		return fmt.Errorf("Node %s cannot share the rpc server on %s (client certificate requirements differ)",
+			rn.name, rn.Client.rpc)
+
+	} else {
+
+		rn.LogInfo("Starting node ", rn.name, " using rpc server on: ", rn.Client.rpc)
 	}
 
-	// Kick of the rpc listener
+	if l.cert != nil {
+		rn.cert = l.cert
 
-	go func() {
-		rpc.Accept(l)
-		rn.wg.Done()
-		rn.LogInfo("Connection closed: ", rn.Client.rpc)
-	}()
+		rn.LogInfo("SSL fingerprint: ", rn.SSLFingerprint())
+	}
 
+	l.refs++
 	rn.listener = l
 
 	// Register this node in the global server map
@@ -148,23 +284,109 @@ func (rn *RufsNode) Start(serverCert *tls.Certificate) error {
 
 /*
 Shutdown shuts the member manager rpc server for this cluster member down.
+The rpc server keeps running as long as other nodes are using it.
 */
 func (rn *RufsNode) Shutdown() error {
 	var err error
 
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
 	// Close socket
 
 	if rn.listener != nil {
-		rn.LogInfo("Shutdown rpc server on: ", rn.Client.rpc)
-		rn.wg.Add(1)
-		err = rn.listener.Close()
+		rn.LogInfo("Shutdown node on: ", rn.Client.rpc)
 		rn.Client.Shutdown()
-		rn.listener = nil
-		rn.wg.Wait()
 		delete(rufsServer.nodes, rn.name)
+
+		if rn.listener.refs--; rn.listener.refs == 0 {
+			rn.LogInfo("Shutdown rpc server on: ", rn.Client.rpc)
+			delete(listeners, rn.Client.rpc)
+			err = rn.listener.Close()
+			rn.listener.wg.Wait()
+		}
+
+		rn.listener = nil
+
 	} else {
 		LogDebug("Node ", rn.name, " already shut down")
 	}
 
 	return err
 }
+
+/*
+listeners contains all running rpc servers by their rpc interface
+*/
+var listeners = make(map[string]*nodeListener)
+
+/*
+listenersLock protects the listeners map
+*/
+var listenersLock = &sync.Mutex{}
+
+/*
+nodeListener is a rpc server listener which can be shared by several nodes.
+*/
+type nodeListener struct {
+	net.Listener
+	cert       *tls.Certificate // Server certificate
+	clientAuth bool             // Flag if client certificates are required
+	refs       int              // Number of nodes using this listener
+	wg         sync.WaitGroup   // Waitgroup for listener shutdown
+}
+
+/*
+newNodeListener creates a new listener on a given rpc interface and starts
+accepting connections. Client certificates are pinned by their fingerprint
+(like server certificates) as they are usually self-signed. The TLS layer
+only makes sure that a client owns the certificate it presents - the nodes
+check the fingerprint of the certificate for each request.
+*/
+func newNodeListener(rpcInterface string, serverCert *tls.Certificate, clientAuth bool) (*nodeListener, error) {
+
+	l, err := net.Listen("tcp", rpcInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverCert != nil && serverCert.Certificate[0] != nil {
+
+		// Wrap the listener in a TLS listener
+
+		config := tls.Config{Certificates: []tls.Certificate{*serverCert}}
+
+		if clientAuth {
+			config.ClientAuth = tls.RequireAnyClientCert
+		}
+
+		l = tls.NewListener(l, &config)
+
+	} else {
+
+		serverCert = nil
+	}
+
+	nl := &nodeListener{l, serverCert, clientAuth, 0, sync.WaitGroup{}}
+
+	// Kick of the rpc listener
+
+	nl.wg.Add(1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+
+			// Connections are either used for RPC calls or data streams
+
+			go serveConn(conn)
+		}
+		nl.wg.Done()
+		LogInfo("Connection closed: ", rpcInterface)
+	}()
+
+	return nl, nil
+}
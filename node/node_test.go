@@ -11,6 +11,7 @@
 package node
 
 import (
+	"bytes"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -368,7 +370,7 @@ func Test2NodeNetwork(t *testing.T) {
 	}
 
 	nnet2[1].DataHandler = func(ctrl map[string]string, data []byte) ([]byte, error) {
-		return nil, &Error{ErrNodeComm, "Testerror2", false}
+		return nil, &Error{ErrNodeComm, "Testerror2", false, false}
 	}
 
 	datares, err = nnet2[0].Client.SendData(nnet2[1].name, nil, []byte("testmsg"))
@@ -377,6 +379,36 @@ func Test2NodeNetwork(t *testing.T) {
 		t.Error("Unexpected result: ", dataReceived, datares, err)
 		return
 	}
+
+	// Check access handler
+
+	var sourceReceived string
+
+	nnet2[1].AccessHandler = func(source string, ctrl map[string]string) error {
+		sourceReceived = source
+		if ctrl["foo"] == "bar" {
+			return nil
+		}
+		return fmt.Errorf("Access denied")
+	}
+
+	datares, err = nnet2[0].Client.SendData(nnet2[1].name, nil, []byte("testmsg"))
+
+	if err == nil || err.Error() != "RufsError: Remote error (Access denied)" || sourceReceived != nnet2[0].name {
+		t.Error("Unexpected result: ", sourceReceived, datares, err)
+		return
+	}
+
+	datares, err = nnet2[0].Client.SendData(nnet2[1].name, map[string]string{
+		"foo": "bar",
+	}, []byte("testmsg"))
+
+	if err == nil || err.Error() != "RufsError: Network error (Testerror2)" {
+		t.Error("Unexpected result: ", datares, err)
+		return
+	}
+
+	nnet2[1].AccessHandler = nil
 }
 
 func TestNodeErrors(t *testing.T) {
@@ -403,9 +435,9 @@ func TestNodeErrors(t *testing.T) {
 		return
 	}
 
-	// Now corrupt the token of the Client
+	// Now corrupt the secret of the Client
 
-	cl.token.NodeAuth = "123"
+	cl.secret = "123"
 
 	_, _, err = cl.SendPing("TestNode", fmt.Sprintf("localhost:%v", 9019))
 
@@ -439,3 +471,514 @@ func TestNodeErrors(t *testing.T) {
 		return
 	}
 }
+
+func TestReadOnlyError(t *testing.T) {
+
+	err := categorizeError(&ReadOnlyError{"footest"})
+
+	if rerr, ok := err.(*Error); !ok || !rerr.IsReadOnly || rerr.IsNotExist ||
+		err.Error() != "RufsError: Remote error (Branch footest is read-only)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	for _, msg := range []string{"foo is read-only", "Branch foo bar is read-only", "Branch foo is read-only!"} {
+		if rerr := categorizeError(fmt.Errorf(msg)).(*Error); rerr.IsReadOnly {
+			t.Error("Unexpected result:", msg)
+			return
+		}
+	}
+}
+
+func TestSharedListener(t *testing.T) {
+	nnet2 := createNodeNetwork(2)
+
+	// Start a third node on the same interface as the second node
+
+	n3 := NewNode(nnet2[1].Client.rpc, "TestNode-3", "test123", nnet2[1].Client.cert, nil)
+
+	nnet2[0].Start(nnet2[0].Client.cert)
+	nnet2[1].Start(nnet2[1].Client.cert)
+	defer nnet2[0].Shutdown()
+	defer nnet2[1].Shutdown()
+
+	if err := n3.Start(nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n3.SSLFingerprint() != nnet2[1].SSLFingerprint() {
+		t.Error("Unexpected result:", n3.SSLFingerprint(), nnet2[1].SSLFingerprint())
+		return
+	}
+
+	res, _, err := nnet2[0].Client.SendPing(n3.name, n3.Client.rpc)
+
+	if fmt.Sprint(res) != "[Pong]" || err != nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Shutting down the second node should not affect the third node
+
+	nnet2[1].Shutdown()
+
+	nnet2[0].Client.Shutdown()
+
+	res, _, err = nnet2[0].Client.SendPing(n3.name, n3.Client.rpc)
+
+	if fmt.Sprint(res) != "[Pong]" || err != nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	res, _, err = nnet2[0].Client.SendPing(nnet2[1].name, n3.Client.rpc)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Unknown target node)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if err := n3.Shutdown(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	nnet2[0].Client.Shutdown()
+
+	res, _, err = nnet2[0].Client.SendPing(n3.name, n3.Client.rpc)
+
+	if err == nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+}
+
+func TestStream(t *testing.T) {
+
+	// Debug logging
+
+	// liveOutput = true
+	// LogDebug = LogInfo
+	// defer func() { liveOutput = false }()
+
+	nnet2 := createNodeNetwork(2)
+
+	nnet2[0].Start(nnet2[0].Client.cert) // Start the server with the client certificate
+	nnet2[1].Start(nnet2[1].Client.cert) // Start the server with the client certificate
+	defer nnet2[0].Shutdown()
+	defer nnet2[1].Shutdown()
+
+	nnet2[0].Client.RegisterPeer(nnet2[1].name, nnet2[1].Client.rpc, nnet2[1].SSLFingerprint())
+
+	err := nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{}, nil, nil)
+	if err == nil || err.Error() != "RufsError: Remote error (Node TestNode-1 does not support data streams)" {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+
+	// Make frames very small
+
+	oldMaxStreamFrameSize := MaxStreamFrameSize
+	defer func() {
+		MaxStreamFrameSize = oldMaxStreamFrameSize
+	}()
+	MaxStreamFrameSize = 3
+
+	var ctrlReceived map[string]string
+	var dataReceived bytes.Buffer
+
+	nnet2[1].StreamHandler = func(ctrl map[string]string, in io.Reader, out io.Writer) error {
+		ctrlReceived = ctrl
+
+		if ctrl["op"] == "pull" {
+			_, err := out.Write([]byte("testdata from node"))
+			return err
+		} else if ctrl["op"] == "push" {
+			_, err := io.Copy(&dataReceived, in)
+			return err
+		}
+
+		out.Write([]byte("partial"))
+
+		return fmt.Errorf("Testerror")
+	}
+
+	// Pull data
+
+	var out bytes.Buffer
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "pull",
+	}, nil, &out)
+
+	if err != nil || out.String() != "testdata from node" || fmt.Sprint(ctrlReceived) != "map[op:pull]" {
+		t.Error("Unexpected result: ", out.String(), ctrlReceived, err)
+		return
+	}
+
+	// Push data
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "push",
+	}, bytes.NewBufferString("testdata to node"), nil)
+
+	if err != nil || dataReceived.String() != "testdata to node" {
+		t.Error("Unexpected result: ", dataReceived.String(), err)
+		return
+	}
+
+	// Errors are reported after any data which was already sent
+
+	out.Reset()
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "fail",
+	}, nil, &out)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Testerror)" || out.String() != "partial" {
+		t.Error("Unexpected result: ", out.String(), err)
+		return
+	}
+
+	// Local errors are transferred to the node
+
+	dataReceived.Reset()
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.Write([]byte("abc"))
+		pw.CloseWithError(fmt.Errorf("Localerror"))
+	}()
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "push",
+	}, pr, nil)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Localerror)" || dataReceived.String() != "abc" {
+		t.Error("Unexpected result: ", dataReceived.String(), err)
+		return
+	}
+
+	// Check access handler
+
+	var sourceReceived string
+
+	nnet2[1].AccessHandler = func(source string, ctrl map[string]string) error {
+		sourceReceived = source
+		return fmt.Errorf("Access denied")
+	}
+
+	out.Reset()
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "pull",
+	}, nil, &out)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Access denied)" ||
+		out.String() != "" || sourceReceived != nnet2[0].name {
+		t.Error("Unexpected result: ", out.String(), sourceReceived, err)
+		return
+	}
+
+	nnet2[1].AccessHandler = nil
+
+	// Check authentication
+
+	nnet2[0].Client.secret = "123"
+
+	err = nnet2[0].Client.SendStream(nnet2[1].name, map[string]string{
+		"op": "pull",
+	}, nil, &out)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+
+	if err := nnet2[0].Client.SendStream("foo", nil, nil, nil); err == nil || err.Error() != "Unknown peer: foo" {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	nnet := createNodeNetwork(3)
+
+	// The second node only accepts the client certificate of the first node
+
+	nnet[1].RequireClientCerts([]string{strings.ToUpper(nnet[0].Client.SSLFingerprint())})
+
+	if err := nnet[1].Start(nnet[1].Client.cert); err != nil {
+		t.Error(err)
+		return
+	}
+	defer nnet[1].Shutdown()
+
+	nnet[1].StreamHandler = func(ctrl map[string]string, in io.Reader, out io.Writer) error {
+		_, err := out.Write([]byte("testdata from node"))
+		return err
+	}
+
+	res, _, err := nnet[0].Client.SendPing(nnet[1].name, nnet[1].Client.rpc)
+
+	if fmt.Sprint(res) != "[Pong]" || err != nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// The third node knows the secret but has an unknown certificate
+
+	res, _, err = nnet[2].Client.SendPing(nnet[1].name, nnet[1].Client.rpc)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Client certificate is not authorized)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	nnet[2].Client.RegisterPeer(nnet[1].name, nnet[1].Client.rpc, "")
+
+	var out bytes.Buffer
+
+	err = nnet[2].Client.SendStream(nnet[1].name, map[string]string{}, nil, &out)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Client certificate is not authorized)" || out.String() != "" {
+		t.Error("Unexpected result:", out.String(), err)
+		return
+	}
+
+	// Connections without a client certificate are refused
+
+	conn, err := tls.Dial("tcp", nnet[1].Client.rpc, &tls.Config{InsecureSkipVerify: true})
+
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	if err == nil {
+		t.Error("Connection without client certificate was accepted")
+		return
+	}
+
+	// Revoke the first client and authorize the third
+
+	nnet[1].RequireClientCerts([]string{nnet[2].Client.SSLFingerprint()})
+
+	res, _, err = nnet[0].Client.SendPing(nnet[1].name, nnet[1].Client.rpc)
+
+	if err == nil || err.Error() != "RufsError: Remote error (Client certificate is not authorized)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if err = nnet[2].Client.SendStream(nnet[1].name, map[string]string{}, nil, &out); err != nil ||
+		out.String() != "testdata from node" {
+		t.Error("Unexpected result:", out.String(), err)
+		return
+	}
+
+	// Test error cases
+
+	n3 := NewNode(nnet[1].Client.rpc, "TestNode-3", "test123", nnet[1].Client.cert, nil)
+
+	if err := n3.Start(nil); err == nil ||
+		err.Error() != "Node TestNode-3 cannot share the rpc server on localhost:9021 (client certificate requirements differ)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	n4 := NewNode("localhost:9029", "TestNode-4", "test123", nil, nil)
+	n4.RequireClientCerts(nil)
+
+	if err := n4.Start(nil); err == nil ||
+		err.Error() != "Node TestNode-4 requires client certificates but has no server certificate" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestChallengeAuth(t *testing.T) {
+	nnet2 := createNodeNetwork(2)
+
+	nnet2[0].Start(nnet2[0].Client.cert)
+	nnet2[1].Start(nnet2[1].Client.cert)
+	defer nnet2[0].Shutdown()
+	defer nnet2[1].Shutdown()
+
+	var sourceReceived string
+
+	nnet2[1].DataHandler = func(ctrl map[string]string, data []byte) ([]byte, error) {
+		return []byte("testdata"), nil
+	}
+
+	nnet2[1].AccessHandler = func(source string, ctrl map[string]string) error {
+		sourceReceived = source
+		return nil
+	}
+
+	nnet2[1].StreamHandler = func(ctrl map[string]string, in io.Reader, out io.Writer) error {
+		_, err := out.Write([]byte("testdata from node"))
+		return err
+	}
+
+	nnet2[0].Client.RegisterPeer(nnet2[1].name, nnet2[1].Client.rpc, nnet2[1].SSLFingerprint())
+
+	if res, err := nnet2[0].Client.SendData(nnet2[1].name, map[string]string{}, nil); err != nil ||
+		string(res) != "testdata" || sourceReceived != nnet2[0].name {
+		t.Error("Unexpected result:", string(res), sourceReceived, err)
+		return
+	}
+
+	// The name of the requesting node is taken from the session
+
+	nnet2[0].Client.token.NodeName = "mallory"
+
+	if res, err := nnet2[0].Client.SendData(nnet2[1].name, map[string]string{}, nil); err != nil ||
+		string(res) != "testdata" || sourceReceived != nnet2[0].name {
+		t.Error("Unexpected result:", string(res), sourceReceived, err)
+		return
+	}
+
+	nnet2[0].Client.token.NodeName = nnet2[0].name
+
+	// A response to a challenge can only be used once
+
+	server := newRufsServer(rufsServer.nodes, "")
+	nonce := server.challenge()
+	token := &RufsNodeToken{"foo", authResponse("test123", nonce, nnet2[1].name, "foo")}
+
+	if err := server.authenticate(nnet2[1].name, token); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := server.authenticate(nnet2[1].name, token); err != ErrInvalidToken {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	server = newRufsServer(rufsServer.nodes, "")
+	server.challenge()
+
+	if err := server.authenticate(nnet2[1].name, token); err != ErrInvalidToken {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := server.authenticate("foo", token); err != ErrUnknownTarget {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Static tokens are only accepted in compatibility mode
+
+	cl := NewNamedClient("legacy", "test123", nnet2[0].Client.cert)
+	cl.LegacyTokens = true
+	cl.RegisterPeer(nnet2[1].name, nnet2[1].Client.rpc, "")
+
+	if _, err := cl.SendData(nnet2[1].name, map[string]string{}, nil); err == nil ||
+		err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := cl.SendStream(nnet2[1].name, map[string]string{}, nil, nil); err == nil ||
+		err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	nnet2[1].AcceptLegacyTokens = true
+
+	if res, err := cl.SendData(nnet2[1].name, map[string]string{}, nil); err != nil ||
+		string(res) != "testdata" || sourceReceived != "legacy" {
+		t.Error("Unexpected result:", string(res), sourceReceived, err)
+		return
+	}
+
+	var out bytes.Buffer
+
+	if err := cl.SendStream(nnet2[1].name, map[string]string{}, nil, &out); err != nil ||
+		out.String() != "testdata from node" {
+		t.Error("Unexpected result:", out.String(), err)
+		return
+	}
+
+	cl.token.NodeAuth = "123"
+
+	if err := cl.SendStream(nnet2[1].name, map[string]string{}, nil, &out); err == nil ||
+		err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	cl.Shutdown()
+}
+
+func TestSecrets(t *testing.T) {
+	nnet2 := createNodeNetwork(2)
+
+	nnet2[1].Start(nnet2[1].Client.cert)
+	defer nnet2[1].Shutdown()
+
+	nnet2[1].SetSecrets([]Secret{
+		{"test123", time.Time{}},
+		{"new456", time.Now().Add(time.Hour)},
+		{"old789", time.Now().Add(-time.Hour)},
+	})
+
+	ping := func(cl *Client) error {
+		_, _, err := cl.SendPing(nnet2[1].name, nnet2[1].Client.rpc)
+		return err
+	}
+
+	cl1 := NewClient("test123", nnet2[0].Client.cert)
+	cl2 := NewClient("new456", nnet2[0].Client.cert)
+	cl3 := NewClient("old789", nnet2[0].Client.cert)
+
+	cl1.RegisterPeer(nnet2[1].name, nnet2[1].Client.rpc, "")
+	defer cl1.Shutdown()
+
+	if err := ping(cl1); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ping(cl2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ping(cl3); err == nil || err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Static tokens are checked against all accepted secrets
+
+	nnet2[1].AcceptLegacyTokens = true
+	cl2.LegacyTokens = true
+
+	if err := ping(cl2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Sessions end once their secret is no longer accepted
+
+	nnet2[1].SetSecrets([]Secret{
+		{"new456", time.Time{}},
+	})
+
+	if err := ping(cl1); err == nil || err.Error() != "RufsError: Remote error (Invalid node token)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := ping(cl2); err != nil {
+		t.Error(err)
+		return
+	}
+}
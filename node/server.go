@@ -12,10 +12,14 @@ package node
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
 	"net/rpc"
+	"sync"
 
 	"devt.de/krotik/common/errorutil"
 )
@@ -24,11 +28,7 @@ func init() {
 
 	// Create singleton Server instance.
 
-	rufsServer = &RufsServer{make(map[string]*RufsNode)}
-
-	// Register the cluster API as RPC server
-
-	errorutil.AssertOk(rpc.Register(rufsServer))
+	rufsServer = newRufsServer(make(map[string]*RufsNode), "")
 }
 
 /*
@@ -42,6 +42,11 @@ in this file.
 */
 const (
 
+	// Authentication functions
+
+	RPCChallenge    RPCFunction = "Challenge"
+	RPCAuthenticate RPCFunction = "Authenticate"
+
 	// General functions
 
 	RPCPing RPCFunction = "Ping"
@@ -69,18 +74,82 @@ const (
 )
 
 /*
-rufsServer is the Server instance which serves rpc calls
+rufsServer is the Server instance which holds all local nodes
 */
 var rufsServer *RufsServer
 
 /*
-RufsServer is the RPC exposed Rufs API of a machine. Server is a singleton and will
-route incoming (authenticated) requests to registered RufsNodes. The calling
-node is referred to as source node and the called node is referred to as
-target node.
+RufsServer is the RPC exposed Rufs API of a machine. Server will route incoming
+(authenticated) requests to registered RufsNodes. The calling node is referred
+to as source node and the called node is referred to as target node. Each
+connection is served by its own Server object which shares the map of local
+nodes with the singleton Server instance.
 */
 type RufsServer struct {
-	nodes map[string]*RufsNode // Map of local RufsNodes
+	nodes    map[string]*RufsNode // Map of local RufsNodes
+	clientFP string               // Fingerprint of the client certificate of the connection
+	lock     *sync.Mutex          // Lock for challenge and sessions
+	nonce    string               // Pending challenge of the connection
+	sessions map[string]*session  // Authenticated sessions by target node
+}
+
+/*
+session is an authenticated session between a source and a target node.
+*/
+type session struct {
+	source string // Name of the source node
+	secret string // Secret which was used for the authentication
+}
+
+/*
+newRufsServer creates a new Server object.
+*/
+func newRufsServer(nodes map[string]*RufsNode, clientFP string) *RufsServer {
+	return &RufsServer{nodes, clientFP, &sync.Mutex{}, "", make(map[string]*session)}
+}
+
+/*
+newRPCServer creates a new rpc server which serves the Rufs API for a single
+connection.
+*/
+func newRPCServer(clientFP string) *rpc.Server {
+	server := rpc.NewServer()
+
+	errorutil.AssertOk(server.Register(newRufsServer(rufsServer.nodes, clientFP)))
+
+	return server
+}
+
+// Authentication functions
+// ========================
+
+/*
+Challenge answers with a random nonce which the client has to use for its
+authentication. Each challenge can only be used once.
+*/
+func (s *RufsServer) Challenge(request map[RequestArgument]interface{},
+	response *interface{}) error {
+
+	if target, _ := request[RequestTARGET].(string); s.nodes[target] == nil {
+		return ErrUnknownTarget
+	}
+
+	*response = s.challenge()
+
+	return nil
+}
+
+/*
+Authenticate establishes a session for the connection if the given client
+token contains the correct response to the last challenge.
+*/
+func (s *RufsServer) Authenticate(request map[RequestArgument]interface{},
+	response *interface{}) error {
+
+	target, _ := request[RequestTARGET].(string)
+	token, _ := request[RequestTOKEN].(*RufsNodeToken)
+
+	return s.authenticate(target, token)
 }
 
 // General functions
@@ -95,7 +164,7 @@ func (s *RufsServer) Ping(request map[RequestArgument]interface{},
 
 	// Verify the given token and retrieve the target member
 
-	if _, err := s.checkToken(request); err != nil {
+	if _, _, err := s.checkToken(request); err != nil {
 		return err
 	}
 
@@ -116,16 +185,25 @@ func (s *RufsServer) Data(request map[RequestArgument]interface{},
 
 	// Verify the given token and retrieve the target member
 
-	node, err := s.checkToken(request)
+	node, source, err := s.checkToken(request)
 
 	if err != nil || node.DataHandler == nil {
 		return err
 	}
 
+	ctrl := request[RequestCTRL].(map[string]string)
+
+	// Check that the requesting node is allowed to make the request
+
+	if node.AccessHandler != nil {
+		if err = node.AccessHandler(source, ctrl); err != nil {
+			return err
+		}
+	}
+
 	// Forward to the registered data handler
 
-	res, err := node.DataHandler(request[RequestCTRL].(map[string]string),
-		request[RequestDATA].([]byte))
+	res, err := node.DataHandler(ctrl, request[RequestDATA].([]byte))
 
 	if err == nil {
 		*response = res
@@ -138,29 +216,144 @@ func (s *RufsServer) Data(request map[RequestArgument]interface{},
 // ================
 
 /*
-checkToken checks the member token in a given request.
+challenge creates a new challenge for the connection. Any previous challenge
+becomes invalid.
 */
-func (s *RufsServer) checkToken(request map[RequestArgument]interface{}) (*RufsNode, error) {
+func (s *RufsServer) challenge() string {
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+	errorutil.AssertOk(err)
+
+	nonce := hex.EncodeToString(buf)
+
+	s.lock.Lock()
+	s.nonce = nonce
+	s.lock.Unlock()
+
+	return nonce
+}
+
+/*
+authenticate verifies the response of a client to the last challenge and
+establishes a session between the client and a given target node. The
+response is checked against all accepted secrets of the target. The
+challenge is consumed by the attempt.
+*/
+func (s *RufsServer) authenticate(target string, token *RufsNodeToken) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	nonce := s.nonce
+	s.nonce = ""
+
+	node, ok := s.nodes[target]
+
+	if !ok {
+		return ErrUnknownTarget
+	} else if token == nil {
+		return ErrInvalidToken
+	}
+
+	if nonce != "" {
+
+		// Check the response against all accepted secrets of the target
+
+		for _, secret := range node.acceptedSecrets() {
+			expectedAuth := authResponse(secret, nonce, target, token.NodeName)
+
+			if hmac.Equal([]byte(token.NodeAuth), []byte(expectedAuth)) {
+				s.sessions[target] = &session{token.NodeName, secret}
+				return nil
+			}
+		}
+	}
+
+	return ErrInvalidToken
+}
+
+/*
+checkToken checks that a request is either part of an authenticated session
+or contains a valid static token (if the target accepts static tokens). Also
+checks the client certificate of the connection. Returns the target member
+and the name of the requesting node.
+*/
+func (s *RufsServer) checkToken(request map[RequestArgument]interface{}) (*RufsNode, string, error) {
 	err := ErrUnknownTarget
 
 	// Get the target member
 
-	target := request[RequestTARGET].(string)
-	token := request[RequestTOKEN].(*RufsNodeToken)
+	target, _ := request[RequestTARGET].(string)
+	token, _ := request[RequestTOKEN].(*RufsNodeToken)
 
 	if node, ok := s.nodes[target]; ok {
 		err = ErrInvalidToken
 
-		// Generate expected auth from given requesting node name in token and secret of target
+		var source string
+
+		s.lock.Lock()
+		sess, ok := s.sessions[target]
 
-		expectedAuth := fmt.Sprintf("%X", sha512.Sum512_224([]byte(token.NodeName+node.secret)))
+		if ok && !node.acceptsSecret(sess.secret) {
 
-		if token.NodeAuth == expectedAuth {
-			return node, nil
+			// The secret of the session is no longer accepted
+
+			delete(s.sessions, target)
+			ok = false
+
+		} else if ok {
+			source = sess.source
+		}
+
+		s.lock.Unlock()
+
+		if !ok && node.AcceptLegacyTokens && token != nil {
+			source = token.NodeName
+
+			// Generate expected auth from given requesting node name in token and secrets of target
+
+			for _, secret := range node.acceptedSecrets() {
+				if ok = hmac.Equal([]byte(token.NodeAuth), []byte(legacyToken(token.NodeName, secret))); ok {
+					break
+				}
+			}
+		}
+
+		if ok {
+
+			// Check the client certificate if the target requires one
+
+			if !node.isAuthorizedClient(s.clientFP) {
+				LogDebug(node.name, ": ", fmt.Sprintf("Rejecting %v with client certificate fingerprint: %v",
+					source, s.clientFP))
+
+				return nil, "", ErrUntrustedClient
+			}
+
+			return node, source, nil
 		}
 	}
 
-	return nil, err
+	return nil, "", err
+}
+
+/*
+authResponse calculates the response of a node to a given challenge. The
+response is bound to the challenge, the target node and the name of the
+requesting node.
+*/
+func authResponse(secret string, nonce string, target string, source string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s\x00%s\x00%s", nonce, target, source)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+legacyToken calculates the static token of a node.
+*/
+func legacyToken(name string, secret string) string {
+	return fmt.Sprintf("%X", sha512.Sum512_224([]byte(name+secret)))
 }
 
 /*
@@ -0,0 +1,324 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package node
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+/*
+StreamHandler is a function to handle incoming stream requests. A stream
+request has a control object which contains information on what the data is
+and how it should be used. The handler can read data which is streamed by the
+client from the in reader and stream data back to the client by writing to the
+out writer. The stream ends once the handler returns.
+*/
+type StreamHandler func(ctrl map[string]string, in io.Reader, out io.Writer) error
+
+/*
+streamMagic is sent by clients at the beginning of a connection to request
+a data stream instead of RPC calls. The node answers with a challenge.
+*/
+const streamMagic = "RUFS/STREAM2\n"
+
+/*
+legacyStreamMagic is sent by clients which authenticate with a static token
+to request a data stream.
+*/
+const legacyStreamMagic = "RUFS/STREAM1\n"
+
+/*
+MaxStreamFrameSize is the maximum size of a single frame in a data stream
+*/
+var MaxStreamFrameSize = 1024 * 1024
+
+/*
+maxErrorFrameSize is the maximum size of an error message in a data stream
+*/
+const maxErrorFrameSize = 64 * 1024
+
+/*
+Frame types of a data stream
+*/
+const (
+	frameData  byte = iota // Frame contains data
+	frameEnd               // Frame marks the regular end of the stream
+	frameError             // Frame contains an error message
+)
+
+/*
+streamRequest is the initial request of a data stream.
+*/
+type streamRequest struct {
+	Target string            // Target node
+	Token  *RufsNodeToken    // Client token which is used for authorization checks
+	Ctrl   map[string]string // Control object (i.e. what to do with the data)
+}
+
+/*
+serveConn serves a single incoming connection. The connection is either used
+for RPC calls or as a data stream.
+*/
+func serveConn(conn net.Conn) {
+	var clientFP string
+
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+
+		// Do the handshake and look at the client certificate
+
+		if err := tlsconn.Handshake(); err != nil {
+			LogDebug("Handshake with ", conn.RemoteAddr(), " failed: ", err)
+			conn.Close()
+			return
+		}
+
+		if certs := tlsconn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			clientFP = fingerprint(certs[0].Raw)
+		}
+	}
+
+	br := bufio.NewReader(conn)
+
+	if magic, err := br.Peek(len(streamMagic)); err == nil &&
+		(string(magic) == streamMagic || string(magic) == legacyStreamMagic) {
+
+		br.Discard(len(streamMagic))
+		serveStream(conn, br, newRufsServer(rufsServer.nodes, clientFP),
+			string(magic) == legacyStreamMagic)
+		return
+	}
+
+	newRPCServer(clientFP).ServeConn(&bufferedConn{conn, br})
+}
+
+/*
+serveStream serves a data stream. The client has to answer a challenge in
+its stream request unless it uses a static token.
+*/
+func serveStream(conn net.Conn, br *bufio.Reader, server *RufsServer, legacy bool) {
+	var req streamRequest
+	var node *RufsNode
+	var source string
+	var err error
+
+	defer conn.Close()
+
+	sw := &streamWriter{bufio.NewWriter(conn)}
+
+	if !legacy {
+		sw.w.WriteString(server.challenge() + "\n")
+		err = sw.w.Flush()
+	}
+
+	if err == nil {
+		err = gob.NewDecoder(br).Decode(&req)
+	}
+
+	if err == nil && !legacy {
+		err = server.authenticate(req.Target, req.Token)
+	}
+
+	if err == nil {
+
+		// Verify the given token and retrieve the target member
+
+		if node, source, err = server.checkToken(map[RequestArgument]interface{}{
+			RequestTARGET: req.Target,
+			RequestTOKEN:  req.Token,
+		}); err == nil {
+
+			if node.StreamHandler == nil {
+				err = fmt.Errorf("Node %v does not support data streams", node.name)
+
+			} else if node.AccessHandler != nil {
+
+				// Check that the requesting node is allowed to use the stream
+
+				err = node.AccessHandler(source, req.Ctrl)
+			}
+
+			if err == nil {
+				err = node.StreamHandler(req.Ctrl, &streamReader{r: br}, sw)
+			}
+		}
+	}
+
+	if err != nil {
+		sw.CloseWithError(err)
+	} else {
+		sw.Close()
+	}
+
+	// Wait for the client to close the connection - closing the connection
+	// with unread data might discard the final frame on the client side
+
+	conn.SetReadDeadline(time.Now().Add(DialTimeout))
+	io.Copy(ioutil.Discard, br)
+}
+
+/*
+bufferedConn is a network connection which reads through a buffered reader.
+*/
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+/*
+Read reads data from the connection.
+*/
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+/*
+streamWriter writes data frames to a data stream.
+*/
+type streamWriter struct {
+	w *bufio.Writer
+}
+
+/*
+Write writes len(p) bytes from p as data frames to the stream.
+*/
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	var n int
+
+	for len(p) > 0 {
+		l := len(p)
+
+		if l > MaxStreamFrameSize {
+			l = MaxStreamFrameSize
+		}
+
+		if err := sw.writeFrame(frameData, p[:l]); err != nil {
+			return n, err
+		}
+
+		n += l
+		p = p[l:]
+	}
+
+	return n, nil
+}
+
+/*
+Close marks the regular end of the stream.
+*/
+func (sw *streamWriter) Close() error {
+	return sw.writeFrame(frameEnd, nil)
+}
+
+/*
+CloseWithError ends the stream with a given error.
+*/
+func (sw *streamWriter) CloseWithError(err error) error {
+	msg := []byte(err.Error())
+
+	if len(msg) > maxErrorFrameSize {
+		msg = msg[:maxErrorFrameSize]
+	}
+
+	return sw.writeFrame(frameError, msg)
+}
+
+/*
+writeFrame writes a single frame to the stream.
+*/
+func (sw *streamWriter) writeFrame(frameType byte, p []byte) error {
+	var header [5]byte
+
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(p)))
+
+	sw.w.Write(header[:])
+	sw.w.Write(p)
+
+	return sw.w.Flush()
+}
+
+/*
+streamReader reads data frames from a data stream.
+*/
+type streamReader struct {
+	r         *bufio.Reader
+	remaining int   // Remaining bytes of the current data frame
+	err       error // Error which ended the stream
+}
+
+/*
+Read reads up to len(p) bytes from the stream. Returns io.EOF once the end
+of the stream has been reached.
+*/
+func (sr *streamReader) Read(p []byte) (int, error) {
+
+	for sr.remaining == 0 {
+		var header [5]byte
+
+		if sr.err != nil {
+			return 0, sr.err
+		}
+
+		if _, err := io.ReadFull(sr.r, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			sr.err = err
+			return 0, err
+		}
+
+		l := int(binary.BigEndian.Uint32(header[1:]))
+
+		if (header[0] == frameData && l > MaxStreamFrameSize) ||
+			(header[0] != frameData && l > maxErrorFrameSize) {
+			sr.err = fmt.Errorf("Stream frame too big: %v", l)
+			return 0, sr.err
+		}
+
+		switch header[0] {
+
+		case frameData:
+			sr.remaining = l
+
+		case frameEnd:
+			sr.err = io.EOF
+
+		default:
+			msg := make([]byte, l)
+
+			if _, sr.err = io.ReadFull(sr.r, msg); sr.err == nil {
+				sr.err = errors.New(string(msg))
+			}
+		}
+	}
+
+	if len(p) > sr.remaining {
+		p = p[:sr.remaining]
+	}
+
+	n, err := sr.r.Read(p)
+	sr.remaining -= n
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,216 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"devt.de/krotik/rufs/node"
+)
+
+/*
+ReplicaRetryInterval is the time for which a replica is avoided after a
+failed read.
+*/
+var ReplicaRetryInterval = 10 * time.Second
+
+/*
+replicaStats records the read latency and the failures of branches which
+are mapped as replicas.
+*/
+type replicaStats struct {
+	lock    *sync.Mutex
+	latency map[string]time.Duration // Average read latency of each branch
+	failed  map[string]time.Time     // Time of the last failed read of each branch
+}
+
+/*
+newReplicaStats creates a new replicaStats object.
+*/
+func newReplicaStats() *replicaStats {
+	return &replicaStats{&sync.Mutex{}, make(map[string]time.Duration),
+		make(map[string]time.Time)}
+}
+
+/*
+record records the outcome of a read from a given branch. A latency of 0
+does not change the average latency of the branch.
+*/
+func (rs *replicaStats) record(branch string, latency time.Duration, err error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if isBranchFailure(err) {
+		rs.failed[branch] = time.Now()
+		return
+	}
+
+	delete(rs.failed, branch)
+
+	if latency > 0 {
+		if l, ok := rs.latency[branch]; ok {
+			latency = (4*l + latency) / 5
+		}
+
+		rs.latency[branch] = latency
+	}
+}
+
+/*
+order returns the order in which a given list of replicas should be read.
+Healthy replicas come before replicas which failed recently. The first
+replica is chosen at random with a probability which is inversely
+proportional to its latency - the remaining healthy replicas are ordered by
+their latency.
+*/
+func (rs *replicaStats) order(branches []string) []string {
+	var healthy, failed []string
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	for _, b := range branches {
+		if t, ok := rs.failed[b]; ok && time.Since(t) < ReplicaRetryInterval {
+			failed = append(failed, b)
+		} else {
+			healthy = append(healthy, b)
+		}
+	}
+
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return rs.latency[healthy[i]] < rs.latency[healthy[j]]
+	})
+
+	if len(healthy) > 1 {
+		var total float64
+
+		weights := make([]float64, len(healthy))
+
+		for i, b := range healthy {
+			weights[i] = 1 / float64(rs.latency[b]+time.Millisecond)
+			total += weights[i]
+		}
+
+		r := rand.Float64() * total
+
+		for i, w := range weights {
+			if r < w || i == len(weights)-1 {
+				first := healthy[i]
+				copy(healthy[1:i+1], healthy[:i])
+				healthy[0] = first
+				break
+			}
+
+			r -= w
+		}
+	}
+
+	return append(healthy, failed...)
+}
+
+/*
+replicaGroups splits the branches of a tree path into groups which are read in
+turn. All branches which are mapped as replicas form a single group at the
+position of the first replica - every other branch forms a group of its own.
+Returns the groups and a flag for each group if it consists of replicas.
+*/
+func replicaGroups(branches []string, opts []MappingOptions) ([][]string, []bool) {
+	var groups [][]string
+	var replica []bool
+
+	replicaGroup := -1
+
+	for i, b := range branches {
+
+		if opts[i].Replica && replicaGroup >= 0 {
+			groups[replicaGroup] = append(groups[replicaGroup], b)
+			continue
+		}
+
+		if opts[i].Replica {
+			replicaGroup = len(groups)
+		}
+
+		groups = append(groups, []string{b})
+		replica = append(replica, opts[i].Replica)
+	}
+
+	return groups, replica
+}
+
+/*
+isBranchFailure returns if a given error was caused by a branch which
+could not be reached or which dropped a connection.
+*/
+func isBranchFailure(err error) bool {
+	rerr, ok := err.(*node.Error)
+
+	return ok && (rerr.Type == node.ErrNodeComm || rerr.Detail == io.ErrUnexpectedEOF.Error())
+}
+
+/*
+replicaInfos returns the file information including checksums of a given
+file on a list of replicas. Replicas which cannot provide the information
+are left out.
+*/
+func (t *Tree) replicaInfos(branches []string, rpath string) map[string]os.FileInfo {
+	infos := make(map[string]os.FileInfo)
+
+	dir, file := path.Split(rpath)
+
+	for _, b := range branches {
+
+		res, err := t.client.SendData(b, map[string]string{
+			ParamAction:    OpDir,
+			ParamPath:      dir,
+			ParamPattern:   fmt.Sprintf("^%v$", regexp.QuoteMeta(file)),
+			ParamRecursive: "false",
+			ParamChecksums: "true",
+		}, nil)
+
+		if err == nil {
+			var dest []interface{}
+
+			if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
+				for _, fis := range dest[1].([][]os.FileInfo) {
+					for _, fi := range fis {
+						if fi.Name() == file && !fi.IsDir() {
+							infos[b] = fi
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return infos
+}
+
+/*
+isSameReplicaFile returns if two files have the same size and checksum.
+*/
+func isSameReplicaFile(fi1 os.FileInfo, fi2 os.FileInfo) bool {
+	rfi1, ok1 := fi1.(*FileInfo)
+	rfi2, ok2 := fi2.(*FileInfo)
+
+	return ok1 && ok2 && rfi1.Size() == rfi2.Size() &&
+		rfi1.Checksum() != "" && rfi1.Checksum() == rfi2.Checksum()
+}
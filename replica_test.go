@@ -0,0 +1,262 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+	"devt.de/krotik/rufs/node"
+)
+
+func TestReplicaOrder(t *testing.T) {
+
+	rs := newReplicaStats()
+
+	rs.record("b1", 2*time.Millisecond, nil)
+	rs.record("b2", time.Millisecond, nil)
+	rs.record("b3", time.Millisecond, &node.Error{Type: node.ErrNodeComm})
+
+	// Reads are spread across the healthy replicas
+
+	first := make(map[string]int)
+
+	for i := 0; i < 100; i++ {
+		order := rs.order([]string{"b3", "b1", "b2"})
+
+		if order[2] != "b3" {
+			t.Error("Unexpected result:", order)
+			return
+		}
+
+		first[order[0]]++
+	}
+
+	if first["b1"] == 0 || first["b2"] == 0 || first["b2"] < first["b1"] {
+		t.Error("Unexpected result:", first)
+		return
+	}
+
+	// A successful read makes a replica healthy again
+
+	rs.record("b3", 0, nil)
+
+	if order := rs.order([]string{"b3"}); len(order) != 1 || order[0] != "b3" {
+		t.Error("Unexpected result:", order)
+		return
+	}
+
+	if _, ok := rs.failed["b3"]; ok {
+		t.Error("Replica should be healthy")
+		return
+	}
+
+	// Errors of the remote action do not affect the health of a replica
+
+	rs.record("b1", 0, &node.Error{Type: node.ErrRemoteAction, Detail: "file does not exist"})
+
+	if _, ok := rs.failed["b1"]; ok {
+		t.Error("Replica should be healthy")
+		return
+	}
+}
+
+/*
+testProxy forwards connections on a given address to a branch until it is cut.
+*/
+type testProxy struct {
+	net.Listener
+	lock  *sync.Mutex
+	conns []net.Conn
+}
+
+func newTestProxy(addr string, target string) *testProxy {
+	l, err := net.Listen("tcp", addr)
+	errorutil.AssertOk(err)
+
+	p := &testProxy{l, &sync.Mutex{}, nil}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			tconn, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			p.lock.Lock()
+			p.conns = append(p.conns, conn, tconn)
+			p.lock.Unlock()
+
+			go io.Copy(conn, tconn)
+			go io.Copy(tconn, conn)
+		}
+	}()
+
+	return p
+}
+
+func (p *testProxy) cut() {
+	p.Close()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+/*
+cutWriter cuts a proxy once the first data has been written.
+*/
+type cutWriter struct {
+	bytes.Buffer
+	proxy *testProxy
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if w.Len() == 0 {
+		w.proxy.cut()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestReplicaReads(t *testing.T) {
+
+	rep1, err := createBranch("reptest1", "rep1", false)
+	errorutil.AssertOk(err)
+	rep2, err := createBranch("reptest2", "rep2", false)
+	errorutil.AssertOk(err)
+
+	defer func() {
+		errorutil.AssertOk(rep1.Shutdown())
+		errorutil.AssertOk(rep2.Shutdown())
+		os.RemoveAll("rep1")
+		os.RemoveAll("rep2")
+	}()
+
+	data := make([]byte, 8*1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	ioutil.WriteFile("rep1/test1", data, 0660)
+	ioutil.WriteFile("rep2/test1", data, 0660)
+
+	rep1RPC := fmt.Sprintf("%v:%v", branchConfigs["reptest1"][config.RPCHost], branchConfigs["reptest1"][config.RPCPort])
+	rep2RPC := fmt.Sprintf("%v:%v", branchConfigs["reptest2"][config.RPCHost], branchConfigs["reptest2"][config.RPCPort])
+
+	// Create a tree which reaches the first replica through a proxy
+
+	createTree := func() (*Tree, *testProxy) {
+		proxy := newTestProxy("localhost:0", rep1RPC)
+
+		tree, err := NewTree(map[string]interface{}{
+			config.TreeSecret: "123",
+		}, clientCert)
+		errorutil.AssertOk(err)
+
+		errorutil.AssertOk(tree.AddBranch("reptest1", proxy.Addr().String(), ""))
+		errorutil.AssertOk(tree.AddBranch("reptest2", rep2RPC, ""))
+		errorutil.AssertOk(tree.AddMappingWithOptions("/", "reptest1", false, MappingOptions{Replica: true}))
+		errorutil.AssertOk(tree.AddMappingWithOptions("/", "reptest2", false, MappingOptions{Replica: true}))
+
+		// Make sure the first replica is read first
+
+		tree.replicas.record("reptest2", 0, &node.Error{Type: node.ErrNodeComm})
+
+		return tree, proxy
+	}
+
+	tree, proxy := createTree()
+
+	if res := tree.String(); res != "/: reptest1(r replica), reptest2(r replica)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if conf := tree.Config(); !strings.Contains(conf, `"replica": true`) {
+		t.Error("Unexpected result:", conf)
+		return
+	}
+
+	// Read a file while the first replica drops out
+
+	w := &cutWriter{bytes.Buffer{}, proxy}
+
+	if err := tree.ReadFileToBuffer("/test1", w); err != nil || !bytes.Equal(w.Bytes(), data) {
+		t.Error("Unexpected result:", w.Len(), err)
+		return
+	}
+
+	if _, ok := tree.replicas.failed["reptest1"]; !ok {
+		t.Error("Replica should have failed")
+		return
+	}
+
+	// Listings and single reads go to the remaining replica
+
+	if fi, err := tree.Stat("/test1"); err != nil || fi.Size() != int64(len(data)) {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+
+	p := make([]byte, 10)
+
+	if n, err := tree.ReadFile("/test1", p, 100); n != 10 || err != nil || !bytes.Equal(p, data[100:110]) {
+		t.Error("Unexpected result:", n, err, p)
+		return
+	}
+
+	// A read is not continued on a replica with a different file
+
+	data[len(data)/2]++
+	ioutil.WriteFile("rep2/test1", data, 0660)
+
+	tree, proxy = createTree()
+
+	w = &cutWriter{bytes.Buffer{}, proxy}
+
+	if err := tree.ReadFileToBuffer("/test1", w); err == nil || w.Len() == len(data) {
+		t.Error("Unexpected result:", w.Len(), err)
+		return
+	}
+}
+
+func TestReplicaGroups(t *testing.T) {
+
+	// Only branches which are mapped as replicas share reads
+
+	groups, replica := replicaGroups([]string{"b1", "r1", "b2", "r2"}, []MappingOptions{
+		{}, {Replica: true}, {}, {Replica: true},
+	})
+
+	if res := fmt.Sprint(groups, replica); res != "[[b1] [r1 r2] [b2]] [false true false]" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
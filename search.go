@@ -0,0 +1,362 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Search filters which can be given to a search. All given filters must match
+for an item to be part of the search result.
+*/
+const (
+	SearchName    = "search_name"    // Glob pattern for item names
+	SearchMinSize = "search_minsize" // Minimum file size in bytes
+	SearchMaxSize = "search_maxsize" // Maximum file size in bytes
+	SearchAfter   = "search_after"   // Earliest modification time
+	SearchBefore  = "search_before"  // Latest modification time
+	SearchContent = "search_content" // String which must be contained in a file
+)
+
+/*
+searchFilter is a parsed set of search filters.
+*/
+type searchFilter struct {
+	name    string    // Glob pattern for item names
+	minSize int64     // Minimum file size (-1 if not set)
+	maxSize int64     // Maximum file size (-1 if not set)
+	after   time.Time // Earliest modification time (zero if not set)
+	before  time.Time // Latest modification time (zero if not set)
+	content []byte    // Content substring (nil if not set)
+
+	contains func(localPath string, sub []byte) (bool, error) // Function to search the content of a file
+}
+
+/*
+newSearchFilter parses a given set of search filters.
+*/
+func newSearchFilter(query map[string]string) (*searchFilter, error) {
+	var err error
+
+	sf := &searchFilter{query[SearchName], -1, -1, time.Time{}, time.Time{}, nil, fileContains}
+
+	if sf.name != "" {
+		if _, err = path.Match(sf.name, ""); err != nil {
+			return nil, fmt.Errorf("Invalid name pattern %v: %v", sf.name, err)
+		}
+	}
+
+	parseSize := func(key string) int64 {
+		var size int64 = -1
+
+		if v := query[key]; v != "" && err == nil {
+			if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = fmt.Errorf("Invalid size %v: %v", v, err)
+			}
+		}
+
+		return size
+	}
+
+	parseTime := func(key string) time.Time {
+		var t time.Time
+
+		if v := query[key]; v != "" && err == nil {
+			if t, err = ParseSearchTime(v); err != nil {
+				err = fmt.Errorf("Invalid time %v: %v", v, err)
+			}
+		}
+
+		return t
+	}
+
+	sf.minSize = parseSize(SearchMinSize)
+	sf.maxSize = parseSize(SearchMaxSize)
+	sf.after = parseTime(SearchAfter)
+	sf.before = parseTime(SearchBefore)
+
+	if c := query[SearchContent]; c != "" {
+		sf.content = []byte(c)
+	}
+
+	return sf, err
+}
+
+/*
+ParseSearchTime parses a time value of a search filter. The value can be
+given in RFC3339 format or as a date (YYYY-MM-DD).
+*/
+func ParseSearchTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+
+	if err != nil {
+		if dt, derr := time.ParseInLocation("2006-01-02", v, time.Local); derr == nil {
+			t, err = dt, nil
+		}
+	}
+
+	return t, err
+}
+
+/*
+match checks if a given item matches the filter.
+*/
+func (sf *searchFilter) match(localPath string, fi os.FileInfo) bool {
+
+	if sf.name != "" {
+		if ok, _ := path.Match(sf.name, fi.Name()); !ok {
+			return false
+		}
+	}
+
+	if sf.minSize >= 0 || sf.maxSize >= 0 || sf.content != nil {
+
+		// Size and content filters only match files
+
+		if fi.IsDir() || (sf.minSize >= 0 && fi.Size() < sf.minSize) ||
+			(sf.maxSize >= 0 && fi.Size() > sf.maxSize) {
+			return false
+		}
+	}
+
+	if (!sf.after.IsZero() && fi.ModTime().Before(sf.after)) ||
+		(!sf.before.IsZero() && fi.ModTime().After(sf.before)) {
+		return false
+	}
+
+	if sf.content != nil {
+		ok, _ := sf.contains(localPath, sf.content)
+		return ok
+	}
+
+	return true
+}
+
+/*
+fileContains checks if a given file contains a given byte sequence.
+*/
+func fileContains(localPath string, sub []byte) (bool, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return readerContains(f, sub)
+}
+
+/*
+readerContains checks if the data of a given reader contains a given byte
+sequence. The data is read in chunks.
+*/
+func readerContains(r io.Reader, sub []byte) (bool, error) {
+	buf := make([]byte, 0, 64*1024+len(sub))
+
+	for {
+
+		// Keep the end of the last chunk so matches can span chunks
+
+		if keep := len(sub) - 1; len(buf) > keep {
+			buf = append(buf[:0], buf[len(buf)-keep:]...)
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if bytes.Contains(buf, sub) {
+			return true, nil
+		}
+
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Branch functions
+// ================
+
+/*
+fileContains checks if a given local file of the branch contains a given byte
+sequence.
+*/
+func (b *Branch) fileContains(localPath string, sub []byte) (bool, error) {
+	var size int64
+
+	f, err := b.openFile(localPath, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if size, err = f.Size(); err != nil {
+		return false, err
+	}
+
+	return readerContains(io.NewSectionReader(f, 0, size), sub)
+}
+
+/*
+Search walks a given path and returns all items which match a given set of
+search filters. Union markers are always part of the result if the union flag
+(ParamUnion) is set in the query. Files which do not match are flagged with
+os.ModeIrregular as they still shadow the files of other branches. The result
+has the same form as a recursive directory listing.
+*/
+func (b *Branch) Search(spath string, query map[string]string) ([]string, [][]os.FileInfo, error) {
+	var rpaths []string
+	var rfis [][]os.FileInfo
+	var addSubDir func(string, string) error
+
+	sf, err := newSearchFilter(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subPath, err := b.constructSubPath(spath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sf.contains = b.fileContains
+
+	union := strings.ToLower(query[ParamUnion]) == "true"
+
+	addSubDir = func(p string, rp string) error {
+		var matches []os.FileInfo
+
+		fis, err := b.readDir(p)
+
+		if err == nil {
+			for _, fi := range fis {
+				if isTempFile(fi.Name()) {
+					continue
+				}
+
+				if (union && IsUnionMarker(fi.Name())) || sf.match(filepath.Join(p, b.localName(fi.Name())), fi) {
+					matches = append(matches, WrapFileInfo(p, fi))
+
+				} else if !fi.IsDir() {
+
+					// Files which do not match still shadow the files of
+					// other branches - return them flagged as irregular
+
+					rfi := WrapFileInfo(p, fi).(*FileInfo)
+					rfi.FiMode |= os.ModeIrregular
+
+					matches = append(matches, rfi)
+				}
+			}
+
+			if rp == spath {
+				matches = b.markHidden(spath, matches, union)
+			}
+
+			if len(matches) > 0 {
+				rpaths = append(rpaths, rp)
+				rfis = append(rfis, matches)
+			}
+
+			for _, fi := range fis {
+				if err == nil && fi.IsDir() {
+					err = addSubDir(filepath.Join(p, b.localName(fi.Name())), path.Join(rp, fi.Name()))
+				}
+			}
+		}
+
+		return err
+	}
+
+	if err = addSubDir(subPath, spath); os.IsNotExist(err) {
+
+		// Ignore any not exists errors - a path which does not exist might
+		// still be hidden on other branches
+
+		err = nil
+
+		if fis := b.markHidden(spath, nil, union); len(fis) > 0 {
+			return []string{spath}, [][]os.FileInfo{fis}, nil
+		}
+	}
+
+	return rpaths, rfis, err
+}
+
+// Tree functions
+// ==============
+
+/*
+Search searches all branches under a given path for items which match a
+given set of search filters. The results of all branches are merged. The
+result has the same form as a recursive directory listing but only contains
+directories with matching items.
+*/
+func (t *Tree) Search(spath string, query map[string]string) ([]string, [][]os.FileInfo, error) {
+	var dirs []string
+	var fis [][]os.FileInfo
+
+	// Check the given filters before sending them to the branches
+
+	if _, err := newSearchFilter(query); err != nil {
+		return nil, nil, err
+	}
+
+	t.treeLock.RLock()
+	defer t.treeLock.RUnlock()
+
+	spath = strings.TrimSuffix(path.Clean("/"+spath), "/")
+
+	ctrl := map[string]string{
+		ParamAction: OpSearch,
+	}
+
+	for k, v := range query {
+		if strings.HasPrefix(k, "search_") {
+			ctrl[k] = v
+		}
+	}
+
+	listings, err := t.collectListings(spath, true, ctrl)
+
+	if err == nil {
+		mdirs, mfis := mergeListings(listings, t.inUnion(spath, true))
+
+		// Only keep matching items and directories which contain them
+
+		for i, d := range mdirs {
+			var dfis []os.FileInfo
+
+			for _, fi := range mfis[i] {
+				if fi.Mode()&os.ModeIrregular == 0 {
+					dfis = append(dfis, fi)
+				}
+			}
+
+			if len(dfis) > 0 {
+				dirs = append(dirs, d)
+				fis = append(fis, dfis)
+			}
+		}
+	}
+
+	return dirs, fis, err
+}
@@ -0,0 +1,202 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSearch(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", false))
+
+	os.Mkdir("foo/srtest", 0770)
+	os.MkdirAll("bar/srtest/sub", 0770)
+	defer os.RemoveAll("foo/srtest")
+	defer os.RemoveAll("bar/srtest")
+
+	ioutil.WriteFile("foo/srtest/file1.txt", []byte("upper hello"), 0660)
+	ioutil.WriteFile("foo/srtest/file2.log", []byte("upper"), 0660)
+	ioutil.WriteFile("bar/srtest/file1.txt", []byte("lower"), 0660)
+	ioutil.WriteFile("bar/srtest/file3.txt", []byte("lower hello"), 0660)
+	ioutil.WriteFile("bar/srtest/sub/file4.txt", []byte("lower hello world"), 0660)
+
+	search := func(query map[string]string, expected string) error {
+		paths, infos, err := tree.Search("/srtest", query)
+		if res := DirResultToString(paths, infos); err != nil || res != expected {
+			return fmt.Errorf("Unexpected result: %v %v", res, err)
+		}
+		return nil
+	}
+
+	if err := search(map[string]string{
+		SearchName: "*.txt",
+	}, `
+/srtest
+-rw-rw-rw- 11 B   file1.txt
+-rw-rw-rw- 11 B   file3.txt
+
+/srtest/sub
+-rw-rw-rw- 17 B   file4.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := search(map[string]string{
+		SearchContent: "hello",
+		SearchMinSize: "12",
+	}, `
+/srtest/sub
+-rw-rw-rw- 17 B   file4.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Files on the upper branch which do not match shadow files on the
+	// lower branch
+
+	if err := search(map[string]string{
+		SearchContent: "lower",
+	}, `
+/srtest
+-rw-rw-rw- 11 B   file3.txt
+
+/srtest/sub
+-rw-rw-rw- 17 B   file4.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Deleted files are not found
+
+	if ok, err := tree.ItemOp("/srtest", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "file3.txt",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if err := search(map[string]string{
+		SearchContent: "hello",
+		SearchMaxSize: "11",
+	}, `
+/srtest
+-rw-rw-rw- 11 B   file1.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Search by modification time
+
+	if err := search(map[string]string{
+		SearchAfter: time.Now().Add(time.Hour).Format(time.RFC3339),
+	}, ""); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := search(map[string]string{
+		SearchAfter:  "2000-01-01",
+		SearchBefore: time.Now().Add(time.Hour).Format(time.RFC3339),
+		SearchName:   "*.log",
+	}, `
+/srtest
+-rw-rw-rw- 5 B   file2.log
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// An empty query matches everything
+
+	if err := search(map[string]string{}, `
+/srtest
+-rw-rw-rw-  11 B   file1.txt
+-rw-rw-rw-   5 B   file2.log
+drwxrwxrwx 4.0 KiB sub
+
+/srtest/sub
+-rw-rw-rw- 17 B   file4.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Test error cases
+
+	if _, _, err := tree.Search("/srtest", map[string]string{
+		SearchName: "[",
+	}); err == nil || err.Error() != "Invalid name pattern [: syntax error in pattern" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, _, err := tree.Search("/srtest", map[string]string{
+		SearchMinSize: "a",
+	}); err == nil || err.Error() != `Invalid size a: strconv.ParseInt: parsing "a": invalid syntax` {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, _, err := tree.Search("/srtest", map[string]string{
+		SearchBefore: "today",
+	}); err == nil || err.Error() != `Invalid time today: parsing time "today" as "2006-01-02T15:04:05Z07:00": cannot parse "today" as "2006"` {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestFileContains(t *testing.T) {
+
+	data := make([]byte, 200*1024)
+	copy(data[64*1024-2:], []byte("needle"))
+
+	ioutil.WriteFile("foo/containstest", data, 0660)
+	defer os.Remove("foo/containstest")
+
+	if ok, err := fileContains("foo/containstest", []byte("needle")); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if ok, err := fileContains("foo/containstest", []byte("needles")); ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if ok, err := fileContains("foo/doesnotexist", []byte("needle")); ok || err == nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+}
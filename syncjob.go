@@ -0,0 +1,562 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+SyncJobHistorySize is the number of runs which are kept in the history of a
+sync job.
+*/
+var SyncJobHistorySize = 10
+
+/*
+SyncJobCheckInterval is the interval in which the schedules of all sync jobs
+are checked.
+*/
+var SyncJobCheckInterval = time.Second
+
+/*
+SyncJob is a named sync which runs according to a schedule. A schedule is
+either a cron expression with the fields minute, hour, day of month, month
+and day of week (e.g. "30 2 * * 1-5") or a fixed interval (e.g. "@every 1h").
+A job does a two-way sync if it has a conflict policy and a one-way sync
+otherwise.
+*/
+type SyncJob struct {
+	Name      string       `json:"name"`      // Unique name of the job
+	Src       string       `json:"src"`       // Source directory (first directory of a two-way sync)
+	Dst       string       `json:"dst"`       // Destination directory (second directory of a two-way sync)
+	Schedule  string       `json:"schedule"`  // Schedule of the job
+	Policy    string       `json:"policy"`    // Conflict policy of a two-way sync (empty for a one-way sync)
+	Options   SyncOptions  `json:"options"`   // Options of a one-way sync
+	Paused    bool         `json:"paused"`    // Flag if scheduled runs are paused
+	LastError string       `json:"lasterror"` // Error of the last run (empty if the last run succeeded)
+	History   []SyncJobRun `json:"history"`   // Last runs of the job (oldest first)
+	Running   bool         `json:"-"`         // Flag if the job is currently running
+	NextRun   time.Time    `json:"-"`         // Time of the next scheduled run (zero if paused)
+	schedule  *syncSchedule
+}
+
+/*
+SyncJobRun is a single run of a sync job.
+*/
+type SyncJobRun struct {
+	Start    time.Time     `json:"start"`    // Start time of the run
+	Duration time.Duration `json:"duration"` // Duration of the run
+	Error    string        `json:"error"`    // Error of the run (empty if the run succeeded)
+}
+
+/*
+syncJobs holds all sync jobs of a tree and controls the scheduler.
+*/
+type syncJobs struct {
+	lock *sync.Mutex
+	jobs map[string]*SyncJob // Map of all jobs
+	file string              // File which stores the jobs (empty if jobs are not persisted)
+	stop chan bool           // Channel to stop the scheduler (nil if not running)
+}
+
+/*
+newSyncJobs creates a new syncJobs object and loads all jobs from a given
+file. Jobs are not persisted if no file is given.
+*/
+func newSyncJobs(file string) (*syncJobs, error) {
+	var jobs []*SyncJob
+
+	sj := &syncJobs{&sync.Mutex{}, make(map[string]*SyncJob), file, nil}
+
+	if file == "" {
+		return sj, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err == nil {
+		if err = json.Unmarshal(data, &jobs); err != nil {
+			err = fmt.Errorf("Could not read sync jobs from %v: %v", file, err)
+		}
+
+		for _, job := range jobs {
+			if err == nil {
+				if job.schedule, err = parseSyncSchedule(job.Schedule); err == nil {
+					sj.jobs[job.Name] = job
+					sj.scheduleNext(job)
+				}
+			}
+		}
+
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return sj, err
+}
+
+/*
+save writes all jobs to the job file. This function expects the caller to
+hold the lock.
+*/
+func (sj *syncJobs) save() error {
+	var names []string
+
+	if sj.file == "" {
+		return nil
+	}
+
+	for name := range sj.jobs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	jobs := make([]*SyncJob, 0, len(names))
+
+	for _, name := range names {
+		jobs = append(jobs, sj.jobs[name])
+	}
+
+	data, err := json.MarshalIndent(jobs, "", "  ")
+
+	if err == nil {
+		err = ioutil.WriteFile(sj.file, data, 0600)
+	}
+
+	return err
+}
+
+/*
+scheduleNext calculates the next scheduled run of a job.
+*/
+func (sj *syncJobs) scheduleNext(job *SyncJob) {
+	if job.Paused {
+		job.NextRun = time.Time{}
+	} else {
+		job.NextRun = job.schedule.next(time.Now())
+	}
+}
+
+/*
+get returns a job. This function expects the caller to hold the lock.
+*/
+func (sj *syncJobs) get(name string) (*SyncJob, error) {
+	job, ok := sj.jobs[name]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown sync job: %v", name)
+	}
+
+	return job, nil
+}
+
+/*
+AddSyncJob adds a new sync job to the tree. The job is persisted if the
+tree has a sync job file.
+*/
+func (t *Tree) AddSyncJob(job SyncJob) error {
+	var err error
+
+	if job.Name == "" {
+		return fmt.Errorf("Sync job needs a name")
+	} else if job.Src == "" || job.Dst == "" {
+		return fmt.Errorf("Sync job %v needs a source and a destination directory", job.Name)
+	} else if job.Policy != "" && job.Policy != ConflictReport &&
+		job.Policy != ConflictNewest && job.Policy != ConflictKeepBoth {
+		return fmt.Errorf("Unknown conflict policy: %v", job.Policy)
+	} else if err = job.Options.check(); err != nil {
+		return err
+	}
+
+	if job.schedule, err = parseSyncSchedule(job.Schedule); err != nil {
+		return err
+	}
+
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	if _, ok := t.syncJobs.jobs[job.Name]; ok {
+		return fmt.Errorf("Sync job %v already exists", job.Name)
+	}
+
+	job.Running = false
+	job.LastError = ""
+	job.History = nil
+
+	t.syncJobs.jobs[job.Name] = &job
+	t.syncJobs.scheduleNext(&job)
+
+	t.startSyncScheduler()
+
+	return t.syncJobs.save()
+}
+
+/*
+SyncJobs returns all sync jobs of the tree sorted by name.
+*/
+func (t *Tree) SyncJobs() []SyncJob {
+	var ret []SyncJob
+
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	for _, job := range t.syncJobs.jobs {
+		j := *job
+		j.History = append([]SyncJobRun{}, job.History...)
+		j.schedule = nil
+
+		ret = append(ret, j)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+/*
+TriggerSyncJob runs a sync job immediately in the background.
+*/
+func (t *Tree) TriggerSyncJob(name string) error {
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	job, err := t.syncJobs.get(name)
+
+	if err == nil {
+		if job.Running {
+			err = fmt.Errorf("Sync job %v is already running", name)
+		} else {
+			job.Running = true
+			go t.runSyncJob(job)
+		}
+	}
+
+	return err
+}
+
+/*
+PauseSyncJob pauses or resumes the scheduled runs of a sync job.
+*/
+func (t *Tree) PauseSyncJob(name string, paused bool) error {
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	job, err := t.syncJobs.get(name)
+
+	if err == nil {
+		job.Paused = paused
+		t.syncJobs.scheduleNext(job)
+
+		err = t.syncJobs.save()
+	}
+
+	return err
+}
+
+/*
+RemoveSyncJob removes a sync job. A running job is not interrupted.
+*/
+func (t *Tree) RemoveSyncJob(name string) error {
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	_, err := t.syncJobs.get(name)
+
+	if err == nil {
+		delete(t.syncJobs.jobs, name)
+
+		err = t.syncJobs.save()
+	}
+
+	return err
+}
+
+/*
+StopSyncJobs stops the scheduler of the sync jobs. The scheduler is started
+again when a new job is added.
+*/
+func (t *Tree) StopSyncJobs() {
+
+	if t.syncJobs == nil {
+		return
+	}
+
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	if t.syncJobs.stop != nil {
+		close(t.syncJobs.stop)
+		t.syncJobs.stop = nil
+	}
+}
+
+/*
+startSyncScheduler starts the scheduler of the sync jobs if it is not
+running. This function expects the caller to hold the lock.
+*/
+func (t *Tree) startSyncScheduler() {
+
+	if t.syncJobs.stop != nil {
+		return
+	}
+
+	stop := make(chan bool)
+	ticker := time.NewTicker(SyncJobCheckInterval)
+
+	t.syncJobs.stop = stop
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.runDueSyncJobs()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+runDueSyncJobs starts all sync jobs which are due.
+*/
+func (t *Tree) runDueSyncJobs() {
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	now := time.Now()
+
+	for _, job := range t.syncJobs.jobs {
+		if !job.Paused && !job.Running && !job.NextRun.IsZero() && !now.Before(job.NextRun) {
+			job.Running = true
+			go t.runSyncJob(job)
+		}
+	}
+}
+
+/*
+runSyncJob runs a given sync job and records the result.
+*/
+func (t *Tree) runSyncJob(job *SyncJob) {
+	var err error
+
+	t.syncJobs.lock.Lock()
+	src, dst, policy, opts := job.Src, job.Dst, job.Policy, job.Options
+	t.syncJobs.lock.Unlock()
+
+	start := time.Now()
+
+	if policy != "" {
+		_, err = t.SyncTwoWay(src, dst, policy, nil)
+	} else {
+		err = t.SyncWithOptions(src, dst, true, opts, nil)
+	}
+
+	run := SyncJobRun{start, time.Since(start), ""}
+
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	t.syncJobs.lock.Lock()
+	defer t.syncJobs.lock.Unlock()
+
+	job.Running = false
+	job.LastError = run.Error
+	job.History = append(job.History, run)
+
+	if len(job.History) > SyncJobHistorySize {
+		job.History = job.History[len(job.History)-SyncJobHistorySize:]
+	}
+
+	t.syncJobs.scheduleNext(job)
+
+	t.syncJobs.save()
+}
+
+// Schedules
+// =========
+
+/*
+syncSchedule is a parsed schedule of a sync job.
+*/
+type syncSchedule struct {
+	every  time.Duration // Fixed interval (0 if the schedule is a cron expression)
+	fields [5]uint64     // Bit masks of the allowed values of all cron fields
+	anyDay [2]bool       // Flags if the day of month or the day of week fields are unrestricted
+}
+
+/*
+Ranges of the cron fields
+*/
+var syncScheduleRanges = [5][2]int{
+	{0, 59}, // Minute
+	{0, 23}, // Hour
+	{1, 31}, // Day of month
+	{1, 12}, // Month
+	{0, 7},  // Day of week (0 and 7 are Sunday)
+}
+
+/*
+parseSyncSchedule parses a given schedule.
+*/
+func parseSyncSchedule(schedule string) (*syncSchedule, error) {
+	var err error
+
+	s := &syncSchedule{}
+
+	if strings.HasPrefix(schedule, "@every ") {
+
+		if s.every, err = time.ParseDuration(strings.TrimSpace(schedule[7:])); err == nil && s.every <= 0 {
+			err = fmt.Errorf("Interval must be positive")
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Invalid schedule %v: %v", schedule, err)
+		}
+
+		return s, err
+	}
+
+	fields := strings.Fields(schedule)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %v: Expected 5 fields (minute hour day month weekday)", schedule)
+	}
+
+	for i, f := range fields {
+		if s.fields[i], err = parseSyncScheduleField(f, syncScheduleRanges[i][0], syncScheduleRanges[i][1]); err != nil {
+			return nil, fmt.Errorf("Invalid schedule %v: %v", schedule, err)
+		}
+	}
+
+	// Sunday can be given as 0 or 7
+
+	if s.fields[4]&(1<<7) != 0 {
+		s.fields[4] |= 1
+	}
+
+	s.anyDay = [2]bool{fields[2] == "*", fields[4] == "*"}
+
+	return s, nil
+}
+
+/*
+parseSyncScheduleField parses a single cron field. A field is a comma
+separated list of values, ranges (a-b) or wildcards (*). Ranges and
+wildcards can have a step value (e.g. 0-30/5).
+*/
+func parseSyncScheduleField(field string, min, max int) (uint64, error) {
+	var res uint64
+
+	for _, part := range strings.Split(field, ",") {
+		var err error
+
+		step := 1
+		start, end := min, max
+
+		if i := strings.Index(part, "/"); i != -1 {
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step in %v", part)
+			}
+
+			part = part[:i]
+		}
+
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			if start, err = strconv.Atoi(bounds[0]); err == nil {
+				end = start
+
+				if len(bounds) == 2 {
+					end, err = strconv.Atoi(bounds[1])
+				}
+			}
+
+			if err != nil || start < min || end > max || start > end {
+				return 0, fmt.Errorf("Invalid value %v (must be between %v and %v)", part, min, max)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+
+	return res, nil
+}
+
+/*
+matches checks if a given value is allowed by a given field.
+*/
+func (s *syncSchedule) matches(field int, value int) bool {
+	return s.fields[field]&(1<<uint(value)) != 0
+}
+
+/*
+matchesDay checks if a given day is allowed by the schedule. If the day of
+month and the day of week are both restricted then either must match.
+*/
+func (s *syncSchedule) matchesDay(t time.Time) bool {
+	dom := s.matches(2, t.Day())
+	dow := s.matches(4, int(t.Weekday()))
+
+	if s.anyDay[0] || s.anyDay[1] {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+/*
+next returns the next time after a given time which matches the schedule.
+Returns a zero time if there is no such time within the next five years.
+*/
+func (s *syncSchedule) next(after time.Time) time.Time {
+
+	if s.every > 0 {
+		return after.Add(s.every)
+	}
+
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+
+		if !s.matches(3, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if !s.matches(1, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if !s.matches(0, t.Minute()) {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,296 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSyncSchedule(t *testing.T) {
+
+	start := time.Date(2020, time.January, 31, 23, 58, 30, 0, time.UTC) // Friday
+
+	tests := []struct {
+		schedule string
+		expected string
+	}{
+		{"* * * * *", "2020-01-31 23:59"},
+		{"*/15 * * * *", "2020-02-01 00:00"},
+		{"30 2 * * *", "2020-02-01 02:30"},
+		{"0 9 * * 1-5", "2020-02-03 09:00"},
+		{"0 0 29 2 *", "2020-02-29 00:00"},
+		{"0 0 1 3 *", "2020-03-01 00:00"},
+		{"0 12 15 * 0", "2020-02-02 12:00"},
+		{"0 12 * * 7", "2020-02-02 12:00"},
+		{"5,10 8-9/1 * * *", "2020-02-01 08:05"},
+		{"0 0 30 2 *", "0001-01-01 00:00"},
+	}
+
+	for _, test := range tests {
+		s, err := parseSyncSchedule(test.schedule)
+		if err != nil {
+			t.Error("Unexpected result:", test.schedule, err)
+			return
+		}
+
+		if res := s.next(start).Format("2006-01-02 15:04"); res != test.expected {
+			t.Error("Unexpected result:", test.schedule, res)
+			return
+		}
+	}
+
+	if s, err := parseSyncSchedule("@every 90s"); err != nil || !s.next(start).Equal(start.Add(90*time.Second)) {
+		t.Error("Unexpected result:", s, err)
+		return
+	}
+
+	// Test error cases
+
+	for schedule, expected := range map[string]string{
+		"* * * *":      "Invalid schedule * * * *: Expected 5 fields (minute hour day month weekday)",
+		"60 * * * *":   "Invalid schedule 60 * * * *: Invalid value 60 (must be between 0 and 59)",
+		"* 5-1 * * *":  "Invalid schedule * 5-1 * * *: Invalid value 5-1 (must be between 0 and 23)",
+		"* * 0 * *":    "Invalid schedule * * 0 * *: Invalid value 0 (must be between 1 and 31)",
+		"* * * a *":    "Invalid schedule * * * a *: Invalid value a (must be between 1 and 12)",
+		"*/0 * * * *":  "Invalid schedule */0 * * * *: Invalid step in */0",
+		"@every 1x":    `Invalid schedule @every 1x: time: unknown unit "x" in duration "1x"`,
+		"@every -1s":   "Invalid schedule @every -1s: Interval must be positive",
+		"* * * * 1,8 ": "Invalid schedule * * * * 1,8 : Invalid value 8 (must be between 0 and 7)",
+	} {
+		if _, err := parseSyncSchedule(schedule); err == nil || err.Error() != expected {
+			t.Error("Unexpected result:", schedule, err)
+			return
+		}
+	}
+}
+
+func TestSyncJobs(t *testing.T) {
+
+	oldCheckInterval := SyncJobCheckInterval
+	oldHistorySize := SyncJobHistorySize
+	SyncJobCheckInterval = 10 * time.Millisecond
+	SyncJobHistorySize = 2
+
+	defer func() {
+		SyncJobCheckInterval = oldCheckInterval
+		SyncJobHistorySize = oldHistorySize
+	}()
+
+	jobFile := "syncjobs.json"
+	defer os.Remove(jobFile)
+
+	cfg := map[string]interface{}{
+		config.TreeSecret:  "123",
+		config.SyncJobFile: jobFile,
+	}
+
+	tree, err := NewTree(cfg, clientCert)
+	errorutil.AssertOk(err)
+	defer tree.StopSyncJobs()
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/src", "footest", false))
+	errorutil.AssertOk(tree.AddMapping("/dst", "bartest", true))
+
+	os.Mkdir("foo/syncjob", 0770)
+	os.Mkdir("bar/syncjob", 0770)
+	defer os.RemoveAll("foo/syncjob")
+	defer os.RemoveAll("bar/syncjob")
+
+	ioutil.WriteFile("foo/syncjob/test1", []byte("test1"), 0660)
+
+	// waitForRuns waits until a job has a given number of runs which started
+	// after a given time
+
+	waitForRuns := func(name string, runs int, after time.Time) (SyncJob, error) {
+		for i := 0; i < 200; i++ {
+			for _, job := range tree.SyncJobs() {
+				if job.Name == name && !job.Running && len(job.History) >= runs &&
+					job.History[len(job.History)-runs].Start.After(after) {
+					return job, nil
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return SyncJob{}, fmt.Errorf("Job %v did not run %v times: %v", name, runs, tree.SyncJobs())
+	}
+
+	// Add a paused job which only runs when it is triggered
+
+	if err := tree.AddSyncJob(SyncJob{
+		Name:     "job1",
+		Src:      "/src/syncjob",
+		Dst:      "/dst/syncjob",
+		Schedule: "0 0 1 1 *",
+		Paused:   true,
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if jobs := tree.SyncJobs(); len(jobs) != 1 || !jobs[0].NextRun.IsZero() || len(jobs[0].History) != 0 {
+		t.Error("Unexpected result:", jobs)
+		return
+	}
+
+	start := time.Now()
+
+	errorutil.AssertOk(tree.TriggerSyncJob("job1"))
+
+	job, err := waitForRuns("job1", 1, start)
+	if err != nil || job.LastError != "" || job.History[0].Duration <= 0 {
+		t.Error("Unexpected result:", job, err)
+		return
+	}
+
+	if res, err := ioutil.ReadFile("bar/syncjob/test1"); err != nil || string(res) != "test1" {
+		t.Error("Unexpected result:", string(res), err)
+		return
+	}
+
+	// Runs with errors are recorded and the history is limited
+
+	os.RemoveAll("bar/syncjob")
+	ioutil.WriteFile("bar/syncjob", []byte("not a directory"), 0660)
+
+	start = time.Now()
+
+	for i := 1; i < 3; i++ {
+		errorutil.AssertOk(tree.TriggerSyncJob("job1"))
+
+		if job, err = waitForRuns("job1", i, start); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if len(job.History) != 2 || job.LastError == "" || job.History[0].Error != job.LastError {
+		t.Error("Unexpected result:", job)
+		return
+	}
+
+	os.Remove("bar/syncjob")
+	os.Mkdir("bar/syncjob", 0770)
+
+	// Scheduled jobs run by themselves - pausing a job stops its runs
+
+	if err := tree.AddSyncJob(SyncJob{
+		Name:     "job2",
+		Src:      "/src/syncjob",
+		Dst:      "/dst/syncjob",
+		Schedule: "@every 20ms",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if job, err = waitForRuns("job2", 2, start); err != nil || job.LastError != "" {
+		t.Error("Unexpected result:", job, err)
+		return
+	}
+
+	errorutil.AssertOk(tree.PauseSyncJob("job2", true))
+
+	job, _ = waitForRuns("job2", 1, start)
+	last := job.History[len(job.History)-1].Start
+
+	time.Sleep(100 * time.Millisecond)
+
+	if job, _ = waitForRuns("job2", 1, start); !job.History[len(job.History)-1].Start.Equal(last) ||
+		!job.NextRun.IsZero() {
+		t.Error("Unexpected result:", job)
+		return
+	}
+
+	// Jobs survive a restart
+
+	tree2, err := NewTree(cfg, clientCert)
+	errorutil.AssertOk(err)
+	defer tree2.StopSyncJobs()
+
+	if jobs := tree2.SyncJobs(); len(jobs) != 2 || jobs[0].Name != "job1" ||
+		len(jobs[0].History) != 2 || jobs[0].LastError == "" || !jobs[1].Paused ||
+		jobs[1].Schedule != "@every 20ms" {
+		t.Error("Unexpected result:", jobs)
+		return
+	}
+
+	errorutil.AssertOk(tree.PauseSyncJob("job2", false))
+
+	if jobs := tree.SyncJobs(); jobs[1].Paused || jobs[1].NextRun.IsZero() {
+		t.Error("Unexpected result:", jobs)
+		return
+	}
+
+	errorutil.AssertOk(tree.RemoveSyncJob("job2"))
+
+	if jobs := tree.SyncJobs(); len(jobs) != 1 || jobs[0].Name != "job1" {
+		t.Error("Unexpected result:", jobs)
+		return
+	}
+
+	// Test error cases
+
+	for _, test := range []struct {
+		job      SyncJob
+		expected string
+	}{
+		{SyncJob{}, "Sync job needs a name"},
+		{SyncJob{Name: "job3"}, "Sync job job3 needs a source and a destination directory"},
+		{SyncJob{Name: "job3", Src: "/a", Dst: "/b", Policy: "foo"}, "Unknown conflict policy: foo"},
+		{SyncJob{Name: "job3", Src: "/a", Dst: "/b", Options: SyncOptions{Exclude: []string{"["}}},
+			"Invalid sync pattern [: syntax error in pattern"},
+		{SyncJob{Name: "job3", Src: "/a", Dst: "/b", Schedule: "foo"},
+			"Invalid schedule foo: Expected 5 fields (minute hour day month weekday)"},
+		{SyncJob{Name: "job1", Src: "/a", Dst: "/b", Schedule: "@every 1h"}, "Sync job job1 already exists"},
+	} {
+		if err := tree.AddSyncJob(test.job); err == nil || err.Error() != test.expected {
+			t.Error("Unexpected result:", err)
+			return
+		}
+	}
+
+	if err := tree.TriggerSyncJob("foo"); err == nil || err.Error() != "Unknown sync job: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := tree.PauseSyncJob("foo", true); err == nil || err.Error() != "Unknown sync job: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := tree.RemoveSyncJob("foo"); err == nil || err.Error() != "Unknown sync job: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	ioutil.WriteFile(jobFile, []byte("["), 0660)
+
+	if _, err := NewTree(cfg, clientCert); err == nil ||
+		err.Error() != "Could not read sync jobs from syncjobs.json: unexpected end of JSON input" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
@@ -24,6 +24,7 @@ var cmdMap = map[string]func(*TreeTerm, ...string) (string, error){
 	"ll":       cmdDir,
 	"checksum": cmdChecksum,
 	"tree":     cmdTree,
+	"find":     cmdFind,
 	"branch":   cmdBranch,
 	"mount":    cmdMount,
 	"reset":    cmdReset,
@@ -36,6 +37,7 @@ var cmdMap = map[string]func(*TreeTerm, ...string) (string, error){
 	"mkdir":    cmdMkDir,
 	"cp":       cmdCp,
 	"sync":     cmdSync,
+	"bisync":   cmdBiSync,
 	"refresh":  cmdRefresh,
 }
 
@@ -45,17 +47,19 @@ var helpMap = map[string]string{
 	"dir [path] [glob]":      "Show a directory listing",
 	"checksum [path] [glob]": "Show a directory listing and file checksums",
 	"tree [path] [glob]":     "Show the listing of a directory and its subdirectories",
-	"branch [branch name] [rpc] [fingerprint]": "List all known branches or add a new branch to the tree",
-	"mount [path] [branch name] [ro]":          "List all mount points or add a new mount point to the tree",
-	"reset [mounts|brances]":                   "Remove all mounts or all mounts and all branches",
-	"ping <branch name> [rpc]":                 "Ping a remote branch",
-	"cat <file>":                               "Read and print the contents of a file",
-	"get <src file> [dst local file]":          "Retrieve a file and store it locally (in the current directory)",
-	"put [src local file] [dst file]":          "Read a local file and store it",
-	"rm <file>":                                "Delete a file or directory (* all files; ** all files/recursive)",
-	"ren <file> <newfile>":                     "Rename a file or directory",
-	"mkdir <dir>":                              "Create a new directory",
-	"cp <src file/dir> <dst dir>":              "Copy a file or directory",
-	"sync <src dir> <dst dir>":                 "Make sure dst has the same files and directories as src",
-	"refresh":                                  "Refreshes all known branches and reconnect if possible",
+	"branch [branch name] [rpc] [fingerprint]":            "List all known branches or add a new branch to the tree",
+	"mount [path] [branch name] [ro] [policy] [priority]": "List all mount points or add a new mount point to the tree",
+	"reset [mounts|brances]":                              "Remove all mounts or all mounts and all branches",
+	"ping <branch name> [rpc]":                            "Ping a remote branch",
+	"cat <file>":                                          "Read and print the contents of a file",
+	"get <src file> [dst local file]":                     "Retrieve a file and store it locally (in the current directory)",
+	"put [src local file] [dst file]":                     "Read a local file and store it",
+	"rm <file>":                                           "Delete a file or directory (* all files; ** all files/recursive)",
+	"ren <file> <newfile>":                                "Rename a file or directory",
+	"mkdir <dir>":                                         "Create a new directory",
+	"cp <src file/dir> <dst dir>":                         "Copy a file or directory",
+	"find [path] [key=value ...]":                         "Search for files (name, minsize, maxsize, after, before, content)",
+	"bisync <dir a> <dir b> [report|newest|keepboth]":     "Sync two directories with each other and resolve conflicts with a policy",
+	"sync <src dir> <dst dir> [options]":                  "Make sure dst has the same files and directories as src (dryrun, nodelete, update, checksum, include=<glob>, exclude=<glob>)",
+	"refresh":                                             "Refreshes all known branches and reconnect if possible",
 }
@@ -13,6 +13,7 @@ package term
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"devt.de/krotik/common/stringutil"
 	"devt.de/krotik/rufs"
@@ -77,3 +78,51 @@ func cmdDirListing(tt *TreeTerm, recursive bool, checksum bool, arg ...string) (
 
 	return res, err
 }
+
+/*
+searchKeys maps find command arguments to search filters.
+*/
+var searchKeys = map[string]string{
+	"name":    rufs.SearchName,
+	"minsize": rufs.SearchMinSize,
+	"maxsize": rufs.SearchMaxSize,
+	"after":   rufs.SearchAfter,
+	"before":  rufs.SearchBefore,
+	"content": rufs.SearchContent,
+}
+
+/*
+cmdFind searches a directory and its subdirectories for matching files.
+*/
+func cmdFind(tt *TreeTerm, arg ...string) (string, error) {
+	var dirs []string
+	var fis [][]os.FileInfo
+	var err error
+	var res string
+
+	dir := tt.cd
+	query := make(map[string]string)
+
+	for i, a := range arg {
+
+		if kv := strings.SplitN(a, "=", 2); len(kv) == 2 {
+			key, ok := searchKeys[kv[0]]
+			if !ok {
+				return "", fmt.Errorf("Unknown search filter: %v", kv[0])
+			}
+			query[key] = kv[1]
+
+		} else if i == 0 {
+			dir = tt.parsePathParam(a)
+
+		} else {
+			return "", fmt.Errorf("Search filters must be given as key=value")
+		}
+	}
+
+	if dirs, fis, err = tt.tree.Search(dir, query); err == nil {
+		res = rufs.DirResultToString(dirs, fis)
+	}
+
+	return res, err
+}
@@ -216,6 +216,10 @@ func cmdCp(tt *TreeTerm, arg ...string) (string, error) {
 					bitutil.ByteSizeString(writtenBytes, false),
 					bitutil.ByteSizeString(totalBytes, false),
 					currentFile, totalFiles))
+			} else if writtenBytes == rufs.CopyStatusResumed {
+				tt.WriteStatus(fmt.Sprintf("Resume %v (%v of %v)", file, currentFile, totalFiles))
+			} else if writtenBytes == rufs.CopyStatusVerifying {
+				tt.WriteStatus(fmt.Sprintf("Verify %v (%v of %v)", file, currentFile, totalFiles))
 			} else {
 				tt.ClearStatus()
 			}
@@ -476,7 +476,7 @@ drwxrwxrwx 0 B   tmp
 		return
 	}
 
-	if buf.String() != "\rCopy /foofile67: 10 B / 10 B (1 of 1)\r                                     \r" {
+	if buf.String() != "\rCopy /foofile67: 10 B / 10 B (1 of 1)\rVerify /foofile67 (1 of 1)           \r                          \r" {
 		t.Errorf("Unexpected buffer: %#v", buf.String())
 		return
 	}
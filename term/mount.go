@@ -13,6 +13,9 @@ package term
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+
+	"devt.de/krotik/rufs"
 )
 
 /*
@@ -86,8 +89,22 @@ func cmdMount(tt *TreeTerm, arg ...string) (string, error) {
 		branchName := arg[1]
 		writable := !(len(arg) > 2 && arg[2] == "ro") // Writeable unless stated otherwise
 
-		if err = tt.tree.AddMapping(dir, branchName, writable); err == nil {
-			res.WriteString(tt.tree.String())
+		var opts rufs.MappingOptions
+
+		if len(arg) > 3 {
+			opts.Policy = arg[3]
+		}
+
+		if len(arg) > 4 {
+			if opts.Priority, err = strconv.Atoi(arg[4]); err != nil {
+				err = fmt.Errorf("mount priority must be an integer: %v", arg[4])
+			}
+		}
+
+		if err == nil {
+			if err = tt.tree.AddMappingWithOptions(dir, branchName, writable, opts); err == nil {
+				res.WriteString(tt.tree.String())
+			}
 		}
 
 	} else {
@@ -12,12 +12,16 @@ package term
 
 import (
 	"fmt"
+	"strings"
 
 	"devt.de/krotik/common/bitutil"
+	"devt.de/krotik/rufs"
 )
 
 /*
-cmdSync Make sure dst has the same files and directories as src.
+cmdSync Make sure dst has the same files and directories as src. Optional
+arguments control the sync: dryrun, nodelete, update, checksum,
+include=<glob> and exclude=<glob>.
 */
 func cmdSync(tt *TreeTerm, arg ...string) (string, error) {
 	var res string
@@ -26,28 +30,103 @@ func cmdSync(tt *TreeTerm, arg ...string) (string, error) {
 	err := fmt.Errorf("sync requires a source and a destination directory")
 
 	if lenArg > 1 {
+		var opts rufs.SyncOptions
 
 		src := tt.parsePathParam(arg[0])
 		dst := tt.parsePathParam(arg[1])
 
-		updFunc := func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+		// Parse the sync options
+
+		for _, a := range arg[2:] {
+
+			if kv := strings.SplitN(a, "=", 2); len(kv) == 2 && kv[0] == "include" {
+				opts.Include = append(opts.Include, kv[1])
+
+			} else if len(kv) == 2 && kv[0] == "exclude" {
+				opts.Exclude = append(opts.Exclude, kv[1])
+
+			} else if a == "dryrun" {
+				opts.DryRun = true
+
+			} else if a == "nodelete" {
+				opts.NoDelete = true
+
+			} else if a == "update" {
+				opts.UpdateOnly = true
+
+			} else if a == "checksum" {
+				opts.ChecksumOnly = true
 
-			if writtenBytes > 0 {
-				tt.WriteStatus(fmt.Sprintf("%v (%v/%v) writing: %v -> %v %v / %v", op,
-					currentFile, totalFiles, srcFile, dstFile,
-					bitutil.ByteSizeString(writtenBytes, false),
-					bitutil.ByteSizeString(totalBytes, false)))
 			} else {
-				tt.ClearStatus()
-				fmt.Fprint(tt.out, fmt.Sprintln(fmt.Sprintf("%v (%v/%v) %v -> %v", op,
-					currentFile, totalFiles, srcFile, dstFile)))
+				return "", fmt.Errorf("Unknown sync option: %v", a)
 			}
 		}
 
-		if err = tt.tree.Sync(src, dst, true, updFunc); err == nil {
+		updFunc := syncUpdFunc(tt)
+
+		if err = tt.tree.SyncWithOptions(src, dst, true, opts, updFunc); err == nil {
+			res = "Done"
+		}
+	}
+
+	return res, err
+}
+
+/*
+cmdBiSync syncs two directories with each other. Items which were changed
+on both sides since the last sync are conflicts which are resolved by a
+conflict policy: report (default), newest or keepboth.
+*/
+func cmdBiSync(tt *TreeTerm, arg ...string) (string, error) {
+	var res string
+
+	lenArg := len(arg)
+	err := fmt.Errorf("bisync requires two directories")
+
+	if lenArg > 1 {
+		var conflicts []string
+
+		dirA := tt.parsePathParam(arg[0])
+		dirB := tt.parsePathParam(arg[1])
+		policy := rufs.ConflictReport
+
+		if lenArg > 2 {
+			policy = arg[2]
+		}
+
+		if conflicts, err = tt.tree.SyncTwoWay(dirA, dirB, policy, syncUpdFunc(tt)); err == nil {
 			res = "Done"
+
+			if len(conflicts) > 0 {
+				res = fmt.Sprintf("Done (%v conflicts)", len(conflicts))
+			}
 		}
 	}
 
 	return res, err
 }
+
+/*
+syncUpdFunc returns an update function which writes the progress of a sync
+to the terminal.
+*/
+func syncUpdFunc(tt *TreeTerm) func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+
+	return func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+
+		if writtenBytes > 0 {
+			tt.WriteStatus(fmt.Sprintf("%v (%v/%v) writing: %v -> %v %v / %v", op,
+				currentFile, totalFiles, srcFile, dstFile,
+				bitutil.ByteSizeString(writtenBytes, false),
+				bitutil.ByteSizeString(totalBytes, false)))
+		} else if op == rufs.SyncResumeFile || op == rufs.SyncVerifyFile ||
+			op == rufs.SyncDeltaFile {
+			tt.WriteStatus(fmt.Sprintf("%v (%v/%v) %v -> %v", op,
+				currentFile, totalFiles, srcFile, dstFile))
+		} else {
+			tt.ClearStatus()
+			fmt.Fprint(tt.out, fmt.Sprintln(fmt.Sprintf("%v (%v/%v) %v -> %v", op,
+				currentFile, totalFiles, srcFile, dstFile)))
+		}
+	}
+}
@@ -109,13 +109,17 @@ drwxrwxrwx 4.0 KiB sub1
 	}
 
 	if buf.String() != "Create directory (1/5)  -> /2/sub1\n\r"+
-		"Copy file (2/5) writing: /1/test1 -> /2/test1 10 B / 10 B\r                                                         \r"+
+		"Copy file (2/5) writing: /1/test1 -> /2/test1 10 B / 10 B\r"+
+		"Verify file (2/5) /1/test1 -> /2/test1                   \r                                      \r"+
 		"Copy file (2/5) /1/test1 -> /2/test1\n\r"+
-		"Copy file (3/5) writing: /1/test2 -> /2/test2 10 B / 10 B\r                                                         \r"+
+		"Copy file (3/5) writing: /1/test2 -> /2/test2 10 B / 10 B\r"+
+		"Verify file (3/5) /1/test2 -> /2/test2                   \r                                      \r"+
 		"Copy file (3/5) /1/test2 -> /2/test2\n\r"+
-		"Copy file (4/5) writing: /1/testfile66 -> /2/testfile66 10 B / 10 B\r                                                                   \r"+
+		"Copy file (4/5) writing: /1/testfile66 -> /2/testfile66 10 B / 10 B\r"+
+		"Verify file (4/5) /1/testfile66 -> /2/testfile66                   \r                                                \r"+
 		"Copy file (4/5) /1/testfile66 -> /2/testfile66\n\r"+
-		"Copy file (5/5) writing: /1/sub1/test3 -> /2/sub1/test3 17 B / 17 B\r                                                                   \r"+
+		"Copy file (5/5) writing: /1/sub1/test3 -> /2/sub1/test3 17 B / 17 B\r"+
+		"Verify file (5/5) /1/sub1/test3 -> /2/sub1/test3                   \r                                                \r"+
 		"Copy file (5/5) /1/sub1/test3 -> /2/sub1/test3\n" {
 		t.Errorf("Unexpected buffer: %#v", buf.String())
 		return
@@ -191,4 +195,99 @@ drwxrwxrwx 4.0 KiB sub1
 		t.Error("Unexpected result: ", res, err)
 		return
 	}
+
+	// Test sync options
+
+	ioutil.WriteFile("./bar/testfile67", []byte("write test"), 0660)
+	defer os.Remove("./bar/testfile67")
+
+	buf.Reset()
+
+	if res, err := term.Run("sync /1 /2 dryrun exclude=sub1"); err != nil || res != "Done" {
+		t.Error(res, err)
+		return
+	}
+
+	if buf.String() != "\r                                                \r"+
+		"Copy file (5/6) /1/testfile67 -> /2/testfile67\n" {
+		t.Errorf("Unexpected buffer: %#v", buf.String())
+		return
+	}
+
+	if _, err := os.Stat("./tmp/testfile67"); !os.IsNotExist(err) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if res, err := term.Run("sync /1 /2 foo"); err == nil || err.Error() != "Unknown sync option: foo" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+}
+
+func TestBiSyncOperation(t *testing.T) {
+	var buf bytes.Buffer
+
+	cfg := map[string]interface{}{
+		config.TreeSecret: "123",
+	}
+
+	os.Mkdir("./foo/bisync", 0770)
+	os.Mkdir("./bar/bisync", 0770)
+	defer os.RemoveAll("./foo/bisync")
+	defer os.RemoveAll("./bar/bisync")
+
+	ioutil.WriteFile("./foo/bisync/test1", []byte("test1"), 0660)
+	ioutil.WriteFile("./foo/bisync/test2", []byte("test2 foo"), 0660)
+	ioutil.WriteFile("./bar/bisync/test2", []byte("test2 bar"), 0660)
+
+	tree, _ := rufs.NewTree(cfg, clientCert)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	fooFP := footest.SSLFingerprint()
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+	barFP := bartest.SSLFingerprint()
+
+	tree.AddBranch(footest.Name(), fooRPC, fooFP)
+	tree.AddBranch(bartest.Name(), barRPC, barFP)
+
+	tree.AddMapping("/1", footest.Name(), true)
+	tree.AddMapping("/2", bartest.Name(), true)
+
+	term := NewTreeTerm(tree, &buf)
+
+	if res, err := term.Run("bisync /1/bisync /2/bisync"); err != nil || res != "Done (1 conflicts)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if res, err := ioutil.ReadFile("./bar/bisync/test1"); err != nil || string(res) != "test1" {
+		t.Error("Unexpected result:", string(res), err)
+		return
+	}
+
+	if res, err := term.Run("bisync /1/bisync /2/bisync keepboth"); err != nil || res != "Done (1 conflicts)" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if res, err := ioutil.ReadFile("./foo/bisync/test2.conflict"); err != nil || string(res) != "test2 bar" {
+		t.Error("Unexpected result:", string(res), err)
+		return
+	}
+
+	if res, err := term.Run("bisync /1/bisync /2/bisync"); err != nil || res != "Done" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if res, err := term.Run("bisync /1/bisync /2/bisync foo"); err == nil || err.Error() != "Unknown conflict policy: foo" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if res, err := term.Run("bisync /1/bisync"); err == nil || err.Error() != "bisync requires two directories" {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
 }
@@ -77,32 +77,34 @@ func TestSimpleTreeExploring(t *testing.T) {
 	if res, err := term.Run("?"); err != nil || res != `
 Available commands:
 ----
-branch [branch name] [rpc] [fingerprint] : List all known branches or add a new branch to the tree
-cat <file>                               : Read and print the contents of a file
-cd [path]                                : Show or change the current directory
-checksum [path] [glob]                   : Show a directory listing and file checksums
-cp <src file/dir> <dst dir>              : Copy a file or directory
-dir [path] [glob]                        : Show a directory listing
-get <src file> [dst local file]          : Retrieve a file and store it locally (in the current directory)
-help [cmd]                               : Show general or command specific help
-mkdir <dir>                              : Create a new directory
-mount [path] [branch name] [ro]          : List all mount points or add a new mount point to the tree
-ping <branch name> [rpc]                 : Ping a remote branch
-put [src local file] [dst file]          : Read a local file and store it
-refresh                                  : Refreshes all known branches and reconnect if possible
-ren <file> <newfile>                     : Rename a file or directory
-reset [mounts|brances]                   : Remove all mounts or all mounts and all branches
-rm <file>                                : Delete a file or directory (* all files; ** all files/recursive)
-sync <src dir> <dst dir>                 : Make sure dst has the same files and directories as src
-tree [path] [glob]                       : Show the listing of a directory and its subdirectories
-unittest [bla]                           : Unit test command
+bisync <dir a> <dir b> [report|newest|keepboth]     : Sync two directories with each other and resolve conflicts with a policy
+branch [branch name] [rpc] [fingerprint]            : List all known branches or add a new branch to the tree
+cat <file>                                          : Read and print the contents of a file
+cd [path]                                           : Show or change the current directory
+checksum [path] [glob]                              : Show a directory listing and file checksums
+cp <src file/dir> <dst dir>                         : Copy a file or directory
+dir [path] [glob]                                   : Show a directory listing
+find [path] [key=value ...]                         : Search for files (name, minsize, maxsize, after, before, content)
+get <src file> [dst local file]                     : Retrieve a file and store it locally (in the current directory)
+help [cmd]                                          : Show general or command specific help
+mkdir <dir>                                         : Create a new directory
+mount [path] [branch name] [ro] [policy] [priority] : List all mount points or add a new mount point to the tree
+ping <branch name> [rpc]                            : Ping a remote branch
+put [src local file] [dst file]                     : Read a local file and store it
+refresh                                             : Refreshes all known branches and reconnect if possible
+ren <file> <newfile>                                : Rename a file or directory
+reset [mounts|brances]                              : Remove all mounts or all mounts and all branches
+rm <file>                                           : Delete a file or directory (* all files; ** all files/recursive)
+sync <src dir> <dst dir> [options]                  : Make sure dst has the same files and directories as src (dryrun, nodelete, update, checksum, include=<glob>, exclude=<glob>)
+tree [path] [glob]                                  : Show the listing of a directory and its subdirectories
+unittest [bla]                                      : Unit test command
 `[1:] {
 		t.Error("Unexpected result: ", res, err)
 		return
 	}
 
-	if res := term.Cmds(); fmt.Sprint(res) != "[? branch cat cd checksum cp dir "+
-		"get help ll mkdir mount ping put refresh ren reset rm sync tree unittest]" {
+	if res := term.Cmds(); fmt.Sprint(res) != "[? bisync branch cat cd checksum cp dir "+
+		"find get help ll mkdir mount ping put refresh ren reset rm sync tree unittest]" {
 		t.Error("Unexpected result:", res)
 		return
 	}
@@ -263,6 +265,53 @@ drwxrwxrwx  0 B   sub1
 		return
 	}
 
+	if res, err := term.Run("find / name=test* content=dir"); err != nil || (res != `
+/sub1
+-rwxrwx--- 17 B   test3
+`[1:] && res != `
+/sub1
+-rwxr-x--- 17 B   test3
+`[1:] && res != `
+/sub1
+-rw-rw-rw- 17 B   test3
+`[1:]) {
+		t.Error("Unexpected result: ", res, err)
+		return
+	}
+
+	if res, err := term.Run("find maxsize=10"); err != nil || (res != `
+/
+-rwxrwx--- 10 B   test1
+-rwxrwx--- 10 B   test2
+`[1:] && res != `
+/
+-rwxr-x--- 10 B   test1
+-rwxr-x--- 10 B   test2
+`[1:] && res != `
+/
+-rw-rw-rw- 10 B   test1
+-rw-rw-rw- 10 B   test2
+`[1:]) {
+		t.Error("Unexpected result: ", res, err)
+		return
+	}
+
+	if _, err := term.Run("find / size=10"); err == nil || err.Error() != "Unknown search filter: size" {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+
+	if _, err := term.Run("find / test1"); err == nil || err.Error() != "Search filters must be given as key=value" {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+
+	if _, err := term.Run("find / minsize=x"); err == nil ||
+		err.Error() != `Invalid size x: strconv.ParseInt: parsing "x": invalid syntax` {
+		t.Error("Unexpected result: ", err)
+		return
+	}
+
 	if res := term.CurrentDir(); res != "/" {
 		t.Error("Unexpected result: ", res)
 		return
@@ -44,6 +44,14 @@ type Tree struct {
 	branchesAll []map[string]string      // All added branches also not working
 	mapping     []map[string]interface{} // Mappings from working branches
 	mappingAll  []map[string]interface{} // All used mappings
+	cache       *BlockCache              // Cache for file blocks (nil if not configured)
+	dirCache    *dirCache                // Cache for directory listings (nil if not configured)
+	hiddenCache *itemCache               // Cache for branches on which items are hidden
+	copyUpCache *itemCache               // Cache for files which need no copy to a writable branch
+	watches     *treeWatches             // Active watches on this tree
+	replicas    *replicaStats            // Read statistics of replicated branches
+	health      *healthMonitor           // Health status of all known branches
+	syncJobs    *syncJobs                // Scheduled sync jobs
 }
 
 /*
@@ -56,22 +64,156 @@ func NewTree(cfg map[string]interface{}, cert *tls.Certificate) (*Tree, error) {
 	// Make sure the given config is ok
 
 	if err = config.CheckTreeConfig(cfg); err == nil {
+		var cache *BlockCache
 
-		// Create RPC client
+		// Create RPC client - the client name is optional and can be
+		// used by branches for access checks
 
-		c := node.NewClient(fileutil.ConfStr(cfg, config.TreeSecret), cert)
+		name := fmt.Sprint(confValue(cfg, config.DefaultTreeConfig, config.TreeClientName))
 
-		// Create the tree
+		c := node.NewNamedClient(name, fileutil.ConfStr(cfg, config.TreeSecret), cert)
 
-		t = &Tree{c, &sync.RWMutex{}, &treeItem{make(map[string]*treeItem),
-			[]string{}, []bool{}}, []map[string]string{},
-			[]map[string]string{}, []map[string]interface{}{},
-			[]map[string]interface{}{}}
+		// Branches of older versions only accept static tokens
+
+		c.LegacyTokens = fileutil.ConfBool(cfg, config.LegacyTokenAuth)
+
+		// Create the block cache and the directory listing cache if
+		// they were configured
+
+		if cache, err = newTreeBlockCache(cfg); err == nil {
+			var ttl, interval int64
+
+			if ttl, err = confInt64(cfg, config.DefaultTreeConfig, config.DirCacheTTL); err == nil {
+				interval, err = confInt64(cfg, config.DefaultTreeConfig, config.HealthCheckInterval)
+			}
+
+			if err == nil {
+				var dc *dirCache
+				var sj *syncJobs
+
+				if ttl > 0 {
+					dc = newDirCache(time.Duration(ttl) * time.Millisecond)
+				}
+
+				// Load the sync jobs
+
+				jobFile := fmt.Sprint(confValue(cfg, config.DefaultTreeConfig, config.SyncJobFile))
+
+				if sj, err = newSyncJobs(jobFile); err != nil {
+					return nil, err
+				}
+
+				// Create the tree
+
+				t = &Tree{c, &sync.RWMutex{}, &treeItem{make(map[string]*treeItem),
+					[]string{}, []bool{}, []MappingOptions{}, 0}, []map[string]string{},
+					[]map[string]string{}, []map[string]interface{}{},
+					[]map[string]interface{}{}, cache, dc, newItemCache(), newItemCache(),
+					&treeWatches{&sync.Mutex{}, make(map[*TreeWatch]bool),
+						make(map[string]map[string]chan bool)}, newReplicaStats(),
+					newHealthMonitor(), sj}
+
+				// Start the background health checks if they were configured
+
+				if interval > 0 {
+					t.StartHealthMonitor(time.Duration(interval) * time.Millisecond)
+				}
+
+				// Start the scheduler if there are stored sync jobs
+
+				if len(sj.jobs) > 0 {
+					sj.lock.Lock()
+					t.startSyncScheduler()
+					sj.lock.Unlock()
+				}
+			}
+		}
 	}
 
 	return t, err
 }
 
+/*
+newTreeBlockCache creates the block cache of a tree. Returns nil if no cache
+is configured.
+*/
+func newTreeBlockCache(cfg map[string]interface{}) (*BlockCache, error) {
+	var memSize, diskSize int64
+	var err error
+
+	diskDir := fmt.Sprint(confValue(cfg, config.DefaultTreeConfig, config.CacheDiskDir))
+
+	if memSize, err = confInt64(cfg, config.DefaultTreeConfig, config.CacheMemSize); err == nil {
+		if diskSize, err = confInt64(cfg, config.DefaultTreeConfig, config.CacheDiskSize); err == nil {
+
+			if diskDir == "" {
+				diskSize = 0
+			}
+
+			if memSize > 0 || diskSize > 0 {
+				return NewBlockCache(DefaultCacheBlockSize, memSize, diskDir, diskSize)
+			}
+		}
+	}
+
+	return nil, err
+}
+
+/*
+SSLFingerprint returns the SSL fingerprint of the client certificate which
+the tree presents to branches.
+*/
+func (t *Tree) SSLFingerprint() string {
+	return t.client.SSLFingerprint()
+}
+
+/*
+CacheStats returns the statistics of the block cache of this tree. Returns
+nil if the tree has no block cache.
+*/
+func (t *Tree) CacheStats() *BlockCacheStats {
+	if t.cache == nil {
+		return nil
+	}
+	return t.cache.Stats()
+}
+
+/*
+DirCacheTTL returns the time for which directory listings are cached. Returns
+0 if directory listings are not cached.
+*/
+func (t *Tree) DirCacheTTL() time.Duration {
+	if t.dirCache == nil {
+		return 0
+	}
+	return t.dirCache.ttl
+}
+
+/*
+invalidateCaches removes all cached listings and item information which might
+be affected by a change of a given path.
+*/
+func (t *Tree) invalidateCaches(spath string) {
+	if t.dirCache != nil {
+		t.dirCache.invalidate(spath)
+	}
+
+	t.hiddenCache.invalidate(spath)
+	t.copyUpCache.invalidate(spath)
+}
+
+/*
+clearCaches removes all cached listings and item information.
+*/
+func (t *Tree) clearCaches() {
+	if t.dirCache != nil {
+		t.dirCache.clear()
+	}
+
+	t.hiddenCache.clear()
+	t.copyUpCache.clear()
+}
+
 /*
 Config returns the current tree configuration as a JSON string.
 */
@@ -110,7 +252,8 @@ func (t *Tree) SetMapping(config string) error {
 
 		if mounts, ok := conf["tree"]; ok {
 			for _, m := range mounts {
-				t.AddMapping(m["path"].(string), m["branch"].(string), m["writeable"].(bool))
+				t.AddMappingWithOptions(m["path"].(string), m["branch"].(string),
+					m["writeable"].(bool), mappingOptions(m))
 			}
 		}
 	}
@@ -127,7 +270,7 @@ func (t *Tree) KnownBranches() map[string]map[string]string {
 	ret := make(map[string]map[string]string)
 
 	t.treeLock.RLock()
-	t.treeLock.RUnlock()
+	defer t.treeLock.RUnlock()
 
 	for _, b := range t.branchesAll {
 		ret[b["branch"]] = b
@@ -145,13 +288,16 @@ func (t *Tree) ActiveBranches() ([]string, []string) {
 
 /*
 NotReachableBranches returns a map of all known branches which couldn't be
-reached. The map contains the name and the definition of the branch.
+reached. The map contains the name and the definition of the branch along
+with its health status (lastseen, rtt and errors).
 */
 func (t *Tree) NotReachableBranches() map[string]map[string]string {
 	ret := make(map[string]map[string]string)
 
+	status := t.BranchStatus()
+
 	t.treeLock.RLock()
-	t.treeLock.RUnlock()
+	defer t.treeLock.RUnlock()
 
 	activeBranches := make(map[string]map[string]string)
 
@@ -163,7 +309,13 @@ func (t *Tree) NotReachableBranches() map[string]map[string]string {
 		name := b["branch"]
 
 		if _, ok := activeBranches[name]; !ok {
-			ret[name] = b
+			nb := status[name].statusMap()
+
+			for k, v := range b {
+				nb[k] = v
+			}
+
+			ret[name] = nb
 		}
 	}
 
@@ -184,6 +336,9 @@ also all known branches.
 */
 func (t *Tree) Reset(branches bool) {
 
+	t.treeLock.Lock()
+	defer t.treeLock.Unlock()
+
 	if branches {
 		peers, _ := t.client.Peers()
 		for _, p := range peers {
@@ -194,13 +349,12 @@ func (t *Tree) Reset(branches bool) {
 		t.branchesAll = []map[string]string{}
 	}
 
-	t.treeLock.Lock()
-	defer t.treeLock.Unlock()
-
 	t.mapping = []map[string]interface{}{}
 	t.mappingAll = []map[string]interface{}{}
 
-	t.root = &treeItem{make(map[string]*treeItem), []string{}, []bool{}}
+	t.root = &treeItem{make(map[string]*treeItem), []string{}, []bool{}, []MappingOptions{}, 0}
+
+	t.clearCaches()
 }
 
 /*
@@ -208,24 +362,40 @@ Refresh refreshes all known branches and mappings. Only reachable branches will
 be mapped into the tree.
 */
 func (t *Tree) Refresh() {
+	t.refreshBranches(true)
+}
+
+/*
+refreshBranches pings known branches and adds or removes them from the tree.
+All branches are pinged and all mappings are rebuilt if the all flag is set.
+Otherwise only branches which are due for a health check are pinged and the
+mappings are only rebuilt if a branch was added or removed.
+*/
+func (t *Tree) refreshBranches(all bool) {
 	addBranches := make(map[string]map[string]string)
 	delBranches := make(map[string]map[string]string)
 
 	nrBranches := t.NotReachableBranches()
 
-	// Check all known branches and decide if they should be added or removed
-
 	t.treeLock.RLock()
+	branchesAll := append([]map[string]string{}, t.branchesAll...)
+	t.treeLock.RUnlock()
+
+	// Check all known branches and decide if they should be added or removed
 
-	for _, data := range t.branchesAll {
+	for _, data := range branchesAll {
 		branchName := data["branch"]
 		branchRPC := data["rpc"]
 
+		if !all && !t.health.isDue(branchName) {
+			continue
+		}
+
 		_, knownAsNotWorking := nrBranches[branchName]
 
 		// Ping the branch
 
-		_, _, err := t.client.SendPing(branchName, branchRPC)
+		_, err := t.pingKnownBranch(branchName, branchRPC)
 
 		if err == nil && knownAsNotWorking {
 
@@ -241,21 +411,28 @@ func (t *Tree) Refresh() {
 		}
 	}
 
-	t.treeLock.RUnlock()
+	if !all && len(addBranches) == 0 && len(delBranches) == 0 {
+		return
+	}
 
 	// Now lock the tree and add/remove branches
 
 	t.treeLock.Lock()
 
-	for i, b := range t.branches {
+	branches := []map[string]string{}
+
+	for _, b := range t.branches {
 		branchName := b["branch"]
 
 		if _, ok := delBranches[branchName]; ok {
 			t.client.RemovePeer(branchName)
-			t.branches = append(t.branches[:i], t.branches[i+1:]...)
+		} else {
+			branches = append(branches, b)
 		}
 	}
 
+	t.branches = branches
+
 	for _, b := range addBranches {
 		branchName := b["branch"]
 		branchRPC := b["rpc"]
@@ -265,19 +442,44 @@ func (t *Tree) Refresh() {
 		t.branches = append(t.branches, b)
 	}
 
-	// Rebuild all mappings
+	// Rebuild all mappings - the new mappings replace the old ones at once
+	// so concurrent operations never see an incomplete tree
 
-	mappings := t.mappingAll
+	t.root, t.mapping = t.buildMappings(t.mappingAll)
 
-	t.mapping = []map[string]interface{}{}
-	t.mappingAll = []map[string]interface{}{}
-	t.root = &treeItem{make(map[string]*treeItem), []string{}, []bool{}}
+	t.clearCaches()
 
 	t.treeLock.Unlock()
+}
+
+/*
+buildMappings builds a new tree root from a given list of mapping
+configurations. Only mappings of registered branches are added. Returns the
+new root and the list of added mappings.
+*/
+func (t *Tree) buildMappings(mappings []map[string]interface{}) (*treeItem, []map[string]interface{}) {
+	peerMap := make(map[string]bool)
+
+	root := &treeItem{make(map[string]*treeItem), []string{}, []bool{}, []MappingOptions{}, 0}
+	added := []map[string]interface{}{}
+
+	peers, _ := t.client.Peers()
+
+	for _, p := range peers {
+		peerMap[p] = true
+	}
 
 	for _, m := range mappings {
-		t.AddMapping(fmt.Sprint(m["path"]), fmt.Sprint(m["branch"]), m["writeable"].(bool))
+		branchName := fmt.Sprint(m["branch"])
+
+		if peerMap[branchName] {
+			root.addMapping(createMappingPath(fmt.Sprint(m["path"])), branchName,
+				m["writeable"].(bool), mappingOptions(m))
+			added = append(added, m)
+		}
 	}
+
+	return root, added
 }
 
 /*
@@ -291,11 +493,13 @@ func (t *Tree) AddBranch(branchName string, branchRPC string, branchFingerprint
 		"fingerprint": branchFingerprint,
 	}
 
+	t.treeLock.Lock()
 	t.branchesAll = append(t.branchesAll, branchMap)
+	t.treeLock.Unlock()
 
 	// First ping the branch and see if we get a response
 
-	_, fp, err := t.client.SendPing(branchName, branchRPC)
+	fp, err := t.pingKnownBranch(branchName, branchRPC)
 
 	// Only add the branch as active if we've seen it
 
@@ -327,10 +531,35 @@ func (t *Tree) AddBranch(branchName string, branchRPC string, branchFingerprint
 	return err
 }
 
+/*
+MappingOptions are optional settings of a mapping.
+*/
+type MappingOptions struct {
+	Policy   string // Write policy for new items (the first policy of the writable mappings of a tree path is used)
+	Priority int    // Branches with a higher priority are read and listed first (across all tree paths)
+	Replica  bool   // The branch is a replica which shares reads with the other replicas of the tree path
+}
+
 /*
 AddMapping adds a mapping from tree path to a branch.
 */
 func (t *Tree) AddMapping(dir, branchName string, writable bool) error {
+	return t.AddMappingWithOptions(dir, branchName, writable, MappingOptions{})
+}
+
+/*
+AddMappingWithOptions adds a mapping from tree path to a branch with given
+options. The write policy determines which writable branches of the tree
+path receive new items. The priority determines the order of all branches
+which provide an item. Reads are spread across the branches of a tree path
+which are mapped as replicas.
+*/
+func (t *Tree) AddMappingWithOptions(dir, branchName string, writable bool, opts MappingOptions) error {
+
+	if !isWritePolicy(opts.Policy) {
+		return fmt.Errorf("Unknown write policy: %v", opts.Policy)
+	}
+
 	t.treeLock.Lock()
 	defer t.treeLock.Unlock()
 
@@ -342,6 +571,18 @@ func (t *Tree) AddMapping(dir, branchName string, writable bool) error {
 		"writeable": writable,
 	}
 
+	if opts.Policy != "" {
+		mappingMap["policy"] = opts.Policy
+	}
+
+	if opts.Priority != 0 {
+		mappingMap["priority"] = opts.Priority
+	}
+
+	if opts.Replica {
+		mappingMap["replica"] = true
+	}
+
 	t.mappingAll = append(t.mappingAll, mappingMap)
 
 	peers, _ := t.client.Peers()
@@ -351,9 +592,11 @@ func (t *Tree) AddMapping(dir, branchName string, writable bool) error {
 
 			// Split the given path and add the mapping
 
-			t.root.addMapping(createMappingPath(dir), branchName, writable)
+			t.root.addMapping(createMappingPath(dir), branchName, writable, opts)
 			t.mapping = append(t.mapping, mappingMap)
 
+			t.clearCaches()
+
 			err = nil
 		}
 	}
@@ -361,6 +604,25 @@ func (t *Tree) AddMapping(dir, branchName string, writable bool) error {
 	return err
 }
 
+/*
+mappingOptions returns the options of a given mapping configuration.
+*/
+func mappingOptions(m map[string]interface{}) MappingOptions {
+	var opts MappingOptions
+
+	opts.Policy, _ = m["policy"].(string)
+	opts.Replica, _ = m["replica"].(bool)
+
+	switch prio := m["priority"].(type) {
+	case int:
+		opts.Priority = prio
+	case float64:
+		opts.Priority = int(prio)
+	}
+
+	return opts
+}
+
 /*
 String returns a string representation of this tree.
 */
@@ -387,6 +649,7 @@ Dir returns file listings matching a given pattern of one or more directories.
 The contents of the given path is returned. Optionally, also the contents of
 all subdirectories can be returned if the recursive flag is set. The return
 values is a list of traversed directories and their corresponding contents.
+Items which are hidden by union markers are not returned.
 */
 func (t *Tree) Dir(dir string, pattern string, recursive bool, checksums bool) ([]string, [][]os.FileInfo, error) {
 	var err error
@@ -409,79 +672,22 @@ func (t *Tree) Dir(dir string, pattern string, recursive bool, checksums bool) (
 		dir = dir[:len(dir)-1]
 	}
 
-	treeVisitor := func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool) {
-
-		for _, b := range branches {
-			var res []byte
-
-			if err == nil {
-
-				res, err = t.client.SendData(b, map[string]string{
-					ParamAction:    OpDir,
-					ParamPath:      path.Join(branchPath...),
-					ParamPattern:   fmt.Sprint(pattern),
-					ParamRecursive: fmt.Sprint(recursive),
-					ParamChecksums: fmt.Sprint(checksums),
-				}, nil)
-
-				if err == nil {
-					var dest []interface{}
-
-					// Unpack the result
-
-					if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
-						bdirs := dest[0].([]string)
-						bfis := dest[1].([][]os.FileInfo)
-
-						// Construct the actual tree path for the returned directories
-
-						for i, d := range bdirs {
-							bdirs[i] = path.Join(treePath, d)
-
-							// Merge these results into the overall results
-
-							found := false
-							for j, dir := range dirs {
-
-								// Check if a directory from the result is already
-								// in the overall result
-
-								if dir == bdirs[i] {
-									found = true
-
-									// Create a map of existing names to avoid duplicates
-
-									existing := make(map[string]bool)
-									for _, fi := range fis[j] {
-										existing[fi.Name()] = true
-									}
-
-									// Only add new files to the overall result
+	// Check the directory listing cache
 
-									for _, fi := range bfis[i] {
-										if _, ok := existing[fi.Name()]; !ok {
-											fis[j] = append(fis[j], fi)
-										}
-									}
-								}
-							}
+	cacheKey := fmt.Sprintf("%v\x00%v\x00%v\x00%v", dir, pattern, recursive, checksums)
 
-							if !found {
-
-								// Just append if the directory is not in the
-								// overall results yet
-
-								dirs = append(dirs, bdirs[i])
-								fis = append(fis, bfis[i])
-							}
-						}
-					}
-				}
-			}
+	if t.dirCache != nil {
+		if cdirs, cfis, ok := t.dirCache.get(cacheKey); ok {
+			return cdirs, cfis, nil
 		}
 	}
 
-	t.root.findPathBranches("/", createMappingPath(dir), recursive, treeVisitor)
+	listings, err := t.branchListings(dir, pattern, recursive, checksums)
+
+	// Merge the listings of all branches - union markers of a branch hide
+	// the items of other branches
+
+	dirs, fis = mergeListings(listings, t.inUnion(dir, recursive))
 
 	// Add pseudo directories for mapping components which have no corresponding
 	// real directories
@@ -492,7 +698,7 @@ func (t *Tree) Dir(dir string, pattern string, recursive bool, checksums bool) (
 	}
 
 	t.root.findPathBranches("/", createMappingPath(dir), recursive,
-		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool) {
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
 
 			if !strings.HasPrefix(treePath, dir) {
 				return
@@ -540,110 +746,269 @@ func (t *Tree) Dir(dir string, pattern string, recursive bool, checksums bool) (
 			}
 		})
 
+	if err == nil && t.dirCache != nil {
+		t.dirCache.put(cacheKey, dir, dirs, fis)
+	}
+
 	return dirs, fis, err
 }
 
 /*
-Stat returns information about a given item. Use this function to find out
-if a given path is a file or directory.
+mergeListings merges the directory listings of several branches. Union
+markers of a branch hide the items of other branches if the union flag is
+set. Items of branches which come first in the given list take precedence.
 */
-func (t *Tree) Stat(item string) (os.FileInfo, error) {
-
-	dir, file := path.Split(item)
-
-	_, fis, err := t.Dir(dir, file, false, true)
+func mergeListings(listings []*branchListing, union bool) ([]string, [][]os.FileInfo) {
+	var dirs []string
+	var fis [][]os.FileInfo
 
-	if len(fis) == 1 {
-		for _, fi := range fis[0] {
-			if fi.Name() == file {
-				return fi, err
-			}
-		}
-	}
+	markers := newUnionMarkers(nil)
 
-	if err == nil {
-		err = &node.Error{
-			Type:       node.ErrRemoteAction,
-			Detail:     os.ErrNotExist.Error(),
-			IsNotExist: true,
-		}
+	if union {
+		markers = newUnionMarkers(listings)
 	}
 
-	return nil, err
-}
-
-/*
-Copy is a general purpose copy function which creates files and directories.
-Destination must be a directory. A non-existing destination
-directory will be created.
-*/
-func (t *Tree) Copy(src []string, dst string,
-	updFunc func(file string, writtenBytes, totalBytes, currentFile, totalFiles int64)) error {
-	var err error
-	var relPaths []string
-
-	files := make(map[string]os.FileInfo) // Make sure any file is only copied once
-	paths := make(map[string]string)
-
-	// Add files to be copied to items
+	for _, l := range listings {
+		for i, d := range l.dirs {
 
-	for _, s := range src {
-		var fi os.FileInfo
+			if markers.isHidden(l.branch, d) {
+				continue
+			}
 
-		fi, err = t.Stat(s)
+			bfis := l.fis[i]
 
-		if fi, err = t.Stat(s); fi != nil {
+			if union {
+				bfis = markers.filter(l.branch, d, bfis)
+			}
 
-			if fi.IsDir() {
+			// Merge these results into the overall results
 
-				// Find all files inside directories
+			found := false
+			for j, dir := range dirs {
 
-				if dirs, fis, err := t.Dir(s, "", true, false); err == nil {
+				// Check if a directory from the result is already
+				// in the overall result
 
-					for i, d := range dirs {
-						for _, fi2 := range fis[i] {
+				if dir == d {
+					found = true
 
-							if !fi2.IsDir() {
+					// Create a map of existing names to avoid duplicates
 
-								// Calculate the relative path by removing
-								// source path from the absolute path
+					existing := make(map[string]bool)
+					for _, fi := range fis[j] {
+						existing[fi.Name()] = true
+					}
 
-								relPath := path.Join(d, fi2.Name())[len(s):]
-								relPath = path.Join("/"+fi.Name(), relPath)
+					// Only add new files to the overall result
 
-								relPaths = append(relPaths, relPath)
-								files[relPath] = fi2
-								paths[relPath] = path.Join(d, fi2.Name())
-							}
+					for _, fi := range bfis {
+						if _, ok := existing[fi.Name()]; !ok {
+							fis[j] = append(fis[j], fi)
 						}
 					}
 				}
+			}
 
-			} else {
-
-				// Single files are just added - these files will always
-				// be at the root of the destination
+			if !found {
 
-				relPath := "/" + fi.Name()
+				// Just append if the directory is not in the
+				// overall results yet
 
-				relPaths = append(relPaths, relPath)
-				files[relPath] = fi
-				paths[relPath] = s
+				dirs = append(dirs, d)
+				fis = append(fis, bfis)
 			}
 		}
-
-		if err != nil {
-			err = fmt.Errorf("Cannot stat %v: %v", s, err.Error())
-			break
-		}
 	}
 
-	if err == nil {
-		var allFiles, cnt int64
+	return dirs, fis
+}
 
-		// Copy all found files
+/*
+branchListings returns the directory listings of all branches which are
+mapped under a given directory.
+*/
+func (t *Tree) branchListings(dir string, pattern string, recursive bool, checksums bool) ([]*branchListing, error) {
+	return t.collectListings(dir, recursive, map[string]string{
+		ParamAction:    OpDir,
+		ParamPattern:   fmt.Sprint(pattern),
+		ParamRecursive: fmt.Sprint(recursive),
+		ParamChecksums: fmt.Sprint(checksums),
+	})
+}
 
-		allFiles = int64(len(files))
+/*
+collectListings sends a given listing request to all branches which are
+mapped under a given directory. The path of each request is the directory
+within the branch. Branches only handle union markers if the directory is
+part of a union.
+*/
+func (t *Tree) collectListings(dir string, recursive bool, ctrl map[string]string) ([]*branchListing, error) {
+	var err error
+	var listings []*branchListing
+
+	union := fmt.Sprint(t.inUnion(dir, recursive))
+
+	t.root.findPathBranches("/", createMappingPath(dir), recursive,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+
+			for i, b := range branches {
+				var res []byte
+
+				if err == nil {
+
+					req := map[string]string{
+						ParamPath:  path.Join(branchPath...),
+						ParamUnion: union,
+					}
+
+					for k, v := range ctrl {
+						req[k] = v
+					}
+
+					res, err = t.client.SendData(b, req, nil)
+
+					if opts[i].Replica && isBranchFailure(err) {
+
+						// Replicas which cannot be reached are left out
+
+						t.replicas.record(b, 0, err)
+						err = nil
+
+					} else if err == nil {
+						var dest []interface{}
+
+						// Unpack the result
+
+						if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
+							bdirs := dest[0].([]string)
+							bfis := dest[1].([][]os.FileInfo)
+
+							// Construct the actual tree path for the returned directories
+
+							for i, d := range bdirs {
+
+								// Record file versions for the block cache
+
+								if t.cache != nil {
+									for _, fi := range bfis[i] {
+										t.cache.UpdateVersion(b, path.Join(d, fi.Name()), fi)
+									}
+								}
+
+								bdirs[i] = path.Join(treePath, d)
+							}
+
+							listings = append(listings, &branchListing{b, bdirs, bfis})
+						}
+					}
+				}
+			}
+		})
+
+	return listings, err
+}
+
+/*
+Stat returns information about a given item. Use this function to find out
+if a given path is a file or directory.
+*/
+func (t *Tree) Stat(item string) (os.FileInfo, error) {
+
+	dir, file := path.Split(item)
+
+	_, fis, err := t.Dir(dir, fmt.Sprintf("^%v$", regexp.QuoteMeta(file)), false, true)
+
+	if len(fis) == 1 {
+		for _, fi := range fis[0] {
+			if fi.Name() == file {
+				return fi, err
+			}
+		}
+	}
+
+	if err == nil {
+		err = &node.Error{
+			Type:       node.ErrRemoteAction,
+			Detail:     os.ErrNotExist.Error(),
+			IsNotExist: true,
+		}
+	}
+
+	return nil, err
+}
+
+/*
+Copy is a general purpose copy function which creates files and directories.
+Destination must be a directory. A non-existing destination
+directory will be created.
+*/
+func (t *Tree) Copy(src []string, dst string,
+	updFunc func(file string, writtenBytes, totalBytes, currentFile, totalFiles int64)) error {
+	var err error
+	var relPaths []string
+
+	files := make(map[string]os.FileInfo) // Make sure any file is only copied once
+	paths := make(map[string]string)
+
+	// Add files to be copied to items
+
+	for _, s := range src {
+		var fi os.FileInfo
+
+		fi, err = t.Stat(s)
+
+		if fi, err = t.Stat(s); fi != nil {
+
+			if fi.IsDir() {
+
+				// Find all files inside directories
+
+				if dirs, fis, err := t.Dir(s, "", true, false); err == nil {
+
+					for i, d := range dirs {
+						for _, fi2 := range fis[i] {
+
+							if !fi2.IsDir() {
+
+								// Calculate the relative path by removing
+								// source path from the absolute path
+
+								relPath := path.Join(d, fi2.Name())[len(s):]
+								relPath = path.Join("/"+fi.Name(), relPath)
+
+								relPaths = append(relPaths, relPath)
+								files[relPath] = fi2
+								paths[relPath] = path.Join(d, fi2.Name())
+							}
+						}
+					}
+				}
+
+			} else {
+
+				// Single files are just added - these files will always
+				// be at the root of the destination
+
+				relPath := "/" + fi.Name()
+
+				relPaths = append(relPaths, relPath)
+				files[relPath] = fi
+				paths[relPath] = s
+			}
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Cannot stat %v: %v", s, err.Error())
+			break
+		}
+	}
+
+	if err == nil {
+		var allFiles, cnt int64
+
+		// Copy all found files
+
+		allFiles = int64(len(files))
 
 		for _, k := range relPaths {
 			var totalSize, totalTransferred int64
@@ -680,19 +1045,134 @@ const (
 	SyncCopyFile        = "Copy file"
 	SyncRemoveDirectory = "Remove directory"
 	SyncRemoveFile      = "Remove file"
+	SyncResumeFile      = "Resume file"
+	SyncVerifyFile      = "Verify file"
+	SyncDeltaFile       = "Delta file"
+	SyncConflict        = "Conflict"
 )
 
+/*
+SyncOptions are optional settings of a sync.
+*/
+type SyncOptions struct {
+	DryRun       bool     `json:"dryrun"`       // Only report the operations of the sync without changing anything
+	Include      []string `json:"include"`      // Glob patterns of files which should be synced (all files if empty)
+	Exclude      []string `json:"exclude"`      // Glob patterns of files and directories which should not be synced
+	NoDelete     bool     `json:"nodelete"`     // Keep items in the destination which are not in the source
+	UpdateOnly   bool     `json:"updateonly"`   // Only replace destination files which are older than the source file
+	ChecksumOnly bool     `json:"checksumonly"` // Compare files only by checksum (sizes and modification times are ignored)
+}
+
+/*
+check checks that all glob patterns of the options are valid.
+*/
+func (o *SyncOptions) check() error {
+
+	for _, patterns := range [][]string{o.Include, o.Exclude} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("Invalid sync pattern %v: %v", p, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+matchesAny checks if a given item matches any of a list of glob patterns.
+Patterns are matched against the name and the relative path of the item.
+*/
+func matchesAny(patterns []string, rpath string) bool {
+	name := path.Base(rpath)
+	rpath = strings.TrimPrefix(rpath, "/")
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		} else if ok, _ = path.Match(p, rpath); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+isSynced checks if an item with a given relative path should be synced.
+Include patterns only apply to files.
+*/
+func (o *SyncOptions) isSynced(rpath string, isDir bool) bool {
+
+	if matchesAny(o.Exclude, rpath) {
+		return false
+	}
+
+	return isDir || len(o.Include) == 0 || matchesAny(o.Include, rpath)
+}
+
+/*
+isExcludedDir checks if a directory with a given relative path or one of
+its parent directories is excluded from the sync.
+*/
+func (o *SyncOptions) isExcludedDir(rpath string) bool {
+
+	for p := path.Clean("/" + rpath); p != "/"; p = path.Dir(p) {
+		if matchesAny(o.Exclude, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+needsUpdate checks if an existing destination file needs to be replaced by
+a given source file.
+*/
+func (o *SyncOptions) needsUpdate(srcFi, dstFi os.FileInfo) bool {
+
+	changed := srcFi.(*FileInfo).Checksum() != dstFi.(*FileInfo).Checksum()
+
+	if !o.ChecksumOnly {
+
+		changed = changed || srcFi.Size() != dstFi.Size()
+
+		if o.UpdateOnly && !srcFi.ModTime().After(dstFi.ModTime()) {
+			changed = false
+		}
+	}
+
+	return changed
+}
+
 /*
 Sync a given destination with a given source directory. After this command has
 finished the dstDir will have the same files and directories as the srcDir.
+Existing files of at least DeltaSyncMinSize bytes are updated with delta
+transfers which only send the changed parts of a file.
 */
 func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 	updFunc func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64)) error {
 
+	return t.SyncWithOptions(srcDir, dstDir, recursive, SyncOptions{}, updFunc)
+}
+
+/*
+SyncWithOptions syncs a given destination with a given source directory
+using given options. Files and directories can be left out of the sync with
+include and exclude patterns. Items in the destination are not deleted if
+they are left out of the sync or if deletion is disabled. A dry run reports
+all operations to the update function without performing them.
+*/
+func (t *Tree) SyncWithOptions(srcDir string, dstDir string, recursive bool, opts SyncOptions,
+	updFunc func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64)) error {
+
 	var currentFile, totalFiles int64
 
-	t.treeLock.RLock()
-	defer t.treeLock.RUnlock()
+	if err := opts.check(); err != nil {
+		return err
+	}
 
 	// doSync syncs a given src directory
 
@@ -706,16 +1186,23 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 		_, dstFis, err := t.Dir(ddir, "", false, true)
 
 		if err == nil {
-			fileMap := make(map[string]string) // Map to quickly lookup destination files
-			dirMap := make(map[string]bool)    // Map to quickly lookup destination directories
+			fileMap := make(map[string]os.FileInfo) // Map to quickly lookup destination files
+			dirMap := make(map[string]bool)         // Map to quickly lookup destination directories
 
 			if len(dstFis) > 0 {
 
 				for _, fi := range dstFis[0] {
+
+					// Items which are left out of the sync are never removed
+
+					if !opts.isSynced(path.Join(dir, fi.Name()), fi.IsDir()) {
+						continue
+					}
+
 					if fi.IsDir() {
 						dirMap[fi.Name()] = true
 					} else {
-						fileMap[fi.Name()] = fi.(*FileInfo).Checksum()
+						fileMap[fi.Name()] = fi
 					}
 				}
 			}
@@ -725,6 +1212,10 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 			for _, fi := range finfos {
 				currentFile++
 
+				if !opts.isSynced(path.Join(dir, fi.Name()), fi.IsDir()) {
+					continue
+				}
+
 				//  Check if we have a directory or a file
 
 				if fi.IsDir() {
@@ -737,10 +1228,12 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 							updFunc(SyncCreateDirectory, "", path.Join(ddir, fi.Name()), 0, 0, currentFile, totalFiles)
 						}
 
-						_, err = t.ItemOp(ddir, map[string]string{
-							ItemOpAction: ItemOpActMkDir,
-							ItemOpName:   fi.Name(),
-						})
+						if !opts.DryRun {
+							_, err = t.ItemOp(ddir, map[string]string{
+								ItemOpAction: ItemOpActMkDir,
+								ItemOpName:   fi.Name(),
+							})
+						}
 					}
 
 					// Remove existing directories from the map so we can
@@ -751,9 +1244,9 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 
 				} else {
 
-					fsum, ok := fileMap[fi.Name()]
+					dfi, ok := fileMap[fi.Name()]
 
-					if !ok || fsum != fi.(*FileInfo).Checksum() {
+					if !ok || opts.needsUpdate(fi, dfi) {
 						var u func(b int)
 
 						s := path.Join(sdir, fi.Name())
@@ -763,26 +1256,29 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 						// is not matching
 
 						if updFunc != nil {
-							var totalTransferred, totalSize int64
+							u = syncCopyUpdFunc(updFunc, s, d, fi.Size(), currentFile, totalFiles)
+						}
+
+						if opts.DryRun {
 
-							totalSize = fi.Size()
+							if updFunc != nil {
+								updFunc(SyncCopyFile, s, d, 0, fi.Size(), currentFile, totalFiles)
+							}
 
-							u = func(b int) {
+						} else {
 
-								if b >= 0 {
-									totalTransferred += int64(b)
-									updFunc(SyncCopyFile, s, d, totalTransferred, totalSize, currentFile, totalFiles)
-								} else {
-									updFunc(SyncCopyFile, s, d, int64(b), totalSize, currentFile, totalFiles)
-								}
+							if ok {
+								err = t.syncFile(s, d, fi, u)
+							} else {
+								err = t.CopyFile(s, d, u)
 							}
-						}
 
-						if err = t.CopyFile(s, d, u); err != nil && updFunc != nil {
+							if err != nil && updFunc != nil {
 
-							// Note at which point the error message was produced
+								// Note at which point the error message was produced
 
-							updFunc(SyncCopyFile, s, d, 0, fi.Size(), currentFile, totalFiles)
+								updFunc(SyncCopyFile, s, d, 0, fi.Size(), currentFile, totalFiles)
+							}
 						}
 					}
 
@@ -798,39 +1294,33 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 				}
 			}
 
-			if err == nil {
+			if err == nil && !opts.NoDelete {
 
 				// Remove files and directories which are in the destination but
 				// not in the source
 
-				for d := range dirMap {
+				remove := func(op string, name string) {
 					if err == nil {
 
 						if updFunc != nil {
-							p := path.Join(ddir, d)
-							updFunc(SyncRemoveDirectory, "", p, 0, 0, currentFile, totalFiles)
+							updFunc(op, "", path.Join(ddir, name), 0, 0, currentFile, totalFiles)
 						}
 
-						_, err = t.ItemOp(ddir, map[string]string{
-							ItemOpAction: ItemOpActDelete,
-							ItemOpName:   d,
-						})
+						if !opts.DryRun {
+							_, err = t.ItemOp(ddir, map[string]string{
+								ItemOpAction: ItemOpActDelete,
+								ItemOpName:   name,
+							})
+						}
 					}
 				}
 
-				for f := range fileMap {
-					if err == nil {
-
-						if updFunc != nil {
-							p := path.Join(ddir, f)
-							updFunc(SyncRemoveFile, "", p, 0, 0, currentFile, totalFiles)
-						}
+				for d := range dirMap {
+					remove(SyncRemoveDirectory, d)
+				}
 
-						_, err = t.ItemOp(ddir, map[string]string{
-							ItemOpAction: ItemOpActDelete,
-							ItemOpName:   f,
-						})
-					}
+				for f := range fileMap {
+					remove(SyncRemoveFile, f)
 				}
 			}
 		}
@@ -850,104 +1340,662 @@ func (t *Tree) Sync(srcDir string, dstDir string, recursive bool,
 		}
 
 		for i, dir := range srcDirs {
+			rdir := relPath(dir, srcDir)
+
+			// Skip the contents of excluded directories
+
+			if opts.isExcludedDir(rdir) {
+				continue
+			}
+
+			if err = doSync(rdir, srcFis[i]); err != nil {
+				break
+			}
+		}
+	}
+
+	return err
+}
+
+/*
+syncCopyUpdFunc creates an update function for a file copy of a sync which
+reports the copy progress as sync operations.
+*/
+func syncCopyUpdFunc(updFunc func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64),
+	srcFile, dstFile string, totalSize, currentFile, totalFiles int64) func(b int) {
+
+	var totalTransferred int64
+
+	return func(b int) {
+
+		if b >= 0 {
+			totalTransferred += int64(b)
+			updFunc(SyncCopyFile, srcFile, dstFile, totalTransferred, totalSize, currentFile, totalFiles)
+		} else if b == CopyStatusResumed {
+			updFunc(SyncResumeFile, srcFile, dstFile, 0, totalSize, currentFile, totalFiles)
+		} else if b == CopyStatusVerifying {
+			updFunc(SyncVerifyFile, srcFile, dstFile, 0, totalSize, currentFile, totalFiles)
+		} else if b == CopyStatusDelta {
+			updFunc(SyncDeltaFile, srcFile, dstFile, 0, totalSize, currentFile, totalFiles)
+		} else {
+			updFunc(SyncCopyFile, srcFile, dstFile, int64(b), totalSize, currentFile, totalFiles)
+		}
+	}
+}
+
+/*
+Copy status codes which are reported to update functions of file copies
+instead of a number of written bytes
+*/
+const (
+	CopyStatusFinished  = -1 // The file was copied
+	CopyStatusResumed   = -2 // The copy continues from a partially copied file
+	CopyStatusVerifying = -3 // The copied data is verified
+	CopyStatusDelta     = -4 // The file is updated with a delta transfer
+)
+
+/*
+CopyFileRetries is the number of times a failed file copy is retried
+*/
+var CopyFileRetries = 3
+
+/*
+CopyFileRetryInterval is the time to wait before a failed file copy is retried
+*/
+var CopyFileRetryInterval = time.Second
+
+/*
+CopyFile copies a given file. The data is written to a temporary file next
+to the destination which is renamed once its checksum has been verified. A
+failed copy is retried from the last confirmed offset of the temporary file -
+this also applies to later copies to the same destination. The given update
+function receives the number of newly written bytes or a copy status code.
+*/
+func (t *Tree) CopyFile(srcPath, dstPath string, updFunc func(writtenBytes int)) error {
+	var srcFi os.FileInfo
+	var reported int64
+	var err error
+
+	if updFunc == nil {
+		updFunc = func(int) {}
+	}
+
+	dstDir, dstFile := path.Split(dstPath)
+	tmpFile := copyTempFileName(dstFile)
+	tmpPath := path.Join(dstDir, tmpFile)
+
+	// Make sure the src exists (empty files report EOF) and get its checksum
+
+	if _, err = t.ReadFile(srcPath, []byte{}, 0); err == nil || IsEOF(err) {
+		srcFi, err = t.Stat(srcPath)
+	}
+
+	for attempt := 0; err == nil; attempt++ {
+		var offset int64
+
+		// Resume from the data which is already in the temporary file
+
+		if tmpFi, serr := t.Stat(tmpPath); serr == nil && tmpFi.Size() <= srcFi.Size() {
+			offset = tmpFi.Size()
+		}
+
+		if offset > 0 {
+			updFunc(CopyStatusResumed)
+		}
+
+		if offset > reported {
+
+			// Report data which was copied by a previous call
+
+			updFunc(int(offset - reported))
+			reported = offset
+		}
+
+		if err = t.copyFileData(srcPath, tmpPath, offset, func(pos int64) {
+
+			// Only report data which was not reported by a previous attempt
+
+			if pos > reported {
+				updFunc(int(pos - reported))
+				reported = pos
+			}
+
+		}); err == nil {
+
+			updFunc(CopyStatusVerifying)
+
+			if err = t.verifyCopy(srcFi, tmpPath); err != nil {
+
+				// Start again from the beginning
+
+				t.ItemOp(dstDir, map[string]string{
+					ItemOpAction: ItemOpActDelete,
+					ItemOpName:   tmpFile,
+				})
+
+			} else {
+
+				// Replace the destination with the verified file
+
+				if _, err = t.ItemOp(dstDir, map[string]string{
+					ItemOpAction:  ItemOpActRename,
+					ItemOpName:    tmpFile,
+					ItemOpNewName: dstFile,
+				}); err == nil {
+					updFunc(CopyStatusFinished)
+					break
+				}
+			}
+		}
+
+		if attempt >= CopyFileRetries || !isRetryableCopyError(err) {
+			break
+		}
+
+		node.LogDebug("Retrying copy of ", srcPath, " to ", dstPath, ": ", err)
+
+		time.Sleep(CopyFileRetryInterval)
+
+		err = nil
+	}
+
+	return err
+}
+
+/*
+copyFileData copies the data of a file from a given offset using a simple
+io.Pipe. The given function receives the position of the written data.
+*/
+func (t *Tree) copyFileData(srcPath, dstPath string, offset int64, posFunc func(pos int64)) error {
+	var err, rerr error
+
+	// Use a pipe to stream the contents of the source file to the destination file
+
+	pr, pw := io.Pipe()
+	done := make(chan bool)
+
+	// Read the source in a go routine
+
+	go func() {
+		rerr = t.readFileToBuffer(srcPath, offset, &positionWriter{pw, offset, posFunc})
+		pw.CloseWithError(rerr)
+		close(done)
+	}()
+
+	// Write the destination file - this will return once the
+	// writer is closed
+
+	err = t.writeFileFromBuffer(dstPath, offset, pr, false)
+
+	select {
+	case <-done:
+
+		// Read errors are reported before write errors if the reading
+		// finished first
+
+		if rerr != nil {
+			err = rerr
+		}
+
+	default:
+
+		// Reading is interrupted - the write error is the cause
+
+		pr.Close()
+		<-done
+	}
+
+	return err
+}
+
+/*
+verifyCopy checks that a copied file has the checksum of its source.
+*/
+func (t *Tree) verifyCopy(srcFi os.FileInfo, dstPath string) error {
+
+	dstFi, err := t.Stat(dstPath)
+
+	if err == nil {
+		srcSum := srcFi.(*FileInfo).Checksum()
+		dstSum := dstFi.(*FileInfo).Checksum()
+
+		if dstFi.Size() != srcFi.Size() || srcSum != dstSum {
+			err = ErrChecksumMismatch
+		}
+	}
+
+	return err
+}
+
+/*
+copyTempFileName returns the name of the temporary file which is used to
+copy a file.
+*/
+func copyTempFileName(name string) string {
+	return "." + name + ".rufspart"
+}
+
+/*
+isRetryableCopyError checks if a file copy should be retried after a given
+error.
+*/
+func isRetryableCopyError(err error) bool {
+
+	if err == ErrChecksumMismatch {
+		return true
+	}
+
+	rerr, ok := err.(*node.Error)
+
+	return ok && rerr.Type == node.ErrNodeComm
+}
+
+/*
+ReadFileToBuffer reads a complete file into a given buffer which implements
+io.Writer. The file is transferred as a single data stream.
+*/
+func (t *Tree) ReadFileToBuffer(spath string, buf io.Writer) error {
+	return t.readFileToBuffer(spath, 0, buf)
+}
+
+/*
+readSource is a group of branches which provide a file under the same branch
+path. Reads are spread across the branches if they are replicas.
+*/
+type readSource struct {
+	replica  bool     // Flag if the branches are replicas
+	rpath    string   // Path of the file on the branches
+	branches []string // Branches which provide the file
+}
+
+/*
+readSources returns the branches which provide a given file along with the
+branches on which the file is hidden.
+*/
+func (t *Tree) readSources(spath string) ([]*readSource, map[string]bool, error) {
+	var sources []*readSource
+
+	t.treeLock.RLock()
+	defer t.treeLock.RUnlock()
+
+	hidden, err := t.hiddenBranches(spath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dir, file := path.Split(spath)
+
+	t.root.findPathBranches(dir, createMappingPath(dir), false,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+			rpath := path.Join(branchPath...)
+			rpath = path.Join(rpath, file)
+
+			groups, replica := replicaGroups(branches, opts)
+
+			for i, g := range groups {
+				sources = append(sources, &readSource{replica[i], rpath, g})
+			}
+		})
+
+	return sources, hidden, nil
+}
+
+/*
+readFileToBuffer reads a file from a given offset into a given buffer. A
+read which fails after some data has been written is continued on another
+replica which has a file with the same size and checksum. The tree lock is
+only held while the branches of the file are resolved.
+*/
+func (t *Tree) readFileToBuffer(spath string, offset int64, buf io.Writer) error {
+	var success bool
+	var source string
+
+	sources, hidden, err := t.readSources(spath)
+
+	if err != nil {
+		return err
+	}
+
+	err = &node.Error{
+		Type:       node.ErrRemoteAction,
+		Detail:     os.ErrNotExist.Error(),
+		IsNotExist: true,
+	}
+
+	cw := &countingWriter{buf, 0, nil}
+
+	for _, s := range sources {
+		var infos map[string]os.FileInfo
+
+		branches, rpath := s.branches, s.rpath
+
+		if s.replica {
+			branches = t.replicas.order(branches)
+
+			// Get the size and checksum of the file on all replicas
+			// so an interrupted read can be continued on another one
+
+			if !success && cw.n == 0 && len(branches) > 1 {
+				infos = t.replicaInfos(branches, rpath)
+			}
+		}
+
+		for _, b := range branches {
+
+			// Only try other branches if we didn't have a success before
+			// and the given buffer did not fail
+
+			if success || hidden[b] || cw.err != nil {
+				continue
+			}
+
+			// Once data has been written only a replica with the same
+			// file can continue the read
+
+			if cw.n > 0 && (infos == nil || !isSameReplicaFile(infos[source], infos[b])) {
+				continue
+			}
+
+			err = t.client.SendStream(b, map[string]string{
+				ParamAction: OpRead,
+				ParamPath:   rpath,
+				ParamOffset: fmt.Sprint(offset + cw.n),
+			}, nil, cw)
+
+			success = err == nil
+
+			if s.replica && cw.err == nil {
+				t.replicas.record(b, 0, err)
+			}
+
+			if source == "" && cw.n > 0 {
+				source = b
+			}
+		}
+	}
+
+	return err
+}
+
+/*
+ReadFile reads up to len(p) bytes into p from the given offset. It
+returns the number of bytes read (0 <= n <= len(p)) and any error
+encountered.
+*/
+func (t *Tree) ReadFile(spath string, p []byte, offset int64) (int, error) {
+	var err error
+	var n int
+	var success bool
+
+	t.treeLock.RLock()
+	defer t.treeLock.RUnlock()
+
+	hidden, err := t.hiddenBranches(spath)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = &node.Error{
+		Type:       node.ErrRemoteAction,
+		Detail:     os.ErrNotExist.Error(),
+		IsNotExist: true,
+	}
+
+	dir, file := path.Split(spath)
+
+	t.root.findPathBranches(dir, createMappingPath(dir), false,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+
+			groups, replica := replicaGroups(branches, opts)
+
+			for i, bs := range groups {
+				isReplica := replica[i]
+
+				if isReplica {
+					bs = t.replicas.order(bs)
+				}
+
+				for _, b := range bs {
+
+					if !success && !hidden[b] { // Only try other branches if we didn't have a success before
+
+						var cached bool
+
+						rpath := path.Join(branchPath...)
+						rpath = path.Join(rpath, file)
+
+						read := func(bp []byte, boffset int64) (int, error) {
+							start := time.Now()
+							n, err := t.readBranchFile(b, rpath, bp, boffset)
+
+							if isReplica {
+								t.replicas.record(b, time.Since(start), err)
+							}
+
+							return n, err
+						}
+
+						if t.cache != nil {
+
+							// Try to serve the request through the block cache
+
+							n, cached, err = t.cache.ReadAt(b, rpath, p, offset, read)
+						}
+
+						if !cached {
+							n, err = read(p, offset)
+						}
+
+						success = err == nil
+
+						// Special case EOF
+
+						if IsEOF(err) {
+							success = true
+						}
+					}
+				}
+			}
+		})
+
+	return n, err
+}
+
+/*
+readBranchFile reads up to len(p) bytes of a file on a given branch from the
+given offset.
+*/
+func (t *Tree) readBranchFile(branch string, rpath string, p []byte, offset int64) (int, error) {
+	var n int
+
+	res, err := t.client.SendData(branch, map[string]string{
+		ParamAction: OpRead,
+		ParamPath:   rpath,
+		ParamOffset: fmt.Sprint(offset),
+		ParamSize:   fmt.Sprint(len(p)),
+	}, nil)
+
+	if err == nil {
+		var dest []interface{}
+
+		// Unpack the result
+
+		if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
+			n = dest[0].(int)
+			buf := dest[1].([]byte)
+
+			copy(p, buf)
+		}
+	}
+
+	return n, err
+}
+
+/*
+WriteFileFromBuffer writes a complete file from a given buffer which implements
+io.Reader. The file is transferred as a single data stream to all writable
+branches. Each branch writes the data into a temporary file which replaces
+the file once all branches received all data - other clients never see a
+partially written file and the file is unchanged if the transfer fails.
+*/
+func (t *Tree) WriteFileFromBuffer(spath string, buf io.Reader) error {
+	return t.writeFileFromBuffer(spath, 0, buf, true)
+}
+
+/*
+writeFileFromBuffer writes a file from a given offset with the data of a
+given buffer. The data is written using write sessions if the atomic flag
+is set. Otherwise the file is truncated after the written data. The tree
+lock is only held while the branches of the file are resolved.
+*/
+func (t *Tree) writeFileFromBuffer(spath string, offset int64, buf io.Reader, atomic bool) error {
+	var err error
+	var wg sync.WaitGroup
+	var branches, rpaths []string
+
+	defer t.invalidateCaches(spath)
+
+	t.treeLock.RLock()
+	branches, rpaths, err = t.writeBranches(spath)
+	union := fmt.Sprint(t.inUnion(path.Dir(path.Clean("/"+spath)), false))
+	t.treeLock.RUnlock()
+
+	if err != nil {
+		return err
+	} else if len(branches) == 0 {
+		return ErrNotWritable
+	}
+
+	if t.cache != nil {
+		defer func() {
+			for i, b := range branches {
+				t.cache.Invalidate(b, rpaths[i])
+			}
+		}()
+	}
+
+	sessions := make([]string, len(branches))
+
+	if atomic {
+
+		// Open a write session on every branch
+
+		for i, b := range branches {
+			var res []byte
+
+			if res, err = t.client.SendData(b, map[string]string{
+				ParamAction: OpOpenWrite,
+				ParamPath:   rpaths[i],
+				ParamUnion:  union,
+			}, nil); err == nil {
+				err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&sessions[i])
+			}
 
-			if err = doSync(relPath(dir, srcDir), srcFis[i]); err != nil {
-				break
+			if err != nil {
+				t.finishWriteSessions(OpAbortWrite, branches[:i], rpaths, sessions)
+				return err
 			}
 		}
 	}
 
-	return err
-}
+	// Stream the data to all writable branches in parallel
 
-/*
-CopyFile copies a given file using a simple io.Pipe.
-*/
-func (t *Tree) CopyFile(srcPath, dstPath string, updFunc func(writtenBytes int)) error {
-	var pw io.WriteCloser
-	var err, rerr error
+	errs := make([]error, len(branches))
+	writers := make([]io.Writer, len(branches))
+	pipeWriters := make([]*io.PipeWriter, len(branches))
 
-	t.treeLock.RLock()
-	defer t.treeLock.RUnlock()
+	for i, b := range branches {
+		pr, pw := io.Pipe()
 
-	// Use a pipe to stream the contents of the source file to the destination file
+		writers[i] = pw
+		pipeWriters[i] = pw
 
-	pr, pw := io.Pipe()
+		wg.Add(1)
 
-	if updFunc != nil {
+		go func(i int, b string, rpath string) {
+			defer wg.Done()
 
-		// Wrap the writer of the pipe
+			ctrl := map[string]string{
+				ParamAction: OpWrite,
+				ParamPath:   rpath,
+				ParamOffset: fmt.Sprint(offset),
+				ParamUnion:  union,
+			}
 
-		pw = &statusUpdatingWriter{pw, updFunc}
-	}
+			if atomic {
+				ctrl[ParamSession] = sessions[i]
+			} else {
+				ctrl[ParamReplace] = "true"
+			}
 
-	// Make sure the src exists
+			errs[i] = t.client.SendStream(b, ctrl, pr, nil)
 
-	if _, rerr = t.ReadFile(srcPath, []byte{}, 0); rerr == nil {
+			// Make sure writes to a failed branch do not block
 
-		// Read the source in a go routine
+			if errs[i] != nil {
+				pr.CloseWithError(errs[i])
+			} else {
+				pr.Close()
+			}
 
-		go func() {
-			rerr = t.ReadFileToBuffer(srcPath, pw)
-			pw.Close()
-		}()
+		}(i, b, rpaths[i])
+	}
 
-		// Write the destination file - this will return once the
-		// writer is closed
+	_, err = io.Copy(io.MultiWriter(writers...), buf)
 
-		err = t.WriteFileFromBuffer(dstPath, pr)
+	for _, pw := range pipeWriters {
+		pw.CloseWithError(err)
 	}
 
-	if rerr != nil {
-
-		// Check if we got an empty file
+	wg.Wait()
 
-		if IsEOF(rerr) {
+	// Errors reported by branches take precedence
 
-			_, err = t.WriteFile(dstPath, nil, 0)
+	for _, berr := range errs {
+		if berr != nil {
+			err = berr
+			break
+		}
+	}
 
-			updFunc(0) // Report the creation of the empty file
+	if atomic {
 
-			rerr = nil
+		// Replace the file on all branches only if all branches
+		// received all data
 
+		if err == nil {
+			err = t.finishWriteSessions(OpCommitWrite, branches, rpaths, sessions)
 		} else {
-
-			// Read errors are reported before write errors
-
-			err = rerr
+			t.finishWriteSessions(OpAbortWrite, branches, rpaths, sessions)
 		}
 	}
 
-	pr.Close()
-
 	return err
 }
 
 /*
-ReadFileToBuffer reads a complete file into a given buffer which implements
-io.Writer.
+finishWriteSessions commits or aborts the write sessions on a list of
+branches. Sessions are aborted once a commit has failed.
 */
-func (t *Tree) ReadFileToBuffer(spath string, buf io.Writer) error {
-	var n int
+func (t *Tree) finishWriteSessions(action string, branches []string, rpaths []string, sessions []string) error {
 	var err error
-	var offset int64
-
-	readBuf := make([]byte, DefaultReadBufferSize)
-
-	for err == nil {
-		n, err = t.ReadFile(spath, readBuf, offset)
-
-		if err == nil {
-			_, err = buf.Write(readBuf[:n])
 
-			offset += int64(n)
+	for i, b := range branches {
 
-		} else if IsEOF(err) {
+		if err != nil {
+			action = OpAbortWrite
+		}
 
-			// We reached the end of the file
+		_, berr := t.client.SendData(b, map[string]string{
+			ParamAction:  action,
+			ParamPath:    rpaths[i],
+			ParamSession: sessions[i],
+		}, nil)
 
-			err = nil
-			break
+		if err == nil && action == OpCommitWrite {
+			err = berr
 		}
 	}
 
@@ -955,96 +2003,184 @@ func (t *Tree) ReadFileToBuffer(spath string, buf io.Writer) error {
 }
 
 /*
-ReadFile reads up to len(p) bytes into p from the given offset. It
-returns the number of bytes read (0 <= n <= len(p)) and any error
-encountered.
+WriteFile writes p into the given file from the given offset. It
+returns the number of written bytes and any error encountered. A file which
+is only provided by read-only branches is copied to the first writable branch
+before it is written.
 */
-func (t *Tree) ReadFile(spath string, p []byte, offset int64) (int, error) {
-	var err error
+func (t *Tree) WriteFile(spath string, p []byte, offset int64) (int, error) {
 	var n int
-	var success bool
+	var branches, rpaths []string
+	var err error
 
 	t.treeLock.RLock()
 	defer t.treeLock.RUnlock()
 
-	err = &node.Error{
-		Type:       node.ErrRemoteAction,
-		Detail:     os.ErrNotExist.Error(),
-		IsNotExist: true,
+	defer func() {
+		t.invalidateCaches(spath)
+
+		if err == nil {
+
+			// The file is now on a writable branch - further writes
+			// do not need to check if it has to be copied
+
+			t.copyUpCache.put(spath, true, UnionMarkerCacheTTL)
+		}
+	}()
+
+	// Copy the file to a writable branch if necessary - otherwise find
+	// the branches which should receive the write
+
+	branch, rpath, err := t.copyUp(spath)
+
+	if err == nil {
+		if branch != "" {
+			branches, rpaths = []string{branch}, []string{rpath}
+		} else if branches, rpaths, err = t.writeBranches(spath); err == nil && len(branches) == 0 {
+			err = ErrNotWritable
+		}
 	}
 
+	union := fmt.Sprint(t.inUnion(path.Dir(path.Clean("/"+spath)), false))
+
+	for i, b := range branches {
+		var res []byte
+
+		if err == nil {
+
+			if t.cache != nil {
+				t.cache.Invalidate(b, rpaths[i])
+			}
+
+			if res, err = t.client.SendData(b, map[string]string{
+				ParamAction: OpWrite,
+				ParamPath:   rpaths[i],
+				ParamOffset: fmt.Sprint(offset),
+				ParamUnion:  union,
+			}, p); err == nil {
+				err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&n)
+			}
+		}
+	}
+
+	return n, err
+}
+
+/*
+copyUp copies a file which is only provided by read-only branches to the
+first writable branch. Returns the branch and the branch path of the copy.
+No branch is returned if the file does not need to be copied.
+*/
+func (t *Tree) copyUp(spath string) (string, string, error) {
+	var readOnly bool
+	var topBranch, src string
+
+	spath = path.Clean("/" + spath)
 	dir, file := path.Split(spath)
 
+	rpaths := make(map[string]string)
+	writableBranches := make(map[string]bool)
+
 	t.root.findPathBranches(dir, createMappingPath(dir), false,
-		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool) {
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
 
-			for _, b := range branches {
+			for i, b := range branches {
+
+				if _, ok := rpaths[b]; !ok {
+					rpaths[b] = path.Join(path.Join(branchPath...), file)
+				}
 
-				if !success { // Only try other branches if we didn't have a success before
+				if !writable[i] {
+					readOnly = true
+				} else if topBranch == "" {
+					topBranch = b
+				}
 
-					var res []byte
+				writableBranches[b] = writableBranches[b] || writable[i]
+			}
+		})
 
-					rpath := path.Join(branchPath...)
-					rpath = path.Join(rpath, file)
+	// Files can only be copied from read-only to writable branches
 
-					if res, err = t.client.SendData(b, map[string]string{
-						ParamAction: OpRead,
-						ParamPath:   rpath,
-						ParamOffset: fmt.Sprint(offset),
-						ParamSize:   fmt.Sprint(len(p)),
-					}, nil); err == nil {
-						var dest []interface{}
+	if topBranch == "" || !readOnly {
+		return "", "", nil
+	}
 
-						// Unpack the result
+	if _, ok := t.copyUpCache.get(spath); ok {
+		return "", "", nil
+	}
 
-						if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
-							n = dest[0].(int)
-							buf := dest[1].([]byte)
+	listings, markers, err := t.unionListing(spath)
 
-							copy(p, buf)
-						}
-					}
+	if err != nil {
+		return "", "", err
+	}
+
+	// Find the branch which supplies the file
+
+	for _, l := range listings {
+		for i, d := range l.dirs {
+
+			if path.Clean(d) != path.Clean(dir) || markers.isHidden(l.branch, spath) {
+				continue
+			}
+
+			for _, fi := range l.fis[i] {
+				if fi.Name() == file && !fi.IsDir() {
+
+					if writableBranches[l.branch] {
 
-					success = err == nil
+						// The file is already on a writable branch
 
-					// Special case EOF
+						return "", "", nil
 
-					if IsEOF(err) {
-						success = true
+					} else if src == "" {
+						src = l.branch
 					}
 				}
 			}
-		})
+		}
+	}
 
-	return n, err
+	if src == "" {
+		return "", "", nil
+	}
+
+	return topBranch, rpaths[topBranch], t.copyBranchFile(src, rpaths[src], topBranch, rpaths[topBranch])
 }
 
 /*
-WriteFileFromBuffer writes a complete file from a given buffer which implements
-io.Reader.
+copyUpItem copies an item which is only provided by read-only branches to the
+first writable branch. The contents of directories are copied recursively.
 */
-func (t *Tree) WriteFileFromBuffer(spath string, buf io.Reader) error {
-	var err error
-	var offset int64
-
-	writeBuf := make([]byte, DefaultReadBufferSize)
+func (t *Tree) copyUpItem(spath string, isDir bool) error {
 
-	for err == nil {
-		var n int
+	if !isDir {
+		_, _, err := t.copyUp(spath)
+		return err
+	}
 
-		if n, err = buf.Read(writeBuf); err == nil {
+	listings, err := t.branchListings(spath, "", true, false)
 
-			_, err = t.WriteFile(spath, writeBuf[:n], offset)
-			offset += int64(n)
+	if err == nil {
+		dirs, fis := mergeListings(listings, true)
 
-		} else if IsEOF(err) {
+		for i, d := range dirs {
 
-			// We reached the end of the file
+			// Directories are created explicitly so empty directories
+			// are copied as well
 
-			t.WriteFile(spath, []byte{}, offset)
+			if err = t.mkdirTopBranch(d); err != nil {
+				break
+			}
 
-			err = nil
-			break
+			for _, fi := range fis[i] {
+				if !fi.IsDir() {
+					if _, _, err = t.copyUp(path.Join(d, fi.Name())); err != nil {
+						return err
+					}
+				}
+			}
 		}
 	}
 
@@ -1052,57 +2188,121 @@ func (t *Tree) WriteFileFromBuffer(spath string, buf io.Reader) error {
 }
 
 /*
-WriteFile writes p into the given file from the given offset. It
-returns the number of written bytes and any error encountered.
+mkdirTopBranch creates a directory on the first writable branch of a union.
 */
-func (t *Tree) WriteFile(spath string, p []byte, offset int64) (int, error) {
-	var err error
-	var n, totalCount, ignoreCount int
-
-	t.treeLock.RLock()
-	defer t.treeLock.RUnlock()
+func (t *Tree) mkdirTopBranch(spath string) error {
+	var topBranch, topPath string
 
-	dir, file := path.Split(spath)
+	spath = path.Clean("/" + spath)
+	dir, name := path.Split(spath)
 
 	t.root.findPathBranches(dir, createMappingPath(dir), false,
-		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool) {
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
 
 			for i, b := range branches {
-				var res []byte
+				if writable[i] && topBranch == "" {
+					topBranch, topPath = b, path.Join(branchPath...)
+				}
+			}
+		})
 
-				if err == nil {
+	if topBranch == "" {
+		return ErrNotWritable
+	}
 
-					totalCount++
+	if t.cache != nil {
+		t.cache.Invalidate(topBranch, path.Join(topPath, name))
+	}
 
-					if !writable[i] {
+	_, err := t.client.SendData(topBranch, map[string]string{
+		ParamAction:  OpItemOp,
+		ParamPath:    topPath,
+		ParamUnion:   "true",
+		ItemOpAction: ItemOpActMkDir,
+		ItemOpName:   name,
+	}, nil)
 
-						// Ignore all non-writable branches
+	return err
+}
 
-						ignoreCount++
+/*
+copyBranchFile copies a file from one branch to another. The destination
+file is only replaced once all data has been copied. Files are only copied
+between branches of a union.
+*/
+func (t *Tree) copyBranchFile(src, srcPath, dst, dstPath string) error {
+	var session string
+	var rerr error
 
-						continue
-					}
+	res, err := t.client.SendData(dst, map[string]string{
+		ParamAction: OpOpenWrite,
+		ParamPath:   dstPath,
+		ParamUnion:  "true",
+	}, nil)
 
-					rpath := path.Join(branchPath...)
-					rpath = path.Join(rpath, file)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&session)
+	}
 
-					if res, err = t.client.SendData(b, map[string]string{
-						ParamAction: OpWrite,
-						ParamPath:   rpath,
-						ParamOffset: fmt.Sprint(offset),
-					}, p); err == nil {
-						err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&n)
-					}
-				}
-			}
+	if err != nil {
+		return err
+	}
 
-		})
+	// Stream the file from the source to the destination branch
+
+	pr, pw := io.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		rerr = t.client.SendStream(src, map[string]string{
+			ParamAction: OpRead,
+			ParamPath:   srcPath,
+			ParamOffset: "0",
+		}, nil, pw)
+		pw.CloseWithError(rerr)
+		close(done)
+	}()
+
+	err = t.client.SendStream(dst, map[string]string{
+		ParamAction:  OpWrite,
+		ParamPath:    dstPath,
+		ParamOffset:  "0",
+		ParamSession: session,
+	}, pr, nil)
+
+	select {
+	case <-done:
+
+		// Read errors are reported before write errors if the reading
+		// finished first
+
+		if rerr != nil {
+			err = rerr
+		}
+
+	default:
+
+		// Reading is interrupted - the write error is the cause
+
+		pr.Close()
+		<-done
 
-	if err == nil && totalCount == ignoreCount {
-		err = fmt.Errorf("All applicable branches for the requested path were mounted as not writable")
+		if err == nil {
+			err = rerr
+		}
 	}
 
-	return n, err
+	if t.cache != nil {
+		t.cache.Invalidate(dst, dstPath)
+	}
+
+	if err == nil {
+		return t.finishWriteSessions(OpCommitWrite, []string{dst}, []string{dstPath}, []string{session})
+	}
+
+	t.finishWriteSessions(OpAbortWrite, []string{dst}, []string{dstPath}, []string{session})
+
+	return err
 }
 
 /*
@@ -1118,6 +2318,8 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 	t.treeLock.RLock()
 	defer t.treeLock.RUnlock()
 
+	defer t.invalidateCaches(dir)
+
 	data := make(map[string]string)
 
 	for k, v := range opdata {
@@ -1125,6 +2327,7 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 	}
 
 	data[ParamAction] = OpItemOp
+	data[ParamUnion] = fmt.Sprint(t.inUnion(dir, false))
 
 	// Check if we should recurse
 
@@ -1132,16 +2335,69 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 		recurse = strings.HasSuffix(r, "**")
 	}
 
+	// Deletes and renames of single items need to know which branches
+	// provide the item - the item has to be hidden on branches which
+	// cannot be changed
+
+	var providers, newProviders map[string]os.FileInfo
+	var topBranch, topPath string
+
+	action := data[ItemOpAction]
+	_, name := path.Split(data[ItemOpName])
+	_, newName := path.Split(data[ItemOpNewName])
+
+	unionOp := (action == ItemOpActDelete || action == ItemOpActRename) &&
+		name != "" && !strings.Contains(name, "*") && data[ParamUnion] == "true"
+
+	if unionOp {
+		if providers, err = t.itemProviders(path.Join(dir, name)); err == nil {
+			if err = t.checkHideable(dir, providers); err == nil && action == ItemOpActRename {
+				if newProviders, err = t.itemProviders(path.Join(dir, newName)); err == nil {
+					err = t.copyUpRenamed(dir, name, providers)
+				}
+			}
+		}
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// New directories are only created on the branches which are selected
+	// by the write policies
+
+	var targets map[string]bool
+
+	if action == ItemOpActMkDir && name != "" {
+		var branches []string
+
+		if branches, _, err = t.writeBranches(path.Join(dir, name)); err != nil {
+			return false, err
+		}
+
+		targets = stringSet(branches)
+	}
+
+	writableBranches := make(map[string]bool)
+
 	t.root.findPathBranches(dir, createMappingPath(dir), recurse,
 		func(item *treeItem, treePath string, branchPath []string,
-			branches []string, writable []bool) {
+			branches []string, writable []bool, opts []MappingOptions) {
 
 			for i, b := range branches {
 				var res []byte
 
 				totalCount++
 
-				if !writable[i] {
+				if writable[i] {
+					writableBranches[b] = true
+
+					if topBranch == "" {
+						topBranch, topPath = b, path.Join(branchPath...)
+					}
+				}
+
+				if !writable[i] || (targets != nil && !targets[b]) {
 
 					// Ignore all non-writable branches
 
@@ -1154,6 +2410,10 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 
 					data[ParamPath] = path.Join(branchPath...)
 
+					if t.cache != nil {
+						t.cache.Invalidate(b, data[ParamPath])
+					}
+
 					res, err = t.client.SendData(b, data, nil)
 
 					if rerr, ok := err.(*node.Error); ok && rerr.IsNotExist {
@@ -1178,7 +2438,7 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 		})
 
 	if totalCount == ignoreCount {
-		err = fmt.Errorf("All applicable branches for the requested path were mounted as not writable")
+		err = ErrNotWritable
 	} else if totalCount == notFoundCount+ignoreCount {
 		err = &node.Error{
 			Type:       node.ErrRemoteAction,
@@ -1187,6 +2447,97 @@ func (t *Tree) ItemOp(dir string, opdata map[string]string) (bool, error) {
 		}
 	}
 
+	if unionOp && topBranch != "" {
+		ret, err = t.updateUnionMarkers(action, topBranch, topPath, name, newName,
+			providers, newProviders, writableBranches, ret, err)
+	}
+
+	return ret, err
+}
+
+/*
+copyUpRenamed copies an item which should be renamed to the first writable
+branch if it is only provided by read-only branches. The copy is renamed and
+the original item is hidden afterwards.
+*/
+func (t *Tree) copyUpRenamed(dir string, name string, providers map[string]os.FileInfo) error {
+	var isDir bool
+
+	writableBranches := make(map[string]bool)
+
+	t.root.findPathBranches(dir, createMappingPath(dir), false,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+
+			for i, b := range branches {
+				writableBranches[b] = writableBranches[b] || writable[i]
+			}
+		})
+
+	for b, fi := range providers {
+		if writableBranches[b] {
+			return nil
+		}
+
+		isDir = isDir || fi.IsDir()
+	}
+
+	if len(providers) == 0 || len(writableBranches) == 0 {
+		return nil
+	}
+
+	return t.copyUpItem(path.Join(dir, name), isDir)
+}
+
+/*
+updateUnionMarkers hides items on branches which could not be changed by a
+delete or rename operation. Markers are written to the top writable branch.
+*/
+func (t *Tree) updateUnionMarkers(action string, topBranch string, topPath string,
+	name string, newName string, providers map[string]os.FileInfo,
+	newProviders map[string]os.FileInfo, writableBranches map[string]bool,
+	ret bool, err error) (bool, error) {
+
+	var isDir bool
+
+	// Check if the item is provided by a branch which was not changed
+
+	unchanged := func(providers map[string]os.FileInfo) bool {
+		res := false
+		for b := range providers {
+			res = res || !writableBranches[b]
+		}
+		return res
+	}
+
+	if !unchanged(providers) {
+		return ret, err
+	}
+
+	for _, fi := range providers {
+		isDir = isDir || fi.IsDir()
+	}
+
+	if rerr, ok := err.(*node.Error); ok && rerr.IsNotExist && action == ItemOpActDelete {
+
+		// The item was only provided by branches which cannot be changed
+
+		err = nil
+	}
+
+	if err == nil && (ret || action == ItemOpActDelete) {
+
+		if err = t.writeUnionMarker(topBranch, path.Join(topPath, WhiteoutPrefix+name)); err == nil &&
+			action == ItemOpActRename && isDir && unchanged(newProviders) {
+
+			// A renamed directory must not show the contents of a directory
+			// with the new name on other branches
+
+			err = t.writeUnionMarker(topBranch, path.Join(topPath, newName, OpaqueMarker))
+		}
+
+		ret = err == nil
+	}
+
 	return ret, err
 }
 
@@ -1327,30 +2678,47 @@ func (f fileInfoSlice) Len() int           { return len(f) }
 func (f fileInfoSlice) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
 func (f fileInfoSlice) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
 
-// Helper object to given status updates when copying files
+// Helper object to count written bytes
 
 /*
-statusUpdatingWriter is an internal io.WriteCloser which is used for status
-updates.
+countingWriter is an internal io.Writer which counts the written bytes.
 */
-type statusUpdatingWriter struct {
-	io.WriteCloser
-	statusUpdate func(writtenBytes int)
+type countingWriter struct {
+	io.Writer
+	n   int64
+	err error // Error of the underlying writer
 }
 
 /*
 Write writes len(p) bytes from p to the writer.
 */
-func (w *statusUpdatingWriter) Write(p []byte) (int, error) {
-	n, err := w.WriteCloser.Write(p)
-	w.statusUpdate(n)
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	if err != nil {
+		w.err = err
+	}
 	return n, err
 }
 
+// Helper object to given status updates when copying files
+
+/*
+positionWriter is an internal io.Writer which reports the position of the
+written data.
+*/
+type positionWriter struct {
+	io.Writer
+	pos       int64
+	posUpdate func(pos int64)
+}
+
 /*
-Close closes the writer.
+Write writes len(p) bytes from p to the writer.
 */
-func (w *statusUpdatingWriter) Close() error {
-	w.statusUpdate(-1)
-	return w.WriteCloser.Close()
+func (w *positionWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.pos += int64(n)
+	w.posUpdate(w.pos)
+	return n, err
 }
@@ -28,18 +28,79 @@ type treeItem struct {
 	children            map[string]*treeItem // Mapping from path component to branch
 	remoteBranches      []string             // List of remote branches which are present on this level
 	remoteBranchWriting []bool               // Flag if the remote branch should receive write requests
+	remoteBranchOpts    []MappingOptions     // Options of the mapping of the remote branch
+	nextWrite           uint32               // Counter for round-robin writes
+}
+
+/*
+pathVisit is a visit of a range of branches of a tree item.
+*/
+type pathVisit struct {
+	item       *treeItem // Visited tree item
+	treePath   string    // Path of the item within the tree
+	branchPath []string  // Subpath within the branches
+	start      int       // Index of the first visited branch
+	end        int       // Index after the last visited branch
 }
 
 /*
 findPathBranches finds all relevant branches for a single path. The iterator
-function receives 4 parameters: The tree item, the total path within the tree,
-the subpath within the branch and a list of all branches for the tree path.
-Calling code should always give a treePath of "/".
+function receives 6 parameters: The tree item, the total path within the tree,
+the subpath within the branch, a list of branches for the tree path, their
+writable flags and their mapping options. Items without branches are visited
+first. Branches are visited in the order of their priority - branches with the
+same priority are visited in the order of the traversal (i.e. branches which
+are mapped higher up in the tree come first). Calling code should always give
+a treePath of "/".
 */
 func (t *treeItem) findPathBranches(treePath string, branchPath []string,
-	recursive bool, visit func(*treeItem, string, []string, []string, []bool)) {
+	recursive bool, visit func(*treeItem, string, []string, []string, []bool, []MappingOptions)) {
+
+	var visits, ordered, branchVisits []*pathVisit
+
+	t.collectPathVisits(treePath, branchPath, recursive, &visits)
+
+	// Split the visits of items with branches into visits of single branches
+
+	for _, v := range visits {
+
+		if len(v.item.remoteBranches) == 0 {
+			ordered = append(ordered, v)
+		}
 
-	visit(t, treePath, branchPath, t.remoteBranches, t.remoteBranchWriting)
+		for i := range v.item.remoteBranches {
+			branchVisits = append(branchVisits, &pathVisit{v.item, v.treePath, v.branchPath, i, i + 1})
+		}
+	}
+
+	sort.SliceStable(branchVisits, func(i, j int) bool {
+		return branchVisits[i].item.remoteBranchOpts[branchVisits[i].start].Priority >
+			branchVisits[j].item.remoteBranchOpts[branchVisits[j].start].Priority
+	})
+
+	// Join the visits of consecutive branches of the same item
+
+	for _, v := range branchVisits {
+		if n := len(ordered); n > 0 && ordered[n-1].item == v.item && ordered[n-1].end == v.start {
+			ordered[n-1].end = v.end
+		} else {
+			ordered = append(ordered, v)
+		}
+	}
+
+	for _, v := range ordered {
+		visit(v.item, v.treePath, v.branchPath, v.item.remoteBranches[v.start:v.end],
+			v.item.remoteBranchWriting[v.start:v.end], v.item.remoteBranchOpts[v.start:v.end])
+	}
+}
+
+/*
+collectPathVisits collects the visits of all tree items for a single path.
+*/
+func (t *treeItem) collectPathVisits(treePath string, branchPath []string,
+	recursive bool, visits *[]*pathVisit) {
+
+	*visits = append(*visits, &pathVisit{t, treePath, branchPath, 0, len(t.remoteBranches)})
 
 	if len(branchPath) > 0 {
 
@@ -47,8 +108,8 @@ func (t *treeItem) findPathBranches(treePath string, branchPath []string,
 
 			// Check if a subpath matches
 
-			c.findPathBranches(path.Join(treePath, branchPath[0]),
-				branchPath[1:], recursive, visit)
+			c.collectPathVisits(path.Join(treePath, branchPath[0]),
+				branchPath[1:], recursive, visits)
 		}
 
 	} else if recursive {
@@ -61,8 +122,8 @@ func (t *treeItem) findPathBranches(treePath string, branchPath []string,
 		sort.Strings(childNames)
 
 		for _, n := range childNames {
-			t.children[n].findPathBranches(path.Join(treePath, n),
-				branchPath, recursive, visit)
+			t.children[n].collectPathVisits(path.Join(treePath, n),
+				branchPath, recursive, visits)
 		}
 	}
 }
@@ -70,7 +131,7 @@ func (t *treeItem) findPathBranches(treePath string, branchPath []string,
 /*
 addMapping adds a new mapping.
 */
-func (t *treeItem) addMapping(mappingPath []string, branchName string, writable bool) {
+func (t *treeItem) addMapping(mappingPath []string, branchName string, writable bool, opts MappingOptions) {
 
 	// Add mapping to a child
 
@@ -86,21 +147,36 @@ func (t *treeItem) addMapping(mappingPath []string, branchName string, writable
 
 		child, ok := t.children[childName]
 		if !ok {
-			child = &treeItem{make(map[string]*treeItem), []string{}, []bool{}}
+			child = &treeItem{make(map[string]*treeItem), []string{}, []bool{}, []MappingOptions{}, 0}
 			t.children[childName] = child
 		}
 
 		// Add rest of the mapping to the child
 
-		child.addMapping(rest, branchName, writable)
+		child.addMapping(rest, branchName, writable, opts)
 
 		return
 	}
 
-	// Add branch name to this branch - keep the order in which the branches were added
+	// Add branch name to this branch - branches are sorted by priority and
+	// keep the order in which they were added if they have the same priority
 
-	t.remoteBranches = append(t.remoteBranches, branchName)
-	t.remoteBranchWriting = append(t.remoteBranchWriting, writable)
+	i := len(t.remoteBranches)
+	for i > 0 && t.remoteBranchOpts[i-1].Priority < opts.Priority {
+		i--
+	}
+
+	t.remoteBranches = append(t.remoteBranches, "")
+	copy(t.remoteBranches[i+1:], t.remoteBranches[i:])
+	t.remoteBranches[i] = branchName
+
+	t.remoteBranchWriting = append(t.remoteBranchWriting, false)
+	copy(t.remoteBranchWriting[i+1:], t.remoteBranchWriting[i:])
+	t.remoteBranchWriting[i] = writable
+
+	t.remoteBranchOpts = append(t.remoteBranchOpts, MappingOptions{})
+	copy(t.remoteBranchOpts[i+1:], t.remoteBranchOpts[i:])
+	t.remoteBranchOpts[i] = opts
 }
 
 /*
@@ -111,16 +187,32 @@ func (t *treeItem) String(indent int, buf *bytes.Buffer) {
 	for i, b := range t.remoteBranches {
 		buf.WriteString(b)
 
+		mode := "r"
 		if t.remoteBranchWriting[i] {
-			buf.WriteString("(w)")
-		} else {
-			buf.WriteString("(r)")
+			mode = "w"
 		}
 
+		opts := t.remoteBranchOpts[i]
+
+		if opts.Priority != 0 {
+			mode = fmt.Sprintf("%v:%v", mode, opts.Priority)
+		}
+
+		if opts.Policy != "" {
+			mode = fmt.Sprintf("%v %v", mode, opts.Policy)
+		}
+
+		if opts.Replica {
+			mode += " replica"
+		}
+
+		buf.WriteString(fmt.Sprintf("(%v)", mode))
+
 		if i < len(t.remoteBranches)-1 {
 			buf.WriteString(", ")
 		}
 	}
+
 	buf.WriteString("\n")
 
 	names := make([]string, 0, len(t.children))
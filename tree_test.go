@@ -17,10 +17,13 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"devt.de/krotik/common/bitutil"
 	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/common/fileutil"
 	"devt.de/krotik/common/pools"
 	"devt.de/krotik/rufs/config"
 	"devt.de/krotik/rufs/node"
@@ -1021,6 +1024,21 @@ drwxrwxrwx 4.0 KiB sub1
 		return
 	}
 
+	if !IsNotWritable(err) || IsNotWritable(nil) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if !IsNotWritable(&node.Error{Type: node.ErrRemoteAction, Detail: "Branch footest3 is read-only", IsReadOnly: true}) {
+		t.Error("Remote read-only error should be detected")
+		return
+	}
+
+	if IsNotWritable(&node.Error{Type: node.ErrRemoteAction, Detail: "foo is read-only"}) {
+		t.Error("Unexpected result")
+		return
+	}
+
 	ok, err = tree.ItemOp("/1/sub1", map[string]string{
 		ItemOpAction: ItemOpActDelete,
 		ItemOpName:   "test_to_delete",
@@ -1199,6 +1217,317 @@ drwxrwxrwx 4.0 KiB bbb
 	errorutil.AssertOk(os.RemoveAll("./foo/sub1/bbb"))
 }
 
+func TestItemOpTruncate(t *testing.T) {
+
+	// Build up a tree from one branch
+
+	cfg := map[string]interface{}{
+		config.TreeSecret: "123",
+	}
+
+	tree, _ := NewTree(cfg, clientCert)
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	tree.AddBranch("footest", branchRPC, "")
+
+	tree.AddMapping("/1", "footest", true)
+
+	os.Mkdir("foo/trtest", 0770)
+	defer os.RemoveAll("foo/trtest")
+
+	ioutil.WriteFile("foo/trtest/test1", []byte("Test1 file"), 0660)
+
+	// Shrink a file
+
+	ok, err := tree.ItemOp("/1/trtest", map[string]string{
+		ItemOpAction: ItemOpActTruncate,
+		ItemOpName:   "test1",
+		ItemOpSize:   "5",
+	})
+
+	if !ok || err != nil {
+		t.Error(ok, err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/trtest/test1"); string(data) != "Test1" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	// Grow a file
+
+	ok, err = tree.ItemOp("/1/trtest", map[string]string{
+		ItemOpAction: ItemOpActTruncate,
+		ItemOpName:   "test1",
+		ItemOpSize:   "7",
+	})
+
+	if data, _ := ioutil.ReadFile("foo/trtest/test1"); !ok || err != nil || string(data) != "Test1\x00\x00" {
+		t.Error("Unexpected result:", ok, err, data)
+		return
+	}
+
+	// Error cases
+
+	if _, err = tree.ItemOp("/1/trtest", map[string]string{
+		ItemOpAction: ItemOpActTruncate,
+		ItemOpName:   "test1",
+		ItemOpSize:   "foo",
+	}); err == nil || !strings.Contains(err.Error(), "invalid syntax") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = tree.ItemOp("/1/trtest", map[string]string{
+		ItemOpAction: ItemOpActTruncate,
+		ItemOpName:   "test2",
+		ItemOpSize:   "1",
+	}); err == nil || err.Error() != "RufsError: Remote error (truncate /trtest/test2: no such file or directory)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Replacing writes cut off the old tail of a file
+
+	ioutil.WriteFile("foo/trtest/test2", []byte("Old longer content"), 0660)
+
+	if err = footest.WriteFileFromBuffer("/trtest/test2", bytes.NewBufferString("New")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/trtest/test2"); string(data) != "New" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	if err = tree.writeFileFromBuffer("/1/trtest/test2", 1, bytes.NewBufferString("ot"), false); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/trtest/test2"); string(data) != "Not" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	// Normal writes keep the rest of the file
+
+	if _, err = tree.WriteFile("/1/trtest/test2", []byte("H"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/trtest/test2"); string(data) != "Hot" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+}
+
+func TestWriteFileCopyUp(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", false))
+
+	os.Mkdir("bar/cutest", 0770)
+	defer os.RemoveAll("foo/cutest")
+	defer os.RemoveAll("bar/cutest")
+
+	ioutil.WriteFile("bar/cutest/test1", []byte("Lower file content"), 0660)
+
+	// The first write copies the whole file to the writable branch
+
+	if n, err := tree.WriteFile("/cutest/test1", []byte("LOWER"), 0); n != 5 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/cutest/test1"); string(data) != "LOWER file content" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("bar/cutest/test1"); string(data) != "Lower file content" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	// Further writes go to the copy
+
+	if n, err := tree.WriteFile("/cutest/test1", []byte("FILE"), 6); n != 4 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	var bb bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/cutest/test1", &bb); err != nil || bb.String() != "LOWER FILE content" {
+		t.Error("Unexpected result:", bb.String(), err)
+		return
+	}
+
+	if res := dirLocal("foo/cutest"); res != "test1(18)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Further writes do not need to check if the file should be copied
+
+	if _, ok := tree.copyUpCache.get("/cutest/test1"); !ok {
+		t.Error("Copy-up check should be cached")
+		return
+	}
+
+	if _, err := tree.ItemOp("/cutest", map[string]string{
+		ItemOpAction: ItemOpActTruncate,
+		ItemOpName:   "test1",
+		ItemOpSize:   "18",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := tree.copyUpCache.get("/cutest/test1"); ok {
+		t.Error("Copy-up check should be removed if the directory changes")
+		return
+	}
+
+	// New files are written as before
+
+	if _, err := tree.WriteFile("/cutest/test2", []byte("New"), 2); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/cutest"); res != "test1(18)\ntest2(5)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Mapping changes remove all cached copy-up checks
+
+	if _, ok := tree.copyUpCache.get("/cutest/test2"); !ok {
+		t.Error("Copy-up check should be cached")
+		return
+	}
+
+	errorutil.AssertOk(tree.AddMapping("/cutest", "bartest", false))
+
+	if len(tree.copyUpCache.entries) != 0 {
+		t.Error("Unexpected result:", tree.copyUpCache.entries)
+		return
+	}
+}
+
+func TestMappingPriority(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", false))
+	errorutil.AssertOk(tree.AddMappingWithOptions("/", "bartest", false, MappingOptions{Priority: 10}))
+
+	// Branches with a higher priority come first
+
+	if res := tree.String(); res != "/: bartest(r:10), footest(r)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The file of the branch with the highest priority is read and listed
+
+	var bb bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/test1", &bb); err != nil || bb.String() != "Test3 file" {
+		t.Error("Unexpected result:", bb.String(), err)
+		return
+	}
+
+	buf := make([]byte, 10)
+
+	if n, err := tree.ReadFile("/test1", buf, 0); err != nil || string(buf[:n]) != "Test3 file" {
+		t.Error("Unexpected result:", string(buf[:n]), err)
+		return
+	}
+
+	if fi, err := tree.Stat("/test1"); err != nil || fi.(*FileInfo).FiChecksum != "5b62da0f" {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+
+	// The priority is part of the tree configuration
+
+	conf := tree.Config()
+
+	if !strings.Contains(conf, `"priority": 10`) {
+		t.Error("Unexpected result:", conf)
+		return
+	}
+
+	errorutil.AssertOk(tree.SetMapping(conf))
+
+	if res := tree.String(); res != "/: bartest(r:10), footest(r)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	tree.Refresh()
+
+	if res := tree.String(); res != "/: bartest(r:10), footest(r)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Priorities also order branches which are mapped under different
+	// tree paths
+
+	os.Mkdir("foo/mpdeep", 0770)
+	defer os.RemoveAll("foo/mpdeep")
+
+	ioutil.WriteFile("foo/mpdeep/test1", []byte("Deep file"), 0660)
+
+	for _, prio := range []int{0, 10} {
+		expected := "Deep file"
+		if prio > 0 {
+			expected = "Test3 file"
+		}
+
+		tree.Reset(false)
+		errorutil.AssertOk(tree.AddMapping("/", "footest", false))
+		errorutil.AssertOk(tree.AddMappingWithOptions("/mpdeep", "bartest", false, MappingOptions{Priority: prio}))
+
+		bb.Reset()
+
+		if err := tree.ReadFileToBuffer("/mpdeep/test1", &bb); err != nil || bb.String() != expected {
+			t.Error("Unexpected result:", prio, bb.String(), err)
+			return
+		}
+
+		if n, err := tree.ReadFile("/mpdeep/test1", buf, 0); err != nil || string(buf[:n]) != expected {
+			t.Error("Unexpected result:", prio, string(buf[:n]), err)
+			return
+		}
+	}
+}
+
 func TestRelPath(t *testing.T) {
 
 	if res := relPath("/1/", ""); res != "/1" {
@@ -1321,10 +1650,13 @@ drwxrwxrwx 4.0 KiB sub2
 	if buf.String() != `
 Create directory  -> /3/sub1
 Copy file /2/test2 -> /3/test2 10 B/10 B
+Verify file /2/test2 -> /3/test2
 Copy file /2/test2 -> /3/test2 finished
 Copy file /2/test3 -> /3/test3 10 B/10 B
+Verify file /2/test3 -> /3/test3
 Copy file /2/test3 -> /3/test3 finished
-Copy file /2/testempty -> /3/testempty
+Verify file /2/testempty -> /3/testempty
+Copy file /2/testempty -> /3/testempty finished
 Remove directory  -> /3/sub2
 Remove file  -> /3/test5
 `[1:] {
@@ -1410,11 +1742,14 @@ drwxrwxrwx 4.0 KiB sub2
 	if buf.String() != `
 Create directory  -> /3/sub1
 Copy file /2/test2 -> /3/test2 10 B/10 B
+Verify file /2/test2 -> /3/test2
 Copy file /2/test2 -> /3/test2 finished
 Copy file /2/test3 -> /3/test3 10 B/10 B
+Verify file /2/test3 -> /3/test3
 Copy file /2/test3 -> /3/test3 finished
 Remove directory  -> /3/sub2
 Copy file /2/sub1/test3 -> /3/sub1/test3 17 B/17 B
+Verify file /2/sub1/test3 -> /3/sub1/test3
 Copy file /2/sub1/test3 -> /3/sub1/test3 finished
 `[1:] {
 		t.Error("Unexpected log:", buf.String())
@@ -1513,6 +1848,186 @@ drwxrwxrwx 4.0 KiB sub1
 	}
 }
 
+func TestSyncOptions(t *testing.T) {
+	var buf bytes.Buffer
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/2", "footest", false))
+	errorutil.AssertOk(tree.AddMapping("/3", "bartest", true))
+
+	os.MkdirAll("foo/syncopt/sub", 0770)
+	os.MkdirAll("foo/syncopt/skip", 0770)
+	os.MkdirAll("bar/syncopt", 0770)
+	defer os.RemoveAll("foo/syncopt")
+	defer os.RemoveAll("bar/syncopt")
+
+	ioutil.WriteFile("foo/syncopt/a.txt", []byte("new a"), 0660)
+	ioutil.WriteFile("foo/syncopt/b.log", []byte("new b"), 0660)
+	ioutil.WriteFile("foo/syncopt/sub/c.txt", []byte("new c"), 0660)
+	ioutil.WriteFile("foo/syncopt/skip/d.txt", []byte("new d"), 0660)
+	ioutil.WriteFile("bar/syncopt/a.txt", []byte("old a"), 0660)
+	ioutil.WriteFile("bar/syncopt/e.txt", []byte("old e"), 0660)
+
+	// Make the destination file older than the source file
+
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes("bar/syncopt/a.txt", past, past)
+
+	updFunc := func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+		if writtenBytes == 0 {
+			buf.WriteString(fmt.Sprintf("%v %v -> %v\n", op, srcFile, dstFile))
+		}
+	}
+
+	checkDst := func(expected string) error {
+		paths, infos, err := tree.Dir("/3/syncopt", "", true, false)
+		if res := DirResultToString(paths, infos); err != nil || res != expected {
+			return fmt.Errorf("Unexpected result: %v %v", res, err)
+		}
+		return nil
+	}
+
+	// A dry run only reports the operations
+
+	if err := tree.SyncWithOptions("/2/syncopt", "/3/syncopt", true, SyncOptions{
+		DryRun: true,
+	}, updFunc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := buf.String(); res != `
+Copy file /2/syncopt/a.txt -> /3/syncopt/a.txt
+Copy file /2/syncopt/b.log -> /3/syncopt/b.log
+Create directory  -> /3/syncopt/skip
+Create directory  -> /3/syncopt/sub
+Remove file  -> /3/syncopt/e.txt
+Copy file /2/syncopt/skip/d.txt -> /3/syncopt/skip/d.txt
+Copy file /2/syncopt/sub/c.txt -> /3/syncopt/sub/c.txt
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if err := checkDst(`
+/3/syncopt
+-rw-rw-rw- 5 B   a.txt
+-rw-rw-rw- 5 B   e.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Sync only text files outside of the skip directory and keep
+	// files which are not in the source
+
+	buf.Reset()
+
+	if err := tree.SyncWithOptions("/2/syncopt", "/3/syncopt", true, SyncOptions{
+		Include:    []string{"*.txt"},
+		Exclude:    []string{"skip"},
+		NoDelete:   true,
+		UpdateOnly: true,
+	}, updFunc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkDst(`
+/3/syncopt
+-rw-rw-rw-   5 B   a.txt
+-rw-rw-rw-   5 B   e.txt
+drwxrwxrwx 4.0 KiB sub
+
+/3/syncopt/sub
+-rw-rw-rw- 5 B   c.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/syncopt/a.txt"); string(res) != "new a" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	// Newer destination files are kept if only updates should be synced
+
+	ioutil.WriteFile("bar/syncopt/a.txt", []byte("dst a"), 0660)
+	ioutil.WriteFile("bar/syncopt/sub/c.txt", []byte("dst c"), 0660)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes("bar/syncopt/a.txt", future, future)
+
+	if err := tree.SyncWithOptions("/2/syncopt", "/3/syncopt", true, SyncOptions{
+		Exclude:    []string{"skip", "*.log", "sub/*"},
+		UpdateOnly: true,
+	}, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkDst(`
+/3/syncopt
+-rw-rw-rw-   5 B   a.txt
+drwxrwxrwx 4.0 KiB sub
+
+/3/syncopt/sub
+-rw-rw-rw- 5 B   c.txt
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/syncopt/a.txt"); string(res) != "dst a" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/syncopt/sub/c.txt"); string(res) != "dst c" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	// Only checksums are compared if requested
+
+	if err := tree.SyncWithOptions("/2/syncopt", "/3/syncopt", true, SyncOptions{
+		Exclude:      []string{"skip", "*.log"},
+		UpdateOnly:   true,
+		ChecksumOnly: true,
+	}, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/syncopt/a.txt"); string(res) != "new a" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/syncopt/sub/c.txt"); string(res) != "new c" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	// Test error cases
+
+	if err := tree.SyncWithOptions("/2/syncopt", "/3/syncopt", true, SyncOptions{
+		Include: []string{"["},
+	}, nil); err == nil || err.Error() != "Invalid sync pattern [: syntax error in pattern" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
 func TestDirPattern(t *testing.T) {
 
 	// Build up a tree from one branch
@@ -1717,3 +2232,287 @@ drwxrwxrwx 4.0 KiB sub1
 		return
 	}
 }
+
+func TestCopyFileResume(t *testing.T) {
+	var buf bytes.Buffer
+
+	tree, _ := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+
+	oldCopyFileRetries := CopyFileRetries
+	oldCopyFileRetryInterval := CopyFileRetryInterval
+	CopyFileRetryInterval = 0
+
+	defer func() {
+		CopyFileRetries = oldCopyFileRetries
+		CopyFileRetryInterval = oldCopyFileRetryInterval
+		os.Remove("foo/copytest1")
+		os.Remove("foo/copytest2")
+		os.Remove("foo/.copytest3.rufspart")
+	}()
+
+	updFunc := func(b int) {
+		buf.WriteString(fmt.Sprintf("%v\n", b))
+	}
+
+	// Resume a copy from a partial temporary file
+
+	ioutil.WriteFile("foo/.copytest1.rufspart", []byte("Test1"), 0660)
+
+	// The temporary file is not part of directory listings
+
+	if _, fis, err := tree.Dir("/", "copytest", false, false); err != nil || len(fis[0]) != 0 {
+		t.Error("Unexpected result:", fis, err)
+		return
+	}
+
+	if fi, err := tree.Stat("/.copytest1.rufspart"); err != nil || fi.Size() != 5 {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+
+	if err := tree.CopyFile("/test1", "/copytest1", updFunc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, err := ioutil.ReadFile("foo/copytest1"); err != nil || string(data) != "Test1 file" {
+		t.Error("Unexpected result:", string(data), err)
+		return
+	}
+
+	if buf.String() != `
+-2
+5
+5
+-3
+-1
+`[1:] {
+		t.Error("Unexpected log:", buf.String())
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/.copytest1.rufspart"); res {
+		t.Error("Temporary file should have been removed")
+		return
+	}
+
+	// Data which does not match the source is copied again
+
+	buf.Reset()
+
+	ioutil.WriteFile("foo/.copytest2.rufspart", []byte("XXXXX"), 0660)
+
+	if err := tree.CopyFile("/test1", "/copytest2", updFunc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, err := ioutil.ReadFile("foo/copytest2"); err != nil || string(data) != "Test1 file" {
+		t.Error("Unexpected result:", string(data), err)
+		return
+	}
+
+	if buf.String() != `
+-2
+5
+5
+-3
+-3
+-1
+`[1:] {
+		t.Error("Unexpected log:", buf.String())
+		return
+	}
+
+	// Give up if the retries are exhausted
+
+	CopyFileRetries = 0
+
+	ioutil.WriteFile("foo/.copytest3.rufspart", []byte("XXXXX"), 0660)
+
+	if err := tree.CopyFile("/test1", "/copytest3", nil); err != ErrChecksumMismatch {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/copytest3"); res {
+		t.Error("Destination file should not exist")
+		return
+	}
+
+	if res, _ := fileutil.PathExists("foo/.copytest3.rufspart"); res {
+		t.Error("Temporary file should have been removed")
+		return
+	}
+
+	// The tree can be changed while a copy waits for a retry
+
+	CopyFileRetries = 1
+	CopyFileRetryInterval = 300 * time.Millisecond
+
+	ioutil.WriteFile("foo/.copytest4.rufspart", []byte("XXXXX"), 0660)
+	defer os.Remove("foo/copytest4")
+
+	verifying := make(chan bool)
+	done := make(chan error)
+
+	go func() {
+		var once sync.Once
+
+		done <- tree.CopyFile("/test1", "/copytest4", func(b int) {
+			if b == CopyStatusVerifying {
+				once.Do(func() { close(verifying) })
+			}
+		})
+	}()
+
+	<-verifying
+
+	errorutil.AssertOk(tree.AddMapping("/copytest", "footest", false))
+
+	select {
+	case err := <-done:
+		t.Error("Copy should still wait for its retry:", err)
+		return
+	default:
+	}
+
+	if err := <-done; err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestCopyFileSpecialNames(t *testing.T) {
+
+	tree, _ := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+
+	os.Mkdir("foo/specialsrc", 0770)
+	defer os.RemoveAll("foo/specialsrc")
+	defer os.RemoveAll("foo/specialdst")
+
+	// Names are not interpreted as regular expressions
+
+	names := []string{"doc (1).txt", "c++.txt", "[draft].txt"}
+
+	for _, name := range names {
+		ioutil.WriteFile("foo/specialsrc/"+name, []byte("Test "+name), 0660)
+
+		if err := tree.CopyFile("/specialsrc/"+name, "/"+name, nil); err != nil {
+			t.Error("Unexpected result:", name, err)
+			return
+		}
+
+		defer os.Remove("foo/" + name)
+
+		if data, err := ioutil.ReadFile("foo/" + name); err != nil || string(data) != "Test "+name {
+			t.Error("Unexpected result:", name, string(data), err)
+			return
+		}
+	}
+
+	if err := tree.Sync("/specialsrc", "/specialdst", false, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/specialdst"); res != `
+[draft].txt(16)
+c++.txt(12)
+doc (1).txt(16)
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestStreamTransfer(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Build up a tree from two branches which are both writable
+
+	cfg := map[string]interface{}{
+		config.TreeSecret: "123",
+	}
+
+	tree, _ := NewTree(cfg, clientCert)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", true))
+	errorutil.AssertOk(tree.AddMapping("/ro", "footest", false))
+
+	// Write a file which needs several frames
+
+	data := make([]byte, 3*1024*1024+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	err := tree.WriteFileFromBuffer("/test_stream", bytes.NewBuffer(data))
+	defer func() {
+		os.Remove("foo/test_stream")
+		os.Remove("bar/test_stream")
+	}()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("foo/test_stream"); !bytes.Equal(res, data) {
+		t.Error("Unexpected result:", len(res))
+		return
+	}
+
+	if res, _ := ioutil.ReadFile("bar/test_stream"); !bytes.Equal(res, data) {
+		t.Error("Unexpected result:", len(res))
+		return
+	}
+
+	if err = tree.ReadFileToBuffer("/test_stream", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Unexpected result:", buf.Len(), err)
+		return
+	}
+
+	// Read errors
+
+	if err = tree.ReadFileToBuffer("/ro/sub1", &buf); err == nil || err.Error() != "RufsError: Remote error (read /sub1: is a directory)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err = tree.ReadFileToBuffer("/xxx/test_stream", &buf); err == nil || err.Error() != "RufsError: Remote error (stat /xxx/test_stream: no such file or directory)" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Write errors
+
+	tree.Reset(false)
+	errorutil.AssertOk(tree.AddMapping("/", "footest", false))
+
+	if err = tree.WriteFileFromBuffer("/test_stream2", bytes.NewBuffer(data)); err != ErrNotWritable {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
@@ -0,0 +1,433 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"devt.de/krotik/rufs/node"
+)
+
+/*
+Conflict policies of a two-way sync. A conflict occurs if an item was changed
+on both sides since the last sync.
+*/
+const (
+	ConflictReport   = "report"   // Conflicts are only reported - both sides are left unchanged
+	ConflictNewest   = "newest"   // The item with the newest modification time wins
+	ConflictKeepBoth = "keepboth" // Both versions of a file are kept - the version of the second directory gets a suffix
+)
+
+/*
+ConflictSuffix is the file name suffix for the second version of a file
+which is kept by the keep both conflict policy.
+*/
+const ConflictSuffix = ".conflict"
+
+/*
+SyncStatePrefix is the name prefix of state snapshot files of two-way syncs.
+The state snapshot is stored in the first directory of a two-way sync.
+*/
+const SyncStatePrefix = ".rufssync."
+
+/*
+syncStateEntry is the recorded state of an item after a two-way sync.
+*/
+type syncStateEntry struct {
+	IsDir    bool
+	Size     int64
+	Checksum string
+}
+
+/*
+newSyncStateEntry creates a state entry for a given item (nil if the item
+does not exist).
+*/
+func newSyncStateEntry(fi os.FileInfo) *syncStateEntry {
+
+	if fi == nil {
+		return nil
+	}
+
+	return &syncStateEntry{fi.IsDir(), fi.Size(), fi.(*FileInfo).Checksum()}
+}
+
+/*
+equal checks if two state entries describe the same item.
+*/
+func (e *syncStateEntry) equal(other *syncStateEntry) bool {
+
+	if e == nil || other == nil {
+		return e == other
+	}
+
+	return e.IsDir == other.IsDir &&
+		(e.IsDir || (e.Size == other.Size && e.Checksum == other.Checksum))
+}
+
+/*
+syncStateFile returns the path of the state snapshot of a two-way sync.
+*/
+func syncStateFile(dirA, dirB string) string {
+	id := crc32.ChecksumIEEE([]byte(path.Clean("/" + dirB)))
+	return path.Join(dirA, fmt.Sprintf("%v%08x", SyncStatePrefix, id))
+}
+
+/*
+SyncTwoWay syncs two directories with each other. A state snapshot of the
+last sync is used to detect which side has changed an item. Changes and
+deletions of one side are applied to the other side. Items which were
+changed on both sides are conflicts which are resolved according to the
+given conflict policy. A deletion on one side never wins over a modification
+on the other side. Conflicts between files and directories are only
+reported by the keep both policy. Returns the relative paths of all
+conflicts.
+*/
+func (t *Tree) SyncTwoWay(dirA string, dirB string, policy string,
+	updFunc func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64)) ([]string, error) {
+
+	var conflicts []string
+	var currentFile, totalFiles int64
+	var removed []string
+	var itemsA, itemsB map[string]os.FileInfo
+	var err error
+
+	if policy != ConflictReport && policy != ConflictNewest && policy != ConflictKeepBoth {
+		return nil, fmt.Errorf("Unknown conflict policy: %v", policy)
+	}
+
+	stateFile := syncStateFile(dirA, dirB)
+
+	if itemsA, err = t.syncListing(dirA); err != nil {
+		return nil, err
+	} else if itemsB, err = t.syncListing(dirB); err != nil {
+		return nil, err
+	}
+
+	state, err := t.readSyncState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect all items which are known on either side or from the last sync
+
+	var items []string
+
+	seen := make(map[string]bool)
+
+	for _, m := range []map[string]os.FileInfo{itemsA, itemsB} {
+		for p := range m {
+			if !seen[p] {
+				seen[p] = true
+				items = append(items, p)
+			}
+		}
+	}
+
+	for p := range state {
+		if !seen[p] {
+			seen[p] = true
+			items = append(items, p)
+		}
+	}
+
+	// Parent directories are processed before their contents
+
+	sort.Strings(items)
+
+	totalFiles = int64(len(items))
+
+	// changedBelow checks if any item below a directory was changed on one side
+
+	changedBelow := func(side map[string]os.FileInfo, dir string) bool {
+		prefix := dir + "/"
+
+		for _, p := range items {
+			if strings.HasPrefix(p, prefix) && !newSyncStateEntry(side[p]).equal(state[p]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// apply applies the state of an item on one side to the other side
+
+	var apply func(string, string, string, map[string]os.FileInfo, map[string]os.FileInfo) error
+
+	apply = func(p, fromDir, toDir string, from, to map[string]os.FileInfo) error {
+		var err error
+
+		fromFi, toFi := from[p], to[p]
+		src, dst := path.Join(fromDir, p), path.Join(toDir, p)
+		dir, name := path.Split(dst)
+
+		remove := func(fi os.FileInfo) error {
+			op := SyncRemoveFile
+
+			if fi.IsDir() {
+				op = SyncRemoveDirectory
+				removed = append(removed, p)
+			}
+
+			if updFunc != nil {
+				updFunc(op, "", dst, 0, 0, currentFile, totalFiles)
+			}
+
+			_, err := t.ItemOp(dir, map[string]string{
+				ItemOpAction: ItemOpActDelete,
+				ItemOpName:   name,
+			})
+
+			return err
+		}
+
+		if fromFi == nil {
+
+			if toFi.IsDir() && changedBelow(to, p) {
+
+				// Directories are not deleted if their content has been
+				// changed on the other side - restore the directory instead
+
+				return apply(p, toDir, fromDir, to, from)
+			}
+
+			return remove(toFi)
+		}
+
+		if toFi != nil && toFi.IsDir() != fromFi.IsDir() {
+			if err = remove(toFi); err != nil {
+				return err
+			}
+
+			toFi = nil
+		}
+
+		if fromFi.IsDir() {
+
+			if toFi == nil {
+
+				if updFunc != nil {
+					updFunc(SyncCreateDirectory, "", dst, 0, 0, currentFile, totalFiles)
+				}
+
+				_, err = t.ItemOp(dir, map[string]string{
+					ItemOpAction: ItemOpActMkDir,
+					ItemOpName:   name,
+				})
+			}
+
+			return err
+		}
+
+		var u func(b int)
+
+		if updFunc != nil {
+			u = syncCopyUpdFunc(updFunc, src, dst, fromFi.Size(), currentFile, totalFiles)
+		}
+
+		if toFi != nil {
+			return t.syncFile(src, dst, fromFi, u)
+		}
+
+		return t.CopyFile(src, dst, u)
+	}
+
+	// keepBoth renames the version of the second directory and copies both
+	// versions to both sides
+
+	keepBoth := func(p string) error {
+		var err error
+
+		newName := path.Base(p) + ConflictSuffix
+
+		for i := 1; itemsA[path.Join(path.Dir(p), newName)] != nil ||
+			itemsB[path.Join(path.Dir(p), newName)] != nil; i++ {
+			newName = fmt.Sprintf("%v%v%v", path.Base(p), ConflictSuffix, i)
+		}
+
+		newPath := path.Join(path.Dir(p), newName)
+
+		if _, err = t.ItemOp(path.Join(dirB, path.Dir(p)), map[string]string{
+			ItemOpAction:  ItemOpActRename,
+			ItemOpName:    path.Base(p),
+			ItemOpNewName: newName,
+		}); err == nil {
+
+			itemsB[newPath] = itemsB[p]
+			delete(itemsB, p)
+
+			if err = apply(p, dirA, dirB, itemsA, itemsB); err == nil {
+				err = apply(newPath, dirB, dirA, itemsB, itemsA)
+			}
+		}
+
+		return err
+	}
+
+	for _, p := range items {
+		currentFile++
+
+		// Skip the contents of removed directories
+
+		skip := false
+
+		for _, r := range removed {
+			if strings.HasPrefix(p, r+"/") {
+				skip = true
+				break
+			}
+		}
+
+		a, b, s := newSyncStateEntry(itemsA[p]), newSyncStateEntry(itemsB[p]), state[p]
+
+		if skip || a.equal(b) {
+			continue
+		}
+
+		if !b.equal(s) && !a.equal(s) {
+
+			// The item was changed on both sides
+
+			conflicts = append(conflicts, p)
+
+			if updFunc != nil {
+				updFunc(SyncConflict, path.Join(dirA, p), path.Join(dirB, p), 0, 0, currentFile, totalFiles)
+			}
+
+			if a == nil {
+				err = apply(p, dirB, dirA, itemsB, itemsA)
+
+			} else if b == nil {
+				err = apply(p, dirA, dirB, itemsA, itemsB)
+
+			} else if policy == ConflictNewest {
+
+				if itemsB[p].ModTime().After(itemsA[p].ModTime()) {
+					err = apply(p, dirB, dirA, itemsB, itemsA)
+				} else {
+					err = apply(p, dirA, dirB, itemsA, itemsB)
+				}
+
+			} else if policy == ConflictKeepBoth && !a.IsDir && !b.IsDir {
+				err = keepBoth(p)
+			}
+
+		} else if b.equal(s) {
+			err = apply(p, dirA, dirB, itemsA, itemsB)
+
+		} else {
+			err = apply(p, dirB, dirA, itemsB, itemsA)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+
+		// Record the new state - items which are still different on both
+		// sides keep their old state
+
+		if itemsA, err = t.syncListing(dirA); err == nil {
+			if itemsB, err = t.syncListing(dirB); err == nil {
+				newState := make(map[string]*syncStateEntry)
+
+				for _, m := range []map[string]os.FileInfo{itemsA, itemsB} {
+					for p := range m {
+						if a := newSyncStateEntry(itemsA[p]); a != nil && a.equal(newSyncStateEntry(itemsB[p])) {
+							newState[p] = a
+						} else if s, ok := state[p]; ok {
+							newState[p] = s
+						}
+					}
+				}
+
+				err = t.writeSyncState(stateFile, newState)
+			}
+		}
+	}
+
+	return conflicts, err
+}
+
+/*
+syncListing returns all items below a given directory (including their
+checksums) mapped by their relative path. State snapshots are not included.
+*/
+func (t *Tree) syncListing(dir string) (map[string]os.FileInfo, error) {
+	items := make(map[string]os.FileInfo)
+
+	dirs, fis, err := t.Dir(dir, "", true, true)
+
+	if err == nil {
+		for i, d := range dirs {
+			rdir := relPath(d, dir)
+
+			for _, fi := range fis[i] {
+				if rdir == "/" && strings.HasPrefix(fi.Name(), SyncStatePrefix) {
+					continue
+				}
+
+				items[path.Join(rdir, fi.Name())] = fi
+			}
+		}
+	}
+
+	return items, err
+}
+
+/*
+readSyncState reads a state snapshot. An empty state is returned if the
+snapshot does not exist.
+*/
+func (t *Tree) readSyncState(stateFile string) (map[string]*syncStateEntry, error) {
+	var buf bytes.Buffer
+
+	state := make(map[string]*syncStateEntry)
+
+	_, err := t.Stat(stateFile)
+
+	if err == nil {
+		if err = t.ReadFileToBuffer(stateFile, &buf); err == nil {
+			if err = json.Unmarshal(buf.Bytes(), &state); err != nil {
+				err = fmt.Errorf("Could not read sync state %v: %v", stateFile, err)
+			}
+		}
+
+	} else if rerr, ok := err.(*node.Error); ok && rerr.IsNotExist {
+		err = nil
+	}
+
+	return state, err
+}
+
+/*
+writeSyncState writes a state snapshot.
+*/
+func (t *Tree) writeSyncState(stateFile string, state map[string]*syncStateEntry) error {
+
+	data, err := json.Marshal(state)
+
+	if err == nil {
+		err = t.WriteFileFromBuffer(stateFile, bytes.NewBuffer(data))
+	}
+
+	return err
+}
@@ -0,0 +1,292 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestSyncTwoWay(t *testing.T) {
+	var buf bytes.Buffer
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/a", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/b", "bartest", true))
+
+	os.Mkdir("foo/twoway", 0770)
+	os.Mkdir("bar/twoway", 0770)
+	defer os.RemoveAll("foo/twoway")
+	defer os.RemoveAll("bar/twoway")
+
+	ioutil.WriteFile("foo/twoway/a.txt", []byte("aaa"), 0660)
+	ioutil.WriteFile("foo/twoway/both.txt", []byte("both"), 0660)
+	ioutil.WriteFile("foo/twoway/diff.txt", []byte("diff a"), 0660)
+	ioutil.WriteFile("bar/twoway/both.txt", []byte("both"), 0660)
+	ioutil.WriteFile("bar/twoway/b.txt", []byte("bbb"), 0660)
+	ioutil.WriteFile("bar/twoway/diff.txt", []byte("diff b"), 0660)
+
+	updFunc := func(op, srcFile, dstFile string, writtenBytes, totalBytes, currentFile, totalFiles int64) {
+		if writtenBytes <= 0 && op != SyncVerifyFile {
+			buf.WriteString(fmt.Sprintf("%v %v -> %v\n", op, srcFile, dstFile))
+		}
+	}
+
+	// listing returns the contents of a local directory
+
+	listing := func(dir string) string {
+		var res []string
+
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			rp := strings.TrimPrefix(filepath.ToSlash(p), dir)
+
+			if strings.HasPrefix(fi.Name(), SyncStatePrefix) || rp == "" {
+				return nil
+			} else if fi.IsDir() {
+				res = append(res, rp+"/")
+			} else {
+				content, _ := ioutil.ReadFile(p)
+				res = append(res, fmt.Sprintf("%v:%v", rp, string(content)))
+			}
+
+			return nil
+		})
+
+		sort.Strings(res)
+
+		return strings.Join(res, "\n")
+	}
+
+	sync := func(policy, expectedConflicts, expectedOps, expectedA, expectedB string) error {
+		buf.Reset()
+
+		conflicts, err := tree.SyncTwoWay("/a/twoway", "/b/twoway", policy, updFunc)
+
+		if err != nil {
+			return err
+		} else if res := fmt.Sprint(conflicts); res != expectedConflicts {
+			return fmt.Errorf("Unexpected conflicts: %v", res)
+		} else if res := buf.String(); res != expectedOps {
+			return fmt.Errorf("Unexpected operations: %v", res)
+		} else if res := listing("foo/twoway"); res != expectedA {
+			return fmt.Errorf("Unexpected listing: %v", res)
+		} else if res := listing("bar/twoway"); res != expectedB {
+			return fmt.Errorf("Unexpected listing: %v", res)
+		}
+
+		return nil
+	}
+
+	// The first sync has no state - files which differ are conflicts
+
+	if err := sync(ConflictReport, "[/diff.txt]", `
+Copy file /a/twoway/a.txt -> /b/twoway/a.txt
+Copy file /b/twoway/b.txt -> /a/twoway/b.txt
+Conflict /a/twoway/diff.txt -> /b/twoway/diff.txt
+`[1:], `
+/a.txt:aaa
+/b.txt:bbb
+/both.txt:both
+/diff.txt:diff a`[1:], `
+/a.txt:aaa
+/b.txt:bbb
+/both.txt:both
+/diff.txt:diff b`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := os.Stat("foo/twoway/" + SyncStatePrefix + "acffce99"); err != nil {
+		t.Error("State snapshot was not written:", err)
+		return
+	}
+
+	// Changes and deletions are applied to the other side - the conflict
+	// remains until it is resolved
+
+	ioutil.WriteFile("bar/twoway/a.txt", []byte("aaa changed"), 0660)
+	os.Remove("foo/twoway/b.txt")
+	os.Mkdir("foo/twoway/sub", 0770)
+	ioutil.WriteFile("foo/twoway/sub/c.txt", []byte("ccc"), 0660)
+
+	if err := sync(ConflictReport, "[/diff.txt]", `
+Copy file /b/twoway/a.txt -> /a/twoway/a.txt
+Remove file  -> /b/twoway/b.txt
+Conflict /a/twoway/diff.txt -> /b/twoway/diff.txt
+Create directory  -> /b/twoway/sub
+Copy file /a/twoway/sub/c.txt -> /b/twoway/sub/c.txt
+`[1:], `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff a
+/sub/
+/sub/c.txt:ccc`[1:], `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The newest file wins
+
+	now := time.Now()
+	os.Chtimes("foo/twoway/diff.txt", now.Add(-time.Hour), now.Add(-time.Hour))
+	os.Chtimes("bar/twoway/diff.txt", now, now)
+
+	if err := sync(ConflictNewest, "[/diff.txt]", `
+Conflict /a/twoway/diff.txt -> /b/twoway/diff.txt
+Copy file /b/twoway/diff.txt -> /a/twoway/diff.txt
+`[1:], `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:], `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Nothing to do if nothing changed
+
+	if err := sync(ConflictReport, "[]", "", `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:], `
+/a.txt:aaa changed
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Keep both versions of a conflicting file
+
+	ioutil.WriteFile("foo/twoway/a.txt", []byte("version a"), 0660)
+	ioutil.WriteFile("bar/twoway/a.txt", []byte("version b"), 0660)
+
+	if err := sync(ConflictKeepBoth, "[/a.txt]", `
+Conflict /a/twoway/a.txt -> /b/twoway/a.txt
+Copy file /a/twoway/a.txt -> /b/twoway/a.txt
+Copy file /b/twoway/a.txt.conflict -> /a/twoway/a.txt.conflict
+`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both
+/diff.txt:diff b
+/sub/
+/sub/c.txt:ccc`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A modification wins over a deletion - a deleted directory is restored
+	// if its content was changed on the other side
+
+	os.Remove("foo/twoway/both.txt")
+	ioutil.WriteFile("bar/twoway/both.txt", []byte("both changed"), 0660)
+	os.RemoveAll("foo/twoway/sub")
+	ioutil.WriteFile("bar/twoway/sub/d.txt", []byte("ddd"), 0660)
+
+	if err := sync(ConflictReport, "[/both.txt]", `
+Conflict /a/twoway/both.txt -> /b/twoway/both.txt
+Copy file /b/twoway/both.txt -> /a/twoway/both.txt
+Create directory  -> /a/twoway/sub
+Remove file  -> /b/twoway/sub/c.txt
+Copy file /b/twoway/sub/d.txt -> /a/twoway/sub/d.txt
+`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both changed
+/diff.txt:diff b
+/sub/
+/sub/d.txt:ddd`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both changed
+/diff.txt:diff b
+/sub/
+/sub/d.txt:ddd`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Deleted directories are removed on the other side
+
+	os.RemoveAll("bar/twoway/sub")
+
+	if err := sync(ConflictReport, "[]", `
+Remove directory  -> /a/twoway/sub
+`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both changed
+/diff.txt:diff b`[1:], `
+/a.txt.conflict:version b
+/a.txt:version a
+/both.txt:both changed
+/diff.txt:diff b`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Test error cases
+
+	if _, err := tree.SyncTwoWay("/a/twoway", "/b/twoway", "foo", nil); err == nil ||
+		err.Error() != "Unknown conflict policy: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	ioutil.WriteFile("foo/twoway/"+SyncStatePrefix+"acffce99", []byte("{"), 0660)
+
+	if _, err := tree.SyncTwoWay("/a/twoway", "/b/twoway", ConflictReport, nil); err == nil ||
+		err.Error() != "Could not read sync state /a/twoway/.rufssync.acffce99: unexpected end of JSON input" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
@@ -11,11 +11,26 @@
 package rufs
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
 
 	"devt.de/krotik/rufs/node"
 )
 
+/*
+ErrNotWritable is returned if a write operation is requested on a path where
+all applicable branches were mounted as not writable.
+*/
+var ErrNotWritable = errors.New("All applicable branches for the requested path were mounted as not writable")
+
+/*
+ErrChecksumMismatch is returned if a copied file does not have the checksum
+of its source.
+*/
+var ErrChecksumMismatch = errors.New("Checksum of the copied file does not match the source")
+
 /*
 IsEOF tests if the given error is an EOF error.
 */
@@ -31,3 +46,86 @@ func IsEOF(err error) bool {
 
 	return false
 }
+
+/*
+IsNotWritable tests if the given error reports that a write operation was
+rejected either by the tree mapping or by a read-only branch.
+*/
+func IsNotWritable(err error) bool {
+
+	if err == ErrNotWritable {
+		return true
+	}
+
+	switch rerr := err.(type) {
+	case *node.ReadOnlyError:
+		return true
+	case *node.Error:
+		return rerr.IsReadOnly
+	}
+
+	return false
+}
+
+/*
+confValue returns a value from a given config. The value from the given
+defaults is returned if the config does not contain the value.
+*/
+func confValue(cfg map[string]interface{}, defaults map[string]interface{}, key string) interface{} {
+
+	if v, ok := cfg[key]; ok && v != nil {
+		return v
+	}
+
+	return defaults[key]
+}
+
+/*
+confInt64 returns an integer value from a given config. The value from the
+given defaults is used if the config does not contain the value.
+*/
+func confInt64(cfg map[string]interface{}, defaults map[string]interface{}, key string) (int64, error) {
+	var ret int64
+	var err error
+
+	switch v := confValue(cfg, defaults, key).(type) {
+	case int:
+		ret = int64(v)
+	case int64:
+		ret = v
+	case float64:
+		ret = int64(v)
+	default:
+		if ret, err = strconv.ParseInt(fmt.Sprint(v), 10, 64); err != nil {
+			err = fmt.Errorf("Config value %v must be an integer: %v", key, v)
+		}
+	}
+
+	return ret, err
+}
+
+/*
+confStrings returns a list of strings from a given config. The value from
+the given defaults is used if the config does not contain the value.
+*/
+func confStrings(cfg map[string]interface{}, defaults map[string]interface{}, key string) ([]string, error) {
+	var ret []string
+	var err error
+
+	switch v := confValue(cfg, defaults, key).(type) {
+	case []string:
+		ret = v
+	case []interface{}:
+		for _, i := range v {
+			s, ok := i.(string)
+			if !ok {
+				return nil, fmt.Errorf("Config value %v must be a list of strings: %v", key, v)
+			}
+			ret = append(ret, s)
+		}
+	default:
+		err = fmt.Errorf("Config value %v must be a list of strings: %v", key, v)
+	}
+
+	return ret, err
+}
@@ -0,0 +1,522 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"devt.de/krotik/rufs/node"
+)
+
+func init() {
+
+	// Make sure we can use the relevant types in a gob operation
+
+	gob.Register([]*WatchEvent{})
+}
+
+/*
+Types of watch events
+*/
+const (
+	WatchCreate   = "create"   // An item was created
+	WatchModify   = "modify"   // A file was modified
+	WatchDelete   = "delete"   // An item was deleted
+	WatchOverflow = "overflow" // Events were lost - clients should reread everything
+)
+
+/*
+MaxWatchEvents is the maximum number of events a branch keeps for clients
+*/
+var MaxWatchEvents = 1000
+
+/*
+WatchPollTimeout is the maximum time a watch request waits on a branch for
+new events
+*/
+var WatchPollTimeout = 10 * time.Second
+
+/*
+WatchRetryInterval is the time a tree waits before it polls a branch again
+after an error
+*/
+var WatchRetryInterval = 5 * time.Second
+
+/*
+WatchEvent is a change of an item on a branch.
+*/
+type WatchEvent struct {
+	Seq  int64  // Sequence number of the event
+	Type string // Type of the event
+	Path string // Path of the changed item within the branch
+}
+
+/*
+WatchHandler is a function which receives events of a tree watch. It gets
+the event type, the tree path of the changed item and the branch where the
+change happened.
+*/
+type WatchHandler func(event string, path string, branch string)
+
+// Branch side
+// ===========
+
+/*
+branchWatcher collects changes of the files of a branch.
+*/
+type branchWatcher struct {
+	lock    *sync.Mutex
+	seq     int64         // Sequence number of the last event
+	events  []*WatchEvent // Latest events (oldest first)
+	notify  chan bool     // Channel which is closed when a new event arrives
+	watcher io.Closer     // Platform specific file system watcher
+}
+
+/*
+startWatcher starts watching the files of this branch. Does nothing if the
+branch is already watched.
+*/
+func (b *Branch) startWatcher() (*branchWatcher, error) {
+	var err error
+
+	b.watchLock.Lock()
+	defer b.watchLock.Unlock()
+
+	if b.watcher == nil {
+		bw := &branchWatcher{&sync.Mutex{}, 0, nil, make(chan bool), nil}
+
+		handler := bw.addEvent
+
+		if b.crypt != nil {
+
+			// Events of encrypted branches need to report item names
+
+			handler = func(eventType string, spath string) {
+				if spath, ok := b.crypt.branchPath(spath); ok {
+					bw.addEvent(eventType, spath)
+				}
+			}
+		}
+
+		if bw.watcher, err = watchDirectory(b.rootPath, handler); err == nil {
+			b.watcher = bw
+		}
+	}
+
+	return b.watcher, err
+}
+
+/*
+stopWatcher stops watching the files of this branch.
+*/
+func (b *Branch) stopWatcher() {
+	b.watchLock.Lock()
+	defer b.watchLock.Unlock()
+
+	if b.watcher != nil {
+		b.watcher.watcher.Close()
+		b.watcher = nil
+	}
+}
+
+/*
+Watch returns all events on items under a given path which happened after
+the event with the given sequence number. The call waits up to the given
+timeout for new events. A negative sequence number returns only the
+current sequence number. A WatchOverflow event is returned if the
+requested events are no longer available.
+*/
+func (b *Branch) Watch(spath string, seq int64, timeout time.Duration) (int64, []*WatchEvent, error) {
+
+	bw, err := b.startWatcher()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return bw.wait(path.Clean("/"+spath), seq, timeout)
+}
+
+/*
+addEvent adds a new event.
+*/
+func (bw *branchWatcher) addEvent(eventType string, spath string) {
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+
+	bw.seq++
+
+	bw.events = append(bw.events, &WatchEvent{bw.seq, eventType, spath})
+
+	if len(bw.events) > MaxWatchEvents {
+		bw.events = bw.events[len(bw.events)-MaxWatchEvents:]
+	}
+
+	// Wake up all waiting requests
+
+	close(bw.notify)
+	bw.notify = make(chan bool)
+}
+
+/*
+wait waits for events after a given sequence number.
+*/
+func (bw *branchWatcher) wait(spath string, seq int64, timeout time.Duration) (int64, []*WatchEvent, error) {
+	var res []*WatchEvent
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+
+	for seq >= 0 && seq == bw.seq {
+		notify := bw.notify
+
+		bw.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			seq = -1
+		}
+
+		bw.lock.Lock()
+	}
+
+	if seq < 0 {
+		return bw.seq, nil, nil
+	}
+
+	if seq > bw.seq || (len(bw.events) > 0 && bw.events[0].Seq > seq+1) {
+
+		// The requested events are not available (anymore)
+
+		return bw.seq, []*WatchEvent{{bw.seq, WatchOverflow, "/"}}, nil
+	}
+
+	for _, e := range bw.events {
+		if e.Seq > seq && isSubPath(spath, e.Path) {
+			res = append(res, e)
+		}
+	}
+
+	return bw.seq, res, nil
+}
+
+// Tree side
+// =========
+
+/*
+TreeWatch is a subscription for changes in a tree.
+*/
+type TreeWatch struct {
+	tree    *Tree        // Watched tree
+	dir     string       // Watched directory
+	handler WatchHandler // Handler for events
+}
+
+/*
+treeWatches manages all watches of a tree.
+*/
+type treeWatches struct {
+	lock    *sync.Mutex
+	watches map[*TreeWatch]bool             // All active watches
+	pollers map[string]map[string]chan bool // Stop channels of branch pollers by branch and branch path
+}
+
+/*
+Watch subscribes to changes under a given directory of the tree. The given
+handler is called for every change. Branches are watched if they are mapped
+under the given directory at the time of the call. Only the part of a branch
+which is mapped under the given directory is watched.
+*/
+func (t *Tree) Watch(dir string, handler WatchHandler) (*TreeWatch, error) {
+	var branches, rpaths []string
+
+	t.treeLock.RLock()
+
+	dir = path.Clean("/" + dir)
+
+	t.root.findPathBranches("/", createMappingPath(dir), true,
+		func(item *treeItem, treePath string, branchPath []string, bs []string, writable []bool, opts []MappingOptions) {
+			for _, b := range bs {
+				branches = append(branches, b)
+				rpaths = append(rpaths, path.Clean("/"+path.Join(branchPath...)))
+			}
+		})
+
+	t.treeLock.RUnlock()
+
+	if len(branches) == 0 {
+		return nil, fmt.Errorf("No branches are mapped under %v", dir)
+	}
+
+	tw := &TreeWatch{t, dir, handler}
+
+	t.watches.lock.Lock()
+	defer t.watches.lock.Unlock()
+
+	t.watches.watches[tw] = true
+
+	for i, b := range branches {
+		rpath := rpaths[i]
+
+		bpollers, ok := t.watches.pollers[b]
+		if !ok {
+			bpollers = make(map[string]chan bool)
+			t.watches.pollers[b] = bpollers
+		}
+
+		// Start a poller for every branch path which is not polled yet -
+		// pollers of paths below the new path are replaced
+
+		polled := false
+		for p := range bpollers {
+			polled = polled || isSubPath(p, rpath)
+		}
+
+		if polled {
+			continue
+		}
+
+		for p, stop := range bpollers {
+			if isSubPath(rpath, p) {
+				close(stop)
+				delete(bpollers, p)
+			}
+		}
+
+		stop := make(chan bool)
+		bpollers[rpath] = stop
+
+		go t.pollBranch(b, rpath, WatchPollTimeout, stop)
+	}
+
+	return tw, nil
+}
+
+/*
+Close ends this watch. Branches are no longer polled once there are no
+active watches.
+*/
+func (tw *TreeWatch) Close() {
+	tws := tw.tree.watches
+
+	tws.lock.Lock()
+	defer tws.lock.Unlock()
+
+	delete(tws.watches, tw)
+
+	if len(tws.watches) == 0 {
+		for b, bpollers := range tws.pollers {
+			for _, stop := range bpollers {
+				close(stop)
+			}
+			delete(tws.pollers, b)
+		}
+	}
+}
+
+/*
+pollBranch polls a given path of a branch for events until the given channel
+is closed.
+*/
+func (t *Tree) pollBranch(branch string, rpath string, timeout time.Duration, stop chan bool) {
+	var seq int64 = -1
+
+	for {
+		var res []byte
+		var err error
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if res, err = t.client.SendData(branch, map[string]string{
+			ParamAction:   OpWatch,
+			ParamPath:     rpath,
+			ParamSequence: fmt.Sprint(seq),
+			ParamTimeout:  fmt.Sprint(int64(timeout / time.Millisecond)),
+		}, nil); err == nil {
+			var dest []interface{}
+
+			// Unpack the result
+
+			if err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&dest); err == nil {
+				seq = dest[0].(int64)
+
+				// A replaced poller must not report events twice
+
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				for _, e := range dest[1].([]*WatchEvent) {
+					t.dispatchWatchEvent(branch, e)
+				}
+			}
+		}
+
+		if err != nil {
+			node.LogDebug("Could not watch branch ", branch, ": ", err)
+
+			// Wait before trying again - changes during this time are lost
+
+			if seq >= 0 {
+				seq = -1
+				t.dispatchWatchEvent(branch, &WatchEvent{0, WatchOverflow, "/"})
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(WatchRetryInterval):
+			}
+		}
+	}
+}
+
+/*
+dispatchWatchEvent sends an event of a branch to all interested watches.
+*/
+func (t *Tree) dispatchWatchEvent(branch string, e *WatchEvent) {
+	var mappings []string
+	var isMarker bool
+
+	type delivery struct {
+		handler WatchHandler
+		path    string
+	}
+
+	var deliveries []delivery
+
+	// Find all tree paths where the branch is mapped
+
+	t.treeLock.RLock()
+
+	t.root.findPathBranches("/", []string{}, true,
+		func(item *treeItem, treePath string, branchPath []string, bs []string, writable []bool, opts []MappingOptions) {
+			for _, b := range bs {
+				if b == branch {
+					mappings = append(mappings, treePath)
+					break
+				}
+			}
+		})
+
+	// Union markers are only handled if the branch is part of a union
+
+	dir, name := path.Split(e.Path)
+
+	if IsUnionMarker(name) {
+		for _, m := range mappings {
+			isMarker = isMarker || t.inUnion(path.Join(m, dir), false)
+		}
+	}
+
+	t.treeLock.RUnlock()
+
+	// Remove outdated data from the caches
+
+	if e.Type == WatchOverflow {
+
+		if t.cache != nil {
+			t.cache.Invalidate(branch, "/")
+		}
+
+		t.clearCaches()
+
+	} else {
+
+		if t.cache != nil {
+			t.cache.Invalidate(branch, e.Path)
+		}
+
+		for _, m := range mappings {
+			t.invalidateCaches(path.Join(m, e.Path))
+		}
+	}
+
+	// Temporary files are not reported
+
+	if isTempFile(path.Base(e.Path)) {
+		return
+	}
+
+	// Whiteout markers are reported as changes of the items they hide
+
+	if isMarker {
+
+		if name == OpaqueMarker || e.Type == WatchModify {
+			return
+		}
+
+		etype := WatchDelete
+		if e.Type == WatchDelete {
+			etype = WatchCreate
+		}
+
+		e = &WatchEvent{e.Seq, etype, path.Join(dir, name[len(WhiteoutPrefix):])}
+	}
+
+	// Translate the branch path into tree paths for all watches
+
+	t.watches.lock.Lock()
+
+	for tw := range t.watches.watches {
+		seen := make(map[string]bool)
+
+		for _, m := range mappings {
+			p := path.Join(m, e.Path)
+
+			if e.Type == WatchOverflow {
+
+				// Overflow events are reported for the mapping point or
+				// the watched directory - whichever is deeper
+
+				if isSubPath(tw.dir, m) {
+					p = m
+				} else if isSubPath(m, tw.dir) {
+					p = tw.dir
+				}
+			}
+
+			if isSubPath(tw.dir, p) && !seen[p] {
+				seen[p] = true
+				deliveries = append(deliveries, delivery{tw.handler, p})
+			}
+		}
+	}
+
+	t.watches.lock.Unlock()
+
+	for _, d := range deliveries {
+		d.handler(e.Type, d.path, branch)
+	}
+}
+
+/*
+isSubPath checks if a given path is equal to or below a given directory.
+*/
+func isSubPath(dir string, spath string) bool {
+	return dir == "/" || spath == dir || strings.HasPrefix(spath, dir+"/")
+}
@@ -0,0 +1,221 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"devt.de/krotik/rufs/node"
+)
+
+/*
+inotifyMask are the inotify events which are watched on every directory
+*/
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+/*
+inotifyWatcher watches a directory tree using inotify.
+*/
+type inotifyWatcher struct {
+	rootPath string                               // Watched directory (absolute path)
+	fd       int                                  // Inotify file descriptor
+	file     *os.File                             // File for reading the inotify file descriptor
+	handler  func(eventType string, spath string) // Handler for events
+	lock     *sync.Mutex                          // Lock for watches
+	watches  map[int32]string                     // Mapping from watch descriptor to path
+}
+
+/*
+watchDirectory starts watching all directories under a given root path. The
+given handler receives events with paths relative to the root path.
+*/
+func watchDirectory(rootPath string, handler func(eventType string, spath string)) (io.Closer, error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("Could not watch %v: %v", rootPath, err)
+	}
+
+	// Using a non-blocking file descriptor allows Close to interrupt
+	// a pending read
+
+	w := &inotifyWatcher{rootPath, fd, os.NewFile(uintptr(fd), "inotify"), handler,
+		&sync.Mutex{}, make(map[int32]string)}
+
+	if err = w.addWatches("/", nil); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.readEvents()
+
+	return w, nil
+}
+
+/*
+Close stops watching.
+*/
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+/*
+addWatches adds watches for a directory and all its subdirectories. All
+found items are reported to the given function.
+*/
+func (w *inotifyWatcher) addWatches(dir string, found func(spath string)) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return filepath.Walk(filepath.Join(w.rootPath, dir), func(p string, info os.FileInfo, err error) error {
+
+		if err != nil {
+
+			// Items might be removed while we walk
+
+			if os.IsNotExist(err) {
+				err = nil
+			}
+
+			return err
+		}
+
+		rel, _ := filepath.Rel(w.rootPath, p)
+		spath := path.Clean("/" + filepath.ToSlash(rel))
+
+		if found != nil && spath != dir {
+			found(spath)
+		}
+
+		if info.IsDir() {
+			var wd int
+
+			if wd, err = syscall.InotifyAddWatch(w.fd, p, inotifyMask); err == nil {
+				w.watches[int32(wd)] = spath
+
+			} else if os.IsNotExist(err) {
+				err = nil
+
+			} else {
+				err = fmt.Errorf("Could not watch %v: %v", p, err)
+			}
+		}
+
+		return err
+	})
+}
+
+/*
+removeWatches removes the watches of a directory and all its subdirectories.
+*/
+func (w *inotifyWatcher) removeWatches(dir string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for wd, spath := range w.watches {
+		if isSubPath(dir, spath) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+/*
+readEvents reads inotify events until the watcher is closed.
+*/
+func (w *inotifyWatcher) readEvents() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := w.file.Read(buf)
+
+		if err != nil {
+			if !strings.Contains(err.Error(), "file already closed") {
+				node.LogDebug("Stopped watching ", w.rootPath, ": ", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+
+			offset = nameStart + int(event.Len)
+
+			w.handleEvent(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+/*
+handleEvent handles a single inotify event.
+*/
+func (w *inotifyWatcher) handleEvent(wd int32, mask uint32, name string) {
+
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.handler(WatchOverflow, "/")
+		return
+	}
+
+	w.lock.Lock()
+	dir, ok := w.watches[wd]
+	if ok && mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.lock.Unlock()
+
+	if !ok || name == "" {
+		return
+	}
+
+	spath := path.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+
+		w.handler(WatchCreate, spath)
+
+		if isDir {
+
+			// Watch the new directory - items which were created before
+			// the watch was added are reported as well
+
+			if err := w.addWatches(spath, func(p string) {
+				w.handler(WatchCreate, p)
+			}); err != nil {
+				node.LogDebug("Could not watch new directory: ", err)
+			}
+		}
+
+	} else if mask&syscall.IN_CLOSE_WRITE != 0 {
+
+		w.handler(WatchModify, spath)
+
+	} else if mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+
+		if isDir && mask&syscall.IN_MOVED_FROM != 0 {
+			w.removeWatches(spath)
+		}
+
+		w.handler(WatchDelete, spath)
+	}
+}
@@ -0,0 +1,26 @@
+// +build !linux
+
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+watchDirectory starts watching all directories under a given root path.
+Watching is only supported on Linux.
+*/
+func watchDirectory(rootPath string, handler func(eventType string, spath string)) (io.Closer, error) {
+	return nil, fmt.Errorf("Watching is not supported on this platform")
+}
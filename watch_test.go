@@ -0,0 +1,316 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"devt.de/krotik/rufs/config"
+)
+
+func TestBranchWatch(t *testing.T) {
+
+	seq, events, err := footest.Watch("/", -1, 0)
+	if err != nil || events != nil {
+		t.Error("Unexpected result:", seq, events, err)
+		return
+	}
+
+	defer os.RemoveAll("foo/watchtest")
+
+	// Collect events until the expected events were seen
+
+	collect := func(spath string, expected string) string {
+		var res []string
+
+		timeout := time.Now().Add(5 * time.Second)
+
+		for time.Now().Before(timeout) {
+			var events []*WatchEvent
+
+			if seq, events, err = footest.Watch(spath, seq, time.Second); err != nil {
+				return err.Error()
+			}
+
+			for _, e := range events {
+				res = append(res, fmt.Sprintf("%v %v", e.Type, e.Path))
+			}
+
+			if strings.Join(res, "\n") == expected {
+				break
+			}
+		}
+
+		return strings.Join(res, "\n")
+	}
+
+	os.Mkdir("foo/watchtest", 0770)
+
+	if res := collect("/", "create /watchtest"); res != "create /watchtest" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	ioutil.WriteFile("foo/watchtest/test1", []byte("foo"), 0660)
+
+	if res := collect("/", `
+create /watchtest/test1
+modify /watchtest/test1`[1:]); res != `
+create /watchtest/test1
+modify /watchtest/test1`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	os.Rename("foo/watchtest/test1", "foo/watchtest/test2")
+
+	if res := collect("/watchtest", `
+delete /watchtest/test1
+create /watchtest/test2`[1:]); res != `
+delete /watchtest/test1
+create /watchtest/test2`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Events outside of the requested path are not returned
+
+	os.Remove("foo/watchtest/test2")
+
+	if seq, events, err = footest.Watch("/sub1", seq, 5*time.Second); err != nil || events != nil {
+		t.Error("Unexpected result:", events, err)
+		return
+	}
+
+	// Requests for events which are no longer available produce an overflow event
+
+	oldMaxWatchEvents := MaxWatchEvents
+	MaxWatchEvents = 1
+	defer func() {
+		MaxWatchEvents = oldMaxWatchEvents
+	}()
+
+	oldSeq := seq
+
+	ioutil.WriteFile("foo/watchtest/test3", []byte("foo"), 0660)
+
+	for i := 0; i < 50 && seq < oldSeq+2; i++ {
+		seq, _, _ = footest.Watch("/", seq, 100*time.Millisecond)
+	}
+
+	if _, events, err = footest.Watch("/", oldSeq, 0); err != nil || len(events) != 1 ||
+		events[0].Type != WatchOverflow || events[0].Path != "/" {
+		t.Error("Unexpected result:", events, err)
+		return
+	}
+
+	if _, events, err = footest.Watch("/", seq+10, 0); err != nil || len(events) != 1 ||
+		events[0].Type != WatchOverflow {
+		t.Error("Unexpected result:", events, err)
+		return
+	}
+
+	// Requests without new events time out
+
+	if res, events, err := footest.Watch("/", seq, 10*time.Millisecond); err != nil ||
+		res != seq || events != nil {
+		t.Error("Unexpected result:", res, events, err)
+		return
+	}
+}
+
+func TestTreeWatch(t *testing.T) {
+
+	oldWatchPollTimeout := WatchPollTimeout
+	WatchPollTimeout = 100 * time.Millisecond
+	defer func() {
+		WatchPollTimeout = oldWatchPollTimeout
+	}()
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := tree.Watch("/", nil); err == nil || err.Error() != "No branches are mapped under /" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost],
+		branchConfigs["footest"][config.RPCPort])
+
+	tree.AddBranch("footest", branchRPC, "")
+	tree.AddMapping("/", "footest", true)
+	tree.AddMapping("/mnt/foo", "footest", false)
+
+	defer os.RemoveAll("foo/watchtest2")
+
+	var lock sync.Mutex
+	var rootEvents, mntEvents []string
+
+	watchRoot, err := tree.Watch("/", func(event string, path string, branch string) {
+		lock.Lock()
+		defer lock.Unlock()
+		rootEvents = append(rootEvents, fmt.Sprintf("%v %v %v", event, path, branch))
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer watchRoot.Close()
+
+	watchMnt, err := tree.Watch("/mnt/", func(event string, path string, branch string) {
+		lock.Lock()
+		defer lock.Unlock()
+		mntEvents = append(mntEvents, fmt.Sprintf("%v %v %v", event, path, branch))
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer watchMnt.Close()
+
+	// Wait until the pollers have retrieved the current sequence number
+
+	time.Sleep(200 * time.Millisecond)
+
+	os.Mkdir("foo/watchtest2", 0770)
+
+	getEvents := func(expectedRoot int, expectedMnt int) (string, string) {
+
+		for i := 0; i < 50; i++ {
+			lock.Lock()
+			done := len(rootEvents) >= expectedRoot && len(mntEvents) >= expectedMnt
+			lock.Unlock()
+
+			if done {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		sort.Strings(rootEvents)
+
+		return strings.Join(rootEvents, "\n"), strings.Join(mntEvents, "\n")
+	}
+
+	if root, mnt := getEvents(2, 1); root != `
+create /mnt/foo/watchtest2 footest
+create /watchtest2 footest`[1:] || mnt != "create /mnt/foo/watchtest2 footest" {
+		t.Error("Unexpected result:", root, mnt)
+		return
+	}
+}
+
+func TestTreeWatchAccessControl(t *testing.T) {
+	var err error
+
+	oldWatchPollTimeout := WatchPollTimeout
+	WatchPollTimeout = 100 * time.Millisecond
+	oldACL := footest.acl
+	defer func() {
+		WatchPollTimeout = oldWatchPollTimeout
+		footest.acl = oldACL
+	}()
+
+	footest.acl, err = NewAccessControlList(map[string]interface{}{
+		"alice": []interface{}{
+			map[string]interface{}{"path": "/watchacl", "access": "r"},
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret:     "123",
+		config.TreeClientName: "alice",
+	}, clientCert)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	branchRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost],
+		branchConfigs["footest"][config.RPCPort])
+
+	tree.AddBranch("footest", branchRPC, "")
+	tree.AddMapping("/", "footest", false)
+
+	os.Mkdir("foo/watchacl", 0770)
+	defer os.RemoveAll("foo/watchacl")
+	defer os.Remove("foo/watchacl2")
+
+	var lock sync.Mutex
+	var events []string
+
+	// Only the watched directory is polled on the branch
+
+	watch, err := tree.Watch("/watchacl", func(event string, path string, branch string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, fmt.Sprintf("%v %v %v", event, path, branch))
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer watch.Close()
+
+	// Wait until the poller has retrieved the current sequence number
+
+	time.Sleep(200 * time.Millisecond)
+
+	ioutil.WriteFile("foo/watchacl2", []byte("test"), 0660)
+	ioutil.WriteFile("foo/watchacl/test1", []byte("test"), 0660)
+
+	for i := 0; i < 50; i++ {
+		lock.Lock()
+		done := len(events) > 0
+		lock.Unlock()
+
+		if done {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if res := strings.Join(events, "\n"); !strings.HasPrefix(res, "create /watchacl/test1 footest") {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
@@ -0,0 +1,449 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"devt.de/krotik/common/fileutil"
+)
+
+/*
+Union markers - a whiteout marker .wh.<name> on a branch hides the item <name>
+on all branches of a union which come after the branch. An opaque marker in a
+directory hides the contents of the directory on all branches which come after
+the branch.
+*/
+const (
+	WhiteoutPrefix = ".wh."         // Name prefix of whiteout markers
+	OpaqueMarker   = ".wh..wh..opq" // Name of opaque directory markers
+)
+
+/*
+UnionMarkerCacheTTL is the time for which the union markers of an item are
+cached for reads. Changes through the tree and watched changes invalidate the
+cache immediately. Changes which are made directly on a branch are noticed
+after this time.
+*/
+var UnionMarkerCacheTTL = time.Second
+
+/*
+IsUnionMarker returns if a given file name is a whiteout or opaque marker.
+*/
+func IsUnionMarker(name string) bool {
+	return strings.HasPrefix(name, WhiteoutPrefix)
+}
+
+/*
+branchListing is the directory listing of a single branch. Directories are
+given as tree paths.
+*/
+type branchListing struct {
+	branch string
+	dirs   []string
+	fis    [][]os.FileInfo
+}
+
+/*
+unionMarkers holds the union markers of a set of branch listings.
+*/
+type unionMarkers struct {
+	whiteouts map[string]string // Whited out tree paths to the branch holding the marker
+	opaques   map[string]string // Opaque tree directories to the branch holding the marker
+	order     map[string]int    // Position of each branch in the union
+}
+
+/*
+newUnionMarkers collects all union markers of a given set of branch listings.
+The listings must be in the order of the union (i.e. listings of branches with
+a higher priority come first).
+*/
+func newUnionMarkers(listings []*branchListing) *unionMarkers {
+	m := &unionMarkers{make(map[string]string), make(map[string]string), make(map[string]int)}
+
+	for pos, l := range listings {
+
+		if _, ok := m.order[l.branch]; !ok {
+			m.order[l.branch] = pos
+		}
+
+		for i, d := range l.dirs {
+			for _, fi := range l.fis[i] {
+				var markers map[string]string
+				var p string
+
+				if name := fi.Name(); name == OpaqueMarker {
+					markers, p = m.opaques, path.Clean(d)
+				} else if IsUnionMarker(name) {
+					markers, p = m.whiteouts, path.Join(d, name[len(WhiteoutPrefix):])
+				} else {
+					continue
+				}
+
+				if _, ok := markers[p]; !ok {
+					markers[p] = l.branch
+				}
+			}
+		}
+	}
+
+	return m
+}
+
+/*
+isHidden returns if a given tree path of a given branch is hidden by the
+markers of a branch which comes before it in the union.
+*/
+func (m *unionMarkers) isHidden(branch string, treePath string) bool {
+
+	isOther := func(markers map[string]string, p string) bool {
+		b, ok := markers[p]
+		return ok && b != branch && m.order[b] < m.order[branch]
+	}
+
+	p := path.Clean(treePath)
+
+	if isOther(m.whiteouts, p) {
+		return true
+	}
+
+	for p != "/" && p != "." {
+		p = path.Dir(p)
+
+		if isOther(m.whiteouts, p) || isOther(m.opaques, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+holdsMarker returns if a given branch holds a marker which hides a given tree
+path on other branches.
+*/
+func (m *unionMarkers) holdsMarker(branch string, treePath string) bool {
+	p := path.Clean(treePath)
+
+	if m.whiteouts[p] == branch {
+		return true
+	}
+
+	for p != "/" && p != "." {
+		p = path.Dir(p)
+
+		if m.whiteouts[p] == branch || m.opaques[p] == branch {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+filter removes all union markers and all hidden items from the listing of a
+directory of a given branch.
+*/
+func (m *unionMarkers) filter(branch string, dir string, fis []os.FileInfo) []os.FileInfo {
+	ret := make([]os.FileInfo, 0, len(fis))
+
+	for _, fi := range fis {
+		if !IsUnionMarker(fi.Name()) && !m.isHidden(branch, path.Join(dir, fi.Name())) {
+			ret = append(ret, fi)
+		}
+	}
+
+	return ret
+}
+
+// Tree functions
+// ==============
+
+/*
+inUnion returns if the items of a given directory are provided by more than
+one branch. Union markers are only handled for directories of a union. All
+subdirectories are taken into account if the recursive flag is set.
+*/
+func (t *Tree) inUnion(dir string, recursive bool) bool {
+	var count int
+
+	t.root.findPathBranches("/", createMappingPath(dir), recursive,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+			count += len(branches)
+		})
+
+	return count > 1
+}
+
+/*
+unionListing lists a single item on all branches of the tree. Returns the
+listings of the parent directory which only contain the item and the union
+markers which apply to it.
+*/
+func (t *Tree) unionListing(spath string) ([]*branchListing, *unionMarkers, error) {
+	dir, file := path.Split(path.Clean("/" + spath))
+
+	listings, err := t.branchListings(dir, fmt.Sprintf("^%v$", regexp.QuoteMeta(file)), false, false)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return listings, newUnionMarkers(listings), nil
+}
+
+/*
+itemProviders returns all branches which provide a given item in the union
+view along with the information of the item on each branch.
+*/
+func (t *Tree) itemProviders(spath string) (map[string]os.FileInfo, error) {
+	providers, _, err := t.unionProviders(spath)
+	return providers, err
+}
+
+/*
+unionProviders returns all branches which provide a given item in the union
+view along with the union markers which apply to the item.
+*/
+func (t *Tree) unionProviders(spath string) (map[string]os.FileInfo, *unionMarkers, error) {
+	spath = path.Clean("/" + spath)
+	dir, file := path.Split(spath)
+
+	listings, markers, err := t.unionListing(spath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	providers := make(map[string]os.FileInfo)
+
+	for _, l := range listings {
+		for i, d := range l.dirs {
+			if path.Clean(d) != path.Clean(dir) || markers.isHidden(l.branch, spath) {
+				continue
+			}
+
+			for _, fi := range l.fis[i] {
+				if _, ok := providers[l.branch]; !ok && fi.Name() == file {
+					providers[l.branch] = fi
+				}
+			}
+		}
+	}
+
+	return providers, markers, nil
+}
+
+/*
+hiddenBranches returns all branches on which a given item is hidden by the
+union markers of other branches. Items are never hidden if there is only one
+branch for the item. The result is cached so reads of the same item do not
+need to look up the markers every time.
+*/
+func (t *Tree) hiddenBranches(spath string) (map[string]bool, error) {
+
+	spath = path.Clean("/" + spath)
+	dir, _ := path.Split(spath)
+
+	if !t.inUnion(dir, false) {
+		return nil, nil
+	}
+
+	if cached, ok := t.hiddenCache.get(spath); ok {
+		return cached.(map[string]bool), nil
+	}
+
+	listings, markers, err := t.unionListing(spath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := make(map[string]bool)
+
+	for _, l := range listings {
+		if markers.isHidden(l.branch, spath) {
+			hidden[l.branch] = true
+		}
+	}
+
+	t.hiddenCache.put(spath, hidden, UnionMarkerCacheTTL)
+
+	return hidden, nil
+}
+
+/*
+checkHideable checks that an item in a given directory can be hidden by a
+union marker on the top writable branch. Items of read-only branches which
+come before the top writable branch cannot be hidden.
+*/
+func (t *Tree) checkHideable(dir string, providers map[string]os.FileInfo) error {
+	var readOnly []string
+
+	writableBranches := make(map[string]bool)
+
+	t.root.findPathBranches(dir, createMappingPath(dir), false,
+		func(item *treeItem, treePath string, branchPath []string, branches []string, writable []bool, opts []MappingOptions) {
+
+			for i, b := range branches {
+				if writable[i] {
+					writableBranches[b] = true
+				} else if len(writableBranches) == 0 {
+					readOnly = append(readOnly, b)
+				}
+			}
+		})
+
+	// Branches which are mapped several times might be writable in
+	// another mapping - the operation itself reports missing writable
+	// branches
+
+	for _, b := range readOnly {
+		if _, ok := providers[b]; ok && !writableBranches[b] && len(writableBranches) > 0 {
+			return ErrNotWritable
+		}
+	}
+
+	return nil
+}
+
+/*
+writeUnionMarker creates a union marker on a given branch.
+*/
+func (t *Tree) writeUnionMarker(branch string, rpath string) error {
+	var n int
+
+	res, err := t.client.SendData(branch, map[string]string{
+		ParamAction: OpWrite,
+		ParamPath:   rpath,
+		ParamOffset: "0",
+	}, []byte{})
+
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&n)
+	}
+
+	return err
+}
+
+/*
+stringSet converts a list of strings into a set.
+*/
+func stringSet(l []string) map[string]bool {
+	ret := make(map[string]bool)
+
+	for _, s := range l {
+		ret[s] = true
+	}
+
+	return ret
+}
+
+// Branch functions
+// ================
+
+/*
+hidesSubPath returns if a marker in one of the parent directories of a given
+path hides the path on other branches.
+*/
+func (b *Branch) hidesSubPath(spath string) bool {
+	p := path.Clean("/" + spath)
+
+	for p != "/" {
+		dir, name := path.Split(p)
+
+		if subDir, err := b.constructSubPath(dir); err == nil {
+			for _, marker := range []string{WhiteoutPrefix + name, OpaqueMarker} {
+				if ok, _ := fileutil.PathExists(filepath.Join(subDir, b.localName(marker))); ok {
+					return true
+				}
+			}
+		}
+
+		p = path.Clean(dir)
+	}
+
+	return false
+}
+
+/*
+markHidden adds an opaque marker to the listing of a given path if a marker
+in one of its parent directories hides the path on other branches. Listings
+are only marked if the union flag is set.
+*/
+func (b *Branch) markHidden(spath string, fis []os.FileInfo, union bool) []os.FileInfo {
+
+	if union && b.hidesSubPath(spath) {
+
+		for _, fi := range fis {
+			if fi.Name() == OpaqueMarker {
+				return fis
+			}
+		}
+
+		fis = append(fis, &FileInfo{
+			FiName: OpaqueMarker,
+			FiMode: 0644,
+		})
+	}
+
+	return fis
+}
+
+/*
+clearWhiteouts removes all whiteout markers which hide a given path or one
+of its parent directories. A directory which replaces a whited out directory
+becomes opaque so the contents of other branches stay hidden.
+*/
+func (b *Branch) clearWhiteouts(spath string) {
+	p := path.Clean("/" + spath)
+
+	for p != "/" {
+		dir, name := path.Split(p)
+
+		if subDir, err := b.constructSubPath(dir); err == nil {
+
+			if err = os.Remove(filepath.Join(subDir, b.localName(WhiteoutPrefix+name))); err == nil {
+				itemPath := filepath.Join(subDir, b.localName(name))
+
+				if fi, err := os.Stat(itemPath); err == nil && fi.IsDir() {
+					ioutil.WriteFile(filepath.Join(itemPath, b.localName(OpaqueMarker)), nil, 0644)
+				}
+			}
+		}
+
+		p = path.Clean(dir)
+	}
+}
+
+/*
+createsItem returns if a write to a given local path of a branch in a union
+creates a new item. Whiteout markers only need to be removed for new items.
+*/
+func createsItem(localPath string, union bool) bool {
+
+	if !union {
+		return false
+	}
+
+	_, err := os.Lstat(localPath)
+
+	return os.IsNotExist(err)
+}
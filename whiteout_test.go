@@ -0,0 +1,452 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+	"devt.de/krotik/rufs/node"
+)
+
+func TestUnionWhiteouts(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", false))
+
+	os.Mkdir("foo/wotest", 0770)
+	os.MkdirAll("bar/wotest/dir1", 0770)
+	defer os.RemoveAll("foo/wotest")
+	defer os.RemoveAll("bar/wotest")
+
+	ioutil.WriteFile("foo/wotest/file1", []byte("upper1"), 0660)
+	ioutil.WriteFile("foo/wotest/file5", []byte("upper5"), 0660)
+	ioutil.WriteFile("bar/wotest/file1", []byte("lower1"), 0660)
+	ioutil.WriteFile("bar/wotest/file3", []byte("lower3"), 0660)
+	ioutil.WriteFile("bar/wotest/file5", []byte("lower5"), 0660)
+	ioutil.WriteFile("bar/wotest/dir1/file2", []byte("lower2"), 0660)
+
+	checkDir := func(expected string) error {
+		paths, infos, err := tree.Dir("/wotest", "", true, false)
+		if res := DirResultToString(paths, infos); err != nil || res != expected {
+			return fmt.Errorf("Unexpected result: %v %v", res, err)
+		}
+		return nil
+	}
+
+	checkNotExist := func(item string) error {
+		var buf bytes.Buffer
+
+		if _, err := tree.Stat(item); err == nil || !err.(*node.Error).IsNotExist {
+			return fmt.Errorf("Unexpected stat result: %v", err)
+		}
+
+		if err := tree.ReadFileToBuffer(item, &buf); err == nil {
+			return fmt.Errorf("Unexpected read result: %v %v", buf.String(), err)
+		}
+
+		return nil
+	}
+
+	if err := checkDir(`
+/wotest
+drwxrwxrwx 4.0 KiB dir1
+-rw-rw-rw-   6 B   file1
+-rw-rw-rw-   6 B   file3
+-rw-rw-rw-   6 B   file5
+
+/wotest/dir1
+-rw-rw-rw- 6 B   file2
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Delete a file which also exists on the read-only branch
+
+	if ok, err := tree.ItemOp("/wotest", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "file1",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if err := checkNotExist("/wotest/file1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Delete a directory which only exists on the read-only branch
+
+	if ok, err := tree.ItemOp("/wotest", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "dir1",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if err := checkNotExist("/wotest/dir1/file2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Rename a file which exists on both branches
+
+	if ok, err := tree.ItemOp("/wotest", map[string]string{
+		ItemOpAction:  ItemOpActRename,
+		ItemOpName:    "file5",
+		ItemOpNewName: "file6",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if err := checkDir(`
+/wotest
+-rw-rw-rw- 6 B   file3
+-rw-rw-rw- 6 B   file6
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wotest"); res != `
+.wh.dir1(0)
+.wh.file1(0)
+.wh.file5(0)
+file6(6)
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Writing a deleted file removes the whiteout
+
+	if _, err := tree.WriteFile("/wotest/file1", []byte("new1"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/wotest/file1", &buf); err != nil || buf.String() != "new1" {
+		t.Error("Unexpected result:", buf.String(), err)
+		return
+	}
+
+	// A newly created directory hides the contents of the deleted directory
+
+	if ok, err := tree.ItemOp("/wotest", map[string]string{
+		ItemOpAction: ItemOpActMkDir,
+		ItemOpName:   "dir1",
+	}); !ok || err != nil {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if err := checkDir(`
+/wotest
+drwxrwxrwx 4.0 KiB dir1
+-rw-rw-rw-   4 B   file1
+-rw-rw-rw-   6 B   file3
+-rw-rw-rw-   6 B   file6
+
+/wotest/dir1
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wotest/dir1"); res != ".wh..wh..opq(0)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if err := checkNotExist("/wotest/dir1/file2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Items which only exist on the read-only branch are copied before
+	// they are renamed
+
+	os.MkdirAll("bar/wotest/dir2/empty", 0770)
+	ioutil.WriteFile("bar/wotest/dir2/file8", []byte("lower8"), 0660)
+
+	for _, names := range [][]string{{"file3", "file7"}, {"dir2", "dir3"}} {
+		if ok, err := tree.ItemOp("/wotest", map[string]string{
+			ItemOpAction:  ItemOpActRename,
+			ItemOpName:    names[0],
+			ItemOpNewName: names[1],
+		}); !ok || err != nil {
+			t.Error("Unexpected result:", names, ok, err)
+			return
+		}
+	}
+
+	if err := checkDir(`
+/wotest
+drwxrwxrwx 4.0 KiB dir1
+drwxrwxrwx 4.0 KiB dir3
+-rw-rw-rw-   4 B   file1
+-rw-rw-rw-   6 B   file6
+-rw-rw-rw-   6 B   file7
+
+/wotest/dir1
+
+/wotest/dir3
+drwxrwxrwx 4.0 KiB empty
+-rw-rw-rw-   6 B   file8
+
+/wotest/dir3/empty
+`[1:]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wotest"); res != `
+.wh.dir2(0)
+.wh.file3(0)
+.wh.file5(0)
+dir1(dir)
+dir3(dir)
+file1(4)
+file6(6)
+file7(6)
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Items are unchanged on the read-only branch
+
+	if res := dirLocal("bar/wotest"); res != `
+dir1(dir)
+dir2(dir)
+file1(6)
+file3(6)
+file5(6)
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestUnionMarkerPriority(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMappingWithOptions("/", "bartest", false, MappingOptions{Priority: 10}))
+
+	os.Mkdir("foo/woprio", 0770)
+	os.Mkdir("bar/woprio", 0770)
+	defer os.RemoveAll("foo/woprio")
+	defer os.RemoveAll("bar/woprio")
+
+	// Markers only hide the items of branches which come after them
+
+	ioutil.WriteFile("foo/woprio/.wh.file1", nil, 0660)
+	ioutil.WriteFile("bar/woprio/file1", []byte("bar1"), 0660)
+	ioutil.WriteFile("foo/woprio/file2", []byte("foo2"), 0660)
+	ioutil.WriteFile("bar/woprio/.wh.file2", nil, 0660)
+
+	paths, infos, err := tree.Dir("/woprio", "", false, false)
+	if res := DirResultToString(paths, infos); err != nil || res != `
+/woprio
+-rw-rw-rw- 4 B   file1
+`[1:] {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if err := tree.ReadFileToBuffer("/woprio/file1", &buf); err != nil || buf.String() != "bar1" {
+		t.Error("Unexpected result:", buf.String(), err)
+		return
+	}
+
+	if _, err := tree.Stat("/woprio/file2"); err == nil {
+		t.Error("File should be hidden")
+		return
+	}
+
+	// Items of read-only branches which come before all writable branches
+	// cannot be hidden
+
+	if ok, err := tree.ItemOp("/woprio", map[string]string{
+		ItemOpAction: ItemOpActDelete,
+		ItemOpName:   "file1",
+	}); ok || err != ErrNotWritable {
+		t.Error("Unexpected result:", ok, err)
+		return
+	}
+
+	if fi, err := tree.Stat("/woprio/file1"); err != nil || fi.Size() != 4 {
+		t.Error("Unexpected result:", fi, err)
+		return
+	}
+}
+
+func TestUnionMarkerCache(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", false))
+
+	os.Mkdir("foo/wocache", 0770)
+	os.Mkdir("bar/wocache", 0770)
+	defer os.RemoveAll("foo/wocache")
+	defer os.RemoveAll("bar/wocache")
+
+	ioutil.WriteFile("bar/wocache/file1", []byte("bar1"), 0660)
+
+	buf := make([]byte, 4)
+
+	read := func() string {
+		n, err := tree.ReadFile("/wocache/file1", buf, 0)
+		return fmt.Sprint(string(buf[:n]), " ", err)
+	}
+
+	if res := read(); res != "bar1 <nil>" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The markers are not looked up again for further reads
+
+	ioutil.WriteFile("foo/wocache/.wh.file1", nil, 0660)
+
+	if res := read(); res != "bar1 <nil>" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Changes through the tree invalidate the cache
+
+	if _, err := tree.WriteFile("/wocache/file2", []byte("foo2"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := read(); res != " RufsError: Remote error (stat /wocache/file1: no such file or directory)" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestUnionMarkersOutsideUnion(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+
+	os.Mkdir("foo/wosingle", 0770)
+	os.Mkdir("bar/wosingle", 0770)
+	defer os.RemoveAll("foo/wosingle")
+	defer os.RemoveAll("bar/wosingle")
+
+	ioutil.WriteFile("foo/wosingle/file1", []byte("foo1"), 0660)
+	ioutil.WriteFile("foo/wosingle/.wh.file1", []byte("user"), 0660)
+
+	// Files which look like union markers are normal files if the branch
+	// is not part of a union
+
+	paths, infos, err := tree.Dir("/wosingle", "", false, false)
+	if res := DirResultToString(paths, infos); err != nil || res != `
+/wosingle
+-rw-rw-rw- 4 B   .wh.file1
+-rw-rw-rw- 4 B   file1
+`[1:] {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if _, err := tree.WriteFile("/wosingle/.wh.file2", []byte("user"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := tree.WriteFile("/wosingle/file2", []byte("foo2"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wosingle"); res != ".wh.file1(4)\n.wh.file2(4)\nfile1(4)\nfile2(4)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Whiteout markers of a union are only removed if an item is created
+
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", false))
+
+	ioutil.WriteFile("bar/wosingle/file3", []byte("bar3"), 0660)
+	ioutil.WriteFile("foo/wosingle/.wh.file3", nil, 0660)
+
+	if _, err := tree.WriteFile("/wosingle/file1", []byte("FOO1"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := tree.WriteFile("/wosingle/file3", []byte("foo3"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wosingle"); res != ".wh.file1(4)\n.wh.file2(4)\nfile1(4)\nfile2(4)\nfile3(4)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
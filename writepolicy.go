@@ -0,0 +1,195 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+/*
+Write policies which determine the writable branches of a mapping that
+receive new items. Existing items are always written on all writable
+branches which have them.
+*/
+const (
+	WritePolicyAll        = "all"        // Write to all writable branches (default)
+	WritePolicyFirst      = "first"      // Write to the first writable branch
+	WritePolicyMostFree   = "mostfree"   // Write to the writable branch with the most free space
+	WritePolicyRoundRobin = "roundrobin" // Write to the writable branches in turn
+)
+
+/*
+isWritePolicy checks if a given string is a known write policy. The empty
+string is accepted as the default policy.
+*/
+func isWritePolicy(policy string) bool {
+	return policy == "" || policy == WritePolicyAll || policy == WritePolicyFirst ||
+		policy == WritePolicyMostFree || policy == WritePolicyRoundRobin
+}
+
+/*
+writeCandidate is a writable branch which might receive a write.
+*/
+type writeCandidate struct {
+	branch string // Name of the branch
+	rpath  string // Path of the item on the branch
+	policy string // Write policy of the mapping of the branch
+}
+
+/*
+writeBranches returns the branches and branch paths which should receive a
+write of a given item. The write policy of a tree path is the first policy
+which is given for one of its writable mappings.
+*/
+func (t *Tree) writeBranches(spath string) ([]string, []string, error) {
+	var err error
+	var branches, rpaths []string
+	var items []*treeItem
+	var providers map[string]os.FileInfo
+	var markers *unionMarkers
+
+	spath = path.Clean("/" + spath)
+	dir, file := path.Split(spath)
+
+	// Collect the writable branches of all tree items - the branches of an
+	// item might not be visited in one go if other branches have a higher
+	// priority
+
+	candidates := make(map[*treeItem][]*writeCandidate)
+
+	t.root.findPathBranches(dir, createMappingPath(dir), false,
+		func(item *treeItem, treePath string, branchPath []string, bs []string, writable []bool, opts []MappingOptions) {
+
+			for i, b := range bs {
+				if writable[i] {
+
+					if _, ok := candidates[item]; !ok {
+						items = append(items, item)
+					}
+
+					candidates[item] = append(candidates[item], &writeCandidate{b,
+						path.Join(path.Join(branchPath...), file), opts[i].Policy})
+				}
+			}
+		})
+
+	for _, item := range items {
+		var policy string
+
+		selected := candidates[item]
+
+		for _, c := range selected {
+			if c.policy != "" {
+				policy = c.policy
+				break
+			}
+		}
+
+		if len(selected) > 1 && policy != "" && policy != WritePolicyAll {
+
+			// Existing items are written where they are
+
+			if providers == nil {
+				if providers, markers, err = t.unionProviders(spath); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			selected = nil
+
+			for _, c := range candidates[item] {
+				if _, ok := providers[c.branch]; ok {
+					selected = append(selected, c)
+				}
+			}
+
+			// Deleted items are re-created on the branch which holds
+			// the marker - the marker would hide them on other branches
+
+			for _, c := range candidates[item] {
+				if len(selected) == 0 && markers.holdsMarker(c.branch, spath) {
+					selected = append(selected, c)
+				}
+			}
+
+			if len(selected) == 0 {
+				if selected, err = t.selectWriteBranch(item, policy, candidates[item]); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		for _, c := range selected {
+			branches = append(branches, c.branch)
+			rpaths = append(rpaths, c.rpath)
+		}
+	}
+
+	return branches, rpaths, err
+}
+
+/*
+selectWriteBranch selects the branch for a new item from a list of writable
+branches of a tree item according to a given write policy.
+*/
+func (t *Tree) selectWriteBranch(item *treeItem, policy string, candidates []*writeCandidate) ([]*writeCandidate, error) {
+	var err error
+
+	if policy == WritePolicyRoundRobin {
+		n := atomic.AddUint32(&item.nextWrite, 1) - 1
+
+		return candidates[int(n%uint32(len(candidates))):][:1], nil
+
+	} else if policy == WritePolicyMostFree {
+		var selected []*writeCandidate
+		var maxFree uint64
+
+		for _, c := range candidates {
+			var free uint64
+
+			// Branches which cannot report their free space are skipped
+
+			if free, err = t.branchFreeSpace(c.branch); err == nil && (selected == nil || free > maxFree) {
+				selected, maxFree = []*writeCandidate{c}, free
+			}
+		}
+
+		if selected != nil {
+			return selected, nil
+		}
+
+		return nil, err
+	}
+
+	return candidates[:1], nil
+}
+
+/*
+branchFreeSpace queries the free space of a given branch.
+*/
+func (t *Tree) branchFreeSpace(branch string) (uint64, error) {
+	var free uint64
+
+	res, err := t.client.SendData(branch, map[string]string{
+		ParamAction: OpFreeSpace,
+		ParamPath:   "/",
+	}, nil)
+
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(res)).Decode(&free)
+	}
+
+	return free, err
+}
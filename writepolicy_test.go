@@ -0,0 +1,221 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestWritePolicy(t *testing.T) {
+
+	if free, err := footest.FreeSpace(); err != nil || free == 0 {
+		t.Error("Unexpected result:", free, err)
+		return
+	}
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	createTree := func(policy string) *Tree {
+		tree, err := NewTree(map[string]interface{}{
+			config.TreeSecret: "123",
+		}, clientCert)
+		errorutil.AssertOk(err)
+
+		errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+		errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+		errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+		errorutil.AssertOk(tree.AddMappingWithOptions("/", "bartest", true, MappingOptions{Policy: policy}))
+
+		return tree
+	}
+
+	os.Mkdir("foo/wptest", 0770)
+	os.Mkdir("bar/wptest", 0770)
+	defer os.RemoveAll("foo/wptest")
+	defer os.RemoveAll("bar/wptest")
+
+	tree, _ := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+
+	if err := tree.AddMappingWithOptions("/", "footest", true, MappingOptions{Policy: "foo"}); err == nil ||
+		err.Error() != "Unknown write policy: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Write to the first writable branch
+
+	tree = createTree(WritePolicyFirst)
+
+	if res := tree.String(); res != "/: footest(w), bartest(w first)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if _, err := tree.WriteFile("/wptest/test1", []byte("Test1"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := tree.ItemOp("/wptest", map[string]string{
+		ItemOpAction: ItemOpActMkDir,
+		ItemOpName:   "dir1",
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wptest") + dirLocal("bar/wptest"); res != "dir1(dir)\ntest1(5)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The policy is part of the tree configuration
+
+	conf := tree.Config()
+
+	if !strings.Contains(conf, `"policy": "first"`) {
+		t.Error("Unexpected result:", conf)
+		return
+	}
+
+	tree = createTree("")
+	errorutil.AssertOk(tree.SetMapping(conf))
+
+	if res := tree.String(); res != "/: footest(w), bartest(w first)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Write new files in turn - existing files are written where they are
+
+	tree = createTree(WritePolicyRoundRobin)
+
+	for i := 2; i < 5; i++ {
+		if _, err := tree.WriteFile(fmt.Sprintf("/wptest/test%v", i), []byte("Test"), 0); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if _, err := tree.WriteFile("/wptest/test3", []byte("Test3"), 4); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wptest"); res != "dir1(dir)\ntest1(5)\ntest2(4)\ntest4(4)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := dirLocal("bar/wptest"); res != "test3(9)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Write to the branch with the most free space
+
+	tree = createTree(WritePolicyMostFree)
+
+	if err := tree.WriteFileFromBuffer("/wptest/test5", strings.NewReader("Test5")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, fooErr := os.Stat("foo/wptest/test5")
+	_, barErr := os.Stat("bar/wptest/test5")
+
+	if (fooErr == nil) == (barErr == nil) {
+		t.Error("File should be on exactly one branch:", fooErr, barErr)
+		return
+	}
+
+	// Re-created files are written on the branch which holds the whiteout
+	// marker of the deleted file
+
+	lower, err := createBranch("wptest3", "wp3", false)
+	errorutil.AssertOk(err)
+
+	defer func() {
+		errorutil.AssertOk(lower.Shutdown())
+		os.RemoveAll("wp3")
+	}()
+
+	os.Mkdir("wp3/wptest", 0770)
+	ioutil.WriteFile("wp3/wptest/test6", []byte("Lower6"), 0660)
+
+	tree = createTree(WritePolicyRoundRobin)
+
+	errorutil.AssertOk(tree.AddBranch("wptest3", fmt.Sprintf("%v:%v",
+		branchConfigs["wptest3"][config.RPCHost], branchConfigs["wptest3"][config.RPCPort]), ""))
+	errorutil.AssertOk(tree.AddMapping("/", "wptest3", false))
+
+	for i := 0; i < 3; i++ {
+
+		if ok, err := tree.ItemOp("/wptest", map[string]string{
+			ItemOpAction: ItemOpActDelete,
+			ItemOpName:   "test6",
+		}); !ok || err != nil {
+			t.Error("Unexpected result:", ok, err)
+			return
+		}
+
+		if _, err := tree.Stat("/wptest/test6"); err == nil {
+			t.Error("File should be hidden")
+			return
+		}
+
+		if _, err := tree.WriteFile("/wptest/test6", []byte(fmt.Sprint("Test", i)), 0); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if fi, err := tree.Stat("/wptest/test6"); err != nil || fi.Size() != 5 {
+			t.Error("Unexpected result:", i, fi, err)
+			return
+		}
+	}
+
+	// Policies are kept for each mapping - the first policy of a tree path
+	// is used
+
+	tree = createTree(WritePolicyRoundRobin)
+
+	tree.Reset(false)
+	errorutil.AssertOk(tree.AddMappingWithOptions("/", "footest", true, MappingOptions{Policy: WritePolicyFirst}))
+	errorutil.AssertOk(tree.AddMappingWithOptions("/", "bartest", true, MappingOptions{Policy: WritePolicyRoundRobin}))
+
+	if res := tree.String(); res != "/: footest(w first), bartest(w roundrobin)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := tree.WriteFile(fmt.Sprintf("/wptest/test7_%v", i), []byte("Test7"), 0); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	if res := dirLocal("bar/wptest"); strings.Contains(res, "test7") {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"devt.de/krotik/common/cryptutil"
+)
+
+/*
+WriteSessionTimeout is the time after which an unused write session is
+aborted
+*/
+var WriteSessionTimeout = 10 * time.Minute
+
+/*
+tempFilePattern matches the names of temporary files which are used for
+writes and file copies.
+*/
+var tempFilePattern = regexp.MustCompile(`^\..+\.(rufswrite[0-9]+|rufspart)$`)
+
+/*
+isTempFile returns if a given file name is a temporary file of a write or a
+file copy. Temporary files are not part of the union view.
+*/
+func isTempFile(name string) bool {
+	return tempFilePattern.MatchString(name)
+}
+
+/*
+writeSession is an atomic write of a whole file. All data is written into a
+temporary file which replaces the destination file once the session is
+committed.
+*/
+type writeSession struct {
+	lock     *sync.Mutex
+	spath    string     // Path of the destination file within the branch
+	dstPath  string     // Local path of the destination file
+	file     branchFile // Temporary file
+	created  bool       // Flag if the destination file is created in a union
+	lastUsed time.Time  // Last time the session was used (guarded by the sessions lock)
+	writers  int        // Number of running writes (guarded by the sessions lock)
+}
+
+/*
+writeSessions holds all open write sessions of a branch.
+*/
+type writeSessions struct {
+	lock     *sync.Mutex
+	sessions map[string]*writeSession
+}
+
+/*
+OpenWriteSession opens a new write session for a given file. Returns the id
+of the new session.
+*/
+func (b *Branch) OpenWriteSession(spath string) (string, error) {
+	return b.openWriteSession(spath, false)
+}
+
+/*
+openWriteSession opens a new write session for a given file. Whiteout markers
+of a new file are removed on commit if the union flag is set.
+*/
+func (b *Branch) openWriteSession(spath string, union bool) (string, error) {
+	var created bool
+	var f *os.File
+	var bf branchFile
+	var mode os.FileMode = 0644
+
+	if err := b.checkReadOnly(); err != nil {
+		return "", err
+	}
+
+	b.abortExpiredWriteSessions()
+
+	dstPath, err := b.constructSubPath(spath)
+
+	if err == nil {
+		dir, name := filepath.Split(dstPath)
+
+		created = createsItem(dstPath, union)
+
+		if fi, serr := os.Stat(dstPath); serr == nil {
+
+			if fi.IsDir() {
+				return "", fmt.Errorf("write %v: is a directory", path.Clean("/"+spath))
+			}
+
+			mode = fi.Mode()
+		}
+
+		// Ensure path exists and create the temporary file next to the
+		// destination so it can be renamed
+
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			if f, err = ioutil.TempFile(dir, "."+name+".rufswrite"); err == nil {
+
+				if err = f.Chmod(mode); err != nil {
+					f.Close()
+					os.Remove(f.Name())
+
+				} else if bf, err = b.wrapFile(f); err != nil {
+					os.Remove(f.Name())
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("%x", cryptutil.GenerateUUID())
+
+	b.writeSessions.lock.Lock()
+	defer b.writeSessions.lock.Unlock()
+
+	b.writeSessions.sessions[id] = &writeSession{&sync.Mutex{},
+		path.Clean("/" + spath), dstPath, bf, created, time.Now(), 0}
+
+	return id, nil
+}
+
+/*
+CommitWriteSession writes the data of a write session to disk and replaces
+the destination file.
+*/
+func (b *Branch) CommitWriteSession(id string, spath string) error {
+
+	ws, err := b.getWriteSession(id, spath, true)
+
+	if err == nil {
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+
+		if err = ws.file.Sync(); err == nil {
+			if err = ws.file.Close(); err == nil {
+				if err = os.Rename(ws.file.Name(), ws.dstPath); err == nil && ws.created {
+					b.clearWhiteouts(ws.spath)
+				}
+			}
+		}
+
+		if err != nil {
+			ws.file.Close()
+			os.Remove(ws.file.Name())
+		}
+	}
+
+	return err
+}
+
+/*
+AbortWriteSession discards all data of a write session.
+*/
+func (b *Branch) AbortWriteSession(id string, spath string) error {
+
+	ws, err := b.getWriteSession(id, spath, true)
+
+	if err == nil {
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+
+		ws.file.Close()
+		err = os.Remove(ws.file.Name())
+	}
+
+	return err
+}
+
+/*
+writeSessionData writes data from a given reader into a write session at a
+given offset.
+*/
+func (b *Branch) writeSessionData(id string, spath string, offset int64, r io.Reader) (int64, error) {
+	var n int64
+
+	ws, err := b.getWriteSession(id, spath, false)
+
+	if err == nil {
+
+		// Make sure the session does not expire while data is written
+
+		b.writeSessions.lock.Lock()
+		ws.writers++
+		b.writeSessions.lock.Unlock()
+
+		defer func() {
+			b.writeSessions.lock.Lock()
+			ws.writers--
+			ws.lastUsed = time.Now()
+			b.writeSessions.lock.Unlock()
+		}()
+
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+
+		n, err = io.Copy(&offsetWriter{ws.file, offset}, r)
+	}
+
+	return n, err
+}
+
+/*
+getWriteSession returns the write session with a given id for a given file.
+The session is removed if the remove flag is set.
+*/
+func (b *Branch) getWriteSession(id string, spath string, remove bool) (*writeSession, error) {
+	b.writeSessions.lock.Lock()
+	defer b.writeSessions.lock.Unlock()
+
+	ws, ok := b.writeSessions.sessions[id]
+
+	if !ok || ws.spath != path.Clean("/"+spath) {
+		return nil, fmt.Errorf("Unknown write session %v for %v", id, spath)
+	}
+
+	if remove {
+		delete(b.writeSessions.sessions, id)
+	} else {
+		ws.lastUsed = time.Now()
+	}
+
+	return ws, nil
+}
+
+/*
+abortExpiredWriteSessions aborts all write sessions which were not used for
+longer than WriteSessionTimeout.
+*/
+func (b *Branch) abortExpiredWriteSessions() {
+	b.abortWriteSessions(func(ws *writeSession) bool {
+		return ws.writers == 0 && time.Since(ws.lastUsed) > WriteSessionTimeout
+	})
+}
+
+/*
+abortAllWriteSessions aborts all write sessions.
+*/
+func (b *Branch) abortAllWriteSessions() {
+	b.abortWriteSessions(func(ws *writeSession) bool {
+		return true
+	})
+}
+
+/*
+abortWriteSessions aborts all write sessions which match a given function.
+*/
+func (b *Branch) abortWriteSessions(match func(ws *writeSession) bool) {
+	var aborted []*writeSession
+
+	b.writeSessions.lock.Lock()
+
+	for id, ws := range b.writeSessions.sessions {
+		if match(ws) {
+			aborted = append(aborted, ws)
+			delete(b.writeSessions.sessions, id)
+		}
+	}
+
+	b.writeSessions.lock.Unlock()
+
+	for _, ws := range aborted {
+		ws.lock.Lock()
+		ws.file.Close()
+		os.Remove(ws.file.Name())
+		ws.lock.Unlock()
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ * Rufs - Remote Union File System
+ *
+ * Copyright 2017 Matthias Ladkau. All rights reserved.
+ *
+ * This Source Code Form is subject to the terms of the MIT
+ * License, If a copy of the MIT License was not distributed with this
+ * file, You can obtain one at https://opensource.org/licenses/MIT.
+ */
+
+package rufs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"devt.de/krotik/common/errorutil"
+	"devt.de/krotik/rufs/config"
+)
+
+func TestWriteSession(t *testing.T) {
+
+	os.Mkdir("foo/wstest", 0770)
+	defer os.RemoveAll("foo/wstest")
+
+	ioutil.WriteFile("foo/wstest/test1", []byte("Old content"), 0660)
+
+	oldFi, _ := os.Stat("foo/wstest/test1")
+
+	id, err := footest.OpenWriteSession("/wstest/test1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := footest.writeSessionData(id, "/wstest/test1", 0, bytes.NewBufferString("New")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The file is unchanged until the session is committed
+
+	if data, _ := ioutil.ReadFile("foo/wstest/test1"); string(data) != "Old content" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	// The temporary file is not listed unless it is asked for by name
+
+	tmpFiles, _ := filepath.Glob("foo/wstest/.test1.rufswrite*")
+	if len(tmpFiles) != 1 {
+		t.Error("Unexpected result:", tmpFiles)
+		return
+	}
+
+	tmpName := filepath.Base(tmpFiles[0])
+
+	if _, fis, err := footest.Dir("/wstest", "", false, false); err != nil ||
+		len(fis[0]) != 1 || fis[0][0].Name() != "test1" {
+		t.Error("Unexpected result:", fis, err)
+		return
+	}
+
+	if _, fis, err := footest.Dir("/wstest", "^"+regexp.QuoteMeta(tmpName)+"$", false, false); err != nil ||
+		len(fis[0]) != 1 || fis[0][0].Name() != tmpName {
+		t.Error("Unexpected result:", fis, err)
+		return
+	}
+
+	if _, fis, err := footest.Search("/wstest", map[string]string{
+		SearchName: "*test1*",
+	}); err != nil || len(fis) != 1 || len(fis[0]) != 1 || fis[0][0].Name() != "test1" {
+		t.Error("Unexpected result:", fis, err)
+		return
+	}
+
+	if _, err := footest.writeSessionData(id, "/wstest/test2", 0, bytes.NewBufferString("New")); err == nil ||
+		err.Error() != fmt.Sprintf("Unknown write session %v for /wstest/test2", id) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := footest.CommitWriteSession(id, "/wstest/test1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if data, _ := ioutil.ReadFile("foo/wstest/test1"); string(data) != "New" {
+		t.Error("Unexpected result:", string(data))
+		return
+	}
+
+	// The mode of the file is kept
+
+	if fi, _ := os.Stat("foo/wstest/test1"); fi.Mode() != oldFi.Mode() {
+		t.Error("Unexpected result:", fi.Mode())
+		return
+	}
+
+	if res := dirLocal("foo/wstest"); res != "test1(3)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A session can only be used once
+
+	if err := footest.CommitWriteSession(id, "/wstest/test1"); err == nil ||
+		err.Error() != fmt.Sprintf("Unknown write session %v for /wstest/test1", id) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Abort a session
+
+	if id, err = footest.OpenWriteSession("/wstest/test2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	footest.writeSessionData(id, "/wstest/test2", 0, bytes.NewBufferString("foo"))
+
+	if err := footest.AbortWriteSession(id, "/wstest/test2"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := dirLocal("foo/wstest"); res != "test1(3)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Unused sessions expire
+
+	oldWriteSessionTimeout := WriteSessionTimeout
+	WriteSessionTimeout = 0
+	defer func() {
+		WriteSessionTimeout = oldWriteSessionTimeout
+	}()
+
+	id, _ = footest.OpenWriteSession("/wstest/test2")
+	time.Sleep(time.Millisecond)
+	id2, _ := footest.OpenWriteSession("/wstest/test3")
+
+	if err := footest.CommitWriteSession(id, "/wstest/test2"); err == nil {
+		t.Error("Session should have expired")
+		return
+	}
+
+	footest.AbortWriteSession(id2, "/wstest/test3")
+
+	if res := dirLocal("foo/wstest"); res != "test1(3)\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if _, err := footest.OpenWriteSession("/wstest"); err == nil || err.Error() != "write /wstest: is a directory" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+/*
+failingReader returns an error after its data was read.
+*/
+type failingReader struct {
+	io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = fmt.Errorf("Upload failed")
+	}
+	return n, err
+}
+
+func TestTreeAtomicWrite(t *testing.T) {
+
+	tree, err := NewTree(map[string]interface{}{
+		config.TreeSecret: "123",
+	}, clientCert)
+	errorutil.AssertOk(err)
+
+	fooRPC := fmt.Sprintf("%v:%v", branchConfigs["footest"][config.RPCHost], branchConfigs["footest"][config.RPCPort])
+	barRPC := fmt.Sprintf("%v:%v", branchConfigs["bartest"][config.RPCHost], branchConfigs["bartest"][config.RPCPort])
+
+	errorutil.AssertOk(tree.AddBranch("footest", fooRPC, ""))
+	errorutil.AssertOk(tree.AddBranch("bartest", barRPC, ""))
+	errorutil.AssertOk(tree.AddMapping("/", "footest", true))
+	errorutil.AssertOk(tree.AddMapping("/", "bartest", true))
+
+	os.Mkdir("foo/wstest2", 0770)
+	os.Mkdir("bar/wstest2", 0770)
+	defer os.RemoveAll("foo/wstest2")
+	defer os.RemoveAll("bar/wstest2")
+
+	ioutil.WriteFile("foo/wstest2/test1", []byte("Old content"), 0660)
+	ioutil.WriteFile("bar/wstest2/test1", []byte("Old content"), 0660)
+
+	// A failed upload leaves the files unchanged
+
+	if err := tree.WriteFileFromBuffer("/wstest2/test1",
+		&failingReader{bytes.NewBufferString("New content which is not complete")}); err == nil {
+		t.Error("Write should have failed")
+		return
+	}
+
+	for _, dir := range []string{"foo/wstest2", "bar/wstest2"} {
+		if res := dirLocal(dir); res != "test1(11)\n" {
+			t.Error("Unexpected result:", dir, res)
+			return
+		}
+	}
+
+	// A complete upload replaces the files
+
+	if err := tree.WriteFileFromBuffer("/wstest2/test1", bytes.NewBufferString("New")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, f := range []string{"foo/wstest2/test1", "bar/wstest2/test1"} {
+		if data, _ := ioutil.ReadFile(f); string(data) != "New" {
+			t.Error("Unexpected result:", f, string(data))
+			return
+		}
+	}
+
+	for _, dir := range []string{"foo/wstest2", "bar/wstest2"} {
+		if res := dirLocal(dir); res != "test1(3)\n" {
+			t.Error("Unexpected result:", dir, res)
+			return
+		}
+	}
+
+	// The tree can be changed while data is transferred
+
+	changeTree := func() error {
+		done := make(chan error)
+
+		go func() {
+			done <- tree.AddMapping("/wstest3", "footest", false)
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("Tree could not be changed during the transfer")
+		}
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error)
+
+	go func() {
+		written <- tree.WriteFileFromBuffer("/wstest2/test1", pr)
+	}()
+
+	pw.Write([]byte("Newer"))
+
+	if err := changeTree(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pw.Close()
+
+	if err := <-written; err != nil {
+		t.Error(err)
+		return
+	}
+
+	bw := &blockingWriter{make(chan bool), make(chan bool), nil}
+	read := make(chan error)
+
+	go func() {
+		read <- tree.ReadFileToBuffer("/wstest2/test1", bw)
+	}()
+
+	<-bw.started
+
+	if err := changeTree(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	close(bw.release)
+
+	if err := <-read; err != nil || string(bw.data) != "Newer" {
+		t.Error("Unexpected result:", string(bw.data), err)
+		return
+	}
+}
+
+/*
+blockingWriter blocks the first write until it is released.
+*/
+type blockingWriter struct {
+	started chan bool
+	release chan bool
+	data    []byte
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.data == nil {
+		close(w.started)
+		<-w.release
+	}
+	w.data = append(w.data, p...)
+	return len(p), nil
+}